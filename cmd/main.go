@@ -1,8 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"log/slog"
+	"os"
 	"referral-system/src/svc"
+	"strconv"
 )
 
 // Injected via -ldflags -X
@@ -13,5 +16,41 @@ func main() {
 		slog.String("name", "referral-system"),
 		slog.String("version", VERSION),
 	)
-	svc.Run()
+	if len(os.Args) < 2 {
+		svc.Run()
+		return
+	}
+	switch os.Args[1] {
+	case "dry-run":
+		svc.DryRun()
+	case "reconcile":
+		// optional: number of days to reconcile
+		days := 0
+		if len(os.Args) > 2 {
+			var err error
+			days, err = strconv.Atoi(os.Args[2])
+			if err != nil || days <= 0 {
+				fmt.Println("invalid number of days " + os.Args[2])
+				os.Exit(1)
+			}
+		}
+		svc.Reconcile(days)
+	case "backfill":
+		svc.Backfill()
+	case "export":
+		// first and last day, optional: output file (.csv or .json)
+		if len(os.Args) < 4 {
+			fmt.Println("usage: referral-system export <from yyyy-mm-dd> <to yyyy-mm-dd> [file]")
+			os.Exit(1)
+		}
+		outFile := ""
+		if len(os.Args) > 4 {
+			outFile = os.Args[4]
+		}
+		svc.Export(os.Args[2], os.Args[3], outFile)
+	default:
+		fmt.Println("unknown command " + os.Args[1])
+		fmt.Println("usage: referral-system [dry-run | reconcile [days] | backfill | export <from> <to> [file]]")
+		os.Exit(1)
+	}
 }
@@ -12,9 +12,16 @@ const (
 	API_PORT             = "API_PORT"
 	API_BIND_ADDR        = "API_BIND_ADDR"
 	KEYFILE_PATH         = "KEYFILE_PATH"
+	ADMIN_API_KEYS       = "ADMIN_API_KEYS"
+	PAY_EXEC_MODE        = "PAY_EXEC_MODE"
+	LOCAL_BROKER_KEY     = "LOCAL_BROKER_KEY"
+	BROKER_ID            = "BROKER_ID"
+	DENY_LIST_PATH       = "DENY_LIST_PATH"
+	METRICS_ADDR         = "METRICS_ADDR"
 
 	// other constants
 	DEFAULT_CODE               = "DEFAULT"
 	REFERRER_TOKENX_BAL_FREQ_H = 24 * 5
 	MAX_REFERRAL_CHAIN_LEN     = 5
+	MAX_CODE_TIERS             = 10
 )
@@ -0,0 +1,295 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"referral-system/src/referral"
+	"referral-system/src/utils"
+	"strconv"
+)
+
+// onDryRun simulates the next payment batch without sending
+// transactions and returns the planned payments
+func onDryRun(w http.ResponseWriter, r *http.Request, app *referral.App) {
+	slog.Info("payment dry-run requested by " + adminFromCtx(r))
+	res, err := app.SimulatePayments()
+	if err != nil {
+		errMsg := err.Error()
+		http.Error(w, string(formatError(errMsg)), http.StatusInternalServerError)
+		return
+	}
+	response := utils.APIResponse{Type: "dry-run", Data: res}
+	// Marshal the struct into JSON
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("onDryRun unable to marshal response" + err.Error())
+		errMsg := "Unavailable"
+		http.Error(w, string(formatError(errMsg)), http.StatusInternalServerError)
+		return
+	}
+	// Set the Content-Type header to application/json
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
+
+// onBatchStatus reports the state of the current payment batch
+func onBatchStatus(w http.ResponseWriter, app *referral.App) {
+	writeBatchStatus(w, app.BatchStatus())
+}
+
+// onBatchAction starts, pauses, resumes or skips a payment batch
+func onBatchAction(w http.ResponseWriter, r *http.Request, app *referral.App, action string) {
+	admin := adminFromCtx(r)
+	var res utils.APIBatchStatus
+	var err error
+	switch action {
+	case referral.BATCH_ACTION_START:
+		res, err = app.StartBatch(admin)
+	case referral.BATCH_ACTION_PAUSE:
+		res, err = app.PauseBatch(admin)
+	case referral.BATCH_ACTION_RESUME:
+		res, err = app.ResumeBatch(admin)
+	case referral.BATCH_ACTION_SKIP:
+		res, err = app.SkipBatch(admin)
+	default:
+		err = errors.New("unknown action")
+	}
+	if err != nil {
+		slog.Info("batch " + action + " by " + admin + " rejected: " + err.Error())
+		http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+		return
+	}
+	writeBatchStatus(w, res)
+}
+
+func writeBatchStatus(w http.ResponseWriter, status utils.APIBatchStatus) {
+	response := utils.APIResponse{Type: "batch", Data: status}
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("writeBatchStatus unable to marshal response" + err.Error())
+		errMsg := "Unavailable"
+		http.Error(w, string(formatError(errMsg)), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
+
+// onDenyList returns the deny list
+func onDenyList(w http.ResponseWriter, app *referral.App) {
+	entries, err := app.DenyList()
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	writeDenyList(w, entries)
+}
+
+// onDenyAddr adds an address to the deny list
+func onDenyAddr(w http.ResponseWriter, r *http.Request, app *referral.App) {
+	var jsonData []byte
+	if r.Body != nil {
+		defer r.Body.Close()
+		jsonData, _ = io.ReadAll(r.Body)
+	}
+	var req referral.DenyFileEntry
+	err := json.Unmarshal(jsonData, &req)
+	if err != nil {
+		errMsg := `Wrong argument types. Usage: {'addr' : '0xabc...', 'reason' : 'sanctioned'}`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	if !isValidEvmAddr(req.Addr) {
+		errMsg := `invalid address`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	err = app.DenyAddr(adminFromCtx(r), req.Addr, req.Reason)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	onDenyList(w, app)
+}
+
+// onAllowAddr removes an address from the deny list
+func onAllowAddr(w http.ResponseWriter, r *http.Request, app *referral.App, addr string) {
+	if !isValidEvmAddr(addr) {
+		errMsg := `invalid address`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	err := app.AllowAddr(adminFromCtx(r), addr)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+		return
+	}
+	onDenyList(w, app)
+}
+
+func writeDenyList(w http.ResponseWriter, entries []utils.APIDenyEntry) {
+	response := utils.APIResponse{Type: "deny-list", Data: entries}
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("writeDenyList unable to marshal response" + err.Error())
+		errMsg := "Unavailable"
+		http.Error(w, string(formatError(errMsg)), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
+
+// onReconciliation returns the result of the latest reconciliation run
+func onReconciliation(w http.ResponseWriter, app *referral.App) {
+	res, err := app.LastReconciliation()
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	writeReconciliation(w, res)
+}
+
+// onReconcile compares the on-chain payments with the database
+func onReconcile(w http.ResponseWriter, r *http.Request, app *referral.App) {
+	days := 0
+	if d := r.URL.Query().Get("days"); d != "" {
+		var err error
+		days, err = strconv.Atoi(d)
+		if err != nil || days <= 0 {
+			errMsg := `invalid number of days`
+			http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+			return
+		}
+	}
+	slog.Info("reconciliation requested by " + adminFromCtx(r))
+	res, err := app.Reconcile(days)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	writeReconciliation(w, res)
+}
+
+func writeReconciliation(w http.ResponseWriter, res utils.APIReconciliation) {
+	response := utils.APIResponse{Type: "reconciliation", Data: res}
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("writeReconciliation unable to marshal response" + err.Error())
+		errMsg := "Unavailable"
+		http.Error(w, string(formatError(errMsg)), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
+
+// onWebhookDeliveries returns the latest webhook deliveries
+func onWebhookDeliveries(w http.ResponseWriter, r *http.Request, app *referral.App) {
+	addr := r.URL.Query().Get("addr")
+	if addr != "" && !isValidEvmAddr(addr) {
+		errMsg := `invalid address`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	res, err := app.WebhookDeliveries(addr)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	response := utils.APIResponse{Type: "webhook-deliveries", Data: res}
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("onWebhookDeliveries unable to marshal response" + err.Error())
+		errMsg := "Unavailable"
+		http.Error(w, string(formatError(errMsg)), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
+
+// onGasReport returns the gas costs of the payments per batch or period
+func onGasReport(w http.ResponseWriter, r *http.Request, app *referral.App) {
+	period := r.URL.Query().Get("period")
+	switch period {
+	case "":
+		period = referral.GAS_PERIOD_BATCH
+	case referral.GAS_PERIOD_BATCH, referral.GAS_PERIOD_DAY, referral.GAS_PERIOD_WEEK, referral.GAS_PERIOD_MONTH:
+	default:
+		errMsg := `invalid period, use batch, day, week or month`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	days := 0
+	if d := r.URL.Query().Get("days"); d != "" {
+		var err error
+		days, err = strconv.Atoi(d)
+		if err != nil || days <= 0 {
+			errMsg := `invalid number of days`
+			http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+			return
+		}
+	}
+	res, err := app.GasReport(period, days)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	response := utils.APIResponse{Type: "gas-report", Data: res}
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("onGasReport unable to marshal response" + err.Error())
+		errMsg := "Unavailable"
+		http.Error(w, string(formatError(errMsg)), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
+
+// onPayoutExport returns the payee transfers of the days from-to as
+// csv (default) or json
+func onPayoutExport(w http.ResponseWriter, r *http.Request, app *referral.App) {
+	query := r.URL.Query()
+	from, to, err := referral.ParseExportPeriod(query.Get("from"), query.Get("to"))
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+		return
+	}
+	format := query.Get("format")
+	if format != "" && format != "csv" && format != "json" {
+		errMsg := `invalid format, use csv or json`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	slog.Info("payout export requested by " + adminFromCtx(r))
+	res, err := app.PayoutExport(from, to)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusInternalServerError)
+		return
+	}
+	if format == "json" {
+		response := utils.APIResponse{Type: "payout-export", Data: res}
+		jsonResponse, err := json.Marshal(response)
+		if err != nil {
+			slog.Error("onPayoutExport unable to marshal response" + err.Error())
+			errMsg := "Unavailable"
+			http.Error(w, string(formatError(errMsg)), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonResponse)
+		return
+	}
+	fileName := "payouts-" + res.BrokerId + "-" + query.Get("from") + "-" + query.Get("to") + ".csv"
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+fileName+`"`)
+	err = referral.WritePayoutExportCsv(w, []utils.APIPayoutExport{res})
+	if err != nil {
+		slog.Error("onPayoutExport unable to write csv" + err.Error())
+	}
+}
@@ -4,18 +4,31 @@ import (
 	"encoding/json"
 	"net"
 	"net/http"
-	"referral-system/src/referral"
 	"sync"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/exp/slog"
 )
 
-func StartApiServer(app *referral.App, host string, port string, wg *sync.WaitGroup) {
+// StartApiServer serves the api of the apps. keys are the admin api keys
+// bound to their broker, the admin api is disabled without keys
+func StartApiServer(apps *Apps, host string, port string, keys map[string]AdminKey, wg *sync.WaitGroup) {
 	defer wg.Done()
 	router := chi.NewRouter()
 	RegisterGlobalMiddleware(router)
-	RegisterRoutes(router, app)
+	if len(keys) == 0 {
+		slog.Info("no admin api keys configured, admin api disabled")
+	}
+	register := func(r chi.Router) {
+		RegisterRoutes(r, apps)
+		if len(keys) > 0 {
+			RegisterAdminRoutes(r, apps, keys)
+		}
+	}
+	// routes of the default broker and routes scoped by broker
+	register(router)
+	router.Route("/b/{brokerId}", register)
 
 	addr := net.JoinHostPort(
 		host,
@@ -29,6 +42,16 @@ func StartApiServer(app *referral.App, host string, port string, wg *sync.WaitGr
 	slog.Error("api server is shutting down: " + err.Error())
 }
 
+// StartMetricsServer serves the prometheus metrics on /metrics at addr
+// (host:port), separate from the public API
+func StartMetricsServer(addr string) {
+	router := chi.NewRouter()
+	router.Handle("/metrics", promhttp.Handler())
+	slog.Info("starting metrics server host_port " + addr)
+	err := http.ListenAndServe(addr, router)
+	slog.Error("metrics server is shutting down: " + err.Error())
+}
+
 func formatError(errorMsg string) []byte {
 	response := struct {
 		Error string `json:"error"`
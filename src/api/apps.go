@@ -0,0 +1,78 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"referral-system/src/referral"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Apps holds the referral app of each broker and chain served by the api.
+// Requests select the chain with the query parameter chainId and the broker
+// with the route prefix /b/{brokerId}. Without chainId the first configured
+// chain is used, without broker the first broker of the chain.
+type Apps struct {
+	byChain   map[int]map[string]*referral.App
+	defBroker map[int]string
+	defChain  int
+}
+
+// NewApps creates the registry for the given apps, the first app
+// is the default
+func NewApps(apps []*referral.App) *Apps {
+	reg := Apps{
+		byChain:   make(map[int]map[string]*referral.App),
+		defBroker: make(map[int]string),
+	}
+	for k, app := range apps {
+		chainId := app.Settings.ChainId
+		if k == 0 {
+			reg.defChain = chainId
+		}
+		if reg.byChain[chainId] == nil {
+			reg.byChain[chainId] = make(map[string]*referral.App)
+			reg.defBroker[chainId] = app.Settings.BrokerId
+		}
+		reg.byChain[chainId][app.Settings.BrokerId] = app
+	}
+	return &reg
+}
+
+// Get returns the app for the chainId and brokerId given in the request
+func (a *Apps) Get(r *http.Request) (*referral.App, error) {
+	chainId := a.defChain
+	chainIdStr := r.URL.Query().Get("chainId")
+	if chainIdStr != "" {
+		var err error
+		chainId, err = strconv.Atoi(chainIdStr)
+		if err != nil {
+			return nil, errors.New("invalid chainId")
+		}
+	}
+	brokers, exists := a.byChain[chainId]
+	if !exists {
+		return nil, errors.New("chainId " + chainIdStr + " not supported")
+	}
+	brokerId := chi.URLParam(r, "brokerId")
+	if brokerId == "" {
+		brokerId = a.defBroker[chainId]
+	}
+	app, exists := brokers[brokerId]
+	if !exists {
+		return nil, errors.New("broker " + brokerId + " not served on chain " + strconv.Itoa(chainId))
+	}
+	return app, nil
+}
+
+// resolve returns the app for the request or writes an error
+// response and returns nil
+func (a *Apps) resolve(w http.ResponseWriter, r *http.Request) *referral.App {
+	app, err := a.Get(r)
+	if err != nil {
+		http.Error(w, string(formatError(err.Error())), http.StatusBadRequest)
+		return nil
+	}
+	return app
+}
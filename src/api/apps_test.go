@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"referral-system/src/referral"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func testApp(chainId int, brokerId string) *referral.App {
+	var app referral.App
+	app.Settings.ChainId = chainId
+	app.Settings.BrokerId = brokerId
+	return &app
+}
+
+func TestAppsGet(t *testing.T) {
+	apps := NewApps([]*referral.App{
+		testApp(1101, "alpha"),
+		testApp(1101, "beta"),
+		testApp(42161, "gamma"),
+	})
+	router := chi.NewRouter()
+	var got *referral.App
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		got = apps.resolve(w, r)
+	}
+	router.Get("/settings", handler)
+	router.Get("/b/{brokerId}/settings", handler)
+	for _, tc := range []struct {
+		url      string
+		chainId  int
+		brokerId string
+	}{
+		{"/settings", 1101, "alpha"},
+		{"/b/beta/settings", 1101, "beta"},
+		{"/settings?chainId=42161", 42161, "gamma"},
+		{"/b/gamma/settings?chainId=42161", 42161, "gamma"},
+		{"/b/gamma/settings", 0, ""},
+		{"/settings?chainId=1", 0, ""},
+		{"/settings?chainId=abc", 0, ""},
+	} {
+		got = nil
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if tc.brokerId == "" {
+			if got != nil || rec.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected bad request, got status %d", tc.url, rec.Code)
+			}
+			continue
+		}
+		if got == nil || got.Settings.ChainId != tc.chainId || got.Settings.BrokerId != tc.brokerId {
+			t.Errorf("%s: expected broker %s on chain %d, got %v", tc.url, tc.brokerId, tc.chainId, got)
+		}
+	}
+}
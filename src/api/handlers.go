@@ -162,6 +162,8 @@ func onUpsertCode(w http.ResponseWriter, r *http.Request, app *referral.App) {
 			'agencyAddr' : '0xcbc...',
 			'createdOn' : 1696166434,
 			'passOnPercTDF' : 5000,
+			'validFrom' : 1696166434, (optional)
+			'expiry' : 1697376034, (optional)
 			'signature' :  '0xa1ef...'
 		}`
 		errMsg = strings.ReplaceAll(errMsg, "\t", "")
@@ -184,6 +186,11 @@ func onUpsertCode(w http.ResponseWriter, r *http.Request, app *referral.App) {
 		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
 		return
 	}
+	if req.Expiry != 0 && (req.Expiry <= req.ValidFrom || req.Expiry <= req.CreatedOn) {
+		errMsg := `expiry invalid`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
 	addr, err := RecoverCodeSigAddr(req)
 	if err != nil {
 		slog.Info("Recovering code selection failed:" + err.Error())
@@ -228,19 +235,240 @@ func onCodeRebate(w http.ResponseWriter, r *http.Request, app *referral.App) {
 		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
 		return
 	}
+	// optional: tiers reached by the trader
+	traderAddr := r.URL.Query().Get("traderAddr")
+	if traderAddr != "" && !isValidEvmAddr(traderAddr) {
+		errMsg := "Incorrect 'traderAddr' parameter"
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
 	code = WashCode(code)
-	rebate, err := app.CutPercentageCode(code)
+	res, err := app.CodeRebate(code, traderAddr)
 	if err != nil {
 		errMsg := err.Error()
 		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
 		return
 	}
+	response := utils.APIResponse{Type: "code-rebate", Data: res}
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("code-rebate unable to marshal response" + err.Error())
+		errMsg := "Unavailable"
+		http.Error(w, string(formatError(errMsg)), http.StatusInternalServerError)
+		return
+	}
 	// Write the JSON response
-	stringValue := strconv.FormatFloat(rebate, 'f', -1, 64)
-	jsonResponse := `{"type":"code-rebate", "data":{"rebate_percent": ` + stringValue + `}}`
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
+
+// onCodeTiers replaces the volume tiers of a code
+func onCodeTiers(w http.ResponseWriter, r *http.Request, app *referral.App) {
+	// Read the JSON data from the request body
+	var jsonData []byte
+	if r.Body != nil {
+		defer r.Body.Close()
+		jsonData, _ = io.ReadAll(r.Body)
+	}
+	var req utils.APICodeTiersPayload
+	err := json.Unmarshal(jsonData, &req)
+	if err != nil {
+		errMsg := `Wrong argument types. Usage:
+		{
+			'code' : 'CODE1',
+			'referrerAddr' : '0xabc...' ,
+			'createdOn' : 1696166434,
+			'tiers' : [{'minVolume': 100000, 'passOnPercTDF': 7500}],
+			'signature' :  '0xa1ef...'
+		}`
+		errMsg = strings.ReplaceAll(errMsg, "\t", "")
+		errMsg = strings.ReplaceAll(errMsg, "\n", "")
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	if !isValidEvmAddr(req.ReferrerAddr) {
+		errMsg := `invalid address`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	if !isCurrentTimestamp(req.CreatedOn) {
+		errMsg := `timestamp not current`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	if len(req.Tiers) > env.MAX_CODE_TIERS {
+		errMsg := `too many tiers`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	for k, tier := range req.Tiers {
+		if tier.PassOnPercTDF >= 10000 {
+			errMsg := `pass on percentage invalid`
+			http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+			return
+		}
+		if tier.MinVolume == 0 || (k > 0 && tier.MinVolume <= req.Tiers[k-1].MinVolume) {
+			errMsg := `tier volumes must be positive and increasing`
+			http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+			return
+		}
+	}
+	addr, err := RecoverCodeTiersSigAddr(req)
+	if err != nil {
+		slog.Info("Recovering code tiers signature failed:" + err.Error())
+		errMsg := `code tiers signature recovery failed`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	if strings.ToLower(addr.String()) != strings.ToLower(req.ReferrerAddr) {
+		errMsg := `code tiers signature wrong`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	req.Code = WashCode(req.Code)
+	err = app.SetCodeTiers(req)
+	if err != nil {
+		errMsg := `code tiers failed:` + err.Error()
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonResponse := `{"type":"code-tiers", "data":{"code": "` + req.Code + `"}}`
+	w.Write([]byte(jsonResponse))
+}
+
+// onPayoutAddr registers the payout address of an agency or referrer
+func onPayoutAddr(w http.ResponseWriter, r *http.Request, app *referral.App) {
+	// Read the JSON data from the request body
+	var jsonData []byte
+	if r.Body != nil {
+		defer r.Body.Close()
+		jsonData, _ = io.ReadAll(r.Body)
+	}
+	var req utils.APIPayoutAddrPayload
+	err := json.Unmarshal(jsonData, &req)
+	if err != nil {
+		errMsg := `Wrong argument types. Usage:
+		{
+			'addr' : '0xabc...',
+			'payoutAddr' : '0xcbc...',
+			'brokerAddr' : '0xdbc...',
+			'createdOn' : 1696166434,
+			'signature' :  '0xa1ef...'
+		}`
+		errMsg = strings.ReplaceAll(errMsg, "\t", "")
+		errMsg = strings.ReplaceAll(errMsg, "\n", "")
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	if !isValidEvmAddr(req.Addr) || !isValidEvmAddr(req.PayoutAddr) || !isValidEvmAddr(req.BrokerAddr) {
+		errMsg := `invalid address`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	if !isCurrentTimestamp(req.CreatedOn) {
+		errMsg := `timestamp not current`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	if !strings.EqualFold(req.BrokerAddr, app.BrokerAddr) {
+		errMsg := `wrong broker address`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	addr, err := RecoverPayoutAddrSigAddr(req)
+	if err != nil {
+		slog.Info("Recovering payout address signature failed:" + err.Error())
+		errMsg := `payout address signature recovery failed`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	if strings.ToLower(addr.String()) != strings.ToLower(req.Addr) {
+		errMsg := `payout address signature wrong`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	err = app.SetPayoutAddr(req)
+	if err != nil {
+		errMsg := `payout address failed:` + err.Error()
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonResponse := `{"type":"payout-addr", "data":{"addr": "` + strings.ToLower(req.Addr) +
+		`", "payoutAddr": "` + strings.ToLower(req.PayoutAddr) + `"}}`
 	w.Write([]byte(jsonResponse))
 }
 
+func onWebhook(w http.ResponseWriter, r *http.Request, app *referral.App) {
+	// Read the JSON data from the request body
+	var jsonData []byte
+	if r.Body != nil {
+		defer r.Body.Close()
+		jsonData, _ = io.ReadAll(r.Body)
+	}
+	var req utils.APIWebhookPayload
+	err := json.Unmarshal(jsonData, &req)
+	if err != nil {
+		errMsg := `Wrong argument types. Usage:
+		{
+			'addr' : '0xabc...',
+			'url' : 'https://...',
+			'events' : 'code-selected,payment-confirmed',
+			'brokerAddr' : '0xdbc...',
+			'createdOn' : 1696166434,
+			'signature' :  '0xa1ef...'
+		}`
+		errMsg = strings.ReplaceAll(errMsg, "\t", "")
+		errMsg = strings.ReplaceAll(errMsg, "\n", "")
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	if !isValidEvmAddr(req.Addr) || !isValidEvmAddr(req.BrokerAddr) {
+		errMsg := `invalid address`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	if !isCurrentTimestamp(req.CreatedOn) {
+		errMsg := `timestamp not current`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	if !strings.EqualFold(req.BrokerAddr, app.BrokerAddr) {
+		errMsg := `wrong broker address`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	addr, err := RecoverWebhookSigAddr(req)
+	if err != nil {
+		slog.Info("Recovering webhook signature failed:" + err.Error())
+		errMsg := `webhook signature recovery failed`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	if strings.ToLower(addr.String()) != strings.ToLower(req.Addr) {
+		errMsg := `webhook signature wrong`
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	sub, err := app.SetWebhook(req)
+	if err != nil {
+		errMsg := `webhook failed:` + err.Error()
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	response := utils.APIResponse{Type: "webhook", Data: sub}
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("onWebhook unable to marshal response" + err.Error())
+		errMsg := "Unavailable"
+		http.Error(w, string(formatError(errMsg)), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+}
+
 func onReferCut(w http.ResponseWriter, r *http.Request, app *referral.App) {
 	// Read the JSON data from the request body
 	addr := r.URL.Query().Get("addr")
@@ -317,6 +545,62 @@ func onEarnings(w http.ResponseWriter, r *http.Request, app *referral.App) {
 	w.Write(jsonResponse)
 }
 
+func onClaimProof(w http.ResponseWriter, r *http.Request, app *referral.App) {
+	addr := r.URL.Query().Get("addr")
+	if addr == "" || !isValidEvmAddr(addr) {
+		errMsg := "Incorrect 'addr' parameter"
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	res, err := app.ClaimProofs(strings.ToLower(addr))
+	if err != nil {
+		errMsg := err.Error()
+		http.Error(w, string(formatError(errMsg)), http.StatusInternalServerError)
+		return
+	}
+	response := utils.APIResponse{Type: "claim-proof", Data: res}
+	// Marshal the struct into JSON
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("onClaimProof unable to marshal response" + err.Error())
+		errMsg := "Unavailable"
+		http.Error(w, string(formatError(errMsg)), http.StatusInternalServerError)
+		return
+	}
+	// Set the Content-Type header to application/json
+	w.Header().Set("Content-Type", "application/json")
+	// Write the JSON response
+	w.Write(jsonResponse)
+}
+
+func onPaymentRetries(w http.ResponseWriter, r *http.Request, app *referral.App) {
+	addr := r.URL.Query().Get("addr")
+	if addr == "" || !isValidEvmAddr(addr) {
+		errMsg := "Incorrect 'addr' parameter"
+		http.Error(w, string(formatError(errMsg)), http.StatusBadRequest)
+		return
+	}
+	res, err := app.PaymentRetries(strings.ToLower(addr))
+	if err != nil {
+		errMsg := err.Error()
+		http.Error(w, string(formatError(errMsg)), http.StatusInternalServerError)
+		return
+	}
+	response := utils.APIResponse{Type: "payment-retries", Data: res}
+	// Marshal the struct into JSON
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("onPaymentRetries unable to marshal response" + err.Error())
+		errMsg := "Unavailable"
+		http.Error(w, string(formatError(errMsg)), http.StatusInternalServerError)
+		return
+	}
+	// Set the Content-Type header to application/json
+	w.Header().Set("Content-Type", "application/json")
+	// Write the JSON response
+	w.Write(jsonResponse)
+}
+
 func onFoodChain(w http.ResponseWriter, r *http.Request, app *referral.App) {
 
 	code := r.URL.Query().Get("code")
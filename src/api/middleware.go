@@ -1,9 +1,120 @@
 package api
 
 import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"referral-system/src/metrics"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 )
 
+type ctxKey string
+
+const adminCtxKey ctxKey = "admin"
+
 func RegisterGlobalMiddleware(r chi.Router) {
 	// CORS handled by nginx
+	r.Use(Metrics)
+}
+
+// Metrics records latency and status code of every request per
+// route pattern
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		metrics.HttpRequests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+		metrics.HttpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// ParseAdminKeys parses the admin api keys configured as
+// "name1:key1,name2:key2" and returns a map key->name
+func ParseAdminKeys(s string) map[string]string {
+	keys := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		name, key, found := strings.Cut(strings.TrimSpace(entry), ":")
+		if !found || name == "" || key == "" {
+			continue
+		}
+		keys[key] = name
+	}
+	return keys
+}
+
+// AdminKey is the admin owning an api key and the broker the
+// admin may act on
+type AdminKey struct {
+	Name     string
+	BrokerId string
+}
+
+// BindAdminKeys parses the admin api keys of a broker (see
+// ParseAdminKeys) and adds them to keys, bound to brokerId. A key
+// can only be bound to one broker.
+func BindAdminKeys(keys map[string]AdminKey, s string, brokerId string) error {
+	for key, name := range ParseAdminKeys(s) {
+		if other, exists := keys[key]; exists && other.BrokerId != brokerId {
+			return errors.New("admin key of " + name + " is used for brokers " + other.BrokerId + " and " + brokerId)
+		}
+		keys[key] = AdminKey{Name: name, BrokerId: brokerId}
+	}
+	return nil
+}
+
+// AdminAuth only lets requests with a valid api key in the
+// header "Authorization: Bearer <key>" pass, and only for the
+// broker the key is bound to. The name of the admin is stored
+// in the request context
+func AdminAuth(keys map[string]AdminKey, apps *Apps) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			var admin AdminKey
+			if found {
+				for key, k := range keys {
+					if subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1 {
+						admin = k
+					}
+				}
+			}
+			if admin.Name == "" {
+				http.Error(w, string(formatError("unauthorized")), http.StatusUnauthorized)
+				return
+			}
+			app := apps.resolve(w, r)
+			if app == nil {
+				return
+			}
+			if app.Settings.BrokerId != admin.BrokerId {
+				slog.Info("admin " + admin.Name + " of broker " + admin.BrokerId + " denied for broker " + app.Settings.BrokerId)
+				http.Error(w, string(formatError("forbidden")), http.StatusForbidden)
+				return
+			}
+			ctx := context.WithValue(r.Context(), adminCtxKey, admin.Name)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// adminFromCtx returns the name of the authenticated admin
+func adminFromCtx(r *http.Request) string {
+	name, _ := r.Context().Value(adminCtxKey).(string)
+	return name
 }
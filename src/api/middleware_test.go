@@ -0,0 +1,77 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"referral-system/src/referral"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestParseAdminKeys(t *testing.T) {
+	keys := ParseAdminKeys("alice:k1, bob:k2,broken,:k3,carol:")
+	if len(keys) != 2 {
+		t.Errorf("expected 2 keys, got %d", len(keys))
+		return
+	}
+	if keys["k1"] != "alice" || keys["k2"] != "bob" {
+		t.Errorf("wrong keys parsed: %v", keys)
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	var admin string
+	apps := NewApps([]*referral.App{testApp(1101, "alpha"), testApp(1101, "beta")})
+	keys := make(map[string]AdminKey)
+	if err := BindAdminKeys(keys, "alice:k1", "alpha"); err != nil {
+		t.Fatal(err)
+	}
+	if err := BindAdminKeys(keys, "bob:k2", "beta"); err != nil {
+		t.Fatal(err)
+	}
+	if err := BindAdminKeys(keys, "mallory:k1", "beta"); err == nil {
+		t.Errorf("expected a key bound to two brokers to be rejected")
+	}
+	router := chi.NewRouter()
+	register := func(r chi.Router) {
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(AdminAuth(keys, apps))
+			r.Get("/dry-run", func(w http.ResponseWriter, r *http.Request) {
+				admin = adminFromCtx(r)
+			})
+		})
+	}
+	register(router)
+	router.Route("/b/{brokerId}", register)
+	for _, tc := range []struct {
+		url    string
+		header string
+		status int
+		admin  string
+	}{
+		{"/admin/dry-run", "", http.StatusUnauthorized, ""},
+		{"/admin/dry-run", "Bearer wrong", http.StatusUnauthorized, ""},
+		{"/admin/dry-run", "k1", http.StatusUnauthorized, ""},
+		{"/admin/dry-run", "Bearer k1", http.StatusOK, "alice"},
+		{"/b/alpha/admin/dry-run", "Bearer k1", http.StatusOK, "alice"},
+		{"/b/beta/admin/dry-run", "Bearer k1", http.StatusForbidden, ""},
+		{"/admin/dry-run", "Bearer k2", http.StatusForbidden, ""},
+		{"/b/beta/admin/dry-run", "Bearer k2", http.StatusOK, "bob"},
+		{"/b/gamma/admin/dry-run", "Bearer k2", http.StatusBadRequest, ""},
+	} {
+		admin = ""
+		req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%s %q: expected status %d, got %d", tc.url, tc.header, tc.status, rec.Code)
+		}
+		if admin != tc.admin {
+			t.Errorf("%s %q: expected admin %q in context, got %q", tc.url, tc.header, tc.admin, admin)
+		}
+	}
+}
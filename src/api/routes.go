@@ -2,74 +2,218 @@ package api
 
 import (
 	"net/http"
-	"referral-system/src/referral"
 
 	"github.com/go-chi/chi/v5"
 )
 
 // RegisterRoutes registers all API routes for D8X-Backend application
-func RegisterRoutes(router chi.Router, app *referral.App) {
+func RegisterRoutes(router chi.Router, apps *Apps) {
 
 	router.Get("/my-code-selection", func(w http.ResponseWriter, r *http.Request) {
-		OnMyCodeSelection(w, r, app)
+		if app := apps.resolve(w, r); app != nil {
+			OnMyCodeSelection(w, r, app)
+		}
 	})
 
 	// Endpoint: /my-referrals?addr=0xabce...
 	router.Get("/my-referrals", func(w http.ResponseWriter, r *http.Request) {
-		onMyReferrals(w, r, app)
+		if app := apps.resolve(w, r); app != nil {
+			onMyReferrals(w, r, app)
+		}
 	})
 
 	// Endpoint: /open-pay?traderAddr=0xabce...
 	router.Get("/open-pay", func(w http.ResponseWriter, r *http.Request) {
-		onOpenPay(w, r, app)
+		if app := apps.resolve(w, r); app != nil {
+			onOpenPay(w, r, app)
+		}
 	})
 
 	router.Get("/food-chain", func(w http.ResponseWriter, r *http.Request) {
-		onFoodChain(w, r, app)
+		if app := apps.resolve(w, r); app != nil {
+			onFoodChain(w, r, app)
+		}
 	})
 
 	// Endpoint: /earnings
 	router.Get("/earnings", func(w http.ResponseWriter, r *http.Request) {
-		onEarnings(w, r, app)
+		if app := apps.resolve(w, r); app != nil {
+			onEarnings(w, r, app)
+		}
 	})
 
 	// Endpoint: /settings
 	router.Get("/settings", func(w http.ResponseWriter, r *http.Request) {
-		onSettings(w, app)
+		if app := apps.resolve(w, r); app != nil {
+			onSettings(w, app)
+		}
 	})
 
 	// Endpoint: /refer-cut
 	router.Get("/refer-cut", func(w http.ResponseWriter, r *http.Request) {
-		onReferCut(w, r, app)
+		if app := apps.resolve(w, r); app != nil {
+			onReferCut(w, r, app)
+		}
 	})
 
-	// Endpoint: /code-rebate?code=ABCD
+	// Endpoint: /code-rebate?code=ABCD[&traderAddr=0xabce...]
 	router.Get("/code-rebate", func(w http.ResponseWriter, r *http.Request) {
-		onCodeRebate(w, r, app)
+		if app := apps.resolve(w, r); app != nil {
+			onCodeRebate(w, r, app)
+		}
 	})
 
 	// Endpoint: /next-pay
 	router.Get("/next-pay", func(w http.ResponseWriter, r *http.Request) {
-		onNextPay(w, r, app)
+		if app := apps.resolve(w, r); app != nil {
+			onNextPay(w, r, app)
+		}
+	})
+
+	// Endpoint: /claim-proof?addr=0xabce...
+	router.Get("/claim-proof", func(w http.ResponseWriter, r *http.Request) {
+		if app := apps.resolve(w, r); app != nil {
+			onClaimProof(w, r, app)
+		}
+	})
+
+	// Endpoint: /payment-retries?addr=0xabce...
+	router.Get("/payment-retries", func(w http.ResponseWriter, r *http.Request) {
+		if app := apps.resolve(w, r); app != nil {
+			onPaymentRetries(w, r, app)
+		}
 	})
 
 	router.Get("/token-info", func(w http.ResponseWriter, r *http.Request) {
-		onTokenInfo(w, r, app)
+		if app := apps.resolve(w, r); app != nil {
+			onTokenInfo(w, r, app)
+		}
 	})
 
 	router.Post("/select-code", func(w http.ResponseWriter, r *http.Request) {
-		onSelectCode(w, r, app)
+		if app := apps.resolve(w, r); app != nil {
+			onSelectCode(w, r, app)
+		}
 	})
 
 	router.Post("/refer", func(w http.ResponseWriter, r *http.Request) {
-		onRefer(w, r, app)
+		if app := apps.resolve(w, r); app != nil {
+			onRefer(w, r, app)
+		}
 	})
 
 	router.Get("/executor", func(w http.ResponseWriter, r *http.Request) {
-		onExecutor(w, r, app)
+		if app := apps.resolve(w, r); app != nil {
+			onExecutor(w, r, app)
+		}
 	})
 
 	router.Post("/upsert-code", func(w http.ResponseWriter, r *http.Request) {
-		onUpsertCode(w, r, app)
+		if app := apps.resolve(w, r); app != nil {
+			onUpsertCode(w, r, app)
+		}
+	})
+
+	router.Post("/code-tiers", func(w http.ResponseWriter, r *http.Request) {
+		if app := apps.resolve(w, r); app != nil {
+			onCodeTiers(w, r, app)
+		}
+	})
+
+	router.Post("/payout-addr", func(w http.ResponseWriter, r *http.Request) {
+		if app := apps.resolve(w, r); app != nil {
+			onPayoutAddr(w, r, app)
+		}
+	})
+
+	router.Post("/webhook", func(w http.ResponseWriter, r *http.Request) {
+		if app := apps.resolve(w, r); app != nil {
+			onWebhook(w, r, app)
+		}
+	})
+}
+
+// RegisterAdminRoutes registers the admin routes. All admin routes require
+// an api key, see AdminAuth
+func RegisterAdminRoutes(router chi.Router, apps *Apps, keys map[string]AdminKey) {
+	router.Route("/admin", func(r chi.Router) {
+		r.Use(AdminAuth(keys, apps))
+
+		// Endpoint: /admin/dry-run
+		r.Get("/dry-run", func(w http.ResponseWriter, r *http.Request) {
+			if app := apps.resolve(w, r); app != nil {
+				onDryRun(w, r, app)
+			}
+		})
+
+		// Endpoint: /admin/batch
+		r.Get("/batch", func(w http.ResponseWriter, r *http.Request) {
+			if app := apps.resolve(w, r); app != nil {
+				onBatchStatus(w, app)
+			}
+		})
+
+		// Endpoint: /admin/batch/{action}, action = start|pause|resume|skip
+		r.Post("/batch/{action}", func(w http.ResponseWriter, r *http.Request) {
+			if app := apps.resolve(w, r); app != nil {
+				onBatchAction(w, r, app, chi.URLParam(r, "action"))
+			}
+		})
+
+		// Endpoint: /admin/reconciliation, result of the latest run
+		r.Get("/reconciliation", func(w http.ResponseWriter, r *http.Request) {
+			if app := apps.resolve(w, r); app != nil {
+				onReconciliation(w, app)
+			}
+		})
+
+		// Endpoint: /admin/reconciliation[?days=14], runs a reconciliation
+		r.Post("/reconciliation", func(w http.ResponseWriter, r *http.Request) {
+			if app := apps.resolve(w, r); app != nil {
+				onReconcile(w, r, app)
+			}
+		})
+
+		// Endpoint: /admin/gas-report[?period=batch|day|week|month&days=30]
+		r.Get("/gas-report", func(w http.ResponseWriter, r *http.Request) {
+			if app := apps.resolve(w, r); app != nil {
+				onGasReport(w, r, app)
+			}
+		})
+
+		// Endpoint: /admin/payout-export?from=2024-06-01&to=2024-06-30[&format=csv|json]
+		r.Get("/payout-export", func(w http.ResponseWriter, r *http.Request) {
+			if app := apps.resolve(w, r); app != nil {
+				onPayoutExport(w, r, app)
+			}
+		})
+
+		// Endpoint: /admin/webhook-deliveries[?addr=0x...], latest deliveries
+		r.Get("/webhook-deliveries", func(w http.ResponseWriter, r *http.Request) {
+			if app := apps.resolve(w, r); app != nil {
+				onWebhookDeliveries(w, r, app)
+			}
+		})
+
+		// Endpoint: /admin/deny-list
+		r.Get("/deny-list", func(w http.ResponseWriter, r *http.Request) {
+			if app := apps.resolve(w, r); app != nil {
+				onDenyList(w, app)
+			}
+		})
+
+		// Endpoint: /admin/deny-list, body {"addr": "0x...", "reason": "..."}
+		r.Post("/deny-list", func(w http.ResponseWriter, r *http.Request) {
+			if app := apps.resolve(w, r); app != nil {
+				onDenyAddr(w, r, app)
+			}
+		})
+
+		// Endpoint: /admin/deny-list/{addr}
+		r.Delete("/deny-list/{addr}", func(w http.ResponseWriter, r *http.Request) {
+			if app := apps.resolve(w, r); app != nil {
+				onAllowAddr(w, r, app, chi.URLParam(r, "addr"))
+			}
+		})
 	})
 }
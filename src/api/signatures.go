@@ -122,11 +122,18 @@ func GetReferralTypedDataHash(rpl utils.APIReferPayload) ([]byte, error) {
 	return typedData.HashStruct("NewReferral", typedData.Message)
 }
 
+// GetCodeDigest returns the EIP-191 digest of the code payload. ValidFrom
+// and Expiry are only part of the digest if one of them is set, so
+// that payloads without validity are signed as before
 func GetCodeDigest(rpl utils.APICodePayload) ([32]byte, error) {
 	types := []string{"string", "address", "uint32", "uint256"}
 	addrA := common.HexToAddress(rpl.ReferrerAddr) // can be 0
 	ts := big.NewInt(int64(rpl.CreatedOn))
 	values := []interface{}{rpl.Code, addrA, rpl.PassOnPercTDF, ts}
+	if rpl.HasValidity() {
+		types = append(types, "uint256", "uint256")
+		values = append(values, big.NewInt(int64(rpl.ValidFrom)), big.NewInt(int64(rpl.Expiry)))
+	}
 	digest0, err := abiEncodeBytes32(types, values...)
 	if err != nil {
 		return [32]byte{}, err
@@ -136,15 +143,82 @@ func GetCodeDigest(rpl utils.APICodePayload) ([32]byte, error) {
 	return digestBytes32, nil
 }
 
+// GetCodeTypedDataHash returns the EIP-712 hash of the code payload. The
+// fields ValidFrom and Expiry are only part of the type NewCode if one
+// of them is set
 func GetCodeTypedDataHash(cp utils.APICodePayload) ([]byte, error) {
+	fields := []apitypes.Type{
+		{Name: "Code", Type: "string"},
+		{Name: "ReferrerAddr", Type: "address"},
+		{Name: "PassOnPercTDF", Type: "uint32"},
+		{Name: "CreatedOn", Type: "uint256"},
+	}
+	msg := apitypes.TypedDataMessage{
+		"Code":          cp.Code,
+		"ReferrerAddr":  cp.ReferrerAddr,
+		"PassOnPercTDF": big.NewInt(int64(cp.PassOnPercTDF)),
+		"CreatedOn":     big.NewInt(int64(cp.CreatedOn)),
+	}
+	if cp.HasValidity() {
+		fields = append(fields,
+			apitypes.Type{Name: "ValidFrom", Type: "uint256"},
+			apitypes.Type{Name: "Expiry", Type: "uint256"})
+		msg["ValidFrom"] = big.NewInt(int64(cp.ValidFrom))
+		msg["Expiry"] = big.NewInt(int64(cp.Expiry))
+	}
+	// Hash the unsigned message using EIP-712
+	typedData := apitypes.TypedData{
+		Types: apitypes.Types{
+			"NewCode": fields,
+			"EIP712Domain": []apitypes.Type{
+				{Name: "name", Type: "string"},
+			},
+		},
+		Domain: apitypes.TypedDataDomain{
+			Name: "Referral System",
+		},
+		Message:     msg,
+		PrimaryType: "NewCode",
+	}
+	return typedData.HashStruct("NewCode", typedData.Message)
+}
+
+func GetCodeTiersDigest(tp utils.APICodeTiersPayload) ([32]byte, error) {
+	types := []string{"string", "address", "uint256", "uint256[]", "uint32[]"}
+	addr := common.HexToAddress(tp.ReferrerAddr)
+	ts := big.NewInt(int64(tp.CreatedOn))
+	volumes := make([]*big.Int, len(tp.Tiers))
+	passOn := make([]uint32, len(tp.Tiers))
+	for k, tier := range tp.Tiers {
+		volumes[k] = new(big.Int).SetUint64(tier.MinVolume)
+		passOn[k] = tier.PassOnPercTDF
+	}
+	values := []interface{}{tp.Code, addr, ts, volumes, passOn}
+	digest0, err := abiEncodeBytes32(types, values...)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	var digestBytes32 [32]byte
+	copy(digestBytes32[:], solsha3.SoliditySHA3(digest0))
+	return digestBytes32, nil
+}
+
+func GetCodeTiersTypedDataHash(tp utils.APICodeTiersPayload) ([]byte, error) {
+	volumes := make([]interface{}, len(tp.Tiers))
+	passOn := make([]interface{}, len(tp.Tiers))
+	for k, tier := range tp.Tiers {
+		volumes[k] = new(big.Int).SetUint64(tier.MinVolume)
+		passOn[k] = big.NewInt(int64(tier.PassOnPercTDF))
+	}
 	// Hash the unsigned message using EIP-712
 	typedData := apitypes.TypedData{
 		Types: apitypes.Types{
-			"NewCode": []apitypes.Type{
+			"CodeTiers": []apitypes.Type{
 				{Name: "Code", Type: "string"},
 				{Name: "ReferrerAddr", Type: "address"},
-				{Name: "PassOnPercTDF", Type: "uint32"},
 				{Name: "CreatedOn", Type: "uint256"},
+				{Name: "MinVolumes", Type: "uint256[]"},
+				{Name: "PassOnPercTDF", Type: "uint32[]"},
 			},
 			"EIP712Domain": []apitypes.Type{
 				{Name: "name", Type: "string"},
@@ -154,14 +228,99 @@ func GetCodeTypedDataHash(cp utils.APICodePayload) ([]byte, error) {
 			Name: "Referral System",
 		},
 		Message: apitypes.TypedDataMessage{
-			"Code":          cp.Code,
-			"ReferrerAddr":  cp.ReferrerAddr,
-			"PassOnPercTDF": big.NewInt(int64(cp.PassOnPercTDF)),
-			"CreatedOn":     big.NewInt(int64(cp.CreatedOn)),
+			"Code":          tp.Code,
+			"ReferrerAddr":  tp.ReferrerAddr,
+			"CreatedOn":     big.NewInt(int64(tp.CreatedOn)),
+			"MinVolumes":    volumes,
+			"PassOnPercTDF": passOn,
 		},
-		PrimaryType: "NewCode",
+		PrimaryType: "CodeTiers",
 	}
-	return typedData.HashStruct("NewCode", typedData.Message)
+	return typedData.HashStruct("CodeTiers", typedData.Message)
+}
+
+func GetPayoutAddrDigest(pl utils.APIPayoutAddrPayload) ([32]byte, error) {
+	types := []string{"address", "address", "address", "uint256"}
+	values := []interface{}{common.HexToAddress(pl.Addr), common.HexToAddress(pl.PayoutAddr),
+		common.HexToAddress(pl.BrokerAddr), big.NewInt(int64(pl.CreatedOn))}
+	digest0, err := abiEncodeBytes32(types, values...)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	var digestBytes32 [32]byte
+	copy(digestBytes32[:], solsha3.SoliditySHA3(digest0))
+	return digestBytes32, nil
+}
+
+func GetPayoutAddrTypedDataHash(pl utils.APIPayoutAddrPayload) ([]byte, error) {
+	// Hash the unsigned message using EIP-712
+	typedData := apitypes.TypedData{
+		Types: apitypes.Types{
+			"PayoutAddress": []apitypes.Type{
+				{Name: "Addr", Type: "address"},
+				{Name: "PayoutAddr", Type: "address"},
+				{Name: "BrokerAddr", Type: "address"},
+				{Name: "CreatedOn", Type: "uint256"},
+			},
+			"EIP712Domain": []apitypes.Type{
+				{Name: "name", Type: "string"},
+			},
+		},
+		Domain: apitypes.TypedDataDomain{
+			Name: "Referral System",
+		},
+		Message: apitypes.TypedDataMessage{
+			"Addr":       pl.Addr,
+			"PayoutAddr": pl.PayoutAddr,
+			"BrokerAddr": pl.BrokerAddr,
+			"CreatedOn":  big.NewInt(int64(pl.CreatedOn)),
+		},
+		PrimaryType: "PayoutAddress",
+	}
+	return typedData.HashStruct("PayoutAddress", typedData.Message)
+}
+
+func GetWebhookDigest(pl utils.APIWebhookPayload) ([32]byte, error) {
+	types := []string{"address", "string", "string", "address", "uint256"}
+	values := []interface{}{common.HexToAddress(pl.Addr), pl.Url, pl.Events,
+		common.HexToAddress(pl.BrokerAddr), big.NewInt(int64(pl.CreatedOn))}
+	digest0, err := abiEncodeBytes32(types, values...)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	var digestBytes32 [32]byte
+	copy(digestBytes32[:], solsha3.SoliditySHA3(digest0))
+	return digestBytes32, nil
+}
+
+func GetWebhookTypedDataHash(pl utils.APIWebhookPayload) ([]byte, error) {
+	// Hash the unsigned message using EIP-712
+	typedData := apitypes.TypedData{
+		Types: apitypes.Types{
+			"Webhook": []apitypes.Type{
+				{Name: "Addr", Type: "address"},
+				{Name: "Url", Type: "string"},
+				{Name: "Events", Type: "string"},
+				{Name: "BrokerAddr", Type: "address"},
+				{Name: "CreatedOn", Type: "uint256"},
+			},
+			"EIP712Domain": []apitypes.Type{
+				{Name: "name", Type: "string"},
+			},
+		},
+		Domain: apitypes.TypedDataDomain{
+			Name: "Referral System",
+		},
+		Message: apitypes.TypedDataMessage{
+			"Addr":       pl.Addr,
+			"Url":        pl.Url,
+			"Events":     pl.Events,
+			"BrokerAddr": pl.BrokerAddr,
+			"CreatedOn":  big.NewInt(int64(pl.CreatedOn)),
+		},
+		PrimaryType: "Webhook",
+	}
+	return typedData.HashStruct("Webhook", typedData.Message)
 }
 
 // RecoverCodeSelectSigAddr recovers the address of a signed APICodeSelectionPayload
@@ -242,6 +401,84 @@ func RecoverCodeSigAddr(cp utils.APICodePayload) (common.Address, error) {
 	return addr, nil
 }
 
+// RecoverCodeTiersSigAddr recovers the address of a signed APICodeTiersPayload
+// which is sent when a referrer sets the volume tiers of their code
+func RecoverCodeTiersSigAddr(tp utils.APICodeTiersPayload) (common.Address, error) {
+	typedDataHash, err := GetCodeTiersTypedDataHash(tp)
+	if err != nil {
+		return common.Address{}, err
+	}
+	// try to recover
+	addr, err := recoverEvmAddressEip712(string(typedDataHash), tp.Signature)
+
+	if err == nil && strings.ToLower(addr.String()) == strings.ToLower(tp.ReferrerAddr) {
+		return addr, err
+	}
+
+	// recovery using EIP-712 failed - try EIP-191
+	digestBytes32, err := GetCodeTiersDigest(tp)
+	if err != nil {
+		return common.Address{}, err
+	}
+	addr, err = recoverEvmAddressEip191(string(digestBytes32[:]), tp.Signature)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return addr, nil
+}
+
+// RecoverPayoutAddrSigAddr recovers the address of a signed APIPayoutAddrPayload
+// which is sent when an agency/referrer registers their payout address
+func RecoverPayoutAddrSigAddr(pl utils.APIPayoutAddrPayload) (common.Address, error) {
+	typedDataHash, err := GetPayoutAddrTypedDataHash(pl)
+	if err != nil {
+		return common.Address{}, err
+	}
+	// try to recover
+	addr, err := recoverEvmAddressEip712(string(typedDataHash), pl.Signature)
+
+	if err == nil && strings.ToLower(addr.String()) == strings.ToLower(pl.Addr) {
+		return addr, err
+	}
+
+	// recovery using EIP-712 failed - try EIP-191
+	digestBytes32, err := GetPayoutAddrDigest(pl)
+	if err != nil {
+		return common.Address{}, err
+	}
+	addr, err = recoverEvmAddressEip191(string(digestBytes32[:]), pl.Signature)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return addr, nil
+}
+
+// RecoverWebhookSigAddr recovers the address of a signed APIWebhookPayload
+// which is sent when a partner registers their webhook
+func RecoverWebhookSigAddr(pl utils.APIWebhookPayload) (common.Address, error) {
+	typedDataHash, err := GetWebhookTypedDataHash(pl)
+	if err != nil {
+		return common.Address{}, err
+	}
+	// try to recover
+	addr, err := recoverEvmAddressEip712(string(typedDataHash), pl.Signature)
+
+	if err == nil && strings.ToLower(addr.String()) == strings.ToLower(pl.Addr) {
+		return addr, err
+	}
+
+	// recovery using EIP-712 failed - try EIP-191
+	digestBytes32, err := GetWebhookDigest(pl)
+	if err != nil {
+		return common.Address{}, err
+	}
+	addr, err = recoverEvmAddressEip191(string(digestBytes32[:]), pl.Signature)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return addr, nil
+}
+
 func bytesFromHexString(hexNumber string) ([]byte, error) {
 	data, err := hex.DecodeString(strings.TrimPrefix(hexNumber, "0x"))
 	if err != nil {
@@ -1,10 +1,15 @@
 package api
 
 import (
+	"bytes"
 	"fmt"
 	"referral-system/src/utils"
 	"strings"
 	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
 )
 
 func TestGetCodeSelectionDigest(t *testing.T) {
@@ -215,3 +220,182 @@ func TestRecoverReferralAddr2(t *testing.T) {
 		return
 	}
 }
+
+func TestRecoverCodeSigAddrValidity(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	signer := crypto.PubkeyToAddress(key.PublicKey)
+	var rc = utils.APICodePayload{
+		Code:          "CAMPAIGN",
+		ReferrerAddr:  signer.Hex(),
+		CreatedOn:     1696166434,
+		PassOnPercTDF: 333,
+		ValidFrom:     1696166434,
+		Expiry:        1697376034,
+	}
+	h, err := GetCodeTypedDataHash(rc)
+	if err != nil {
+		t.Fatalf("typed data failed: %v", err)
+	}
+	noValidity := rc
+	noValidity.ValidFrom, noValidity.Expiry = 0, 0
+	h0, _ := GetCodeTypedDataHash(noValidity)
+	if bytes.Equal(h, h0) {
+		t.Errorf("validity not part of typed data hash")
+	}
+	// sign like a wallet with eth_signTypedData
+	domain := apitypes.TypedData{
+		Types:  apitypes.Types{"EIP712Domain": []apitypes.Type{{Name: "name", Type: "string"}}},
+		Domain: apitypes.TypedDataDomain{Name: "Referral System"},
+	}
+	domainSep, _ := domain.HashStruct("EIP712Domain", domain.Domain.Map())
+	digest := crypto.Keccak256([]byte("\x19\x01" + string(domainSep) + string(h)))
+	sig, _ := crypto.Sign(digest, key)
+	sig[64] += 27
+	rc.Signature = hexutil.Encode(sig)
+	addr, err := RecoverCodeSigAddr(rc)
+	if err != nil || addr != signer {
+		t.Errorf("wrong address recovered: %s (%v)", addr.Hex(), err)
+	}
+	// the expiry cannot be changed without a new signature
+	rc.Expiry += 86400
+	addr, _ = RecoverCodeSigAddr(rc)
+	if addr == signer {
+		t.Errorf("modified expiry accepted")
+	}
+}
+
+func TestRecoverCodeTiersSigAddr(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	signer := crypto.PubkeyToAddress(key.PublicKey)
+	var tp = utils.APICodeTiersPayload{
+		Code:         "ABCD",
+		ReferrerAddr: signer.Hex(),
+		CreatedOn:    1696166434,
+		Tiers: []utils.APICodeTierPayload{
+			{MinVolume: 100000, PassOnPercTDF: 5000},
+			{MinVolume: 1000000, PassOnPercTDF: 7500},
+		},
+	}
+	h, err := GetCodeTiersTypedDataHash(tp)
+	if err != nil {
+		t.Fatalf("typed data failed: %v", err)
+	}
+	domain := apitypes.TypedData{
+		Types:  apitypes.Types{"EIP712Domain": []apitypes.Type{{Name: "name", Type: "string"}}},
+		Domain: apitypes.TypedDataDomain{Name: "Referral System"},
+	}
+	domainSep, _ := domain.HashStruct("EIP712Domain", domain.Domain.Map())
+	sig, _ := crypto.Sign(crypto.Keccak256([]byte("\x19\x01"+string(domainSep)+string(h))), key)
+	sig[64] += 27
+	tp.Signature = hexutil.Encode(sig)
+	addr, err := RecoverCodeTiersSigAddr(tp)
+	if err != nil || addr != signer {
+		t.Errorf("wrong address recovered: %s (%v)", addr.Hex(), err)
+	}
+	// EIP-191 signature of the digest
+	d, err := GetCodeTiersDigest(tp)
+	if err != nil {
+		t.Fatalf("digest failed: %v", err)
+	}
+	sig, _ = crypto.Sign(crypto.Keccak256([]byte("\x19Ethereum Signed Message:\n32"+string(d[:]))), key)
+	tp.Signature = hexutil.Encode(sig)
+	addr, err = RecoverCodeTiersSigAddr(tp)
+	if err != nil || addr != signer {
+		t.Errorf("wrong address recovered from EIP-191 signature: %s (%v)", addr.Hex(), err)
+	}
+	// tiers cannot be changed without a new signature
+	tp.Tiers[1].PassOnPercTDF = 9900
+	addr, _ = RecoverCodeTiersSigAddr(tp)
+	if addr == signer {
+		t.Errorf("modified tiers accepted")
+	}
+}
+
+func TestRecoverPayoutAddrSigAddr(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	signer := crypto.PubkeyToAddress(key.PublicKey)
+	var pl = utils.APIPayoutAddrPayload{
+		Addr:       signer.Hex(),
+		PayoutAddr: "0x9d5aaB428e98678d0E645ea4AeBd25f744341a05",
+		BrokerAddr: "0x5A09217F6D36E73eE5495b430e889f8c57876Ef3",
+		CreatedOn:  1696166434,
+	}
+	h, err := GetPayoutAddrTypedDataHash(pl)
+	if err != nil {
+		t.Fatalf("typed data failed: %v", err)
+	}
+	domain := apitypes.TypedData{
+		Types:  apitypes.Types{"EIP712Domain": []apitypes.Type{{Name: "name", Type: "string"}}},
+		Domain: apitypes.TypedDataDomain{Name: "Referral System"},
+	}
+	domainSep, _ := domain.HashStruct("EIP712Domain", domain.Domain.Map())
+	sig, _ := crypto.Sign(crypto.Keccak256([]byte("\x19\x01"+string(domainSep)+string(h))), key)
+	sig[64] += 27
+	pl.Signature = hexutil.Encode(sig)
+	addr, err := RecoverPayoutAddrSigAddr(pl)
+	if err != nil || addr != signer {
+		t.Errorf("wrong address recovered: %s (%v)", addr.Hex(), err)
+	}
+	// EIP-191 signature of the digest
+	d, err := GetPayoutAddrDigest(pl)
+	if err != nil {
+		t.Fatalf("digest failed: %v", err)
+	}
+	sig, _ = crypto.Sign(crypto.Keccak256([]byte("\x19Ethereum Signed Message:\n32"+string(d[:]))), key)
+	pl.Signature = hexutil.Encode(sig)
+	addr, err = RecoverPayoutAddrSigAddr(pl)
+	if err != nil || addr != signer {
+		t.Errorf("wrong address recovered from EIP-191 signature: %s (%v)", addr.Hex(), err)
+	}
+	// the payout address cannot be changed without a new signature
+	pl.PayoutAddr = "0x85ded23c7bc09ae051bf83eb1cd91a90fae37366"
+	addr, _ = RecoverPayoutAddrSigAddr(pl)
+	if addr == signer {
+		t.Errorf("modified payout address accepted")
+	}
+}
+
+func TestRecoverWebhookSigAddr(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	signer := crypto.PubkeyToAddress(key.PublicKey)
+	var pl = utils.APIWebhookPayload{
+		Addr:       signer.Hex(),
+		Url:        "https://crm.example.org/hooks/referral",
+		Events:     "code-selected,payment-confirmed",
+		BrokerAddr: "0x5A09217F6D36E73eE5495b430e889f8c57876Ef3",
+		CreatedOn:  1696166434,
+	}
+	h, err := GetWebhookTypedDataHash(pl)
+	if err != nil {
+		t.Fatalf("typed data failed: %v", err)
+	}
+	domain := apitypes.TypedData{
+		Types:  apitypes.Types{"EIP712Domain": []apitypes.Type{{Name: "name", Type: "string"}}},
+		Domain: apitypes.TypedDataDomain{Name: "Referral System"},
+	}
+	domainSep, _ := domain.HashStruct("EIP712Domain", domain.Domain.Map())
+	sig, _ := crypto.Sign(crypto.Keccak256([]byte("\x19\x01"+string(domainSep)+string(h))), key)
+	sig[64] += 27
+	pl.Signature = hexutil.Encode(sig)
+	addr, err := RecoverWebhookSigAddr(pl)
+	if err != nil || addr != signer {
+		t.Errorf("wrong address recovered: %s (%v)", addr.Hex(), err)
+	}
+	// EIP-191 signature of the digest
+	d, err := GetWebhookDigest(pl)
+	if err != nil {
+		t.Fatalf("digest failed: %v", err)
+	}
+	sig, _ = crypto.Sign(crypto.Keccak256([]byte("\x19Ethereum Signed Message:\n32"+string(d[:]))), key)
+	pl.Signature = hexutil.Encode(sig)
+	addr, err = RecoverWebhookSigAddr(pl)
+	if err != nil || addr != signer {
+		t.Errorf("wrong address recovered from EIP-191 signature: %s (%v)", addr.Hex(), err)
+	}
+	// the url cannot be changed without a new signature
+	pl.Url = "https://attacker.example.org"
+	addr, _ = RecoverWebhookSigAddr(pl)
+	if addr == signer {
+		t.Errorf("modified url accepted")
+	}
+}
@@ -10,6 +10,14 @@ import (
 	"golang.org/x/exp/slog"
 )
 
+// FindBlockWithTs searches the block at timestamp ts and returns its
+// number and timestamp. The search steps back with an estimated block
+// time (initially 10s). If a step reaches beyond the genesis block, the
+// search continues from genesis instead of failing: the initial estimate
+// overshoots on chains with slower blocks, and on a chain younger than
+// the payment lookback (e.g. a new deployment) SavePayments, Reconcile
+// and the indexer would otherwise fail on every run. For ts before the
+// first block the search returns a block near genesis.
 func FindBlockWithTs(client *ethclient.Client, ts uint64) (uint64, uint64, error) {
 	blockB, err := BlockByNumberL2Compat(client, context.Background(), nil)
 	if err != nil {
@@ -28,7 +36,8 @@ func FindBlockWithTs(client *ethclient.Client, ts uint64) (uint64, uint64, error
 		tDiff := float64(tsB - ts)
 		blocksBack := uint64(max(tDiff/timeEst, 1))
 		if blocksBack >= numB {
-			return 0, 0, errors.New("genesis Block reached timestamp search failed")
+			// chain younger than the estimate: search from genesis
+			blocksBack = numB
 		}
 		numA = numB - blocksBack
 		numABig := big.NewInt(int64(numA))
@@ -42,6 +51,10 @@ func FindBlockWithTs(client *ethclient.Client, ts uint64) (uint64, uint64, error
 		if tsA < ts {
 			break
 		}
+		if numA == 0 {
+			// ts is before the genesis block
+			return 0, tsA, nil
+		}
 		timeEst = float64(tsB-tsA) / float64(blocksBack)
 		tsB = tsA
 		numB = numA
@@ -0,0 +1,44 @@
+package contracts_test
+
+import (
+	"context"
+	"math/big"
+	"referral-system/src/contracts"
+	"referral-system/src/simchain"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// TestFindBlockWithTsShortChain searches on a chain that is younger than
+// the searched time span, as for a new deployment
+func TestFindBlockWithTsShortChain(t *testing.T) {
+	sim, err := simchain.New(types.GenesisAlloc{})
+	if err != nil {
+		t.Fatalf("starting chain: %v", err)
+	}
+	defer sim.Close()
+	// hourly blocks: the initial estimate of 10 seconds per block
+	// reaches back beyond genesis
+	for k := 0; k < 10; k++ {
+		if err := sim.AdjustTime(time.Hour); err != nil {
+			t.Fatalf("adjust time: %v", err)
+		}
+	}
+	// before the first block: searched from genesis, the binary search
+	// stops within two blocks
+	num, _, err := contracts.FindBlockWithTs(sim.Client, uint64(time.Now().Unix()-14*86400))
+	if err != nil || num > 2 {
+		t.Errorf("expected block near genesis, got %d (%v)", num, err)
+	}
+	// after genesis
+	b3, err := sim.Client.HeaderByNumber(context.Background(), big.NewInt(3))
+	if err != nil {
+		t.Fatalf("header: %v", err)
+	}
+	num, ts, err := contracts.FindBlockWithTs(sim.Client, b3.Time+60)
+	if err != nil || num < 2 || num > 4 || ts > b3.Time+3600 {
+		t.Errorf("expected block around 3, got %d ts %d (%v)", num, ts, err)
+	}
+}
@@ -0,0 +1,605 @@
+// Code generated - DO NOT EDIT.
+// This file is a generated binding and any manual changes will be lost.
+
+package contracts
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var (
+	_ = errors.New
+	_ = big.NewInt
+	_ = strings.NewReader
+	_ = ethereum.NotFound
+	_ = bind.Bind
+	_ = common.Big1
+	_ = types.BloomLookup
+	_ = event.NewSubscription
+	_ = abi.ConvertType
+)
+
+// ClaimDistributorMetaData contains all meta data concerning the ClaimDistributor contract.
+var ClaimDistributorMetaData = &bind.MetaData{
+	ABI: "[{\"inputs\":[],\"stateMutability\":\"nonpayable\",\"type\":\"constructor\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":true,\"internalType\":\"address\",\"name\":\"account\",\"type\":\"address\"},{\"indexed\":true,\"internalType\":\"address\",\"name\":\"token\",\"type\":\"address\"},{\"indexed\":false,\"internalType\":\"uint256\",\"name\":\"amount\",\"type\":\"uint256\"}],\"name\":\"Claimed\",\"type\":\"event\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":false,\"internalType\":\"bytes32\",\"name\":\"oldMerkleRoot\",\"type\":\"bytes32\"},{\"indexed\":false,\"internalType\":\"bytes32\",\"name\":\"newMerkleRoot\",\"type\":\"bytes32\"}],\"name\":\"MerkleRootUpdated\",\"type\":\"event\"},{\"inputs\":[{\"internalType\":\"address\",\"name\":\"account\",\"type\":\"address\"},{\"internalType\":\"address\",\"name\":\"token\",\"type\":\"address\"},{\"internalType\":\"uint256\",\"name\":\"cumulativeAmount\",\"type\":\"uint256\"},{\"internalType\":\"bytes32[]\",\"name\":\"proof\",\"type\":\"bytes32[]\"}],\"name\":\"claim\",\"outputs\":[],\"stateMutability\":\"nonpayable\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"address\",\"name\":\"\",\"type\":\"address\"},{\"internalType\":\"address\",\"name\":\"\",\"type\":\"address\"}],\"name\":\"cumulativeClaimed\",\"outputs\":[{\"internalType\":\"uint256\",\"name\":\"\",\"type\":\"uint256\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[],\"name\":\"merkleRoot\",\"outputs\":[{\"internalType\":\"bytes32\",\"name\":\"\",\"type\":\"bytes32\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[],\"name\":\"owner\",\"outputs\":[{\"internalType\":\"address\",\"name\":\"\",\"type\":\"address\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"bytes32\",\"name\":\"merkleRoot_\",\"type\":\"bytes32\"}],\"name\":\"setMerkleRoot\",\"outputs\":[],\"stateMutability\":\"nonpayable\",\"type\":\"function\"}]",
+}
+
+// ClaimDistributorABI is the input ABI used to generate the binding from.
+// Deprecated: Use ClaimDistributorMetaData.ABI instead.
+var ClaimDistributorABI = ClaimDistributorMetaData.ABI
+
+// ClaimDistributor is an auto generated Go binding around an Ethereum contract.
+type ClaimDistributor struct {
+	ClaimDistributorCaller     // Read-only binding to the contract
+	ClaimDistributorTransactor // Write-only binding to the contract
+	ClaimDistributorFilterer   // Log filterer for contract events
+}
+
+// ClaimDistributorCaller is an auto generated read-only Go binding around an Ethereum contract.
+type ClaimDistributorCaller struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// ClaimDistributorTransactor is an auto generated write-only Go binding around an Ethereum contract.
+type ClaimDistributorTransactor struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// ClaimDistributorFilterer is an auto generated log filtering Go binding around an Ethereum contract events.
+type ClaimDistributorFilterer struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// ClaimDistributorSession is an auto generated Go binding around an Ethereum contract,
+// with pre-set call and transact options.
+type ClaimDistributorSession struct {
+	Contract     *ClaimDistributor // Generic contract binding to set the session for
+	CallOpts     bind.CallOpts     // Call options to use throughout this session
+	TransactOpts bind.TransactOpts // Transaction auth options to use throughout this session
+}
+
+// ClaimDistributorCallerSession is an auto generated read-only Go binding around an Ethereum contract,
+// with pre-set call options.
+type ClaimDistributorCallerSession struct {
+	Contract *ClaimDistributorCaller // Generic contract caller binding to set the session for
+	CallOpts bind.CallOpts           // Call options to use throughout this session
+}
+
+// ClaimDistributorTransactorSession is an auto generated write-only Go binding around an Ethereum contract,
+// with pre-set transact options.
+type ClaimDistributorTransactorSession struct {
+	Contract     *ClaimDistributorTransactor // Generic contract transactor binding to set the session for
+	TransactOpts bind.TransactOpts           // Transaction auth options to use throughout this session
+}
+
+// ClaimDistributorRaw is an auto generated low-level Go binding around an Ethereum contract.
+type ClaimDistributorRaw struct {
+	Contract *ClaimDistributor // Generic contract binding to access the raw methods on
+}
+
+// ClaimDistributorCallerRaw is an auto generated low-level read-only Go binding around an Ethereum contract.
+type ClaimDistributorCallerRaw struct {
+	Contract *ClaimDistributorCaller // Generic read-only contract binding to access the raw methods on
+}
+
+// ClaimDistributorTransactorRaw is an auto generated low-level write-only Go binding around an Ethereum contract.
+type ClaimDistributorTransactorRaw struct {
+	Contract *ClaimDistributorTransactor // Generic write-only contract binding to access the raw methods on
+}
+
+// NewClaimDistributor creates a new instance of ClaimDistributor, bound to a specific deployed contract.
+func NewClaimDistributor(address common.Address, backend bind.ContractBackend) (*ClaimDistributor, error) {
+	contract, err := bindClaimDistributor(address, backend, backend, backend)
+	if err != nil {
+		return nil, err
+	}
+	return &ClaimDistributor{ClaimDistributorCaller: ClaimDistributorCaller{contract: contract}, ClaimDistributorTransactor: ClaimDistributorTransactor{contract: contract}, ClaimDistributorFilterer: ClaimDistributorFilterer{contract: contract}}, nil
+}
+
+// NewClaimDistributorCaller creates a new read-only instance of ClaimDistributor, bound to a specific deployed contract.
+func NewClaimDistributorCaller(address common.Address, caller bind.ContractCaller) (*ClaimDistributorCaller, error) {
+	contract, err := bindClaimDistributor(address, caller, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &ClaimDistributorCaller{contract: contract}, nil
+}
+
+// NewClaimDistributorTransactor creates a new write-only instance of ClaimDistributor, bound to a specific deployed contract.
+func NewClaimDistributorTransactor(address common.Address, transactor bind.ContractTransactor) (*ClaimDistributorTransactor, error) {
+	contract, err := bindClaimDistributor(address, nil, transactor, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &ClaimDistributorTransactor{contract: contract}, nil
+}
+
+// NewClaimDistributorFilterer creates a new log filterer instance of ClaimDistributor, bound to a specific deployed contract.
+func NewClaimDistributorFilterer(address common.Address, filterer bind.ContractFilterer) (*ClaimDistributorFilterer, error) {
+	contract, err := bindClaimDistributor(address, nil, nil, filterer)
+	if err != nil {
+		return nil, err
+	}
+	return &ClaimDistributorFilterer{contract: contract}, nil
+}
+
+// bindClaimDistributor binds a generic wrapper to an already deployed contract.
+func bindClaimDistributor(address common.Address, caller bind.ContractCaller, transactor bind.ContractTransactor, filterer bind.ContractFilterer) (*bind.BoundContract, error) {
+	parsed, err := ClaimDistributorMetaData.GetAbi()
+	if err != nil {
+		return nil, err
+	}
+	return bind.NewBoundContract(address, *parsed, caller, transactor, filterer), nil
+}
+
+// Call invokes the (constant) contract method with params as input values and
+// sets the output to result. The result type might be a single field for simple
+// returns, a slice of interfaces for anonymous returns and a struct for named
+// returns.
+func (_ClaimDistributor *ClaimDistributorRaw) Call(opts *bind.CallOpts, result *[]interface{}, method string, params ...interface{}) error {
+	return _ClaimDistributor.Contract.ClaimDistributorCaller.contract.Call(opts, result, method, params...)
+}
+
+// Transfer initiates a plain transaction to move funds to the contract, calling
+// its default method if one is available.
+func (_ClaimDistributor *ClaimDistributorRaw) Transfer(opts *bind.TransactOpts) (*types.Transaction, error) {
+	return _ClaimDistributor.Contract.ClaimDistributorTransactor.contract.Transfer(opts)
+}
+
+// Transact invokes the (paid) contract method with params as input values.
+func (_ClaimDistributor *ClaimDistributorRaw) Transact(opts *bind.TransactOpts, method string, params ...interface{}) (*types.Transaction, error) {
+	return _ClaimDistributor.Contract.ClaimDistributorTransactor.contract.Transact(opts, method, params...)
+}
+
+// Call invokes the (constant) contract method with params as input values and
+// sets the output to result. The result type might be a single field for simple
+// returns, a slice of interfaces for anonymous returns and a struct for named
+// returns.
+func (_ClaimDistributor *ClaimDistributorCallerRaw) Call(opts *bind.CallOpts, result *[]interface{}, method string, params ...interface{}) error {
+	return _ClaimDistributor.Contract.contract.Call(opts, result, method, params...)
+}
+
+// Transfer initiates a plain transaction to move funds to the contract, calling
+// its default method if one is available.
+func (_ClaimDistributor *ClaimDistributorTransactorRaw) Transfer(opts *bind.TransactOpts) (*types.Transaction, error) {
+	return _ClaimDistributor.Contract.contract.Transfer(opts)
+}
+
+// Transact invokes the (paid) contract method with params as input values.
+func (_ClaimDistributor *ClaimDistributorTransactorRaw) Transact(opts *bind.TransactOpts, method string, params ...interface{}) (*types.Transaction, error) {
+	return _ClaimDistributor.Contract.contract.Transact(opts, method, params...)
+}
+
+// CumulativeClaimed is a free data retrieval call binding the contract method 0x865c6953.
+//
+// Solidity: function cumulativeClaimed(address , address ) view returns(uint256)
+func (_ClaimDistributor *ClaimDistributorCaller) CumulativeClaimed(opts *bind.CallOpts, arg0 common.Address, arg1 common.Address) (*big.Int, error) {
+	var out []interface{}
+	err := _ClaimDistributor.contract.Call(opts, &out, "cumulativeClaimed", arg0, arg1)
+
+	if err != nil {
+		return *new(*big.Int), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new(*big.Int)).(**big.Int)
+
+	return out0, err
+
+}
+
+// CumulativeClaimed is a free data retrieval call binding the contract method 0x865c6953.
+//
+// Solidity: function cumulativeClaimed(address , address ) view returns(uint256)
+func (_ClaimDistributor *ClaimDistributorSession) CumulativeClaimed(arg0 common.Address, arg1 common.Address) (*big.Int, error) {
+	return _ClaimDistributor.Contract.CumulativeClaimed(&_ClaimDistributor.CallOpts, arg0, arg1)
+}
+
+// CumulativeClaimed is a free data retrieval call binding the contract method 0x865c6953.
+//
+// Solidity: function cumulativeClaimed(address , address ) view returns(uint256)
+func (_ClaimDistributor *ClaimDistributorCallerSession) CumulativeClaimed(arg0 common.Address, arg1 common.Address) (*big.Int, error) {
+	return _ClaimDistributor.Contract.CumulativeClaimed(&_ClaimDistributor.CallOpts, arg0, arg1)
+}
+
+// MerkleRoot is a free data retrieval call binding the contract method 0x2eb4a7ab.
+//
+// Solidity: function merkleRoot() view returns(bytes32)
+func (_ClaimDistributor *ClaimDistributorCaller) MerkleRoot(opts *bind.CallOpts) ([32]byte, error) {
+	var out []interface{}
+	err := _ClaimDistributor.contract.Call(opts, &out, "merkleRoot")
+
+	if err != nil {
+		return *new([32]byte), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new([32]byte)).(*[32]byte)
+
+	return out0, err
+
+}
+
+// MerkleRoot is a free data retrieval call binding the contract method 0x2eb4a7ab.
+//
+// Solidity: function merkleRoot() view returns(bytes32)
+func (_ClaimDistributor *ClaimDistributorSession) MerkleRoot() ([32]byte, error) {
+	return _ClaimDistributor.Contract.MerkleRoot(&_ClaimDistributor.CallOpts)
+}
+
+// MerkleRoot is a free data retrieval call binding the contract method 0x2eb4a7ab.
+//
+// Solidity: function merkleRoot() view returns(bytes32)
+func (_ClaimDistributor *ClaimDistributorCallerSession) MerkleRoot() ([32]byte, error) {
+	return _ClaimDistributor.Contract.MerkleRoot(&_ClaimDistributor.CallOpts)
+}
+
+// Owner is a free data retrieval call binding the contract method 0x8da5cb5b.
+//
+// Solidity: function owner() view returns(address)
+func (_ClaimDistributor *ClaimDistributorCaller) Owner(opts *bind.CallOpts) (common.Address, error) {
+	var out []interface{}
+	err := _ClaimDistributor.contract.Call(opts, &out, "owner")
+
+	if err != nil {
+		return *new(common.Address), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new(common.Address)).(*common.Address)
+
+	return out0, err
+
+}
+
+// Owner is a free data retrieval call binding the contract method 0x8da5cb5b.
+//
+// Solidity: function owner() view returns(address)
+func (_ClaimDistributor *ClaimDistributorSession) Owner() (common.Address, error) {
+	return _ClaimDistributor.Contract.Owner(&_ClaimDistributor.CallOpts)
+}
+
+// Owner is a free data retrieval call binding the contract method 0x8da5cb5b.
+//
+// Solidity: function owner() view returns(address)
+func (_ClaimDistributor *ClaimDistributorCallerSession) Owner() (common.Address, error) {
+	return _ClaimDistributor.Contract.Owner(&_ClaimDistributor.CallOpts)
+}
+
+// Claim is a paid mutator transaction binding the contract method 0xfabed412.
+//
+// Solidity: function claim(address account, address token, uint256 cumulativeAmount, bytes32[] proof) returns()
+func (_ClaimDistributor *ClaimDistributorTransactor) Claim(opts *bind.TransactOpts, account common.Address, token common.Address, cumulativeAmount *big.Int, proof [][32]byte) (*types.Transaction, error) {
+	return _ClaimDistributor.contract.Transact(opts, "claim", account, token, cumulativeAmount, proof)
+}
+
+// Claim is a paid mutator transaction binding the contract method 0xfabed412.
+//
+// Solidity: function claim(address account, address token, uint256 cumulativeAmount, bytes32[] proof) returns()
+func (_ClaimDistributor *ClaimDistributorSession) Claim(account common.Address, token common.Address, cumulativeAmount *big.Int, proof [][32]byte) (*types.Transaction, error) {
+	return _ClaimDistributor.Contract.Claim(&_ClaimDistributor.TransactOpts, account, token, cumulativeAmount, proof)
+}
+
+// Claim is a paid mutator transaction binding the contract method 0xfabed412.
+//
+// Solidity: function claim(address account, address token, uint256 cumulativeAmount, bytes32[] proof) returns()
+func (_ClaimDistributor *ClaimDistributorTransactorSession) Claim(account common.Address, token common.Address, cumulativeAmount *big.Int, proof [][32]byte) (*types.Transaction, error) {
+	return _ClaimDistributor.Contract.Claim(&_ClaimDistributor.TransactOpts, account, token, cumulativeAmount, proof)
+}
+
+// SetMerkleRoot is a paid mutator transaction binding the contract method 0x7cb64759.
+//
+// Solidity: function setMerkleRoot(bytes32 merkleRoot_) returns()
+func (_ClaimDistributor *ClaimDistributorTransactor) SetMerkleRoot(opts *bind.TransactOpts, merkleRoot_ [32]byte) (*types.Transaction, error) {
+	return _ClaimDistributor.contract.Transact(opts, "setMerkleRoot", merkleRoot_)
+}
+
+// SetMerkleRoot is a paid mutator transaction binding the contract method 0x7cb64759.
+//
+// Solidity: function setMerkleRoot(bytes32 merkleRoot_) returns()
+func (_ClaimDistributor *ClaimDistributorSession) SetMerkleRoot(merkleRoot_ [32]byte) (*types.Transaction, error) {
+	return _ClaimDistributor.Contract.SetMerkleRoot(&_ClaimDistributor.TransactOpts, merkleRoot_)
+}
+
+// SetMerkleRoot is a paid mutator transaction binding the contract method 0x7cb64759.
+//
+// Solidity: function setMerkleRoot(bytes32 merkleRoot_) returns()
+func (_ClaimDistributor *ClaimDistributorTransactorSession) SetMerkleRoot(merkleRoot_ [32]byte) (*types.Transaction, error) {
+	return _ClaimDistributor.Contract.SetMerkleRoot(&_ClaimDistributor.TransactOpts, merkleRoot_)
+}
+
+// ClaimDistributorClaimedIterator is returned from FilterClaimed and is used to iterate over the raw logs and unpacked data for Claimed events raised by the ClaimDistributor contract.
+type ClaimDistributorClaimedIterator struct {
+	Event *ClaimDistributorClaimed // Event containing the contract specifics and raw log
+
+	contract *bind.BoundContract // Generic contract to use for unpacking event data
+	event    string              // Event name to use for unpacking event data
+
+	logs chan types.Log        // Log channel receiving the found contract events
+	sub  ethereum.Subscription // Subscription for errors, completion and termination
+	done bool                  // Whether the subscription completed delivering logs
+	fail error                 // Occurred error to stop iteration
+}
+
+// Next advances the iterator to the subsequent event, returning whether there
+// are any more events found. In case of a retrieval or parsing error, false is
+// returned and Error() can be queried for the exact failure.
+func (it *ClaimDistributorClaimedIterator) Next() bool {
+	// If the iterator failed, stop iterating
+	if it.fail != nil {
+		return false
+	}
+	// If the iterator completed, deliver directly whatever's available
+	if it.done {
+		select {
+		case log := <-it.logs:
+			it.Event = new(ClaimDistributorClaimed)
+			if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+				it.fail = err
+				return false
+			}
+			it.Event.Raw = log
+			return true
+
+		default:
+			return false
+		}
+	}
+	// Iterator still in progress, wait for either a data or an error event
+	select {
+	case log := <-it.logs:
+		it.Event = new(ClaimDistributorClaimed)
+		if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+			it.fail = err
+			return false
+		}
+		it.Event.Raw = log
+		return true
+
+	case err := <-it.sub.Err():
+		it.done = true
+		it.fail = err
+		return it.Next()
+	}
+}
+
+// Error returns any retrieval or parsing error occurred during filtering.
+func (it *ClaimDistributorClaimedIterator) Error() error {
+	return it.fail
+}
+
+// Close terminates the iteration process, releasing any pending underlying
+// resources.
+func (it *ClaimDistributorClaimedIterator) Close() error {
+	it.sub.Unsubscribe()
+	return nil
+}
+
+// ClaimDistributorClaimed represents a Claimed event raised by the ClaimDistributor contract.
+type ClaimDistributorClaimed struct {
+	Account common.Address
+	Token   common.Address
+	Amount  *big.Int
+	Raw     types.Log // Blockchain specific contextual infos
+}
+
+// FilterClaimed is a free log retrieval operation binding the contract event 0xf7a40077ff7a04c7e61f6f26fb13774259ddf1b6bce9ecf26a8276cdd3992683.
+//
+// Solidity: event Claimed(address indexed account, address indexed token, uint256 amount)
+func (_ClaimDistributor *ClaimDistributorFilterer) FilterClaimed(opts *bind.FilterOpts, account []common.Address, token []common.Address) (*ClaimDistributorClaimedIterator, error) {
+
+	var accountRule []interface{}
+	for _, accountItem := range account {
+		accountRule = append(accountRule, accountItem)
+	}
+	var tokenRule []interface{}
+	for _, tokenItem := range token {
+		tokenRule = append(tokenRule, tokenItem)
+	}
+
+	logs, sub, err := _ClaimDistributor.contract.FilterLogs(opts, "Claimed", accountRule, tokenRule)
+	if err != nil {
+		return nil, err
+	}
+	return &ClaimDistributorClaimedIterator{contract: _ClaimDistributor.contract, event: "Claimed", logs: logs, sub: sub}, nil
+}
+
+// WatchClaimed is a free log subscription operation binding the contract event 0xf7a40077ff7a04c7e61f6f26fb13774259ddf1b6bce9ecf26a8276cdd3992683.
+//
+// Solidity: event Claimed(address indexed account, address indexed token, uint256 amount)
+func (_ClaimDistributor *ClaimDistributorFilterer) WatchClaimed(opts *bind.WatchOpts, sink chan<- *ClaimDistributorClaimed, account []common.Address, token []common.Address) (event.Subscription, error) {
+
+	var accountRule []interface{}
+	for _, accountItem := range account {
+		accountRule = append(accountRule, accountItem)
+	}
+	var tokenRule []interface{}
+	for _, tokenItem := range token {
+		tokenRule = append(tokenRule, tokenItem)
+	}
+
+	logs, sub, err := _ClaimDistributor.contract.WatchLogs(opts, "Claimed", accountRule, tokenRule)
+	if err != nil {
+		return nil, err
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case log := <-logs:
+				// New log arrived, parse the event and forward to the user
+				event := new(ClaimDistributorClaimed)
+				if err := _ClaimDistributor.contract.UnpackLog(event, "Claimed", log); err != nil {
+					return err
+				}
+				event.Raw = log
+
+				select {
+				case sink <- event:
+				case err := <-sub.Err():
+					return err
+				case <-quit:
+					return nil
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
+
+// ParseClaimed is a log parse operation binding the contract event 0xf7a40077ff7a04c7e61f6f26fb13774259ddf1b6bce9ecf26a8276cdd3992683.
+//
+// Solidity: event Claimed(address indexed account, address indexed token, uint256 amount)
+func (_ClaimDistributor *ClaimDistributorFilterer) ParseClaimed(log types.Log) (*ClaimDistributorClaimed, error) {
+	event := new(ClaimDistributorClaimed)
+	if err := _ClaimDistributor.contract.UnpackLog(event, "Claimed", log); err != nil {
+		return nil, err
+	}
+	event.Raw = log
+	return event, nil
+}
+
+// ClaimDistributorMerkleRootUpdatedIterator is returned from FilterMerkleRootUpdated and is used to iterate over the raw logs and unpacked data for MerkleRootUpdated events raised by the ClaimDistributor contract.
+type ClaimDistributorMerkleRootUpdatedIterator struct {
+	Event *ClaimDistributorMerkleRootUpdated // Event containing the contract specifics and raw log
+
+	contract *bind.BoundContract // Generic contract to use for unpacking event data
+	event    string              // Event name to use for unpacking event data
+
+	logs chan types.Log        // Log channel receiving the found contract events
+	sub  ethereum.Subscription // Subscription for errors, completion and termination
+	done bool                  // Whether the subscription completed delivering logs
+	fail error                 // Occurred error to stop iteration
+}
+
+// Next advances the iterator to the subsequent event, returning whether there
+// are any more events found. In case of a retrieval or parsing error, false is
+// returned and Error() can be queried for the exact failure.
+func (it *ClaimDistributorMerkleRootUpdatedIterator) Next() bool {
+	// If the iterator failed, stop iterating
+	if it.fail != nil {
+		return false
+	}
+	// If the iterator completed, deliver directly whatever's available
+	if it.done {
+		select {
+		case log := <-it.logs:
+			it.Event = new(ClaimDistributorMerkleRootUpdated)
+			if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+				it.fail = err
+				return false
+			}
+			it.Event.Raw = log
+			return true
+
+		default:
+			return false
+		}
+	}
+	// Iterator still in progress, wait for either a data or an error event
+	select {
+	case log := <-it.logs:
+		it.Event = new(ClaimDistributorMerkleRootUpdated)
+		if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+			it.fail = err
+			return false
+		}
+		it.Event.Raw = log
+		return true
+
+	case err := <-it.sub.Err():
+		it.done = true
+		it.fail = err
+		return it.Next()
+	}
+}
+
+// Error returns any retrieval or parsing error occurred during filtering.
+func (it *ClaimDistributorMerkleRootUpdatedIterator) Error() error {
+	return it.fail
+}
+
+// Close terminates the iteration process, releasing any pending underlying
+// resources.
+func (it *ClaimDistributorMerkleRootUpdatedIterator) Close() error {
+	it.sub.Unsubscribe()
+	return nil
+}
+
+// ClaimDistributorMerkleRootUpdated represents a MerkleRootUpdated event raised by the ClaimDistributor contract.
+type ClaimDistributorMerkleRootUpdated struct {
+	OldMerkleRoot [32]byte
+	NewMerkleRoot [32]byte
+	Raw           types.Log // Blockchain specific contextual infos
+}
+
+// FilterMerkleRootUpdated is a free log retrieval operation binding the contract event 0xfd69edeceaf1d6832d935be1fba54ca93bf17e71520c6c9ffc08d6e9529f8757.
+//
+// Solidity: event MerkleRootUpdated(bytes32 oldMerkleRoot, bytes32 newMerkleRoot)
+func (_ClaimDistributor *ClaimDistributorFilterer) FilterMerkleRootUpdated(opts *bind.FilterOpts) (*ClaimDistributorMerkleRootUpdatedIterator, error) {
+
+	logs, sub, err := _ClaimDistributor.contract.FilterLogs(opts, "MerkleRootUpdated")
+	if err != nil {
+		return nil, err
+	}
+	return &ClaimDistributorMerkleRootUpdatedIterator{contract: _ClaimDistributor.contract, event: "MerkleRootUpdated", logs: logs, sub: sub}, nil
+}
+
+// WatchMerkleRootUpdated is a free log subscription operation binding the contract event 0xfd69edeceaf1d6832d935be1fba54ca93bf17e71520c6c9ffc08d6e9529f8757.
+//
+// Solidity: event MerkleRootUpdated(bytes32 oldMerkleRoot, bytes32 newMerkleRoot)
+func (_ClaimDistributor *ClaimDistributorFilterer) WatchMerkleRootUpdated(opts *bind.WatchOpts, sink chan<- *ClaimDistributorMerkleRootUpdated) (event.Subscription, error) {
+
+	logs, sub, err := _ClaimDistributor.contract.WatchLogs(opts, "MerkleRootUpdated")
+	if err != nil {
+		return nil, err
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case log := <-logs:
+				// New log arrived, parse the event and forward to the user
+				event := new(ClaimDistributorMerkleRootUpdated)
+				if err := _ClaimDistributor.contract.UnpackLog(event, "MerkleRootUpdated", log); err != nil {
+					return err
+				}
+				event.Raw = log
+
+				select {
+				case sink <- event:
+				case err := <-sub.Err():
+					return err
+				case <-quit:
+					return nil
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
+
+// ParseMerkleRootUpdated is a log parse operation binding the contract event 0xfd69edeceaf1d6832d935be1fba54ca93bf17e71520c6c9ffc08d6e9529f8757.
+//
+// Solidity: event MerkleRootUpdated(bytes32 oldMerkleRoot, bytes32 newMerkleRoot)
+func (_ClaimDistributor *ClaimDistributorFilterer) ParseMerkleRootUpdated(log types.Log) (*ClaimDistributorMerkleRootUpdated, error) {
+	event := new(ClaimDistributorMerkleRootUpdated)
+	if err := _ClaimDistributor.contract.UnpackLog(event, "MerkleRootUpdated", log); err != nil {
+		return nil, err
+	}
+	event.Raw = log
+	return event, nil
+}
@@ -0,0 +1,21 @@
+
+-- CreateTable
+  -- payments planned by a dry-run of the payment execution,
+  -- no transaction was sent for these entries
+CREATE TABLE if not exists "referral_payment_dry_run" (
+    "run_ts" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "broker_id" VARCHAR(42) NOT NULL,
+    "batch_ts" TIMESTAMPTZ NOT NULL,
+    "trader_addr" VARCHAR(42) NOT NULL,
+    "payee_addr" VARCHAR(42) NOT NULL,
+    "code" VARCHAR(200) NOT NULL,
+    "level" SMALLINT NOT NULL,
+    "pool_id" INTEGER NOT NULL,
+    "token_addr" VARCHAR(42) NOT NULL,
+    -- planned payment in token's number format
+    "amount_cc" DECIMAL(40,0) NOT NULL,
+    CONSTRAINT "referral_payment_dry_run_pkey" PRIMARY KEY ("broker_id", "run_ts", "trader_addr", "payee_addr", "pool_id", "code", "level")
+);
+
+-- CreateIndex
+CREATE INDEX  IF NOT EXISTS "referral_payment_dry_run_run_ts_idx" ON "referral_payment_dry_run"("run_ts");
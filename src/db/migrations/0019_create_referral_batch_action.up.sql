@@ -0,0 +1,15 @@
+-- CreateTable
+  -- manual actions on payment batches via the admin api
+CREATE TABLE if not exists "referral_batch_action" (
+    "id" SERIAL PRIMARY KEY,
+    "broker_id" VARCHAR(42) NOT NULL,
+    -- start, pause, resume, skip
+    "action" VARCHAR(16) NOT NULL,
+    -- name of the admin as configured in ADMIN_API_KEYS
+    "admin_name" VARCHAR(64) NOT NULL,
+    "batch_ts" TIMESTAMPTZ,
+    "ts" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- CreateIndex
+CREATE INDEX  IF NOT EXISTS "referral_batch_action_broker_id_ts_idx" ON "referral_batch_action"("broker_id", "ts");
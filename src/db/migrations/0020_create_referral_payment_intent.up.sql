@@ -0,0 +1,21 @@
+-- CreateTable
+  -- write-ahead record of every payment transaction, written before the
+  -- transaction is sent so that a resumed batch does not pay twice
+CREATE TABLE if not exists "referral_payment_intent" (
+    "broker_id" VARCHAR(42) NOT NULL,
+    "batch_ts" TIMESTAMPTZ NOT NULL,
+    "trader_addr" VARCHAR(42) NOT NULL,
+    "pool_id" INTEGER NOT NULL,
+    "code" VARCHAR(200) NOT NULL,
+    -- pending, submitted, mined, failed
+    "status" VARCHAR(16) NOT NULL,
+    "tx_hash" TEXT,
+    -- MultiPay payment digest for delegated payments
+    "digest" TEXT,
+    "created_ts" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "updated_ts" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT "referral_payment_intent_pkey" PRIMARY KEY ("broker_id", "batch_ts", "trader_addr", "pool_id", "code")
+);
+
+-- CreateIndex
+CREATE INDEX  IF NOT EXISTS "referral_payment_intent_status_idx" ON "referral_payment_intent"("status");
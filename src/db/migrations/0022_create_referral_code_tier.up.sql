@@ -0,0 +1,9 @@
+-- CreateTable: volume tiers of a code, the trader rebate applies from min_volume_cc
+-- (collateral currency, per pool and pay period)
+CREATE TABLE if not exists "referral_code_tier" (
+    "broker_id" VARCHAR(42) NOT NULL,
+    "code" VARCHAR(200) NOT NULL,
+    "min_volume_cc" DECIMAL(40,0) NOT NULL,
+    "trader_rebate_perc" DECIMAL(5,2) NOT NULL,
+    CONSTRAINT "referral_code_tier_pkey" PRIMARY KEY ("broker_id", "code", "min_volume_cc")
+);
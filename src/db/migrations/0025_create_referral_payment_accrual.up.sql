@@ -0,0 +1,21 @@
+-- CreateTable
+  -- broker fees of payments below the minimal payout of the token, carried
+  -- forward until the trader's fees of a later batch cross the threshold
+CREATE TABLE if not exists "referral_payment_accrual" (
+    "broker_id" VARCHAR(42) NOT NULL,
+    -- batch that carried the fees forward
+    "batch_ts" TIMESTAMPTZ NOT NULL,
+    "trader_addr" VARCHAR(42) NOT NULL,
+    "pool_id" INTEGER NOT NULL,
+    "code" VARCHAR(200) NOT NULL,
+    -- ABDK 64x64 format like referral_aggr_fees_per_trader.broker_fee_cc
+    "broker_fee_cc" DECIMAL(40,0) NOT NULL,
+    "last_trade_considered_ts" TIMESTAMPTZ NOT NULL,
+    -- batch that paid the fees, null while carried
+    "paid_batch_ts" TIMESTAMPTZ,
+    "created_ts" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT "referral_payment_accrual_pkey" PRIMARY KEY ("broker_id", "batch_ts", "trader_addr", "pool_id", "code")
+);
+
+-- CreateIndex
+CREATE INDEX  IF NOT EXISTS "referral_payment_accrual_trader_idx" ON "referral_payment_accrual"("broker_id", "trader_addr", "pool_id");
@@ -0,0 +1,20 @@
+-- CreateTable
+  -- payment transactions replaced with the same nonce and higher fees,
+  -- any transaction of the family of original_hash can be mined
+CREATE TABLE if not exists "referral_tx_replacement" (
+    "replacement_hash" TEXT NOT NULL,
+    "broker_id" VARCHAR(42) NOT NULL,
+    -- first transaction sent with the nonce
+    "original_hash" TEXT NOT NULL,
+    -- transaction replaced by this one
+    "replaced_hash" TEXT NOT NULL,
+    "nonce" BIGINT NOT NULL,
+    -- max. fee per gas, gas price for legacy transactions (wei)
+    "gas_fee_cap" DECIMAL(40,0) NOT NULL,
+    "gas_tip_cap" DECIMAL(40,0) NOT NULL,
+    "created_ts" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT "referral_tx_replacement_pkey" PRIMARY KEY ("replacement_hash")
+);
+
+-- CreateIndex
+CREATE INDEX  IF NOT EXISTS "referral_tx_replacement_original_idx" ON "referral_tx_replacement"("original_hash");
@@ -0,0 +1,11 @@
+-- CreateTable
+  -- merkle root of the claims published by a batch in payout mode "claim",
+  -- the root covers the cumulative amounts of all payees up to the batch
+CREATE TABLE if not exists "referral_claim_tree" (
+    "broker_id" VARCHAR(42) NOT NULL,
+    "batch_ts" TIMESTAMPTZ NOT NULL,
+    "root" TEXT NOT NULL,
+    "leaf_count" INTEGER NOT NULL,
+    "created_ts" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT "referral_claim_tree_pkey" PRIMARY KEY ("broker_id", "batch_ts")
+);
@@ -0,0 +1,19 @@
+-- CreateTable
+  -- leaves (payee, token, cumulative amount) of a claim tree and their proofs
+CREATE TABLE if not exists "referral_claim_leaf" (
+    "broker_id" VARCHAR(42) NOT NULL,
+    "batch_ts" TIMESTAMPTZ NOT NULL,
+    "payee_addr" VARCHAR(42) NOT NULL,
+    "token_addr" VARCHAR(42) NOT NULL,
+    -- decimal-N amount claimable in total up to the batch
+    "cumulative_amount" DECIMAL(40,0) NOT NULL,
+    -- decimal-N amount added by the batch
+    "amount" DECIMAL(40,0) NOT NULL,
+    "leaf_hash" TEXT NOT NULL,
+    -- comma-separated sibling hashes from the leaf to the root
+    "proof" TEXT NOT NULL,
+    CONSTRAINT "referral_claim_leaf_pkey" PRIMARY KEY ("broker_id", "batch_ts", "payee_addr", "token_addr")
+);
+
+-- CreateIndex
+CREATE INDEX  IF NOT EXISTS "referral_claim_leaf_payee_idx" ON "referral_claim_leaf"("broker_id", "payee_addr");
@@ -0,0 +1,19 @@
+-- CreateTable
+  -- trader fees allocated to a claim tree instead of being paid, the
+  -- trades count as settled for the open pay view
+CREATE TABLE if not exists "referral_claim_allocation" (
+    "broker_id" VARCHAR(42) NOT NULL,
+    "batch_ts" TIMESTAMPTZ NOT NULL,
+    "trader_addr" VARCHAR(42) NOT NULL,
+    "pool_id" INTEGER NOT NULL,
+    "code" VARCHAR(200) NOT NULL,
+    "token_addr" VARCHAR(42) NOT NULL,
+    -- decimal-N amount allocated to all payees
+    "total_amount" DECIMAL(40,0) NOT NULL,
+    "last_trade_considered_ts" TIMESTAMPTZ NOT NULL,
+    "created_ts" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT "referral_claim_allocation_pkey" PRIMARY KEY ("broker_id", "batch_ts", "trader_addr", "pool_id", "code")
+);
+
+-- CreateIndex
+CREATE INDEX  IF NOT EXISTS "referral_claim_allocation_trader_idx" ON "referral_claim_allocation"("broker_id", "trader_addr", "pool_id");
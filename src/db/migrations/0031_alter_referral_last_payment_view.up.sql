@@ -0,0 +1,87 @@
+-- trades whose fees were allocated to a claim tree count as settled: the last
+-- trade considered by an allocation acts as a payment for the pay period start
+DROP VIEW IF EXISTS referral_aggr_fees_per_trader;
+DROP VIEW IF EXISTS referral_last_payment;
+
+CREATE OR REPLACE VIEW referral_last_payment AS
+SELECT p.broker_addr,
+    p.pool_id,
+    p.trader_addr,
+    bool_and(p.tx_confirmed) AS tx_confirmed,
+    max(p.last_payment_ts) AS last_payment_ts,
+    p.broker_id
+FROM (
+    SELECT lower(referral_payment.broker_addr::text) AS broker_addr,
+        referral_payment.pool_id,
+        lower(referral_payment.trader_addr::text) AS trader_addr,
+        referral_payment.tx_confirmed,
+        referral_payment.block_ts AS last_payment_ts,
+        rs1.broker_id
+    FROM referral_payment
+    JOIN referral_settings rs1 
+        ON rs1.property = 'broker_addr'
+        AND lower(rs1.value) = lower(referral_payment.broker_addr)
+    JOIN referral_settings rs_max_lookback
+        ON rs_max_lookback.property = 'payment_max_lookback_days'
+        AND rs_max_lookback.broker_id = rs1.broker_id
+    WHERE referral_payment.block_ts > (current_date::timestamp - (rs_max_lookback.value || ' days')::interval)
+    UNION ALL
+    SELECT lower(rs1.value) AS broker_addr,
+        acc.pool_id,
+        lower(acc.trader_addr::text) AS trader_addr,
+        true AS tx_confirmed,
+        acc.last_trade_considered_ts AS last_payment_ts,
+        acc.broker_id
+    FROM referral_payment_accrual acc
+    JOIN referral_settings rs1 
+        ON rs1.property = 'broker_addr'
+        AND rs1.broker_id = acc.broker_id
+    UNION ALL
+    SELECT lower(rs1.value) AS broker_addr,
+        alloc.pool_id,
+        lower(alloc.trader_addr::text) AS trader_addr,
+        true AS tx_confirmed,
+        alloc.last_trade_considered_ts AS last_payment_ts,
+        alloc.broker_id
+    FROM referral_claim_allocation alloc
+    JOIN referral_settings rs1 
+        ON rs1.property = 'broker_addr'
+        AND rs1.broker_id = alloc.broker_id
+) p
+GROUP BY p.broker_id, p.trader_addr, p.broker_addr, p.pool_id;
+
+CREATE OR REPLACE VIEW referral_aggr_fees_per_trader AS
+SELECT th.perpetual_id / 100000 AS pool_id,
+    th.trader_addr,
+    th.broker_addr,
+    COALESCE(codeusg.code, 'DEFAULT'::character varying) AS code,
+    sum(th.fee)::numeric(40,0) AS fee_sum_cc,
+    sum((th.broker_fee_tbps::numeric * abs(th.quantity_cc) - 50000::numeric) / 100000::numeric)::numeric(40,0) AS broker_fee_cc,
+    min(th.trade_timestamp) AS first_trade_considered_ts,
+    max(th.trade_timestamp) AS last_trade_considered_ts,
+    lp.last_payment_ts,
+    COALESCE(lp.last_payment_ts, (CURRENT_DATE::timestamp without time zone - ((rs.value::text || ' days'::text)::interval))::timestamp with time zone) AS pay_period_start_ts,
+    sum(abs(th.quantity_cc))::numeric(40,0) AS volume_cc
+ FROM trades_history th
+     JOIN referral_settings rs2 ON rs2.property::text = 'broker_addr'::text 
+        AND lower(rs2.value)=lower(th.broker_addr)
+     JOIN referral_settings rs ON rs.property::text = 'payment_max_lookback_days'::text 
+        AND rs.broker_id = rs2.broker_id
+     LEFT JOIN referral_last_payment lp ON lower(lp.trader_addr) = lower(th.trader_addr::text) AND lp.pool_id = (th.perpetual_id / 100000) 
+        AND lower(lp.trader_addr) = lower(th.trader_addr::text) 
+        AND lower(lp.broker_addr) = lower(th.broker_addr::text)
+     LEFT JOIN (referral_code_usage codeusg
+        JOIN referral_code rc ON rc.code = codeusg.code
+            AND rc.broker_id = codeusg.broker_id)
+        ON lower(th.trader_addr::text) = lower(codeusg.trader_addr::text)
+            AND codeusg.broker_id = rs2.broker_id
+            AND codeusg.valid_from <= th.trade_timestamp
+            AND codeusg.valid_to > th.trade_timestamp
+            AND rc.valid_from <= th.trade_timestamp
+            AND rc.expiry > th.trade_timestamp
+  WHERE (lp.last_payment_ts IS NULL AND (CURRENT_DATE::timestamp without time zone - ((rs.value::text || ' days'::text)::interval)) < th.trade_timestamp 
+  	OR lp.last_payment_ts < th.trade_timestamp) 
+  	AND (lp.pool_id IS NULL OR lp.pool_id = (th.perpetual_id / 100000)) 
+  	AND (lp.tx_confirmed IS NULL OR lp.tx_confirmed = true)
+  GROUP BY lp.pool_id, rs2.value, th.trader_addr, th.broker_addr, lp.last_payment_ts, codeusg.code, (th.perpetual_id / 100000), rs.value
+  ORDER BY th.trader_addr;
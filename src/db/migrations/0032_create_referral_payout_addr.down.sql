@@ -0,0 +1 @@
+drop table if exists referral_payout_addr;
@@ -0,0 +1,15 @@
+-- CreateTable
+  -- payout addresses registered by agencies and referrers: their earnings
+  -- are sent to payout_addr. Every registration is kept, the latest per
+  -- participant is active; payout_addr = addr ends the redirection
+CREATE TABLE if not exists "referral_payout_addr" (
+    "broker_id" VARCHAR(42) NOT NULL,
+    "addr" VARCHAR(42) NOT NULL,
+    "payout_addr" VARCHAR(42) NOT NULL,
+    -- signed timestamp of the registration
+    "created_on" TIMESTAMPTZ NOT NULL,
+    CONSTRAINT "referral_payout_addr_pkey" PRIMARY KEY ("broker_id", "addr", "created_on")
+);
+
+-- CreateIndex
+CREATE INDEX  IF NOT EXISTS "referral_payout_addr_payout_idx" ON "referral_payout_addr"("broker_id", "payout_addr");
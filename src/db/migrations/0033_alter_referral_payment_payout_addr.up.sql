@@ -0,0 +1,5 @@
+-- AddPayoutAddrToReferralPayment
+  -- address that received the payment if the payee registered a payout
+  -- address, null otherwise. payee_addr remains the participant
+ALTER TABLE "referral_payment"
+ADD COLUMN IF NOT EXISTS "payout_addr" VARCHAR(42);
@@ -0,0 +1,13 @@
+-- CreateTable
+  -- addresses that are not paid and cannot create, select or refer codes.
+  -- source: file (DENY_LIST_PATH, replaced on startup) or admin (admin api)
+CREATE TABLE if not exists "referral_deny_list" (
+    "broker_id" VARCHAR(42) NOT NULL,
+    "addr" VARCHAR(42) NOT NULL,
+    "reason" TEXT NOT NULL DEFAULT '',
+    "source" VARCHAR(16) NOT NULL,
+    -- name of the admin, empty for file entries
+    "added_by" VARCHAR(64) NOT NULL DEFAULT '',
+    "created_ts" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT "referral_deny_list_pkey" PRIMARY KEY ("broker_id","addr")
+);
@@ -0,0 +1,15 @@
+-- CreateTable
+  -- actions blocked or payments withheld because of the deny list,
+  -- and changes of the deny list via the admin api
+CREATE TABLE if not exists "referral_deny_audit" (
+    "id" SERIAL PRIMARY KEY,
+    "broker_id" VARCHAR(42) NOT NULL,
+    "addr" VARCHAR(42) NOT NULL,
+    -- refer, upsert-code, select-code, payout-addr, withhold, pay-batch, add, remove
+    "action" VARCHAR(16) NOT NULL,
+    "detail" TEXT NOT NULL DEFAULT '',
+    "ts" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- CreateIndex
+CREATE INDEX  IF NOT EXISTS "referral_deny_audit_broker_id_ts_idx" ON "referral_deny_audit"("broker_id", "ts");
@@ -0,0 +1,5 @@
+-- AddLastTradeConsideredToReferralPaymentIntent
+  -- last trade considered by the payment, a retry of the failed payment
+  -- settles the trades up to this timestamp
+ALTER TABLE "referral_payment_intent"
+ADD COLUMN IF NOT EXISTS "last_trade_considered_ts" TIMESTAMPTZ;
@@ -0,0 +1,30 @@
+-- CreateTable
+  -- retries of failed payments (moved to referral_failed_payment). The retry
+  -- pays the amounts of the original failure with the batch timestamp of the
+  -- failed batch
+CREATE TABLE if not exists "referral_payment_retry" (
+    "broker_id" VARCHAR(42) NOT NULL,
+    -- batch of the failed payment
+    "batch_ts" TIMESTAMPTZ NOT NULL,
+    "trader_addr" VARCHAR(42) NOT NULL,
+    "pool_id" INTEGER NOT NULL,
+    "code" VARCHAR(200) NOT NULL,
+    -- original failure, tx_hash in referral_failed_payment
+    "failed_tx_hash" TEXT NOT NULL,
+    -- scheduled, submitted, paid, exhausted
+    "status" VARCHAR(16) NOT NULL,
+    -- retry transactions sent
+    "attempts" INTEGER NOT NULL DEFAULT 0,
+    "next_attempt_ts" TIMESTAMPTZ NOT NULL,
+    -- latest retry transaction
+    "tx_hash" TEXT,
+    "last_error" TEXT NOT NULL DEFAULT '',
+    -- trades up to this timestamp are settled by the retry
+    "last_trade_considered_ts" TIMESTAMPTZ NOT NULL,
+    "created_ts" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "updated_ts" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT "referral_payment_retry_pkey" PRIMARY KEY ("broker_id", "batch_ts", "trader_addr", "pool_id", "code")
+);
+
+-- CreateIndex
+CREATE INDEX  IF NOT EXISTS "referral_payment_retry_status_idx" ON "referral_payment_retry"("broker_id", "status", "next_attempt_ts");
@@ -0,0 +1 @@
+drop table if exists referral_reconciliation_batch;
@@ -0,0 +1,18 @@
+-- CreateTable
+  -- per batch result of a reconciliation run of on-chain payment events
+  -- against referral_payment. A run is identified by run_ts
+CREATE TABLE if not exists "referral_reconciliation_batch" (
+    "broker_id" VARCHAR(42) NOT NULL,
+    "run_ts" TIMESTAMPTZ NOT NULL,
+    -- batches since from_ts are reconciled
+    "from_ts" TIMESTAMPTZ NOT NULL,
+    "batch_ts" TIMESTAMPTZ NOT NULL,
+    -- payment rows (trader, pool, level) in the database and on-chain
+    "db_payments" INTEGER NOT NULL,
+    "chain_payments" INTEGER NOT NULL,
+    "missing" INTEGER NOT NULL DEFAULT 0,
+    "extra" INTEGER NOT NULL DEFAULT 0,
+    "amount_differs" INTEGER NOT NULL DEFAULT 0,
+    "payee_differs" INTEGER NOT NULL DEFAULT 0,
+    CONSTRAINT "referral_reconciliation_batch_pkey" PRIMARY KEY ("broker_id", "run_ts", "batch_ts")
+);
@@ -0,0 +1,22 @@
+-- CreateTable
+  -- mismatches found by a reconciliation run
+  -- kind: missing (on-chain, not in the database), extra (in the database,
+  -- not on-chain), amount (amounts differ), payee (receiving addresses differ)
+CREATE TABLE if not exists "referral_reconciliation_mismatch" (
+    "id" SERIAL PRIMARY KEY,
+    "broker_id" VARCHAR(42) NOT NULL,
+    "run_ts" TIMESTAMPTZ NOT NULL,
+    "batch_ts" TIMESTAMPTZ NOT NULL,
+    "kind" VARCHAR(16) NOT NULL,
+    "tx_hash" TEXT NOT NULL,
+    "trader_addr" VARCHAR(42) NOT NULL,
+    "pool_id" INTEGER NOT NULL,
+    "level" INTEGER NOT NULL,
+    "db_payee" VARCHAR(42) NOT NULL DEFAULT '',
+    "chain_payee" VARCHAR(42) NOT NULL DEFAULT '',
+    "db_amount_cc" DECIMAL(40,0),
+    "chain_amount_cc" DECIMAL(40,0)
+);
+
+-- CreateIndex
+CREATE INDEX  IF NOT EXISTS "referral_reconciliation_mismatch_run_idx" ON "referral_reconciliation_mismatch"("broker_id", "run_ts");
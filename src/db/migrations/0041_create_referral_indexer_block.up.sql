@@ -0,0 +1,12 @@
+-- CreateTable
+  -- blocks processed by the payment event indexer: the last block of each
+  -- indexed range and the blocks with payment events. The latest block is
+  -- the checkpoint, the hashes detect reorgs
+CREATE TABLE if not exists "referral_indexer_block" (
+    "broker_id" VARCHAR(42) NOT NULL,
+    "block_nr" BIGINT NOT NULL,
+    -- empty if unknown (start of the indexer)
+    "block_hash" VARCHAR(66) NOT NULL DEFAULT '',
+    "created_ts" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT "referral_indexer_block_pkey" PRIMARY KEY ("broker_id", "block_nr")
+);
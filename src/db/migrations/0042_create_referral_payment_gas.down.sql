@@ -0,0 +1 @@
+drop table if exists referral_payment_gas;
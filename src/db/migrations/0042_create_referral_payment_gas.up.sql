@@ -0,0 +1,21 @@
+-- CreateTable
+  -- gas cost of mined payment transactions (successful or failed) from the
+  -- receipts. tx_hash refers to referral_payment.tx_hash
+CREATE TABLE if not exists "referral_payment_gas" (
+    "tx_hash" TEXT NOT NULL,
+    "broker_id" VARCHAR(42) NOT NULL,
+    "batch_ts" TIMESTAMPTZ NOT NULL,
+    -- margin token paid with the transaction, empty if unknown
+    "token_addr" VARCHAR(42) NOT NULL DEFAULT '',
+    "gas_used" BIGINT NOT NULL,
+    -- price paid per gas (wei)
+    "effective_gas_price" DECIMAL(40,0) NOT NULL,
+    -- receipt status, 1 = success
+    "status" SMALLINT NOT NULL,
+    "block_nr" BIGINT NOT NULL,
+    "created_ts" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT "referral_payment_gas_pkey" PRIMARY KEY ("tx_hash")
+);
+
+-- CreateIndex
+CREATE INDEX  IF NOT EXISTS "referral_payment_gas_batch_ts_idx" ON "referral_payment_gas"("broker_id", "batch_ts");
@@ -0,0 +1,15 @@
+-- CreateTable
+  -- webhook subscription of a partner address, registered with a signed
+  -- request. An empty url ends the subscription, the row is kept so that
+  -- older registrations cannot be replayed
+CREATE TABLE if not exists "referral_webhook" (
+    "broker_id" VARCHAR(42) NOT NULL,
+    "addr" VARCHAR(42) NOT NULL,
+    "url" TEXT NOT NULL,
+    -- comma separated event types, empty for all events
+    "events" TEXT NOT NULL DEFAULT '',
+    -- HMAC-SHA256 key of the deliveries (hex)
+    "secret" TEXT NOT NULL,
+    "created_on" TIMESTAMPTZ NOT NULL,
+    CONSTRAINT "referral_webhook_pkey" PRIMARY KEY ("broker_id", "addr")
+);
@@ -0,0 +1,28 @@
+-- CreateTable
+  -- webhook deliveries (outbox and delivery log). Pending deliveries are
+  -- sent by the webhook worker and retried until max. attempts
+CREATE TABLE if not exists "referral_webhook_delivery" (
+    "id" SERIAL PRIMARY KEY,
+    "broker_id" VARCHAR(42) NOT NULL,
+    "addr" VARCHAR(42) NOT NULL,
+    -- url of the latest attempt
+    "url" TEXT NOT NULL,
+    "event" VARCHAR(32) NOT NULL,
+    -- event data (json)
+    "data" TEXT NOT NULL,
+    -- pending, delivered or failed
+    "status" VARCHAR(16) NOT NULL DEFAULT 'pending',
+    "attempts" INTEGER NOT NULL DEFAULT 0,
+    "next_attempt_ts" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    -- http status of the latest attempt, 0 without response
+    "response_code" INTEGER NOT NULL DEFAULT 0,
+    "last_error" TEXT NOT NULL DEFAULT '',
+    "created_ts" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "delivered_ts" TIMESTAMPTZ
+);
+
+-- CreateIndex
+CREATE INDEX  IF NOT EXISTS "referral_webhook_delivery_pending_idx" ON "referral_webhook_delivery"("broker_id", "status", "next_attempt_ts");
+
+-- CreateIndex
+CREATE INDEX  IF NOT EXISTS "referral_webhook_delivery_addr_idx" ON "referral_webhook_delivery"("broker_id", "addr");
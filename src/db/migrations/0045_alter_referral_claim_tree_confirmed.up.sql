@@ -0,0 +1,5 @@
+-- AddConfirmedToReferralClaimTree
+  -- time the root was found on the claim distributor contract, null while
+  -- pending. Allocations to a pending tree do not settle the trades yet
+ALTER TABLE "referral_claim_tree"
+ADD COLUMN IF NOT EXISTS "confirmed_ts" TIMESTAMPTZ;
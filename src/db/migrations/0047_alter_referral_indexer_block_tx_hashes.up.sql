@@ -0,0 +1,5 @@
+-- AddTxHashesToReferralIndexerBlock
+  -- comma separated hashes of the broker's payment transactions indexed in
+  -- the block, a reorg rolls back only these payments
+ALTER TABLE "referral_indexer_block"
+ADD COLUMN IF NOT EXISTS "tx_hashes" TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,101 @@
+// Package metrics defines the Prometheus metrics of the referral system,
+// served on /metrics
+package metrics
+
+import (
+	"net/url"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// payment status labels
+const (
+	PAYMENT_SUBMITTED = "submitted"
+	PAYMENT_CONFIRMED = "confirmed"
+	PAYMENT_FAILED    = "failed"
+	PAYMENT_PURGED    = "purged"
+)
+
+// webhook delivery result labels
+const (
+	WEBHOOK_DELIVERED = "delivered"
+	WEBHOOK_RETRY     = "retry"
+	WEBHOOK_FAILED    = "failed"
+)
+
+var (
+	// Payments counts payment transactions per chain, broker, status, pool and token
+	Payments = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "referral_payments_total",
+		Help: "Payment transactions by status (submitted, confirmed, failed, purged)",
+	}, []string{"chain", "broker", "status", "pool", "token"})
+
+	// PaidAmount sums the confirmed paid amounts in token units
+	PaidAmount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "referral_paid_amount_total",
+		Help: "Confirmed paid amount in token units",
+	}, []string{"chain", "broker", "pool", "token"})
+
+	// TokenBucketWait observes the time spent waiting for a rate limit token
+	TokenBucketWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "referral_token_bucket_wait_seconds",
+		Help:    "Time waited for an RPC rate limit token",
+		Buckets: []float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"topic"})
+
+	// RpcErrors counts RPC errors per endpoint host
+	RpcErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "referral_rpc_errors_total",
+		Help: "RPC errors per endpoint",
+	}, []string{"endpoint"})
+
+	// FilterPaymentsBlock reports the block range (start, current, end)
+	// of the payment event filter per chain
+	FilterPaymentsBlock = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "referral_filter_payments_block",
+		Help: "Block range of reading onchain payments",
+	}, []string{"chain", "position"})
+
+	// IndexerBlock reports the chain head and the checkpoint of the
+	// payment event indexer per chain and broker
+	IndexerBlock = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "referral_indexer_block",
+		Help: "Chain head and checkpoint of the payment event indexer",
+	}, []string{"chain", "broker", "position"})
+
+	// IndexerReorgs counts the reorgs rolled back by the indexer
+	IndexerReorgs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "referral_indexer_reorgs_total",
+		Help: "Reorgs rolled back by the payment event indexer",
+	}, []string{"chain", "broker"})
+
+	// WebhookDeliveries counts webhook delivery attempts per event and
+	// result (delivered, retry, failed)
+	WebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "referral_webhook_deliveries_total",
+		Help: "Webhook delivery attempts by event and result",
+	}, []string{"chain", "broker", "event", "result"})
+	// HttpRequests counts API requests per route, method and status
+	HttpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "referral_http_requests_total",
+		Help: "API requests by route, method and status code",
+	}, []string{"route", "method", "status"})
+
+	// HttpDuration observes the API latency per route and method
+	HttpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "referral_http_request_duration_seconds",
+		Help:    "API request latency by route and method",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+)
+
+// RpcEndpoint returns the host of an rpc url, so that api keys
+// in the url path or query do not end up in labels
+func RpcEndpoint(rpcUrl string) string {
+	u, err := url.Parse(rpcUrl)
+	if err != nil || u.Host == "" {
+		return "unknown"
+	}
+	return u.Host
+}
@@ -0,0 +1,16 @@
+package metrics
+
+import "testing"
+
+func TestRpcEndpoint(t *testing.T) {
+	cases := map[string]string{
+		"https://arb-mainnet.g.alchemy.com/v2/secretkey": "arb-mainnet.g.alchemy.com",
+		"wss://rpc.example.org:8546?key=secret":          "rpc.example.org:8546",
+		"not a url":                                      "unknown",
+	}
+	for in, expected := range cases {
+		if out := RpcEndpoint(in); out != expected {
+			t.Errorf("RpcEndpoint(%s): expected %s, got %s", in, expected, out)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package referral
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"math/big"
+	"referral-system/src/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isBelowMinPayout returns true if the total amount of the planned
+// payment is below the minimal payout configured for the token
+func (a *App) isBelowMinPayout(p PaymentExecution, decimals uint8) bool {
+	minAmount, exists := a.Settings.MinPayout[strings.ToLower(p.TokenAddr)]
+	if !exists || minAmount <= 0 {
+		return false
+	}
+	return utils.DecNToFloat(p.TotalDecN, decimals) < minAmount
+}
+
+// isCarryDue returns true if the oldest fees carried forward in the
+// row are due regardless of the minimal payout
+func (a *App) isCarryDue(row AggregatedFeesRow, before time.Time) bool {
+	return !row.CarriedSince.IsZero() && before.Sub(row.CarriedSince) >= a.Settings.maxCarry()
+}
+
+// maxCarry returns how long fees are carried forward at most
+func (s Settings) maxCarry() time.Duration {
+	if s.MaxCarryDays < 1 {
+		return 30 * 24 * time.Hour
+	}
+	return time.Duration(s.MaxCarryDays) * 24 * time.Hour
+}
+
+// withCarriedFee returns the row with the broker fees carried
+// forward by batches before the given time added
+func (a *App) withCarriedFee(row AggregatedFeesRow, before time.Time) (AggregatedFeesRow, error) {
+	carried, since, err := a.dbGetCarriedFee(row.TraderAddr, row.PoolId, row.Code, before)
+	if err != nil {
+		return row, err
+	}
+	row.BrokerFeeABDKCC = new(big.Int).Add(row.BrokerFeeABDKCC, carried)
+	row.CarriedSince = since
+	return row, nil
+}
+
+// dbGetCarriedFee returns the unpaid broker fees (ABDK) that batches
+// before the given time carried forward for trader, pool and code, and
+// the batch time of the oldest. Fees consumed by a payment of the batch
+// at the given time are included, the batch can plan the payment again.
+func (a *App) dbGetCarriedFee(traderAddr string, poolId uint32, code string, before time.Time) (*big.Int, time.Time, error) {
+	query := `SELECT COALESCE(SUM(broker_fee_cc), 0)::text, MIN(batch_ts)
+		FROM referral_payment_accrual
+		WHERE broker_id=$1 AND trader_addr=$2 AND pool_id=$3 AND code=$4
+			AND (paid_batch_ts IS NULL OR paid_batch_ts = $5)
+			AND batch_ts < $5`
+	var feeStr string
+	var since sql.NullTime
+	err := a.Db.QueryRow(query, a.Settings.BrokerId, strings.ToLower(traderAddr), poolId, code, before).Scan(&feeStr, &since)
+	if err != nil {
+		return nil, time.Time{}, errors.New("dbGetCarriedFee: " + err.Error())
+	}
+	fee, ok := new(big.Int).SetString(feeStr, 10)
+	if !ok {
+		return nil, time.Time{}, errors.New("dbGetCarriedFee: invalid amount " + feeStr)
+	}
+	return fee, since.Time, nil
+}
+
+// withCarriedOnlyRows returns the rows of the open pay view and a row
+// without fees for every trader, pool and code that only has fees
+// carried forward by batches before the given time, e.g., because the
+// trader stopped trading or switched the code. Without it, their
+// carried fees would never be paid.
+func (a *App) withCarriedOnlyRows(rows []AggregatedFeesRow, before time.Time) ([]AggregatedFeesRow, error) {
+	query := `SELECT acc.trader_addr, acc.pool_id, acc.code, MAX(acc.last_trade_considered_ts),
+				mti.token_addr, mti.token_decimals
+			FROM referral_payment_accrual acc
+			JOIN margin_token_info mti
+				ON mti.pool_id = acc.pool_id
+			WHERE acc.broker_id=$1
+				AND (acc.paid_batch_ts IS NULL OR acc.paid_batch_ts = $2)
+				AND acc.batch_ts < $2
+			GROUP BY acc.trader_addr, acc.pool_id, acc.code, mti.token_addr, mti.token_decimals`
+	accRows, err := a.Db.Query(query, a.Settings.BrokerId, before)
+	if err != nil {
+		return nil, errors.New("withCarriedOnlyRows: " + err.Error())
+	}
+	defer accRows.Close()
+	hasFees := make(map[string]bool, len(rows))
+	for _, el := range rows {
+		hasFees[strings.ToLower(el.TraderAddr)+"/"+strconv.Itoa(int(el.PoolId))+"/"+el.Code] = true
+	}
+	for accRows.Next() {
+		var el AggregatedFeesRow
+		accRows.Scan(&el.TraderAddr, &el.PoolId, &el.Code, &el.LastTradeConsidered, &el.TokenAddr, &el.TokenDecimals)
+		if hasFees[strings.ToLower(el.TraderAddr)+"/"+strconv.Itoa(int(el.PoolId))+"/"+el.Code] {
+			continue
+		}
+		el.BrokerFeeABDKCC = new(big.Int)
+		el.VolumeABDKCC = new(big.Int)
+		rows = append(rows, el)
+	}
+	return rows, nil
+}
+
+// dbAccrueFee carries the broker fee (ABDK) of the row forward. The
+// trades of the row are not considered by later batches
+func (a *App) dbAccrueFee(batchTs string, row AggregatedFeesRow, fee *big.Int) error {
+	query := `INSERT INTO referral_payment_accrual
+			(broker_id, batch_ts, trader_addr, pool_id, code, broker_fee_cc, last_trade_considered_ts)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (broker_id, batch_ts, trader_addr, pool_id, code) DO NOTHING`
+	_, err := a.Db.Exec(query, a.Settings.BrokerId, batchTime(batchTs), strings.ToLower(row.TraderAddr),
+		row.PoolId, row.Code, fee.String(), row.LastTradeConsidered)
+	if err != nil {
+		slog.Error("could not carry forward fees for trader " + row.TraderAddr + ": " + err.Error())
+	}
+	return err
+}
+
+// dbSettleAccruals marks the fees carried forward for the payment
+// as paid by the batch. The payment consumes them once it is signed,
+// see dbReleaseAccruals if it is not made
+func (a *App) dbSettleAccruals(batchTs string, p PaymentExecution) error {
+	query := `UPDATE referral_payment_accrual
+		SET paid_batch_ts = $2
+		WHERE broker_id=$1 AND trader_addr=$3 AND pool_id=$4 AND code=$5
+			AND paid_batch_ts IS NULL
+			AND batch_ts < $2`
+	_, err := a.Db.Exec(query, a.Settings.BrokerId, batchTime(batchTs), strings.ToLower(p.TraderAddr), p.PoolId, p.Code)
+	if err != nil {
+		slog.Error("could not settle carried fees for trader " + p.TraderAddr + ": " + err.Error())
+	}
+	return err
+}
+
+// dbReleaseAccruals carries the fees that the payment of the batch
+// consumed forward again, the payment was not made
+func (a *App) dbReleaseAccruals(batchTs string, p PaymentExecution) error {
+	query := `UPDATE referral_payment_accrual
+		SET paid_batch_ts = NULL
+		WHERE broker_id=$1 AND trader_addr=$3 AND pool_id=$4 AND code=$5
+			AND paid_batch_ts = $2`
+	_, err := a.Db.Exec(query, a.Settings.BrokerId, batchTime(batchTs), strings.ToLower(p.TraderAddr), p.PoolId, p.Code)
+	if err != nil {
+		slog.Error("could not release carried fees for trader " + p.TraderAddr + ": " + err.Error())
+	}
+	return err
+}
+
+// carriedFee are the unpaid broker fees carried forward for a trader
+// in a pool and code
+type carriedFee struct {
+	PoolId    uint32
+	Code      string
+	FeeABDKCC *big.Int
+	TokenName string
+}
+
+// dbGetCarriedFees returns the unpaid broker fees carried forward
+// for the trader per pool and code
+func (a *App) dbGetCarriedFees(traderAddr string) ([]carriedFee, error) {
+	query := `SELECT acc.pool_id, acc.code, SUM(acc.broker_fee_cc)::text, mti.token_name
+			FROM referral_payment_accrual acc
+			JOIN margin_token_info mti
+				ON mti.pool_id = acc.pool_id
+			WHERE acc.broker_id=$1 AND acc.trader_addr=$2
+				AND acc.paid_batch_ts IS NULL
+			GROUP BY acc.pool_id, acc.code, mti.token_name`
+	rows, err := a.Db.Query(query, a.Settings.BrokerId, strings.ToLower(traderAddr))
+	if err != nil {
+		return nil, errors.New("dbGetCarriedFees: " + err.Error())
+	}
+	defer rows.Close()
+	var res []carriedFee
+	for rows.Next() {
+		var el carriedFee
+		var fee string
+		rows.Scan(&el.PoolId, &el.Code, &fee, &el.TokenName)
+		el.FeeABDKCC = new(big.Int)
+		el.FeeABDKCC.SetString(fee, 10)
+		res = append(res, el)
+	}
+	return res, nil
+}
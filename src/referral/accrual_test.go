@@ -0,0 +1,30 @@
+package referral
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestIsBelowMinPayout(t *testing.T) {
+	a := &App{Settings: Settings{MinPayout: map[string]float64{"0xabc": 2.5}}}
+	// 6 decimals
+	for _, tc := range []struct {
+		token string
+		total int64
+		below bool
+	}{
+		{"0xabc", 2_499_999, true},
+		{"0xABC", 2_500_000, false},
+		{"0xabc", 0, true},
+		{"0xdef", 1, false},
+	} {
+		p := PaymentExecution{TokenAddr: tc.token, TotalDecN: big.NewInt(tc.total)}
+		if got := a.isBelowMinPayout(p, 6); got != tc.below {
+			t.Errorf("token %s total %d: expected %v, got %v", tc.token, tc.total, tc.below, got)
+		}
+	}
+	a.Settings.MinPayout = nil
+	if a.isBelowMinPayout(PaymentExecution{TokenAddr: "0xabc", TotalDecN: big.NewInt(0)}, 6) {
+		t.Errorf("expected no minimum without configuration")
+	}
+}
@@ -0,0 +1,116 @@
+package referral
+
+import (
+	"encoding/base64"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// gas estimate of an aggregated MultiPay transaction, the
+// transaction gas limit is 5_000_000
+const (
+	MULTIPAY_GAS_BUDGET   = 4_000_000 // max. estimated gas of an aggregated payment
+	MULTIPAY_BASE_GAS     = 60_000    // transaction and signature check
+	MULTIPAY_PAYEE_GAS    = 35_000    // token transfer to a payee
+	MULTIPAY_CALLDATA_GAS = 16        // per byte of calldata
+)
+
+// aggregatedPayment pays the payments of several traders in the same
+// token with one MultiPay transaction. Payees that occur in several
+// payments are paid once with the sum of their amounts.
+type aggregatedPayment struct {
+	TokenAddr  string
+	PayeeAddr  []common.Address
+	AmountDecN []*big.Int
+	TotalDecN  *big.Int
+	// Msg is the manifest that allows to rebuild the payments per trader
+	Msg string
+	// Id = max. last trade considered of the payments
+	Id       int64
+	Payments []PaymentExecution
+	entries  []manifestEntry
+	payeeIdx map[common.Address]int
+	gas      int
+}
+
+func newAggregatedPayment(tokenAddr string) *aggregatedPayment {
+	return &aggregatedPayment{
+		TokenAddr: tokenAddr,
+		TotalDecN: new(big.Int),
+		payeeIdx:  make(map[common.Address]int),
+		gas:       MULTIPAY_BASE_GAS,
+	}
+}
+
+// gasWith returns the estimated gas of the aggregated payment
+// if payment p is added
+func (ap *aggregatedPayment) gasWith(p PaymentExecution) int {
+	gas := ap.gas
+	for k := range p.PayeeAddr {
+		if _, exists := ap.payeeIdx[p.payoutAddr(k)]; !exists {
+			// address and amount
+			gas += MULTIPAY_PAYEE_GAS + 64*MULTIPAY_CALLDATA_GAS
+		}
+	}
+	// manifest entry: pool, encoded code and index/amount per payee
+	gas += (base64.RawURLEncoding.EncodedLen(len(p.Code)) + 8 + len(p.PayeeAddr)*32) * MULTIPAY_CALLDATA_GAS
+	return gas
+}
+
+// add adds payment p, merging payees that are already paid
+func (ap *aggregatedPayment) add(p PaymentExecution) {
+	ap.gas = ap.gasWith(p)
+	e := manifestEntry{PoolId: p.PoolId, Code: p.Code}
+	for k := range p.PayeeAddr {
+		payee := p.payoutAddr(k)
+		idx, exists := ap.payeeIdx[payee]
+		if !exists {
+			idx = len(ap.PayeeAddr)
+			ap.payeeIdx[payee] = idx
+			ap.PayeeAddr = append(ap.PayeeAddr, payee)
+			ap.AmountDecN = append(ap.AmountDecN, new(big.Int))
+		}
+		ap.AmountDecN[idx].Add(ap.AmountDecN[idx], p.AmountDecN[k])
+		ap.TotalDecN.Add(ap.TotalDecN, p.AmountDecN[k])
+		e.PayeeIdx = append(e.PayeeIdx, idx)
+		e.AmountDecN = append(e.AmountDecN, p.AmountDecN[k])
+	}
+	ap.entries = append(ap.entries, e)
+	ap.Payments = append(ap.Payments, p)
+	if p.Id > ap.Id {
+		ap.Id = p.Id
+	}
+}
+
+// aggregatePayments groups the payments by token into MultiPay
+// transactions whose estimated gas stays within MULTIPAY_GAS_BUDGET
+func aggregatePayments(batchTs, brokerId string, payments []PaymentExecution) []aggregatedPayment {
+	byToken := make(map[string][]PaymentExecution)
+	var tokens []string
+	for _, p := range payments {
+		token := strings.ToLower(p.TokenAddr)
+		if _, exists := byToken[token]; !exists {
+			tokens = append(tokens, token)
+		}
+		byToken[token] = append(byToken[token], p)
+	}
+	sort.Strings(tokens)
+	var res []aggregatedPayment
+	for _, token := range tokens {
+		ap := newAggregatedPayment(token)
+		for _, p := range byToken[token] {
+			if len(ap.Payments) > 0 && ap.gasWith(p) > MULTIPAY_GAS_BUDGET {
+				ap.Msg = encodePaymentMsg(batchTs, brokerId, ap.entries)
+				res = append(res, *ap)
+				ap = newAggregatedPayment(token)
+			}
+			ap.add(p)
+		}
+		ap.Msg = encodePaymentMsg(batchTs, brokerId, ap.entries)
+		res = append(res, *ap)
+	}
+	return res
+}
@@ -0,0 +1,68 @@
+package referral
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestAggregatePayments(t *testing.T) {
+	broker := common.HexToAddress("0xb0")
+	referrer := common.HexToAddress("0xaa")
+	payment := func(trader int64, token string) PaymentExecution {
+		return PaymentExecution{
+			TraderAddr: common.BigToAddress(big.NewInt(trader)).Hex(),
+			Code:       "ABC",
+			PoolId:     1,
+			TokenAddr:  token,
+			PayeeAddr:  []common.Address{common.BigToAddress(big.NewInt(trader)), broker, referrer},
+			AmountDecN: []*big.Int{big.NewInt(1), big.NewInt(2), big.NewInt(3)},
+			Id:         trader,
+		}
+	}
+	payments := []PaymentExecution{payment(1, "0xT1"), payment(2, "0xt1"), payment(3, "0xt2")}
+	aps := aggregatePayments("1700000000", "sim", payments)
+	if len(aps) != 2 {
+		t.Fatalf("expected one transaction per token, got %d", len(aps))
+	}
+	ap := aps[0]
+	if len(ap.Payments) != 2 || len(ap.PayeeAddr) != 4 || ap.Id != 2 {
+		t.Fatalf("expected 2 traders with 4 distinct payees, got %d traders %d payees, id %d", len(ap.Payments), len(ap.PayeeAddr), ap.Id)
+	}
+	// broker and referrer are merged
+	if ap.AmountDecN[1].Int64() != 4 || ap.AmountDecN[2].Int64() != 6 || ap.TotalDecN.Int64() != 12 {
+		t.Errorf("unexpected amounts %v total %s", ap.AmountDecN, ap.TotalDecN)
+	}
+	msg, err := decodePaymentMsg(ap.Msg)
+	if err != nil || len(msg.Entries) != 2 {
+		t.Fatalf("expected message with 2 entries: %v", err)
+	}
+	if msg.Version != PAYMENT_MSG_VERSION || msg.BrokerId != "sim" {
+		t.Errorf("unexpected version %d broker %s", msg.Version, msg.BrokerId)
+	}
+	entries := msg.Entries
+	if entries[1].PayeeIdx[0] != 3 || entries[1].PayeeIdx[1] != 1 || entries[1].PayeeIdx[2] != 2 {
+		t.Errorf("unexpected payee indices %v", entries[1].PayeeIdx)
+	}
+
+	// transactions are split when the gas budget is reached
+	payments = nil
+	for k := int64(1); k <= 500; k++ {
+		payments = append(payments, payment(k, "0xt1"))
+	}
+	aps = aggregatePayments("1700000000", "sim", payments)
+	if len(aps) < 2 {
+		t.Fatalf("expected several transactions, got %d", len(aps))
+	}
+	n := 0
+	for _, ap := range aps {
+		if ap.gas > MULTIPAY_GAS_BUDGET {
+			t.Errorf("estimated gas %d above budget", ap.gas)
+		}
+		n += len(ap.Payments)
+	}
+	if n != len(payments) {
+		t.Errorf("expected %d payments, got %d", len(payments), n)
+	}
+}
@@ -0,0 +1,176 @@
+package referral
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"referral-system/src/utils"
+	"strconv"
+	"time"
+)
+
+// manual actions on payment batches
+const (
+	BATCH_ACTION_START  = "start"
+	BATCH_ACTION_PAUSE  = "pause"
+	BATCH_ACTION_RESUME = "resume"
+	BATCH_ACTION_SKIP   = "skip"
+)
+
+// BatchStatus reports the state of the current payment batch
+func (a *App) BatchStatus() utils.APIBatchStatus {
+	hasFinished, ts := a.dbGetPayBatch()
+	running := !a.batchMu.TryLock()
+	if !running {
+		a.batchMu.Unlock()
+	}
+	return utils.APIBatchStatus{
+		BatchTs:  ts,
+		Finished: hasFinished,
+		Running:  running,
+		Paused:   a.batchPaused.Load(),
+	}
+}
+
+// StartBatch starts a new payment batch now, independent of the
+// payment schedule. An unfinished batch has to be resumed or skipped first.
+func (a *App) StartBatch(admin string) (utils.APIBatchStatus, error) {
+	if a.batchPaused.Load() {
+		return utils.APIBatchStatus{}, errors.New("payments paused, resume first")
+	}
+	if !a.batchMu.TryLock() {
+		return utils.APIBatchStatus{}, errors.New("batch already running")
+	}
+	if hasFinished, _ := a.dbGetPayBatch(); !hasFinished {
+		a.batchMu.Unlock()
+		return utils.APIBatchStatus{}, errors.New("unfinished batch, resume or skip it")
+	}
+	ts := time.Now().Unix()
+	batchTs := strconv.FormatInt(ts, 10)
+	err := a.DbSetPaymentExecFinished(batchTs, false)
+	if err != nil {
+		a.batchMu.Unlock()
+		return utils.APIBatchStatus{}, errors.New("failed to register batch")
+	}
+	slog.Info("Batch " + batchTs + " started by " + admin)
+	a.dbInsertBatchAction(admin, BATCH_ACTION_START, ts)
+	a.notify(WEBHOOK_EVENT_BATCH_STARTED, webhookBatch{BatchTs: ts})
+	go a.processLockedBatch(batchTs)
+	return a.BatchStatus(), nil
+}
+
+// PauseBatch pauses payments. A running batch stops after the
+// current payment and remains unfinished; scheduled batches do not
+// start until payments are resumed.
+func (a *App) PauseBatch(admin string) (utils.APIBatchStatus, error) {
+	if a.batchPaused.Load() {
+		return utils.APIBatchStatus{}, errors.New("payments already paused")
+	}
+	err := a.dbSetBatchPaused(true)
+	if err != nil {
+		return utils.APIBatchStatus{}, errors.New("failed to pause payments")
+	}
+	a.batchPaused.Store(true)
+	_, ts := a.dbGetPayBatch()
+	slog.Info("Payments paused by " + admin)
+	a.dbInsertBatchAction(admin, BATCH_ACTION_PAUSE, ts)
+	return a.BatchStatus(), nil
+}
+
+// ResumeBatch lifts a pause and continues an unfinished batch
+func (a *App) ResumeBatch(admin string) (utils.APIBatchStatus, error) {
+	hasFinished, ts := a.dbGetPayBatch()
+	if !a.batchPaused.Load() && hasFinished {
+		return utils.APIBatchStatus{}, errors.New("nothing to resume")
+	}
+	err := a.dbSetBatchPaused(false)
+	if err != nil {
+		return utils.APIBatchStatus{}, errors.New("failed to resume payments")
+	}
+	a.batchPaused.Store(false)
+	batchTs := strconv.FormatInt(ts, 10)
+	slog.Info("Payments resumed by " + admin)
+	a.dbInsertBatchAction(admin, BATCH_ACTION_RESUME, ts)
+	if !hasFinished {
+		if !a.batchMu.TryLock() {
+			// the paused batch has not yet stopped, it continues
+			return a.BatchStatus(), nil
+		}
+		slog.Info("Continuing unfinished batch " + batchTs)
+		go a.processLockedBatch(batchTs)
+	}
+	return a.BatchStatus(), nil
+}
+
+// SkipBatch marks an unfinished batch as finished. Without an
+// unfinished batch the batch that is currently due is skipped.
+// Open payments are paid with the next batch.
+func (a *App) SkipBatch(admin string) (utils.APIBatchStatus, error) {
+	if !a.batchMu.TryLock() {
+		return utils.APIBatchStatus{}, errors.New("batch running, pause first")
+	}
+	hasFinished, ts := a.dbGetPayBatch()
+	if hasFinished {
+		// registering a finished batch now means no payment is due
+		// until the next schedule
+		ts = time.Now().Unix()
+	}
+	batchTs := strconv.FormatInt(ts, 10)
+	err := a.DbSetPaymentExecFinished(batchTs, true)
+	a.batchMu.Unlock()
+	if err != nil {
+		return utils.APIBatchStatus{}, errors.New("failed to skip batch")
+	}
+	slog.Info("Batch " + batchTs + " skipped by " + admin)
+	a.dbInsertBatchAction(admin, BATCH_ACTION_SKIP, ts)
+	return a.BatchStatus(), nil
+}
+
+// processLockedBatch processes a batch for which batchMu has been
+// acquired
+func (a *App) processLockedBatch(batchTs string) {
+	defer a.batchMu.Unlock()
+	a.PaymentExecutor.NewTokenBucket(5, 3)
+	err := a.processPayments(batchTs)
+	if err != nil {
+		slog.Error("Error processing payments:" + err.Error())
+	}
+}
+
+// dbGetBatchPaused returns true if payments have been paused
+func (a *App) dbGetBatchPaused() bool {
+	query := `SELECT value FROM referral_settings rs
+	WHERE rs.property='batch_paused' AND broker_id=$1`
+	var pausedStr string
+	err := a.Db.QueryRow(query, a.Settings.BrokerId).Scan(&pausedStr)
+	if err != nil {
+		return false
+	}
+	return pausedStr == "true"
+}
+
+func (a *App) dbSetBatchPaused(paused bool) error {
+	query := `INSERT INTO referral_settings (property, value, broker_id)
+	VALUES ('batch_paused', $1, $2)
+	ON CONFLICT (broker_id, property) DO UPDATE SET value = EXCLUDED.value`
+	_, err := a.Db.Exec(query, strconv.FormatBool(paused), a.Settings.BrokerId)
+	if err != nil {
+		slog.Error("dbSetBatchPaused:" + err.Error())
+	}
+	return err
+}
+
+// dbInsertBatchAction records a manual batch action, batchTs
+// is zero if there is no batch
+func (a *App) dbInsertBatchAction(admin, action string, batchTs int64) {
+	query := `INSERT INTO referral_batch_action (broker_id, action, admin_name, batch_ts)
+	VALUES ($1, $2, $3, $4)`
+	var ts sql.NullTime
+	if batchTs > 0 {
+		ts = sql.NullTime{Time: time.Unix(batchTs, 0), Valid: true}
+	}
+	_, err := a.Db.Exec(query, a.Settings.BrokerId, action, admin, ts)
+	if err != nil {
+		slog.Error("could not record batch action " + action + ": " + err.Error())
+	}
+}
@@ -0,0 +1,243 @@
+package referral
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"math/big"
+	"referral-system/src/contracts"
+	"referral-system/src/utils"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// payout modes, configured via referralSettings.json "payoutMode"
+const (
+	PAYOUT_MODE_PUSH  = "push"  // payments are sent via MultiPay
+	PAYOUT_MODE_CLAIM = "claim" // payees claim with a merkle proof
+)
+
+// claimKey identifies a leaf of the claim tree
+type claimKey struct {
+	Payee common.Address
+	Token common.Address
+}
+
+// publishClaims allocates the planned payments to their payees and
+// publishes a claim tree of the cumulative amount per payee and token
+// instead of sending the payments. The tree is pending until the broker
+// sets its root on the claim distributor, see confirmClaimRoots
+func (a *App) publishClaims(batchTs string, payments []PaymentExecution) error {
+	if len(payments) == 0 {
+		slog.Info("No claims to publish for batch " + batchTs)
+		return nil
+	}
+	_, prev, err := a.dbGetLatestClaimLeaves("", false)
+	if err != nil {
+		return err
+	}
+	cumulative := make(map[claimKey]*big.Int)
+	var keys []claimKey
+	for _, l := range prev {
+		key := claimKey{l.Payee, l.Token}
+		cumulative[key] = new(big.Int).Set(l.CumulativeAmount)
+		keys = append(keys, key)
+	}
+	added := make(map[claimKey]*big.Int)
+	for _, p := range payments {
+		token := common.HexToAddress(p.TokenAddr)
+		for k := range p.PayeeAddr {
+			if p.AmountDecN[k].Sign() == 0 {
+				continue
+			}
+			key := claimKey{p.payoutAddr(k), token}
+			if _, exists := cumulative[key]; !exists {
+				cumulative[key] = new(big.Int)
+				keys = append(keys, key)
+			}
+			if _, exists := added[key]; !exists {
+				added[key] = new(big.Int)
+			}
+			cumulative[key].Add(cumulative[key], p.AmountDecN[k])
+			added[key].Add(added[key], p.AmountDecN[k])
+		}
+	}
+	leaves := make([]ClaimLeaf, 0, len(keys))
+	for _, key := range keys {
+		leaves = append(leaves, ClaimLeaf{Payee: key.Payee, Token: key.Token, CumulativeAmount: cumulative[key]})
+	}
+	tree := newMerkleTree(leaves)
+	err = a.dbWriteClaimTree(batchTs, tree, added, payments)
+	if err != nil {
+		return err
+	}
+	for _, p := range payments {
+		a.dbSettleAccruals(batchTs, p)
+	}
+	slog.Info("Published claim root " + tree.Root().Hex() + " with " + strconv.Itoa(len(leaves)) +
+		" leaves for batch " + batchTs + ", pending until set on claim distributor " + a.Settings.ClaimDistributorAddr)
+	return nil
+}
+
+// confirmClaimRoots confirms the pending claim trees up to the tree
+// whose root is set on the claim distributor. The roots are cumulative,
+// a later root includes the allocations of the earlier trees.
+func (a *App) confirmClaimRoots() error {
+	dist, err := contracts.NewClaimDistributor(common.HexToAddress(a.Settings.ClaimDistributorAddr), a.rpcClient())
+	if err != nil {
+		return errors.New("confirmClaimRoots: " + err.Error())
+	}
+	root, err := dist.MerkleRoot(&bind.CallOpts{})
+	if err != nil {
+		return errors.New("confirmClaimRoots: " + err.Error())
+	}
+	query := `UPDATE referral_claim_tree
+		SET confirmed_ts = CURRENT_TIMESTAMP
+		WHERE broker_id = $1 AND confirmed_ts IS NULL
+			AND batch_ts <= (
+				SELECT max(batch_ts) FROM referral_claim_tree
+				WHERE broker_id = $1 AND root = $2)`
+	res, err := a.Db.Exec(query, a.Settings.BrokerId, common.Hash(root).Hex())
+	if err != nil {
+		return errors.New("confirmClaimRoots: " + err.Error())
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		slog.Info("Confirmed " + strconv.FormatInt(n, 10) + " claim trees up to root " + common.Hash(root).Hex())
+	}
+	return nil
+}
+
+// dbWriteClaimTree stores the tree with its proofs and the allocations
+// of the payments in one transaction
+func (a *App) dbWriteClaimTree(batchTs string, tree *merkleTree, added map[claimKey]*big.Int, payments []PaymentExecution) error {
+	tx, err := a.Db.Begin()
+	if err != nil {
+		return errors.New("dbWriteClaimTree: " + err.Error())
+	}
+	defer tx.Rollback()
+	ts := batchTime(batchTs)
+	query := `INSERT INTO referral_claim_tree (broker_id, batch_ts, root, leaf_count)
+		VALUES ($1, $2, $3, $4)`
+	_, err = tx.Exec(query, a.Settings.BrokerId, ts, tree.Root().Hex(), len(tree.leaves))
+	if err != nil {
+		return errors.New("dbWriteClaimTree: " + err.Error())
+	}
+	query = `INSERT INTO referral_claim_leaf
+			(broker_id, batch_ts, payee_addr, token_addr, cumulative_amount, amount, leaf_hash, proof)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	for k, l := range tree.leaves {
+		amount, exists := added[claimKey{l.Payee, l.Token}]
+		if !exists {
+			amount = new(big.Int)
+		}
+		proof := make([]string, 0)
+		for _, h := range tree.proof(k) {
+			proof = append(proof, h.Hex())
+		}
+		_, err = tx.Exec(query, a.Settings.BrokerId, ts, strings.ToLower(l.Payee.Hex()), strings.ToLower(l.Token.Hex()),
+			l.CumulativeAmount.String(), amount.String(), l.Hash().Hex(), strings.Join(proof, ","))
+		if err != nil {
+			return errors.New("dbWriteClaimTree: " + err.Error())
+		}
+	}
+	query = `INSERT INTO referral_claim_allocation
+			(broker_id, batch_ts, trader_addr, pool_id, code, token_addr, total_amount, last_trade_considered_ts)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	for _, p := range payments {
+		_, err = tx.Exec(query, a.Settings.BrokerId, ts, strings.ToLower(p.TraderAddr), p.PoolId, p.Code,
+			strings.ToLower(p.TokenAddr), p.TotalDecN.String(), p.LastTradeConsidered)
+		if err != nil {
+			return errors.New("dbWriteClaimTree: " + err.Error())
+		}
+	}
+	return tx.Commit()
+}
+
+// dbGetLatestClaimLeaves returns the root and the leaves of the latest
+// claim tree, or of the latest confirmed tree if confirmed is true,
+// restricted to the payee if not empty
+func (a *App) dbGetLatestClaimLeaves(payee string, confirmed bool) (*claimTreeInfo, []claimLeafRow, error) {
+	var info claimTreeInfo
+	query := `SELECT batch_ts, root FROM referral_claim_tree
+		WHERE broker_id = $1 AND (NOT $2 OR confirmed_ts IS NOT NULL)
+		ORDER BY batch_ts DESC LIMIT 1`
+	err := a.Db.QueryRow(query, a.Settings.BrokerId, confirmed).Scan(&info.BatchTs, &info.Root)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, errors.New("dbGetLatestClaimLeaves: " + err.Error())
+	}
+	query = `SELECT payee_addr, token_addr, cumulative_amount::text, proof
+		FROM referral_claim_leaf
+		WHERE broker_id = $1 AND batch_ts = $2 AND ($3 = '' OR payee_addr = $3)
+		ORDER BY token_addr`
+	rows, err := a.Db.Query(query, a.Settings.BrokerId, info.BatchTs, strings.ToLower(payee))
+	if err != nil {
+		return nil, nil, errors.New("dbGetLatestClaimLeaves: " + err.Error())
+	}
+	defer rows.Close()
+	var res []claimLeafRow
+	for rows.Next() {
+		var payeeAddr, tokenAddr, amount, proof string
+		err = rows.Scan(&payeeAddr, &tokenAddr, &amount, &proof)
+		if err != nil {
+			return nil, nil, errors.New("dbGetLatestClaimLeaves: " + err.Error())
+		}
+		l := claimLeafRow{ClaimLeaf: ClaimLeaf{
+			Payee:            common.HexToAddress(payeeAddr),
+			Token:            common.HexToAddress(tokenAddr),
+			CumulativeAmount: new(big.Int),
+		}}
+		l.CumulativeAmount.SetString(amount, 10)
+		if proof != "" {
+			for _, h := range strings.Split(proof, ",") {
+				l.Proof = append(l.Proof, common.HexToHash(h))
+			}
+		}
+		res = append(res, l)
+	}
+	return &info, res, nil
+}
+
+type claimTreeInfo struct {
+	BatchTs sql.NullTime
+	Root    string
+}
+
+// claimLeafRow is a stored leaf with its proof
+type claimLeafRow struct {
+	ClaimLeaf
+	Proof []common.Hash
+}
+
+// ClaimProofs returns the leaves of the latest confirmed claim tree
+// for the address with their proofs
+func (a *App) ClaimProofs(addr string) (utils.APIResponseClaims, error) {
+	info, leaves, err := a.dbGetLatestClaimLeaves(addr, true)
+	if err != nil {
+		slog.Error(err.Error())
+		return utils.APIResponseClaims{}, errors.New("unable to query claims")
+	}
+	res := utils.APIResponseClaims{Claims: []utils.APIClaim{}}
+	if info == nil {
+		return res, nil
+	}
+	res.BatchTs = info.BatchTs.Time.Unix()
+	res.Root = info.Root
+	for _, l := range leaves {
+		claim := utils.APIClaim{
+			TokenAddr:            l.Token.Hex(),
+			CumulativeAmountDecN: l.CumulativeAmount.String(),
+			Proof:                []string{},
+		}
+		for _, h := range l.Proof {
+			claim.Proof = append(claim.Proof, h.Hex())
+		}
+		res.Claims = append(res.Claims, claim)
+	}
+	return res, nil
+}
@@ -0,0 +1,260 @@
+package referral
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math/big"
+	"os"
+	"referral-system/src/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// actions recorded in referral_deny_audit
+const (
+	DENY_ACTION_REFER       = "refer"
+	DENY_ACTION_UPSERT_CODE = "upsert-code"
+	DENY_ACTION_SELECT_CODE = "select-code"
+	DENY_ACTION_PAYOUT_ADDR = "payout-addr"
+	DENY_ACTION_WITHHOLD    = "withhold"
+	DENY_ACTION_PAY_BATCH   = "pay-batch"
+	DENY_ACTION_WEBHOOK     = "webhook"
+	DENY_ACTION_ADD         = "add"
+	DENY_ACTION_REMOVE      = "remove"
+)
+
+// sources of deny-list entries
+const (
+	DENY_SOURCE_FILE  = "file"
+	DENY_SOURCE_ADMIN = "admin"
+)
+
+// errDenied is exposed to the API, it does not tell which address is denied
+var errDenied = errors.New("address not permitted")
+
+// DenyFileEntry is an entry of the deny-list file (DENY_LIST_PATH)
+type DenyFileEntry struct {
+	Addr   string `json:"addr"`
+	Reason string `json:"reason"`
+}
+
+// LoadDenyList replaces the file entries of the deny list with the
+// entries of the file. Entries added via the admin api are kept.
+func (a *App) LoadDenyList(fileName string) error {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	var entries []DenyFileEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return errors.New("deny list " + fileName + ": " + err.Error())
+	}
+	for _, e := range entries {
+		if !common.IsHexAddress(e.Addr) {
+			return errors.New("deny list " + fileName + ": invalid address " + e.Addr)
+		}
+	}
+	tx, err := a.Db.Begin()
+	if err != nil {
+		return errors.New("LoadDenyList: " + err.Error())
+	}
+	defer tx.Rollback()
+	query := `DELETE FROM referral_deny_list WHERE broker_id = $1 AND source = $2`
+	_, err = tx.Exec(query, a.Settings.BrokerId, DENY_SOURCE_FILE)
+	if err != nil {
+		return errors.New("LoadDenyList: " + err.Error())
+	}
+	query = `INSERT INTO referral_deny_list (broker_id, addr, reason, source)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (broker_id, addr) DO NOTHING`
+	for _, e := range entries {
+		_, err = tx.Exec(query, a.Settings.BrokerId, strings.ToLower(e.Addr), e.Reason, DENY_SOURCE_FILE)
+		if err != nil {
+			return errors.New("LoadDenyList: " + err.Error())
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.New("LoadDenyList: " + err.Error())
+	}
+	slog.Info("Loaded " + strconv.Itoa(len(entries)) + " deny-list entries from " + fileName)
+	return nil
+}
+
+// DenyAddr adds an address to the deny list via the admin api
+func (a *App) DenyAddr(admin, addr, reason string) error {
+	addr = strings.ToLower(addr)
+	query := `INSERT INTO referral_deny_list (broker_id, addr, reason, source, added_by)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (broker_id, addr) DO UPDATE
+		SET reason = EXCLUDED.reason, source = EXCLUDED.source, added_by = EXCLUDED.added_by`
+	_, err := a.Db.Exec(query, a.Settings.BrokerId, addr, reason, DENY_SOURCE_ADMIN, admin)
+	if err != nil {
+		slog.Error("DenyAddr: " + err.Error())
+		return errors.New("failed to add address")
+	}
+	slog.Info("Address " + addr + " denied by " + admin + ": " + reason)
+	a.dbInsertDenyAudit(addr, DENY_ACTION_ADD, "by "+admin+": "+reason)
+	return nil
+}
+
+// AllowAddr removes an address from the deny list via the admin api
+func (a *App) AllowAddr(admin, addr string) error {
+	addr = strings.ToLower(addr)
+	query := `DELETE FROM referral_deny_list WHERE broker_id = $1 AND addr = $2`
+	res, err := a.Db.Exec(query, a.Settings.BrokerId, addr)
+	if err != nil {
+		slog.Error("AllowAddr: " + err.Error())
+		return errors.New("failed to remove address")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("address not in deny list")
+	}
+	slog.Info("Address " + addr + " removed from deny list by " + admin)
+	a.dbInsertDenyAudit(addr, DENY_ACTION_REMOVE, "by "+admin)
+	return nil
+}
+
+// DenyList returns the entries of the deny list
+func (a *App) DenyList() ([]utils.APIDenyEntry, error) {
+	query := `SELECT addr, reason, source, added_by, created_ts
+		FROM referral_deny_list
+		WHERE broker_id = $1
+		ORDER BY created_ts, addr`
+	rows, err := a.Db.Query(query, a.Settings.BrokerId)
+	if err != nil {
+		slog.Error("DenyList: " + err.Error())
+		return nil, errors.New("failed to query deny list")
+	}
+	defer rows.Close()
+	res := []utils.APIDenyEntry{}
+	for rows.Next() {
+		var e utils.APIDenyEntry
+		var ts time.Time
+		err = rows.Scan(&e.Addr, &e.Reason, &e.Source, &e.AddedBy, &ts)
+		if err != nil {
+			slog.Error("DenyList: " + err.Error())
+			return nil, errors.New("failed to query deny list")
+		}
+		e.CreatedTs = ts.Unix()
+		res = append(res, e)
+	}
+	return res, nil
+}
+
+// checkDenied returns errDenied and records the blocked action if one
+// of the addresses is on the deny list. Fails closed on db errors.
+func (a *App) checkDenied(action string, addrs ...string) error {
+	query := `SELECT 1 FROM referral_deny_list WHERE broker_id = $1 AND addr = $2`
+	for _, addr := range addrs {
+		addr = strings.ToLower(addr)
+		var one int
+		err := a.Db.QueryRow(query, a.Settings.BrokerId, addr).Scan(&one)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			slog.Error("checkDenied: " + err.Error())
+			return errors.New("failed")
+		}
+		slog.Info("Blocked " + action + " of denied address " + addr)
+		a.dbInsertDenyAudit(addr, action, "")
+		return errDenied
+	}
+	return nil
+}
+
+// dbGetDenyList returns the denied addresses
+func (a *App) dbGetDenyList() (map[common.Address]bool, error) {
+	query := `SELECT addr FROM referral_deny_list WHERE broker_id = $1`
+	rows, err := a.Db.Query(query, a.Settings.BrokerId)
+	if err != nil {
+		return nil, errors.New("dbGetDenyList: " + err.Error())
+	}
+	defer rows.Close()
+	res := make(map[common.Address]bool)
+	for rows.Next() {
+		var addr string
+		rows.Scan(&addr)
+		res[common.HexToAddress(addr)] = true
+	}
+	return res, nil
+}
+
+// dbInsertDenyAudit records a blocked action
+func (a *App) dbInsertDenyAudit(addr, action, detail string) {
+	query := `INSERT INTO referral_deny_audit (broker_id, addr, action, detail)
+		VALUES ($1, $2, $3, $4)`
+	_, err := a.Db.Exec(query, a.Settings.BrokerId, strings.ToLower(addr), action, detail)
+	if err != nil {
+		slog.Error("could not record deny-list action " + action + " for " + addr + ": " + err.Error())
+	}
+}
+
+// withholdDenied moves the amounts of denied payees to the broker payout
+// address (level 1) and returns the levels withheld. Denied referrers and
+// agencies are replaced by the broker payout address, the trader remains
+// in the payment (with zero amount) as it identifies the payment.
+func withholdDenied(p PaymentExecution, denied map[common.Address]bool, brokerPayout common.Address) (PaymentExecution, []int) {
+	var withheld []int
+	for k := range p.PayeeAddr {
+		if k == 1 || (!denied[p.PayeeAddr[k]] && !denied[p.payoutAddr(k)]) {
+			continue
+		}
+		if withheld == nil {
+			// do not modify the amounts of the caller
+			amounts := make([]*big.Int, len(p.AmountDecN))
+			for j := range amounts {
+				amounts[j] = new(big.Int).Set(p.AmountDecN[j])
+			}
+			p.AmountDecN = amounts
+			payouts := make([]common.Address, len(p.PayeeAddr))
+			for j := range payouts {
+				payouts[j] = p.payoutAddr(j)
+			}
+			p.PayoutAddr = payouts
+		}
+		withheld = append(withheld, k)
+		p.AmountDecN[1].Add(p.AmountDecN[1], p.AmountDecN[k])
+		p.AmountDecN[k].SetInt64(0)
+		if k > 0 {
+			p.PayoutAddr[k] = brokerPayout
+		}
+	}
+	return p, withheld
+}
+
+// withholdDeniedPayment withholds the amounts of denied payees of p and
+// records them
+func (a *App) withholdDeniedPayment(batchTs string, p PaymentExecution, denied map[common.Address]bool) PaymentExecution {
+	orig := p
+	p, withheld := withholdDenied(p, denied, a.Settings.BrokerPayoutAddr)
+	for _, k := range withheld {
+		addr := strings.ToLower(orig.payoutAddr(k).Hex())
+		if denied[orig.PayeeAddr[k]] {
+			addr = strings.ToLower(orig.PayeeAddr[k].Hex())
+		}
+		detail := "batch " + batchTs + ", trader " + strings.ToLower(p.TraderAddr) + ", pool " +
+			strconv.Itoa(int(p.PoolId)) + ", level " + strconv.Itoa(k) + ", amount " + orig.AmountDecN[k].String()
+		slog.Info("Withholding payment to denied address " + addr + ": " + detail)
+		a.dbInsertDenyAudit(addr, DENY_ACTION_WITHHOLD, detail)
+	}
+	return p
+}
+
+// paidAddrs returns the addresses that receive an amount with ap
+func paidAddrs(ap aggregatedPayment) []string {
+	var addrs []string
+	for k, payee := range ap.PayeeAddr {
+		if ap.AmountDecN[k].Sign() != 0 {
+			addrs = append(addrs, payee.Hex())
+		}
+	}
+	return addrs
+}
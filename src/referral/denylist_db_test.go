@@ -0,0 +1,49 @@
+//go:build integration
+
+package referral
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestDenyList loads the deny list from a file and via the admin
+// functions and blocks denied addresses
+func TestDenyList(t *testing.T) {
+	s := newSimDbApp(t, false)
+	a := s.app
+	fileName := filepath.Join(t.TempDir(), "denylist.json")
+	data := `[{"addr": "` + s.trader.Hex() + `", "reason": "sanctioned"}]`
+	if err := os.WriteFile(fileName, []byte(data), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := a.LoadDenyList(fileName); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if err := a.checkDenied(DENY_ACTION_SELECT_CODE, s.referrer.Hex(), s.trader.Hex()); err != errDenied {
+		t.Errorf("expected trader denied, got %v", err)
+	}
+	if err := a.DenyAddr("alice", s.referrer.Hex(), "manual"); err != nil {
+		t.Fatalf("deny: %v", err)
+	}
+	// reloading the file keeps admin entries
+	if err := a.LoadDenyList(fileName); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	entries, err := a.DenyList()
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %v (%v)", entries, err)
+	}
+	if err := a.AllowAddr("alice", s.referrer.Hex()); err != nil {
+		t.Fatalf("allow: %v", err)
+	}
+	if err := a.checkDenied(DENY_ACTION_UPSERT_CODE, s.referrer.Hex()); err != nil {
+		t.Errorf("expected referrer allowed, got %v", err)
+	}
+	var n int
+	a.Db.QueryRow(`SELECT COUNT(*) FROM referral_deny_audit WHERE action = $1`, DENY_ACTION_SELECT_CODE).Scan(&n)
+	if n != 1 {
+		t.Errorf("expected blocked action recorded, got %d", n)
+	}
+}
@@ -0,0 +1,60 @@
+package referral
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestWithholdDenied(t *testing.T) {
+	trader := common.HexToAddress("0x01")
+	broker := common.HexToAddress("0xb0")
+	agency := common.HexToAddress("0xaa")
+	referrer := common.HexToAddress("0xbb")
+	payout := common.HexToAddress("0xcc")
+	p := PaymentExecution{
+		TraderAddr: trader.Hex(),
+		Code:       "ABC",
+		PoolId:     1,
+		TokenAddr:  "0xt1",
+		PayeeAddr:  []common.Address{trader, broker, agency, referrer},
+		AmountDecN: []*big.Int{big.NewInt(1), big.NewInt(2), big.NewInt(3), big.NewInt(4)},
+	}
+	q, withheld := withholdDenied(p, map[common.Address]bool{payout: true}, broker)
+	if withheld != nil || q.PayoutAddr != nil {
+		t.Fatalf("expected nothing withheld, got levels %v", withheld)
+	}
+
+	// the denied trader and agency are not paid, the broker receives their amounts
+	denied := map[common.Address]bool{trader: true, agency: true}
+	q, withheld = withholdDenied(p, denied, broker)
+	if len(withheld) != 2 || withheld[0] != 0 || withheld[1] != 2 {
+		t.Fatalf("expected levels 0 and 2 withheld, got %v", withheld)
+	}
+	expected := []int64{0, 6, 0, 4}
+	for k, amount := range q.AmountDecN {
+		if amount.Int64() != expected[k] {
+			t.Errorf("level %d: expected %d, got %s", k, expected[k], amount)
+		}
+	}
+	if q.payoutAddr(0) != trader || q.payoutAddr(2) != broker || q.payoutAddr(3) != referrer {
+		t.Errorf("unexpected payout addresses %v", q.PayoutAddr)
+	}
+	if p.AmountDecN[2].Int64() != 3 {
+		t.Errorf("amounts of the planned payment modified")
+	}
+	ap := aggregatePayments("1700000000", "sim", []PaymentExecution{q})[0]
+	for _, addr := range paidAddrs(ap) {
+		if addr == trader.Hex() || addr == agency.Hex() {
+			t.Errorf("denied address %s paid", addr)
+		}
+	}
+
+	// a denied payout address is withheld as well
+	q = withPayoutAddrs(p, map[common.Address]common.Address{referrer: payout})
+	q, withheld = withholdDenied(q, map[common.Address]bool{payout: true}, broker)
+	if len(withheld) != 1 || q.payoutAddr(3) != broker || q.AmountDecN[1].Int64() != 6 {
+		t.Errorf("expected payout address withheld, got %v %v", withheld, q.AmountDecN)
+	}
+}
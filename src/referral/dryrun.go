@@ -0,0 +1,159 @@
+package referral
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"referral-system/src/utils"
+	"strings"
+	"time"
+)
+
+// SimulatePayments computes the payments of the next batch the same way
+// processPayments does, but without sending any transaction and without
+// touching the batch status. Like the batch, it uses the current token
+// holdings of the referrers so that their cuts match, but it does not
+// store them. The planned payments are stored in referral_payment_dry_run
+// and returned as report.
+func (a *App) SimulatePayments() (utils.APIResponseDryRun, error) {
+	holdings, err := a.referrerHoldings()
+	if err != nil {
+		slog.Error("SimulatePayments: " + err.Error())
+		return utils.APIResponseDryRun{}, errors.New("failed to query token holdings")
+	}
+	// batch timestamp: continue an unfinished batch or start a new one now
+	batchTime := time.Now().Unix()
+	hasFinished, t := a.dbGetPayBatch()
+	if !hasFinished {
+		batchTime = t
+	}
+	batchTs := fmt.Sprintf("%d", batchTime)
+	feeRows, err := a.dbGetAggregatedFees()
+	if err != nil {
+		slog.Error("SimulatePayments: " + err.Error())
+		return utils.APIResponseDryRun{}, errors.New("failed to query open payments")
+	}
+	feeRows, err = a.withCarriedOnlyRows(feeRows, time.Unix(batchTime, 0))
+	if err != nil {
+		slog.Error("SimulatePayments: " + err.Error())
+		return utils.APIResponseDryRun{}, errors.New("failed to query carried fees")
+	}
+	scale, err := a.DetermineScalingFactor()
+	if err != nil {
+		slog.Error("SimulatePayments: " + err.Error())
+		return utils.APIResponseDryRun{}, errors.New("failed to determine scaling factor")
+	}
+	res := utils.APIResponseDryRun{
+		BatchTs:  batchTime,
+		RunTs:    time.Now().Unix(),
+		Payments: []utils.APIDryRunPayment{},
+		Totals:   []utils.APIDryRunTotal{},
+		Carried:  []utils.APIDryRunCarry{},
+	}
+	redirects, err := a.dbGetPayoutAddrs()
+	if err != nil {
+		slog.Error("SimulatePayments: " + err.Error())
+		return utils.APIResponseDryRun{}, errors.New("failed to query payout addresses")
+	}
+	denied, err := a.dbGetDenyList()
+	if err != nil {
+		slog.Error("SimulatePayments: " + err.Error())
+		return utils.APIResponseDryRun{}, errors.New("failed to query deny list")
+	}
+	chains := a.newCodeChains()
+	chains.holdings = holdings
+	totals := make(map[uint32]*big.Int)
+	decimals := make(map[uint32]uint8)
+	var plans []PaymentExecution
+	for _, el := range feeRows {
+		chain, _, err := chains.get(el.Code, utils.ABDKToFloat(el.VolumeABDKCC))
+		if err != nil {
+			slog.Error("could not find referral chain for code " + el.Code + ": " + err.Error())
+			continue
+		}
+		total, err := a.withCarriedFee(el, time.Unix(batchTime, 0))
+		if err != nil {
+			slog.Error("SimulatePayments: " + err.Error())
+			return utils.APIResponseDryRun{}, errors.New("failed to query carried fees")
+		}
+		p := a.planPayment(total, chain, batchTs, scale[el.PoolId])
+		if a.isBelowMinPayout(p, el.TokenDecimals) && !a.isCarryDue(total, time.Unix(batchTime, 0)) {
+			res.Carried = append(res.Carried, utils.APIDryRunCarry{
+				TraderAddr: strings.ToLower(p.TraderAddr),
+				Code:       p.Code,
+				PoolId:     p.PoolId,
+				TokenAddr:  strings.ToLower(p.TokenAddr),
+				AmountDecN: p.TotalDecN.String(),
+				Amount:     utils.DecNToFloat(p.TotalDecN, el.TokenDecimals),
+			})
+			continue
+		}
+		// amounts of denied payees are reported at the broker payout address
+		p, _ = withholdDenied(withPayoutAddrs(p, redirects), denied, a.Settings.BrokerPayoutAddr)
+		plans = append(plans, p)
+		decimals[p.PoolId] = el.TokenDecimals
+		if _, exists := totals[p.PoolId]; !exists {
+			totals[p.PoolId] = new(big.Int)
+		}
+		for k := range p.PayeeAddr {
+			if p.AmountDecN[k].BitLen() == 0 {
+				continue
+			}
+			totals[p.PoolId].Add(totals[p.PoolId], p.AmountDecN[k])
+			res.Payments = append(res.Payments, utils.APIDryRunPayment{
+				TraderAddr: strings.ToLower(p.TraderAddr),
+				PayeeAddr:  strings.ToLower(p.PayeeAddr[k].String()),
+				Code:       p.Code,
+				Level:      k,
+				PoolId:     p.PoolId,
+				TokenAddr:  strings.ToLower(p.TokenAddr),
+				AmountDecN: p.AmountDecN[k].String(),
+				Amount:     utils.DecNToFloat(p.AmountDecN[k], el.TokenDecimals),
+			})
+		}
+	}
+	for pool, tot := range totals {
+		res.Totals = append(res.Totals, utils.APIDryRunTotal{
+			PoolId:     pool,
+			AmountDecN: tot.String(),
+			Amount:     utils.DecNToFloat(tot, decimals[pool]),
+		})
+	}
+	res.Transactions = len(aggregatePayments(batchTs, a.Settings.BrokerId, plans))
+	err = a.dbWriteDryRun(time.Unix(res.RunTs, 0), time.Unix(batchTime, 0), plans)
+	if err != nil {
+		slog.Error("SimulatePayments: could not store dry-run " + err.Error())
+		return utils.APIResponseDryRun{}, errors.New("failed to store dry-run")
+	}
+	return res, nil
+}
+
+// dbWriteDryRun stores the planned payments of a dry-run
+func (a *App) dbWriteDryRun(runTs time.Time, batchTs time.Time, plans []PaymentExecution) error {
+	tx, err := a.Db.Begin()
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO referral_payment_dry_run (run_ts, broker_id, batch_ts, trader_addr,
+				payee_addr, code, level, pool_id, token_addr, amount_cc)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	for _, p := range plans {
+		for k := range p.PayeeAddr {
+			if p.AmountDecN[k].BitLen() == 0 {
+				continue
+			}
+			_, err = tx.Exec(query, runTs, a.Settings.BrokerId, batchTs,
+				strings.ToLower(p.TraderAddr),
+				strings.ToLower(p.PayeeAddr[k].String()),
+				p.Code, k, p.PoolId,
+				strings.ToLower(p.TokenAddr),
+				p.AmountDecN[k].String())
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
@@ -9,6 +9,7 @@ import (
 	"math/big"
 	"math/rand"
 	"referral-system/src/contracts"
+	"referral-system/src/metrics"
 	"strconv"
 	"strings"
 	"time"
@@ -30,28 +31,90 @@ const (
 	TxFailed                    // 2
 )
 
+// CreateRpcClient connects to a random rpc of the list
 func (a *App) CreateRpcClient() error {
-	rnd := rand.Intn(len(a.Rpc))
+	if len(a.Rpc) == 0 {
+		// no rpc list configured: keep the current client
+		if a.rpcClient() == nil {
+			return errors.New("no rpc configured")
+		}
+		return nil
+	}
+	return a.connectRpc(rand.Intn(len(a.Rpc)))
+}
+
+// connectRpc connects to rpc k of the list
+func (a *App) connectRpc(k int) error {
 	var rpc *ethclient.Client
 	var err error
 	for trial := 0; ; trial++ {
-		rpc, err = ethclient.Dial(a.Rpc[rnd])
+		rpc, err = ethclient.Dial(a.Rpc[k])
 		if err != nil {
+			metrics.RpcErrors.WithLabelValues(metrics.RpcEndpoint(a.Rpc[k])).Inc()
 			if trial == 5 {
 				return err
 			}
 			slog.Info("Rpc error" + err.Error() + " retrying " + strconv.Itoa(5-trial))
-			slog.Info("RPC " + a.Rpc[rnd])
+			slog.Info("RPC " + a.Rpc[k])
 			time.Sleep(time.Duration(2) * time.Second)
 		} else {
 			break
 		}
 	}
-	slog.Info("RPC " + a.Rpc[rnd])
+	slog.Info("RPC " + a.Rpc[k])
+	a.rpcMu.Lock()
 	a.RpcClient = rpc
+	a.rpcIdx = k
+	a.rpcEndpoint = metrics.RpcEndpoint(a.Rpc[k])
+	a.rpcMu.Unlock()
 	return nil
 }
 
+// rpcClient returns the current rpc client, payments switch
+// the client concurrently
+func (a *App) rpcClient() *ethclient.Client {
+	a.rpcMu.Lock()
+	defer a.rpcMu.Unlock()
+	return a.RpcClient
+}
+
+// failoverRpc switches from the failed client to the next rpc of the
+// list, unless another payment switched already. The executor then
+// synchronizes its nonces with the new rpc.
+func (a *App) failoverRpc(failed *ethclient.Client) {
+	a.failoverMu.Lock()
+	defer a.failoverMu.Unlock()
+	if len(a.Rpc) < 2 || a.rpcClient() != failed {
+		return
+	}
+	a.rpcMu.Lock()
+	next := (a.rpcIdx + 1) % len(a.Rpc)
+	a.rpcMu.Unlock()
+	err := a.connectRpc(next)
+	if err != nil {
+		slog.Error("Rpc failover failed: " + err.Error())
+		return
+	}
+	slog.Info("Rpc failover to " + metrics.RpcEndpoint(a.Rpc[next]))
+	a.PaymentExecutor.SetClient(a.rpcClient())
+}
+
+// countRpcError counts an error of the current rpc client
+func (a *App) countRpcError() {
+	a.rpcMu.Lock()
+	endpoint := a.rpcEndpoint
+	a.rpcMu.Unlock()
+	if endpoint == "" {
+		endpoint = "unknown"
+	}
+	metrics.RpcErrors.WithLabelValues(endpoint).Inc()
+}
+
+// chainLabel is the chain label of the metrics
+func (a *App) chainLabel() string {
+	return strconv.Itoa(a.Settings.ChainId)
+}
+
 // CreateMultipayInstance creates a contract instance of MultiPay
 func (a *App) CreateMultipayInstance() error {
 	var err error
@@ -71,9 +134,11 @@ func (a *App) CreateMultipayInstance() error {
 	return nil
 }
 
-// CreateAuth creates the necessary object for write-blockchain transactions
+// CreateAuth creates the necessary object for write-blockchain transactions.
+// The nonce is taken from the nonce manager of the executor, callers must
+// release it if the transaction is not sent.
 func (exc *basePayExec) CreateAuth() (*bind.TransactOpts, error) {
-	client := exc.Client
+	client := exc.client()
 	if client == nil {
 		return nil, errors.New("createAuth: rpc client is nil")
 	}
@@ -90,28 +155,45 @@ func (exc *basePayExec) CreateAuth() (*bind.TransactOpts, error) {
 		return nil, err
 	}
 	signerFn := func(address common.Address, tx *types.Transaction) (*types.Transaction, error) {
-		return types.SignTx(tx, types.NewEIP155Signer(chainIdB), privateKey)
+		return types.SignTx(tx, types.LatestSignerForChainID(chainIdB), privateKey)
 	}
 	auth.Signer = signerFn
 	// set default values
 	auth.Value = big.NewInt(0)
 	auth.GasLimit = uint64(300000)
 
-	nonce, err := client.PendingNonceAt(context.Background(), fromAddress)
+	err = exc.setFees(client, auth)
 	if err != nil {
 		return nil, err
 	}
-	gasPrice, err := client.SuggestGasPrice(context.Background())
+	nonce, err := exc.nonces().acquire(client, fromAddress)
 	if err != nil {
 		return nil, err
 	}
-	nonceB := new(big.Int).SetUint64(nonce)
-	auth.Nonce = nonceB
-	auth.GasPrice = gasPrice
-
+	auth.Nonce = new(big.Int).SetUint64(nonce)
 	return auth, nil
 }
 
+// setFees sets the EIP-1559 fees if the chain has a base fee,
+// the legacy gas price otherwise
+func (exc *basePayExec) setFees(client *ethclient.Client, auth *bind.TransactOpts) error {
+	header, err := client.HeaderByNumber(context.Background(), nil)
+	if err == nil && header.BaseFee != nil {
+		tip, err := client.SuggestGasTipCap(context.Background())
+		if err != nil {
+			return err
+		}
+		auth.GasFeeCap, auth.GasTipCap = exc.GasPolicy.dynamicFees(header.BaseFee, tip)
+		return nil
+	}
+	gasPrice, err := client.SuggestGasPrice(context.Background())
+	if err != nil {
+		return err
+	}
+	auth.GasPrice = exc.GasPolicy.gasPrice(gasPrice)
+	return nil
+}
+
 func (a *App) CreateErc20Instance(tokenAddr string) (*contracts.Erc20, error) {
 	tknAddr := common.HexToAddress(tokenAddr)
 	instance, err := contracts.NewErc20(tknAddr, a.RpcClient)
@@ -141,6 +223,12 @@ func FilterPayments(ctrct *contracts.MultiPay, client *ethclient.Client, startBl
 	var logs []PaymentLog
 	var reportCount int
 	var pathLen = float64(nowBlock - startBlock)
+	chain := "unknown"
+	if chainId, err := client.ChainID(context.Background()); err == nil {
+		chain = chainId.String()
+	}
+	metrics.FilterPaymentsBlock.WithLabelValues(chain, "start").Set(float64(startBlock))
+	metrics.FilterPaymentsBlock.WithLabelValues(chain, "end").Set(float64(nowBlock))
 	// filter payments in batches of 32_768 (and decreasing) blocks to avoid RPC limit
 	count429 := 0
 	deltaBlock := uint64(32_768)
@@ -153,6 +241,7 @@ func FilterPayments(ctrct *contracts.MultiPay, client *ethclient.Client, startBl
 		}
 		for {
 			endBlock := startBlock + deltaBlock
+			metrics.FilterPaymentsBlock.WithLabelValues(chain, "current").Set(float64(startBlock))
 			if reportCount%100 == 0 {
 				msg := fmt.Sprintf("Reading payments from onchain: %.0f%%", 100-100*float64(nowBlock-startBlock)/pathLen)
 				slog.Info(msg)
@@ -213,6 +302,7 @@ func FilterPayments(ctrct *contracts.MultiPay, client *ethclient.Client, startBl
 	if err != nil {
 		return logs, err
 	}
+	metrics.FilterPaymentsBlock.WithLabelValues(chain, "current").Set(float64(nowBlock))
 	slog.Info("Reading payments completed.")
 	return logs, nil
 }
@@ -228,48 +318,31 @@ func processMultiPayEvents(client *ethclient.Client, multiPayPaymentIterator *co
 		if !multiPayPaymentIterator.Next() {
 			break // No more events to process
 		}
-		var pay PaymentLog
 		event := multiPayPaymentIterator.Event
-
-		// decode pool Id from message, and timestamp from event id
-		var s []string = decodePaymentInfo(event.Message)
-		if s == nil {
-			slog.Info("- event message not in expected format")
-			continue
-		}
-		var err error
-		pay.BatchTimestamp, err = strconv.Atoi(s[0])
+		pays, err := decodePaymentEvent(event)
 		if err != nil {
-			slog.Info("- event message batch timestamp not in expected format")
+			slog.Info("- " + err.Error())
 			continue
 		}
-		id, err := strconv.Atoi(s[2])
-		if err != nil {
-			slog.Info("- event message pool id not in expected format")
-			continue
-		}
-		pay.PoolId = uint32(id)
-		pay.Code = s[1]
-		pay.BrokerAddr = event.From.String()
-		//Trader must be the first address
-		pay.PayeeAddr = event.Payees
-		pay.AmountDecN = event.Amounts
-		pay.TxHash = event.Raw.TxHash.String()
-		pay.BlockNumber = uint64(multiPayPaymentIterator.Event.Raw.BlockNumber)
-		if blockTimestamps[pay.BlockNumber] == 0 {
+		blockNumber := uint64(event.Raw.BlockNumber)
+		if blockTimestamps[blockNumber] == 0 {
 			// retrieve timestamp
 			bucket.WaitForToken("Multipay Iterator", false)
-			t := getBlockTimestamp(pay.BlockNumber, client)
+			t := getBlockTimestamp(blockNumber, client)
 			// zero on error
-			blockTimestamps[pay.BlockNumber] = t
+			blockTimestamps[blockNumber] = t
 		}
-		pay.BlockTs = blockTimestamps[pay.BlockNumber]
-		if pay.Code == "DEFAULT" {
-			countDefaultCode += 1
-		} else {
-			slog.Info("Event Data for code " + pay.Code)
+		for _, pay := range pays {
+			pay.BlockNumber = blockNumber
+			pay.BlockHash = event.Raw.BlockHash.Hex()
+			pay.BlockTs = blockTimestamps[blockNumber]
+			if pay.Code == "DEFAULT" {
+				countDefaultCode += 1
+			} else {
+				slog.Info("Event Data for code " + pay.Code)
+			}
+			*logs = append(*logs, pay)
 		}
-		*logs = append(*logs, pay)
 	}
 	if countDefaultCode > 0 {
 		slog.Info("Event Data for code DEFAULT (" + strconv.Itoa(countDefaultCode) + " times)")
@@ -291,6 +364,94 @@ func processMultiPayEvents(client *ethclient.Client, multiPayPaymentIterator *co
 	}
 }
 
+// receiptPaymentLogs returns the payments of the MultiPay payment
+// events in the receipt of a mined transaction
+func (a *App) receiptPaymentLogs(receipt *types.Receipt) ([]PaymentLog, error) {
+	blockNumber := receipt.BlockNumber.Uint64()
+	blockTs := getBlockTimestamp(blockNumber, a.rpcClient())
+	if blockTs == 0 {
+		return nil, errors.New("could not get timestamp of block " + strconv.FormatUint(blockNumber, 10))
+	}
+	var logs []PaymentLog
+	for _, l := range receipt.Logs {
+		event, err := a.MultipayCtrct.ParsePayment(*l)
+		if err != nil {
+			// not a payment event, e.g. token transfer
+			continue
+		}
+		pays, err := decodePaymentEvent(event)
+		if err != nil {
+			return nil, err
+		}
+		for _, pay := range pays {
+			pay.BlockNumber = blockNumber
+			pay.BlockHash = l.BlockHash.Hex()
+			pay.BlockTs = blockTs
+			logs = append(logs, pay)
+		}
+	}
+	return logs, nil
+}
+
+// decodePaymentEvent returns the payments of a MultiPay payment event,
+// one per trader. Aggregated payments are split according to the
+// manifest in the message.
+func decodePaymentEvent(event *contracts.MultiPayPayment) ([]PaymentLog, error) {
+	msg, err := decodePaymentMsg(event.Message)
+	if err != nil {
+		return nil, err
+	}
+	base := PaymentLog{
+		BrokerAddr: event.From.String(),
+		BrokerId:   msg.BrokerId,
+		TxHash:     event.Raw.TxHash.String(),
+	}
+	base.BatchTimestamp, err = strconv.Atoi(msg.BatchTs)
+	if err != nil {
+		return nil, errors.New("event message batch timestamp not in expected format")
+	}
+	if msg.Entries[0].PayeeIdx != nil {
+		return splitPaymentEvent(base, event, msg.Entries)
+	}
+	base.PoolId = msg.Entries[0].PoolId
+	base.Code = msg.Entries[0].Code
+	//Trader must be the first address
+	base.PayeeAddr = event.Payees
+	base.AmountDecN = event.Amounts
+	return []PaymentLog{base}, nil
+}
+
+// splitPaymentEvent splits an aggregated payment into the payments
+// per trader listed in the manifest. The amounts of the manifest must
+// add up to the amounts paid.
+func splitPaymentEvent(base PaymentLog, event *contracts.MultiPayPayment, entries []manifestEntry) ([]PaymentLog, error) {
+	paid := make([]*big.Int, len(event.Payees))
+	for k := range paid {
+		paid[k] = new(big.Int)
+	}
+	pays := make([]PaymentLog, 0, len(entries))
+	for _, e := range entries {
+		pay := base
+		pay.PoolId = e.PoolId
+		pay.Code = e.Code
+		for k, idx := range e.PayeeIdx {
+			if idx >= len(event.Payees) {
+				return nil, errors.New("event manifest payee index out of range")
+			}
+			pay.PayeeAddr = append(pay.PayeeAddr, event.Payees[idx])
+			pay.AmountDecN = append(pay.AmountDecN, e.AmountDecN[k])
+			paid[idx].Add(paid[idx], e.AmountDecN[k])
+		}
+		pays = append(pays, pay)
+	}
+	for k := range paid {
+		if k >= len(event.Amounts) || paid[k].Cmp(event.Amounts[k]) != 0 {
+			return nil, errors.New("event manifest amounts do not match payment " + base.TxHash)
+		}
+	}
+	return pays, nil
+}
+
 // get the block timestamp for a block with a given number
 func getBlockTimestamp(blockNum uint64, client *ethclient.Client) uint64 {
 	var b big.Int
@@ -310,6 +471,15 @@ func QueryTxStatus(client *ethclient.Client, txHash string) TxStatus {
 		slog.Error("Could not obtain transaction " + txHash + " error:" + err.Error())
 		return TxNotFound
 	}
+	return receiptTxStatus(receipt)
+}
+
+// receiptTxStatus returns the status of the transaction of receipt,
+// TxNotFound without receipt
+func receiptTxStatus(receipt *types.Receipt) TxStatus {
+	if receipt == nil {
+		return TxNotFound
+	}
 	if receipt.Status == 1 {
 		return TxConfirmed
 	}
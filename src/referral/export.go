@@ -0,0 +1,206 @@
+package referral
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"referral-system/src/utils"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// EXPORT_DATE_FORMAT is the format of the days of an export period
+const EXPORT_DATE_FORMAT = "2006-01-02"
+
+// payoutExportHeader are the columns of the csv export, totals have
+// the type "total" and only the chain, broker, token, amount and
+// confirmation columns set
+var payoutExportHeader = []string{
+	"type", "chain_id", "broker_id", "trader_addr", "code", "level", "pool_id",
+	"payee_addr", "payout_addr", "token_name", "token_addr", "token_decimals",
+	"amount", "amount_dec_n", "tx_hash", "batch_ts", "block_nr", "block_ts", "confirmed",
+}
+
+// ParseExportPeriod parses the first and the last day (UTC) of an
+// export period and returns the start and the exclusive end
+func ParseExportPeriod(fromDay, toDay string) (time.Time, time.Time, error) {
+	from, err := time.Parse(EXPORT_DATE_FORMAT, fromDay)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("invalid start day " + fromDay)
+	}
+	to, err := time.Parse(EXPORT_DATE_FORMAT, toDay)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("invalid end day " + toDay)
+	}
+	if to.Before(from) {
+		return time.Time{}, time.Time{}, errors.New("end day before start day")
+	}
+	return from, to.AddDate(0, 0, 1), nil
+}
+
+// PayoutExport returns the payee transfers of the broker with a block
+// time in [from, to) and their totals per token
+func (a *App) PayoutExport(from, to time.Time) (utils.APIPayoutExport, error) {
+	transfers, err := a.dbGetPayoutTransfers(from, to)
+	if err != nil {
+		slog.Error(err.Error())
+		return utils.APIPayoutExport{}, errors.New("failed to query payouts")
+	}
+	res := utils.APIPayoutExport{
+		ChainId:    a.Settings.ChainId,
+		BrokerId:   a.Settings.BrokerId,
+		BrokerAddr: a.BrokerAddr,
+		FromTs:     from.Unix(),
+		ToTs:       to.Unix(),
+		Transfers:  transfers,
+		Totals:     payoutTotals(transfers),
+	}
+	slog.Info("Exported " + strconv.Itoa(len(transfers)) + " transfers from " + from.Format(EXPORT_DATE_FORMAT) +
+		" until " + to.Format(EXPORT_DATE_FORMAT))
+	return res, nil
+}
+
+// payoutTotals sums the transfers per token and confirmation status
+func payoutTotals(transfers []utils.APIPayoutTransfer) []utils.APIPayoutTotal {
+	type totalKey struct {
+		TokenAddr string
+		PoolId    uint32
+		Confirmed bool
+	}
+	sums := make(map[totalKey]*big.Int)
+	totals := make(map[totalKey]*utils.APIPayoutTotal)
+	var keys []totalKey
+	for _, tr := range transfers {
+		// pools without token info are not summed together
+		k := totalKey{TokenAddr: tr.TokenAddr, Confirmed: tr.Confirmed}
+		if tr.TokenAddr == "" {
+			k.PoolId = tr.PoolId
+		}
+		if _, exists := totals[k]; !exists {
+			keys = append(keys, k)
+			sums[k] = new(big.Int)
+			totals[k] = &utils.APIPayoutTotal{
+				TokenName:     tr.TokenName,
+				TokenAddr:     tr.TokenAddr,
+				TokenDecimals: tr.TokenDecimals,
+				Confirmed:     tr.Confirmed,
+			}
+		}
+		amount, _ := new(big.Int).SetString(tr.AmountDecN, 10)
+		if amount != nil {
+			sums[k].Add(sums[k], amount)
+		}
+		totals[k].Transfers++
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].TokenAddr != keys[j].TokenAddr {
+			return keys[i].TokenAddr < keys[j].TokenAddr
+		}
+		if keys[i].PoolId != keys[j].PoolId {
+			return keys[i].PoolId < keys[j].PoolId
+		}
+		return keys[i].Confirmed && !keys[j].Confirmed
+	})
+	res := []utils.APIPayoutTotal{}
+	for _, k := range keys {
+		t := totals[k]
+		t.AmountDecN = sums[k].String()
+		t.Amount = utils.DecNToString(sums[k], t.TokenDecimals)
+		res = append(res, *t)
+	}
+	return res
+}
+
+// WritePayoutExportCsv writes the transfers and totals of the exports
+// as csv with one header
+func WritePayoutExportCsv(w io.Writer, exports []utils.APIPayoutExport) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(payoutExportHeader); err != nil {
+		return err
+	}
+	for _, exp := range exports {
+		chainId := strconv.Itoa(exp.ChainId)
+		for _, tr := range exp.Transfers {
+			err := cw.Write([]string{
+				"transfer", chainId, exp.BrokerId, tr.TraderAddr, tr.Code, strconv.Itoa(tr.Level),
+				strconv.FormatUint(uint64(tr.PoolId), 10), tr.PayeeAddr, tr.PayoutAddr, tr.TokenName,
+				tr.TokenAddr, strconv.Itoa(int(tr.TokenDecimals)), tr.Amount, tr.AmountDecN, tr.TxHash,
+				formatExportTs(tr.BatchTs), strconv.FormatInt(tr.BlockNr, 10), formatExportTs(tr.BlockTs),
+				strconv.FormatBool(tr.Confirmed),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for _, t := range exp.Totals {
+			err := cw.Write([]string{
+				"total", chainId, exp.BrokerId, "", "", "", "", "", "", t.TokenName,
+				t.TokenAddr, strconv.Itoa(int(t.TokenDecimals)), t.Amount, t.AmountDecN, "",
+				"", "", "", strconv.FormatBool(t.Confirmed),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// formatExportTs formats a timestamp as RFC3339 in UTC, empty if the
+// timestamp is not set
+func formatExportTs(ts int64) string {
+	if ts == 0 {
+		return ""
+	}
+	return time.Unix(ts, 0).UTC().Format(time.RFC3339)
+}
+
+// dbGetPayoutTransfers returns the payee transfers of the broker with
+// a block time in [from, to). Unconfirmed payments have the time they
+// were sent as block time.
+func (a *App) dbGetPayoutTransfers(from, to time.Time) ([]utils.APIPayoutTransfer, error) {
+	query := `SELECT LOWER(rp.trader_addr), rp.code, rp.level, rp.pool_id, LOWER(rp.payee_addr),
+			COALESCE(LOWER(rp.payout_addr), ''), COALESCE(mti.token_name, ''),
+			COALESCE(LOWER(mti.token_addr), ''), COALESCE(mti.token_decimals, 0),
+			rp.paid_amount_cc::text, rp.tx_hash, rp.batch_ts, rp.block_nr, rp.block_ts, rp.tx_confirmed
+		FROM referral_payment rp
+		LEFT JOIN margin_token_info mti
+			ON mti.pool_id = rp.pool_id
+		WHERE LOWER(rp.broker_addr) = LOWER($1)
+			AND rp.block_ts >= $2 AND rp.block_ts < $3
+		ORDER BY rp.block_ts, rp.tx_hash, rp.trader_addr, rp.level`
+	rows, err := a.Db.Query(query, a.BrokerAddr, from, to)
+	if err != nil {
+		return nil, errors.New("dbGetPayoutTransfers: " + err.Error())
+	}
+	defer rows.Close()
+	res := []utils.APIPayoutTransfer{}
+	for rows.Next() {
+		var tr utils.APIPayoutTransfer
+		var batchTs, blockTs time.Time
+		var blockNr sql.NullInt64
+		err = rows.Scan(&tr.TraderAddr, &tr.Code, &tr.Level, &tr.PoolId, &tr.PayeeAddr, &tr.PayoutAddr,
+			&tr.TokenName, &tr.TokenAddr, &tr.TokenDecimals, &tr.AmountDecN, &tr.TxHash, &batchTs,
+			&blockNr, &blockTs, &tr.Confirmed)
+		if err != nil {
+			return nil, errors.New("dbGetPayoutTransfers: " + err.Error())
+		}
+		amount, ok := new(big.Int).SetString(tr.AmountDecN, 10)
+		if !ok {
+			return nil, errors.New("dbGetPayoutTransfers: invalid amount " + tr.AmountDecN)
+		}
+		tr.Amount = utils.DecNToString(amount, tr.TokenDecimals)
+		tr.BatchTs = batchTs.Unix()
+		tr.BlockTs = blockTs.Unix()
+		if blockNr.Valid {
+			tr.BlockNr = blockNr.Int64
+		}
+		res = append(res, tr)
+	}
+	return res, nil
+}
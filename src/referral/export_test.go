@@ -0,0 +1,68 @@
+package referral
+
+import (
+	"bytes"
+	"encoding/csv"
+	"referral-system/src/utils"
+	"testing"
+	"time"
+)
+
+func TestParseExportPeriod(t *testing.T) {
+	from, to, err := ParseExportPeriod("2024-06-01", "2024-06-30")
+	if err != nil || !from.Equal(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)) ||
+		!to.Equal(time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected period %s - %s (%v)", from, to, err)
+	}
+	if _, _, err := ParseExportPeriod("2024-06-30", "2024-06-01"); err == nil {
+		t.Errorf("expected error for reversed period")
+	}
+	if _, _, err := ParseExportPeriod("2024-06-01", "30.06.2024"); err == nil {
+		t.Errorf("expected error for invalid day")
+	}
+}
+
+func TestPayoutExportCsv(t *testing.T) {
+	usdc := utils.APIPayoutTransfer{TokenName: "USDC", TokenAddr: "0xusdc", TokenDecimals: 6, Confirmed: true}
+	transfers := []utils.APIPayoutTransfer{usdc, usdc, usdc, {PoolId: 7, Confirmed: true, AmountDecN: "5"}}
+	transfers[0].AmountDecN, transfers[0].Amount = "1500000", "1.500000"
+	transfers[0].TraderAddr, transfers[0].BlockTs = "0xt1", 1717200000
+	transfers[1].AmountDecN, transfers[1].Level = "250000", 3
+	transfers[2].AmountDecN, transfers[2].Confirmed = "1000000", false
+	totals := payoutTotals(transfers)
+	if len(totals) != 3 {
+		t.Fatalf("expected 3 totals, got %+v", totals)
+	}
+	// unknown token first, confirmed before unconfirmed
+	if totals[0].TokenAddr != "" || totals[0].AmountDecN != "5" || totals[0].Amount != "5" {
+		t.Errorf("unexpected total of pool without token %+v", totals[0])
+	}
+	if !totals[1].Confirmed || totals[1].Transfers != 2 || totals[1].Amount != "1.750000" || totals[1].AmountDecN != "1750000" {
+		t.Errorf("unexpected confirmed total %+v", totals[1])
+	}
+	if totals[2].Confirmed || totals[2].Amount != "1.000000" {
+		t.Errorf("unexpected unconfirmed total %+v", totals[2])
+	}
+
+	exp := utils.APIPayoutExport{ChainId: 42161, BrokerId: "d8x", Transfers: transfers[:1], Totals: totals[1:2]}
+	var buf bytes.Buffer
+	if err := WritePayoutExportCsv(&buf, []utils.APIPayoutExport{exp, exp}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil || len(records) != 5 {
+		t.Fatalf("expected header and 4 lines, got %d (%v)", len(records), err)
+	}
+	for _, rec := range records {
+		if len(rec) != len(payoutExportHeader) {
+			t.Errorf("expected %d columns, got %v", len(payoutExportHeader), rec)
+		}
+	}
+	tr := records[1]
+	if tr[0] != "transfer" || tr[1] != "42161" || tr[3] != "0xt1" || tr[12] != "1.500000" || tr[17] != "2024-06-01T00:00:00Z" {
+		t.Errorf("unexpected transfer line %v", tr)
+	}
+	if records[2][0] != "total" || records[2][12] != "1.750000" || records[2][18] != "true" {
+		t.Errorf("unexpected total line %v", records[2])
+	}
+}
@@ -0,0 +1,113 @@
+package referral
+
+import (
+	"errors"
+	"math/big"
+	"time"
+)
+
+// GasPolicy configures the fees of payment transactions on a chain
+// (referralSettings.json, "gasPolicy"). Fees are in gwei, zero values
+// select the defaults.
+type GasPolicy struct {
+	// max. fee per gas, default 2 x base fee + priority fee
+	MaxFeeGwei float64 `json:"maxFeeGwei"`
+	// priority fee per gas, default as suggested by the rpc
+	PriorityFeeGwei float64 `json:"priorityFeeGwei"`
+	// fee per gas (max. fee or legacy gas price) never exceeded,
+	// including replacements, default none
+	CeilingGwei float64 `json:"ceilingGwei"`
+	// time a transaction can remain pending before it is
+	// replaced, default 180s
+	ReceiptTimeoutSec int `json:"receiptTimeoutSec"`
+	// fee increase of a replacement in percent, default 15
+	// (nodes require at least 10)
+	BumpPercent int `json:"bumpPercent"`
+	// number of replacements before we stop waiting for
+	// the transaction, default 3
+	MaxReplacements int `json:"maxReplacements"`
+}
+
+func gweiToWei(gwei float64) *big.Int {
+	wei, _ := new(big.Float).Mul(big.NewFloat(gwei), big.NewFloat(1e9)).Int(nil)
+	return wei
+}
+
+// receiptTimeout is the time we wait for the receipt of a transaction
+func (g GasPolicy) receiptTimeout() time.Duration {
+	if g.ReceiptTimeoutSec <= 0 {
+		return 180 * time.Second
+	}
+	return time.Duration(g.ReceiptTimeoutSec) * time.Second
+}
+
+func (g GasPolicy) bumpPercent() int64 {
+	if g.BumpPercent < 10 {
+		return 15
+	}
+	return int64(g.BumpPercent)
+}
+
+func (g GasPolicy) maxReplacements() int {
+	if g.MaxReplacements <= 0 {
+		return 3
+	}
+	return g.MaxReplacements
+}
+
+// capFee caps the fee per gas at the ceiling
+func (g GasPolicy) capFee(fee *big.Int) *big.Int {
+	if g.CeilingGwei > 0 {
+		ceiling := gweiToWei(g.CeilingGwei)
+		if fee.Cmp(ceiling) > 0 {
+			return ceiling
+		}
+	}
+	return fee
+}
+
+// dynamicFees returns the max. fee and the priority fee per gas (wei)
+// of an EIP-1559 transaction given the current base fee and the
+// priority fee suggested by the rpc
+func (g GasPolicy) dynamicFees(baseFee, suggestedTip *big.Int) (*big.Int, *big.Int) {
+	tip := suggestedTip
+	if g.PriorityFeeGwei > 0 {
+		tip = gweiToWei(g.PriorityFeeGwei)
+	}
+	var maxFee *big.Int
+	if g.MaxFeeGwei > 0 {
+		maxFee = gweiToWei(g.MaxFeeGwei)
+	} else {
+		maxFee = new(big.Int).Mul(baseFee, big.NewInt(2))
+		maxFee.Add(maxFee, tip)
+	}
+	maxFee = g.capFee(maxFee)
+	if tip.Cmp(maxFee) > 0 {
+		tip = maxFee
+	}
+	return maxFee, tip
+}
+
+// gasPrice returns the gas price of a legacy transaction
+func (g GasPolicy) gasPrice(suggested *big.Int) *big.Int {
+	if g.MaxFeeGwei > 0 {
+		suggested = gweiToWei(g.MaxFeeGwei)
+	}
+	return g.capFee(suggested)
+}
+
+// bump increases the fee per gas for a replacement transaction,
+// returns an error if the ceiling does not allow the increase
+func (g GasPolicy) bump(fee *big.Int) (*big.Int, error) {
+	bumped := new(big.Int).Mul(fee, big.NewInt(100+g.bumpPercent()))
+	bumped.Div(bumped, big.NewInt(100))
+	// at least +1 wei for tiny fees
+	if bumped.Cmp(fee) <= 0 {
+		bumped.Add(fee, big.NewInt(1))
+	}
+	bumped = g.capFee(bumped)
+	if bumped.Cmp(fee) <= 0 {
+		return nil, errors.New("gas ceiling reached, cannot bump fee")
+	}
+	return bumped, nil
+}
@@ -0,0 +1,45 @@
+package referral
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestGasPolicyFees(t *testing.T) {
+	gwei := func(v int64) *big.Int { return new(big.Int).Mul(big.NewInt(v), big.NewInt(1e9)) }
+	var g GasPolicy
+	maxFee, tip := g.dynamicFees(gwei(10), gwei(2))
+	if maxFee.Cmp(gwei(22)) != 0 || tip.Cmp(gwei(2)) != 0 {
+		t.Errorf("default: expected 22/2 gwei, got %s/%s", maxFee, tip)
+	}
+	g = GasPolicy{PriorityFeeGwei: 1.5, CeilingGwei: 15}
+	maxFee, tip = g.dynamicFees(gwei(10), gwei(2))
+	if maxFee.Cmp(gwei(15)) != 0 || tip.Cmp(big.NewInt(1_500_000_000)) != 0 {
+		t.Errorf("ceiling: expected 15/1.5 gwei, got %s/%s", maxFee, tip)
+	}
+	g = GasPolicy{MaxFeeGwei: 30, PriorityFeeGwei: 40}
+	maxFee, tip = g.dynamicFees(gwei(10), gwei(2))
+	if maxFee.Cmp(gwei(30)) != 0 || tip.Cmp(gwei(30)) != 0 {
+		t.Errorf("max fee: expected 30/30 gwei, got %s/%s", maxFee, tip)
+	}
+	if p := (GasPolicy{CeilingGwei: 5}).gasPrice(gwei(8)); p.Cmp(gwei(5)) != 0 {
+		t.Errorf("legacy: expected 5 gwei, got %s", p)
+	}
+
+	// bump by 15% by default, never above the ceiling
+	g = GasPolicy{CeilingGwei: 25}
+	fee, err := g.bump(gwei(20))
+	if err != nil || fee.Cmp(gwei(23)) != 0 {
+		t.Errorf("bump: expected 23 gwei, got %s (%v)", fee, err)
+	}
+	fee, err = g.bump(gwei(23))
+	if err != nil || fee.Cmp(gwei(25)) != 0 {
+		t.Errorf("bump: expected ceiling 25 gwei, got %s (%v)", fee, err)
+	}
+	if _, err = g.bump(gwei(25)); err == nil {
+		t.Errorf("expected error when bumping at the ceiling")
+	}
+	if fee, _ := (GasPolicy{BumpPercent: 50}).bump(gwei(10)); fee.Cmp(gwei(15)) != 0 {
+		t.Errorf("bump: expected 15 gwei, got %s", fee)
+	}
+}
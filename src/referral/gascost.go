@@ -0,0 +1,186 @@
+package referral
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"math/big"
+	"referral-system/src/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// periods of the gas cost report
+const (
+	GAS_PERIOD_BATCH = "batch"
+	GAS_PERIOD_DAY   = "day"
+	GAS_PERIOD_WEEK  = "week"
+	GAS_PERIOD_MONTH = "month"
+)
+
+// NATIVE_TOKEN_DECIMALS are the decimals of the gas token
+const NATIVE_TOKEN_DECIMALS = 18
+
+// gasPeriodKey is the expression the gas costs are grouped by per period
+var gasPeriodKey = map[string]string{
+	GAS_PERIOD_BATCH: "g.batch_ts",
+	GAS_PERIOD_DAY:   "date_trunc('day', g.batch_ts)",
+	GAS_PERIOD_WEEK:  "date_trunc('week', g.batch_ts)",
+	GAS_PERIOD_MONTH: "date_trunc('month', g.batch_ts)",
+}
+
+// gasCostRow are the summed gas costs of the transactions of a
+// batch or period that paid one token
+type gasCostRow struct {
+	Ts            time.Time
+	TokenAddr     string
+	TokenDecimals uint8
+	Txs           int
+	FailedTxs     int
+	Payments      int
+	GasUsed       uint64
+	FeeWei        *big.Int
+	PaidDecN      *big.Int
+}
+
+// apiGasCost converts the row, the gas share is set if the price of
+// the gas token in the margin token is known
+func (r gasCostRow) apiGasCost(gasTokenPrice map[string]float64) utils.APIGasCost {
+	res := utils.APIGasCost{
+		Ts:         r.Ts.Unix(),
+		TokenAddr:  r.TokenAddr,
+		Txs:        r.Txs,
+		FailedTxs:  r.FailedTxs,
+		Payments:   r.Payments,
+		GasUsed:    r.GasUsed,
+		GasFee:     utils.DecNToFloat(r.FeeWei, NATIVE_TOKEN_DECIMALS),
+		PaidAmount: utils.DecNToFloat(r.PaidDecN, r.TokenDecimals),
+	}
+	if r.Payments > 0 {
+		res.GasFeePerPayment = res.GasFee / float64(r.Payments)
+	}
+	if price, exists := gasTokenPrice[r.TokenAddr]; exists && res.PaidAmount > 0 {
+		share := res.GasFee * price / res.PaidAmount
+		res.GasShare = &share
+	}
+	return res
+}
+
+// GasReport returns the gas costs of the payment transactions of the
+// last days per batch or period (GAS_PERIOD_*) and margin token
+func (a *App) GasReport(period string, days int) (utils.APIGasReport, error) {
+	key, exists := gasPeriodKey[period]
+	if !exists {
+		return utils.APIGasReport{}, errors.New("unknown period " + period)
+	}
+	if days <= 0 {
+		days = 30
+	}
+	fromTs := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	rows, err := a.dbGetGasCosts(key, fromTs)
+	if err != nil {
+		slog.Error(err.Error())
+		return utils.APIGasReport{}, errors.New("failed to query gas costs")
+	}
+	res := utils.APIGasReport{Period: period, FromTs: fromTs.Unix(), Costs: []utils.APIGasCost{}}
+	for _, r := range rows {
+		res.Costs = append(res.Costs, r.apiGasCost(a.Settings.GasTokenPrice))
+	}
+	return res, nil
+}
+
+// dbGetGasCosts sums the gas costs and the amounts paid of the
+// transactions of batches since fromTs grouped by key and token
+func (a *App) dbGetGasCosts(key string, fromTs time.Time) ([]gasCostRow, error) {
+	query := `WITH paid AS (
+			SELECT rp.tx_hash,
+				COUNT(DISTINCT (rp.trader_addr, rp.pool_id, rp.code)) AS payments,
+				SUM(rp.paid_amount_cc) AS paid_cc
+			FROM referral_payment rp
+			WHERE rp.tx_confirmed = true
+				AND rp.tx_hash IN (
+					SELECT tx_hash FROM referral_payment_gas
+					WHERE broker_id = $1 AND batch_ts >= $2)
+			GROUP BY rp.tx_hash
+		), token AS (
+			SELECT LOWER(token_addr) AS token_addr, MAX(token_decimals) AS token_decimals
+			FROM margin_token_info
+			GROUP BY LOWER(token_addr)
+		)
+		SELECT ` + key + ` AS ts, g.token_addr, COALESCE(t.token_decimals, 0),
+			COUNT(*), COUNT(*) FILTER (WHERE g.status <> 1),
+			COALESCE(SUM(p.payments), 0), SUM(g.gas_used),
+			SUM(g.gas_used * g.effective_gas_price), COALESCE(SUM(p.paid_cc), 0)
+		FROM referral_payment_gas g
+		LEFT JOIN paid p ON p.tx_hash = g.tx_hash
+		LEFT JOIN token t ON t.token_addr = g.token_addr
+		WHERE g.broker_id = $1 AND g.batch_ts >= $2
+		GROUP BY 1, g.token_addr, t.token_decimals
+		ORDER BY 1, g.token_addr`
+	rows, err := a.Db.Query(query, a.Settings.BrokerId, fromTs)
+	if err != nil {
+		return nil, errors.New("dbGetGasCosts: " + err.Error())
+	}
+	defer rows.Close()
+	var res []gasCostRow
+	for rows.Next() {
+		var r gasCostRow
+		var fee, paid string
+		err = rows.Scan(&r.Ts, &r.TokenAddr, &r.TokenDecimals, &r.Txs, &r.FailedTxs,
+			&r.Payments, &r.GasUsed, &fee, &paid)
+		if err != nil {
+			return nil, errors.New("dbGetGasCosts: " + err.Error())
+		}
+		r.FeeWei, _ = new(big.Int).SetString(fee, 10)
+		if r.FeeWei == nil {
+			r.FeeWei = new(big.Int)
+		}
+		r.PaidDecN, _ = new(big.Int).SetString(paid, 10)
+		if r.PaidDecN == nil {
+			r.PaidDecN = new(big.Int)
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// dbInsertPaymentGas records the gas cost of a mined payment
+// transaction that paid tokenAddr
+func (a *App) dbInsertPaymentGas(batchTs time.Time, tokenAddr string, receipt *types.Receipt) {
+	price := receipt.EffectiveGasPrice
+	if price == nil {
+		// not reported by the rpc
+		price = new(big.Int)
+	}
+	query := `INSERT INTO referral_payment_gas
+			(tx_hash, broker_id, batch_ts, token_addr, gas_used, effective_gas_price, status, block_nr)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (tx_hash) DO NOTHING`
+	_, err := a.Db.Exec(query, receipt.TxHash.Hex(), a.Settings.BrokerId, batchTs, strings.ToLower(tokenAddr),
+		int64(receipt.GasUsed), price.String(), int(receipt.Status), receipt.BlockNumber.Int64())
+	if err != nil {
+		slog.Error("could not record gas cost of tx " + receipt.TxHash.Hex() + ": " + err.Error())
+		return
+	}
+	slog.Info("Payment tx " + receipt.TxHash.Hex() + " used " + strconv.FormatUint(receipt.GasUsed, 10) +
+		" gas at " + price.String() + " wei")
+}
+
+// dbGetPaymentTxToken returns the margin token paid with txHash, empty
+// if there are no payments of the transaction
+func (a *App) dbGetPaymentTxToken(txHash string) string {
+	query := `SELECT LOWER(mti.token_addr)
+		FROM referral_payment rp
+		JOIN margin_token_info mti ON mti.pool_id = rp.pool_id
+		WHERE rp.tx_hash = $1
+		LIMIT 1`
+	var token string
+	err := a.Db.QueryRow(query, txHash).Scan(&token)
+	if err != nil && err != sql.ErrNoRows {
+		slog.Error("dbGetPaymentTxToken: " + err.Error())
+	}
+	return token
+}
@@ -0,0 +1,41 @@
+package referral
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestApiGasCost(t *testing.T) {
+	ether := new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+	r := gasCostRow{
+		Ts:            time.Unix(1700000000, 0),
+		TokenAddr:     "0xt1",
+		TokenDecimals: 6,
+		Txs:           2,
+		Payments:      4,
+		GasUsed:       1_000_000,
+		// 0.002 native tokens
+		FeeWei:   new(big.Int).Div(ether, big.NewInt(500)),
+		PaidDecN: big.NewInt(400_000_000),
+	}
+	c := r.apiGasCost(nil)
+	if c.Ts != 1700000000 || c.GasFee != 0.002 || c.GasFeePerPayment != 0.0005 || c.PaidAmount != 400 {
+		t.Errorf("unexpected gas cost %+v", c)
+	}
+	if c.GasShare != nil {
+		t.Errorf("expected no gas share without price, got %f", *c.GasShare)
+	}
+	// 0.002 x 2000 = 4 of 400 paid
+	c = r.apiGasCost(map[string]float64{"0xt1": 2000})
+	if c.GasShare == nil || *c.GasShare != 0.01 {
+		t.Errorf("expected gas share 1%%, got %v", c.GasShare)
+	}
+	// failed transactions without payments
+	r.Payments = 0
+	r.PaidDecN = new(big.Int)
+	c = r.apiGasCost(map[string]float64{"0xt1": 2000})
+	if c.GasFeePerPayment != 0 || c.GasShare != nil {
+		t.Errorf("unexpected gas cost without payments %+v", c)
+	}
+}
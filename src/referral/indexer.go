@@ -0,0 +1,419 @@
+package referral
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"referral-system/src/contracts"
+	"referral-system/src/metrics"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// blocks whose hashes are kept to find the common ancestor after a reorg
+const INDEXER_KEEP_BLOCKS = 256
+
+// IndexerSettings configures the continuous payment event indexer
+type IndexerSettings struct {
+	// run the indexer; without it payments are read from the lookback
+	// window at payment time
+	Enabled bool `json:"enabled"`
+	// blocks behind the chain head, default 12
+	Confirmations uint64 `json:"confirmations"`
+	// wait between runs once the indexer follows the head, default 30 seconds
+	PollSeconds int `json:"pollSeconds"`
+	// block of the MultiPay deployment, the indexer starts here. Without
+	// it, the indexer starts at the payment lookback
+	DeploymentBlock uint64 `json:"deploymentBlock"`
+	// blocks per event query, default 10000
+	MaxBlockRange uint64 `json:"maxBlockRange"`
+}
+
+func (s IndexerSettings) confirmations() uint64 {
+	if s.Confirmations == 0 {
+		return 12
+	}
+	return s.Confirmations
+}
+
+func (s IndexerSettings) pollInterval() time.Duration {
+	if s.PollSeconds < 1 {
+		return 30 * time.Second
+	}
+	return time.Duration(s.PollSeconds) * time.Second
+}
+
+func (s IndexerSettings) maxBlockRange() uint64 {
+	if s.MaxBlockRange == 0 {
+		return 10_000
+	}
+	return s.MaxBlockRange
+}
+
+// indexedBlock is a row of referral_indexer_block
+type indexedBlock struct {
+	Nr   uint64
+	Hash string
+	// payment transactions of the broker in the block
+	TxHashes []string
+}
+
+// RunIndexer indexes the payment events of the broker and follows the
+// chain head
+func (a *App) RunIndexer() {
+	slog.Info("Starting payment indexer for broker " + a.Settings.BrokerId)
+	for {
+		caughtUp, err := a.IndexPayments()
+		if err != nil {
+			slog.Error("Payment indexer: " + err.Error())
+			a.countRpcError()
+			a.CreateRpcClient()
+		}
+		if err != nil || caughtUp {
+			time.Sleep(a.Settings.Indexer.pollInterval())
+		}
+	}
+}
+
+// IndexPayments processes the next block range of payment events and
+// returns true if the indexer reached the head minus the confirmations
+func (a *App) IndexPayments() (bool, error) {
+	a.indexMu.Lock()
+	defer a.indexMu.Unlock()
+	client := a.rpcClient()
+	head, err := client.BlockNumber(context.Background())
+	if err != nil {
+		return false, errors.New("IndexPayments: " + err.Error())
+	}
+	metrics.IndexerBlock.WithLabelValues(a.chainLabel(), a.Settings.BrokerId, "head").Set(float64(head))
+	confirmations := a.Settings.Indexer.confirmations()
+	if head < confirmations {
+		return true, nil
+	}
+	safe := head - confirmations
+	var from uint64
+	checkpoint, err := a.dbGetIndexerCheckpoint()
+	switch {
+	case err == sql.ErrNoRows:
+		from, err = a.indexerStartBlock()
+		if err != nil {
+			return false, err
+		}
+	case err != nil:
+		return false, err
+	default:
+		if checkpoint.Hash != "" {
+			hash, err := blockHashAt(client, checkpoint.Nr)
+			if err != nil {
+				return false, errors.New("IndexPayments: " + err.Error())
+			}
+			if hash != checkpoint.Hash {
+				return false, a.rollbackReorg(client)
+			}
+		}
+		from = checkpoint.Nr + 1
+	}
+	to, ok := nextIndexRange(from, safe, a.Settings.Indexer.maxBlockRange())
+	if !ok {
+		return true, nil
+	}
+	logs, err := a.filterBrokerPayments(from, to)
+	if err != nil {
+		return false, err
+	}
+	err = a.savePaymentLogs(logs)
+	if err != nil {
+		return false, err
+	}
+	toHash, err := blockHashAt(client, to)
+	if err != nil {
+		return false, errors.New("IndexPayments: " + err.Error())
+	}
+	err = a.dbInsertIndexedBlocks(a.indexedBlocks(to, toHash, logs))
+	if err != nil {
+		return false, err
+	}
+	if len(logs) > 0 {
+		slog.Info("Indexed " + strconv.Itoa(len(logs)) + " payments in blocks " + strconv.FormatUint(from, 10) +
+			" to " + strconv.FormatUint(to, 10))
+	}
+	metrics.IndexerBlock.WithLabelValues(a.chainLabel(), a.Settings.BrokerId, "checkpoint").Set(float64(to))
+	return to == safe, nil
+}
+
+// indexedBlocks returns the last block of an indexed range and the
+// blocks with payment events, with the transactions of the broker's
+// payments (see savePaymentLogs)
+func (a *App) indexedBlocks(to uint64, toHash string, logs []PaymentLog) []indexedBlock {
+	blocks := []indexedBlock{{Nr: to, Hash: toHash}}
+	idx := map[uint64]int{to: 0}
+	for _, p := range logs {
+		k, exists := idx[p.BlockNumber]
+		if !exists {
+			k = len(blocks)
+			idx[p.BlockNumber] = k
+			blocks = append(blocks, indexedBlock{Nr: p.BlockNumber, Hash: p.BlockHash})
+		}
+		if p.BrokerId != "" && p.BrokerId != a.Settings.BrokerId {
+			continue
+		}
+		if !slices.Contains(blocks[k].TxHashes, p.TxHash) {
+			blocks[k].TxHashes = append(blocks[k].TxHashes, p.TxHash)
+		}
+	}
+	return blocks
+}
+
+// readPayments stores the on-chain payments before a batch: the indexer
+// catches up with the head, without indexer the lookback is scanned
+func (a *App) readPayments() error {
+	if !a.Settings.Indexer.Enabled {
+		return a.SavePayments()
+	}
+	for {
+		caughtUp, err := a.IndexPayments()
+		if err != nil || caughtUp {
+			return err
+		}
+	}
+}
+
+// nextIndexRange returns the last block of the range that starts at
+// from, false if from is beyond safe
+func nextIndexRange(from, safe, maxRange uint64) (uint64, bool) {
+	if from > safe {
+		return 0, false
+	}
+	to := from + maxRange - 1
+	if to > safe {
+		to = safe
+	}
+	return to, true
+}
+
+// indexerStartBlock is the first block of an empty index: the MultiPay
+// deployment or the start of the payment lookback
+func (a *App) indexerStartBlock() (uint64, error) {
+	if a.Settings.Indexer.DeploymentBlock > 0 {
+		return a.Settings.Indexer.DeploymentBlock, nil
+	}
+	tsStart := time.Now().Unix() - int64(a.Settings.PaymentMaxLookBackDays*86400)
+	block, _, err := contracts.FindBlockWithTs(a.rpcClient(), uint64(tsStart))
+	if err != nil {
+		return 0, errors.New("indexerStartBlock: " + err.Error())
+	}
+	return block, nil
+}
+
+// filterBrokerPayments returns the payment events of the broker in the
+// blocks from to to (inclusive)
+func (a *App) filterBrokerPayments(from, to uint64) ([]PaymentLog, error) {
+	opts := &bind.FilterOpts{
+		Start:   from,
+		End:     &to,
+		Context: context.Background(),
+	}
+	broker := []common.Address{common.HexToAddress(a.BrokerAddr)}
+	it, err := a.MultipayCtrct.FilterPayment(opts, broker, []uint32{}, []common.Address{})
+	if err != nil {
+		return nil, errors.New("filterBrokerPayments: " + err.Error())
+	}
+	defer it.Close()
+	var logs []PaymentLog
+	processMultiPayEvents(a.rpcClient(), it, &logs, NewTokenBucket(15, 20))
+	if it.Error() != nil {
+		return nil, errors.New("filterBrokerPayments: " + it.Error().Error())
+	}
+	return logs, nil
+}
+
+// rollbackReorg finds the latest indexed block that is still part of the
+// chain and rolls back the payments of the blocks after it: they are set
+// unconfirmed and indexed again if their transactions are included in
+// the new blocks, otherwise purged to the failed payments
+func (a *App) rollbackReorg(client *ethclient.Client) error {
+	blocks, err := a.dbGetIndexedBlocks()
+	if err != nil {
+		return err
+	}
+	ancestor, err := findCommonAncestor(blocks, func(nr uint64) (string, error) {
+		return blockHashAt(client, nr)
+	})
+	if err != nil {
+		return errors.New("rollbackReorg: " + err.Error())
+	}
+	slog.Warn("Reorg detected, rolling back indexed payments after block " + strconv.FormatUint(ancestor.Nr, 10))
+	metrics.IndexerReorgs.WithLabelValues(a.chainLabel(), a.Settings.BrokerId).Inc()
+	tx, err := a.Db.Begin()
+	if err != nil {
+		return errors.New("rollbackReorg: " + err.Error())
+	}
+	defer tx.Rollback()
+	// other brokers can pay from the same address, only the payments
+	// this broker indexed are rolled back
+	query := `UPDATE referral_payment rp
+		SET tx_confirmed = false, block_nr = NULL
+		FROM referral_indexer_block ib
+		WHERE ib.broker_id = $3 AND ib.block_nr > $2
+			AND rp.block_nr = ib.block_nr
+			AND rp.tx_hash = ANY(string_to_array(ib.tx_hashes, ','))
+			AND lower(rp.broker_addr) = lower($1)`
+	res, err := tx.Exec(query, a.BrokerAddr, ancestor.Nr, a.Settings.BrokerId)
+	if err != nil {
+		return errors.New("rollbackReorg: " + err.Error())
+	}
+	query = `DELETE FROM referral_indexer_block WHERE broker_id = $1 AND block_nr > $2`
+	_, err = tx.Exec(query, a.Settings.BrokerId, ancestor.Nr)
+	if err != nil {
+		return errors.New("rollbackReorg: " + err.Error())
+	}
+	query = `INSERT INTO referral_indexer_block (broker_id, block_nr, block_hash)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (broker_id, block_nr) DO UPDATE SET block_hash = EXCLUDED.block_hash`
+	_, err = tx.Exec(query, a.Settings.BrokerId, ancestor.Nr, ancestor.Hash)
+	if err != nil {
+		return errors.New("rollbackReorg: " + err.Error())
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		slog.Info("Rolled back " + strconv.FormatInt(n, 10) + " payments")
+	}
+	return tx.Commit()
+}
+
+// findCommonAncestor returns the latest of the indexed blocks (sorted
+// by block number) whose hash is unchanged. If none is unchanged, the
+// indexer continues before the oldest block, with unknown hash.
+func findCommonAncestor(blocks []indexedBlock, hashAt func(uint64) (string, error)) (indexedBlock, error) {
+	for k := len(blocks) - 1; k >= 0; k-- {
+		if blocks[k].Hash == "" {
+			return blocks[k], nil
+		}
+		hash, err := hashAt(blocks[k].Nr)
+		if err != nil {
+			return indexedBlock{}, err
+		}
+		if hash == blocks[k].Hash {
+			return blocks[k], nil
+		}
+	}
+	if len(blocks) == 0 || blocks[0].Nr == 0 {
+		return indexedBlock{}, nil
+	}
+	return indexedBlock{Nr: blocks[0].Nr - 1}, nil
+}
+
+// blockHashAt returns the hash of block nr as reported by the rpc
+// (headers of L2 chains do not hash like L1 headers)
+func blockHashAt(client *ethclient.Client, nr uint64) (string, error) {
+	var header struct {
+		Hash common.Hash `json:"hash"`
+	}
+	err := client.Client().CallContext(context.Background(), &header, "eth_getBlockByNumber", hexutil.EncodeUint64(nr), false)
+	if err != nil {
+		return "", err
+	}
+	if header.Hash == (common.Hash{}) {
+		return "", errors.New("block " + strconv.FormatUint(nr, 10) + " not found")
+	}
+	return header.Hash.Hex(), nil
+}
+
+// BackfillPayments restarts the indexer at the MultiPay deployment and
+// indexes the payment events up to the head
+func (a *App) BackfillPayments() error {
+	if a.Settings.Indexer.DeploymentBlock == 0 {
+		return errors.New("indexer deploymentBlock not configured")
+	}
+	a.indexMu.Lock()
+	query := `DELETE FROM referral_indexer_block WHERE broker_id = $1`
+	_, err := a.Db.Exec(query, a.Settings.BrokerId)
+	a.indexMu.Unlock()
+	if err != nil {
+		return errors.New("BackfillPayments: " + err.Error())
+	}
+	slog.Info("Payment indexer restarts at block " + strconv.FormatUint(a.Settings.Indexer.DeploymentBlock, 10))
+	for {
+		caughtUp, err := a.IndexPayments()
+		if err != nil || caughtUp {
+			return err
+		}
+	}
+}
+
+// dbGetIndexerCheckpoint returns the latest indexed block,
+// sql.ErrNoRows if the indexer has not started
+func (a *App) dbGetIndexerCheckpoint() (indexedBlock, error) {
+	query := `SELECT block_nr, block_hash FROM referral_indexer_block
+		WHERE broker_id = $1
+		ORDER BY block_nr DESC
+		LIMIT 1`
+	var b indexedBlock
+	err := a.Db.QueryRow(query, a.Settings.BrokerId).Scan(&b.Nr, &b.Hash)
+	if err != nil && err != sql.ErrNoRows {
+		return b, errors.New("dbGetIndexerCheckpoint: " + err.Error())
+	}
+	return b, err
+}
+
+// dbGetIndexedBlocks returns the kept blocks sorted by block number
+func (a *App) dbGetIndexedBlocks() ([]indexedBlock, error) {
+	query := `SELECT block_nr, block_hash FROM referral_indexer_block
+		WHERE broker_id = $1
+		ORDER BY block_nr`
+	rows, err := a.Db.Query(query, a.Settings.BrokerId)
+	if err != nil {
+		return nil, errors.New("dbGetIndexedBlocks: " + err.Error())
+	}
+	defer rows.Close()
+	var res []indexedBlock
+	for rows.Next() {
+		var b indexedBlock
+		rows.Scan(&b.Nr, &b.Hash)
+		res = append(res, b)
+	}
+	return res, nil
+}
+
+// dbInsertIndexedBlocks stores the indexed blocks and removes all but
+// the latest INDEXER_KEEP_BLOCKS
+func (a *App) dbInsertIndexedBlocks(blocks []indexedBlock) error {
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Nr < blocks[j].Nr
+	})
+	tx, err := a.Db.Begin()
+	if err != nil {
+		return errors.New("dbInsertIndexedBlocks: " + err.Error())
+	}
+	defer tx.Rollback()
+	query := `INSERT INTO referral_indexer_block (broker_id, block_nr, block_hash, tx_hashes)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (broker_id, block_nr) DO UPDATE
+		SET block_hash = EXCLUDED.block_hash, tx_hashes = EXCLUDED.tx_hashes`
+	for _, b := range blocks {
+		_, err = tx.Exec(query, a.Settings.BrokerId, b.Nr, b.Hash, strings.Join(b.TxHashes, ","))
+		if err != nil {
+			return errors.New("dbInsertIndexedBlocks: " + err.Error())
+		}
+	}
+	query = `DELETE FROM referral_indexer_block
+		WHERE broker_id = $1 AND block_nr < (
+			SELECT MIN(block_nr) FROM (
+				SELECT block_nr FROM referral_indexer_block
+				WHERE broker_id = $1
+				ORDER BY block_nr DESC
+				LIMIT $2) latest)`
+	_, err = tx.Exec(query, a.Settings.BrokerId, INDEXER_KEEP_BLOCKS)
+	if err != nil {
+		return errors.New("dbInsertIndexedBlocks: " + err.Error())
+	}
+	return tx.Commit()
+}
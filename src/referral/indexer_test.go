@@ -0,0 +1,46 @@
+package referral
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNextIndexRange(t *testing.T) {
+	if _, ok := nextIndexRange(101, 100, 10); ok {
+		t.Errorf("expected no range beyond the safe block")
+	}
+	if to, ok := nextIndexRange(100, 100, 10); !ok || to != 100 {
+		t.Errorf("expected range to 100, got %d", to)
+	}
+	if to, ok := nextIndexRange(50, 100, 10); !ok || to != 59 {
+		t.Errorf("expected range to 59, got %d", to)
+	}
+}
+
+func TestFindCommonAncestor(t *testing.T) {
+	blocks := []indexedBlock{{Nr: 10, Hash: "0xa"}, {Nr: 20, Hash: "0xb"}, {Nr: 30, Hash: "0xc"}}
+	chain := map[uint64]string{10: "0xa", 20: "0xb", 30: "0xc"}
+	hashAt := func(nr uint64) (string, error) {
+		if h, exists := chain[nr]; exists {
+			return h, nil
+		}
+		return "", errors.New("not found")
+	}
+	// blocks 20 and 30 reorged
+	chain[20], chain[30] = "0xb2", "0xc2"
+	b, err := findCommonAncestor(blocks, hashAt)
+	if err != nil || b.Nr != 10 {
+		t.Errorf("expected ancestor 10, got %d (%v)", b.Nr, err)
+	}
+	// all reorged: continue before the oldest block
+	chain[10] = "0xa2"
+	b, err = findCommonAncestor(blocks, hashAt)
+	if err != nil || b.Nr != 9 || b.Hash != "" {
+		t.Errorf("expected block 9 without hash, got %+v (%v)", b, err)
+	}
+	// rpc errors are returned
+	delete(chain, 30)
+	if _, err = findCommonAncestor(blocks, hashAt); err == nil {
+		t.Errorf("expected error")
+	}
+}
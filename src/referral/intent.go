@@ -0,0 +1,166 @@
+package referral
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// status of a payment intent, see referral_payment_intent
+const (
+	INTENT_PENDING   = "pending"   // recorded, no transaction signed
+	INTENT_SUBMITTED = "submitted" // transaction signed and possibly sent
+	INTENT_MINED     = "mined"     // transaction successfully mined
+	INTENT_FAILED    = "failed"    // transaction reverted or not sent
+)
+
+type DbPaymentIntent struct {
+	Status string
+	TxHash string
+	Digest string
+}
+
+// checkPaymentIntent returns true if payment p of the given batch can be
+// submitted. A submitted payment is checked on-chain: if it was mined it is
+// written to the database instead of being paid again.
+func (a *App) checkPaymentIntent(batchTs string, p PaymentExecution) (bool, error) {
+	intent, err := a.dbGetPaymentIntent(batchTs, p)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	switch intent.Status {
+	case INTENT_MINED:
+		slog.Info("Payment for trader " + p.TraderAddr + " already mined in tx " + intent.TxHash)
+		return false, nil
+	case INTENT_PENDING, INTENT_FAILED:
+		return true, nil
+	}
+	// submitted: the transaction may be on-chain
+	slog.Info("Checking submitted payment tx " + intent.TxHash + " for trader " + p.TraderAddr)
+	// the transaction may have been replaced with higher fees
+	receipt, minedHash := a.queryTxFamilyReceipt(intent.TxHash)
+	switch receiptTxStatus(receipt) {
+	case TxConfirmed:
+		// write the amounts of the mined payment events, the re-planned
+		// payment p can differ from what was paid
+		logs, err := a.receiptPaymentLogs(receipt)
+		if err != nil {
+			return false, errors.New("could not read payments of tx " + minedHash + ": " + err.Error())
+		}
+		if err := a.savePaymentLogs(logs); err != nil {
+			return false, err
+		}
+		a.dbSettleAccruals(batchTs, p)
+		return false, a.dbSetPaymentIntentStatus(batchTs, p, INTENT_MINED)
+	case TxFailed:
+		return true, a.dbSetPaymentIntentStatus(batchTs, p, INTENT_FAILED)
+	}
+	for _, h := range a.dbGetTxFamily(intent.TxHash) {
+		_, isPending, err := a.rpcClient().TransactionByHash(context.Background(), common.HexToHash(h))
+		if err == nil && isPending {
+			return false, errors.New("payment tx " + h + " still pending")
+		}
+	}
+	if intent.Digest != "" {
+		// the payment could have been executed by another transaction
+		executed, err := a.MultipayCtrct.ExecutedPaymentDigests(&bind.CallOpts{}, common.HexToHash(intent.Digest))
+		if err != nil {
+			return false, errors.New("could not query payment digest: " + err.Error())
+		}
+		if executed {
+			// the payment is written to the database when reading the onchain payments
+			slog.Info("Payment digest " + intent.Digest + " already executed for trader " + p.TraderAddr)
+			a.dbSettleAccruals(batchTs, p)
+			return false, a.dbSetPaymentIntentStatus(batchTs, p, INTENT_MINED)
+		}
+	}
+	slog.Info("Payment tx " + intent.TxHash + " not found, resubmitting")
+	return true, nil
+}
+
+// paymentSignedFunc returns the PaymentSigned callback that records the
+// signed transaction for the payments it contains before it is sent and
+// settles the carried fees they include
+func (a *App) paymentSignedFunc(batchTs string, payments ...PaymentExecution) PaymentSigned {
+	return func(tx *types.Transaction, digest common.Hash) error {
+		var digestHex string
+		if digest != (common.Hash{}) {
+			digestHex = digest.Hex()
+		}
+		for _, p := range payments {
+			err := a.dbSetPaymentIntent(batchTs, p, INTENT_SUBMITTED, tx.Hash().Hex(), digestHex)
+			if err != nil {
+				return err
+			}
+			// the payment includes the carried fees, also if its
+			// receipt is not awaited
+			err = a.dbSettleAccruals(batchTs, p)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func (a *App) dbGetPaymentIntent(batchTs string, p PaymentExecution) (DbPaymentIntent, error) {
+	query := `SELECT status, COALESCE(tx_hash, ''), COALESCE(digest, '')
+		FROM referral_payment_intent
+		WHERE broker_id=$1 AND batch_ts=$2 AND trader_addr=$3 AND pool_id=$4 AND code=$5`
+	var intent DbPaymentIntent
+	err := a.Db.QueryRow(query, a.Settings.BrokerId, batchTime(batchTs), strings.ToLower(p.TraderAddr), p.PoolId, p.Code).Scan(
+		&intent.Status, &intent.TxHash, &intent.Digest)
+	return intent, err
+}
+
+// dbSetPaymentIntent inserts or updates the intent for payment p
+func (a *App) dbSetPaymentIntent(batchTs string, p PaymentExecution, status, txHash, digest string) error {
+	query := `INSERT INTO referral_payment_intent
+			(broker_id, batch_ts, trader_addr, pool_id, code, status, tx_hash, digest, last_trade_considered_ts)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''), $9)
+		ON CONFLICT (broker_id, batch_ts, trader_addr, pool_id, code) DO UPDATE
+		SET status = EXCLUDED.status,
+			tx_hash = EXCLUDED.tx_hash,
+			digest = EXCLUDED.digest,
+			last_trade_considered_ts = COALESCE(EXCLUDED.last_trade_considered_ts, referral_payment_intent.last_trade_considered_ts),
+			updated_ts = CURRENT_TIMESTAMP`
+	var lastTrade sql.NullTime
+	if !p.LastTradeConsidered.IsZero() {
+		lastTrade = sql.NullTime{Time: p.LastTradeConsidered, Valid: true}
+	}
+	_, err := a.Db.Exec(query, a.Settings.BrokerId, batchTime(batchTs), strings.ToLower(p.TraderAddr), p.PoolId, p.Code,
+		status, txHash, digest, lastTrade)
+	if err != nil {
+		slog.Error("could not set payment intent to " + status + " for trader " + p.TraderAddr + ": " + err.Error())
+	}
+	return err
+}
+
+// dbSetPaymentIntentStatus updates the status of the intent for payment p
+func (a *App) dbSetPaymentIntentStatus(batchTs string, p PaymentExecution, status string) error {
+	query := `UPDATE referral_payment_intent
+		SET status = $6, updated_ts = CURRENT_TIMESTAMP
+		WHERE broker_id=$1 AND batch_ts=$2 AND trader_addr=$3 AND pool_id=$4 AND code=$5`
+	_, err := a.Db.Exec(query, a.Settings.BrokerId, batchTime(batchTs), strings.ToLower(p.TraderAddr), p.PoolId, p.Code, status)
+	if err != nil {
+		slog.Error("could not set payment intent to " + status + " for trader " + p.TraderAddr + ": " + err.Error())
+	}
+	return err
+}
+
+// batchTime converts the batch timestamp string into time
+func batchTime(batchTs string) time.Time {
+	t, _ := strconv.Atoi(batchTs)
+	return time.Unix(int64(t), 0)
+}
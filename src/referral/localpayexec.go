@@ -0,0 +1,150 @@
+package referral
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"math/big"
+	"referral-system/env"
+	"referral-system/src/contracts"
+	"time"
+
+	"github.com/D8-X/d8x-futures-go-sdk/pkg/d8x_futures"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/spf13/viper"
+)
+
+// LocalPayExec signs payments with a locally held broker key instead of
+// requesting the signature from a remote broker. Without a separate broker
+// key the executor is the payer and pays via MultiPay.Pay directly; in this
+// case the executor needs to approve the MultiPay contract to spend the
+// margin tokens.
+type LocalPayExec struct {
+	basePayExec
+	BrokerPrivKey *ecdsa.PrivateKey
+}
+
+func (exc *LocalPayExec) Init(viper *viper.Viper, multiPayAddr string) error {
+	exc.ChainId = viper.GetInt64(env.CHAIN_ID)
+	exc.MultipayCtrctAddr = multiPayAddr
+	pk, err := crypto.HexToECDSA(viper.GetString(env.BROKER_KEY))
+	if err != nil {
+		return err
+	}
+	exc.ExecPrivKey = pk
+	exc.BrokerPrivKey = pk
+	if k := viper.GetString(env.LOCAL_BROKER_KEY); k != "" {
+		brokerPk, err := crypto.HexToECDSA(k)
+		if err != nil {
+			return errors.New("invalid local broker key: " + err.Error())
+		}
+		exc.BrokerPrivKey = brokerPk
+	}
+	addr, err := privateKeyToAddress(exc.BrokerPrivKey)
+	if err != nil {
+		return err
+	}
+	exc.BrokerAddr = common.HexToAddress(addr)
+	if exc.isDirectPay() {
+		slog.Info("local payment executor pays directly from executor " + addr)
+	} else {
+		slog.Info("local payment executor signs for broker " + addr)
+	}
+	return nil
+}
+
+// isDirectPay is true if executor and payer are the same
+func (exc *LocalPayExec) isDirectPay() bool {
+	return exc.BrokerPrivKey.Equal(exc.ExecPrivKey)
+}
+
+func (exc *LocalPayExec) TransactPayment(tokenAddr common.Address,
+	total *big.Int,
+	amounts []*big.Int,
+	payees []common.Address,
+	id int64,
+	msg,
+	code string,
+	rpc *ethclient.Client,
+	onSigned PaymentSigned) (common.Hash, error) {
+
+	logPaymentIntent(tokenAddr, amounts, payees, id, msg, code)
+	if len(amounts) != len(payees) {
+		return common.Hash{}, errors.New("#amounts must be equal to #payees")
+	}
+	if exc.isDirectPay() {
+		txHash, err := exc.directPay(tokenAddr, amounts, payees, id, msg, onSigned)
+		if err != nil {
+			slog.Error("Unable to pay:" + err.Error())
+			return common.Hash{}, err
+		}
+		slog.Info("Payment submitted tx hash = " + txHash.Hex())
+		return txHash, nil
+	}
+	execAddr, _ := privateKeyToAddress(exc.ExecPrivKey)
+	payment := d8x_futures.PaySummary{
+		Payer:         exc.BrokerAddr,
+		Executor:      common.HexToAddress(execAddr),
+		Token:         tokenAddr,
+		Timestamp:     uint32(time.Now().Unix()),
+		Id:            uint32(id),
+		TotalAmount:   total,
+		ChainId:       exc.ChainId,
+		MultiPayCtrct: common.HexToAddress(exc.MultipayCtrctAddr),
+	}
+	brokerWallet, err := d8x_futures.NewWallet(hex.EncodeToString(crypto.FromECDSA(exc.BrokerPrivKey)), exc.ChainId, rpc)
+	if err != nil {
+		return common.Hash{}, errors.New("error creating wallet:" + err.Error())
+	}
+	dgst, sig, err := d8x_futures.RawCreatePaymentBrokerSignature(&payment, brokerWallet)
+	if err != nil {
+		return common.Hash{}, errors.New("error creating signature:" + err.Error())
+	}
+	digest, err := sdkPaymentDigest(dgst)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	txHash, err := exc.Pay(payment, digest, sig, amounts, payees, msg, onSigned)
+	if err != nil {
+		slog.Error("Unable to pay:" + err.Error())
+		return common.Hash{}, err
+	}
+	slog.Info("Payment submitted tx hash = " + txHash.Hex())
+	return txHash, nil
+}
+
+// directPay executes the payment via MultiPay.Pay with the
+// executor as payer
+func (exc *LocalPayExec) directPay(tokenAddr common.Address, amounts []*big.Int, payees []common.Address, id int64, msg string, onSigned PaymentSigned) (txHash common.Hash, err error) {
+	exc.RPCTokenBucket.WaitForToken("auth", false)
+	auth, err := exc.CreateAuth()
+	if err != nil {
+		slog.Error("Pay: Could not create auth: " + err.Error())
+		return common.Hash{}, err
+	}
+	defer func() {
+		if err != nil {
+			exc.releaseNonce(auth.Nonce.Uint64(), err)
+		}
+	}()
+	mpay, err := contracts.NewMultiPay(common.HexToAddress(exc.MultipayCtrctAddr), exc.client())
+	if err != nil {
+		return common.Hash{}, errors.New("Failed to instantiate Proxy contract: " + err.Error())
+	}
+	auth.GasLimit = 5000000
+	auth.NoSend = true
+	exc.RPCTokenBucket.WaitForToken("Pay", false)
+	tx, err := mpay.Pay(auth, uint32(id), tokenAddr, amounts, payees, msg)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	// direct payments are not registered by digest
+	err = exc.sendSigned(tx, common.Hash{}, onSigned)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return tx.Hash(), nil
+}
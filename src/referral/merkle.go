@@ -0,0 +1,115 @@
+package referral
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// ClaimLeaf is a leaf of a claim tree: Payee can claim up to
+// CumulativeAmount (decimal-N) of Token in total
+type ClaimLeaf struct {
+	Payee            common.Address
+	Token            common.Address
+	CumulativeAmount *big.Int
+}
+
+// Hash returns the leaf hash keccak256(keccak256(abi.encode(payee, token,
+// cumulativeAmount))), the leaf encoding of OpenZeppelin's StandardMerkleTree
+func (l ClaimLeaf) Hash() common.Hash {
+	enc := make([]byte, 0, 96)
+	enc = append(enc, common.LeftPadBytes(l.Payee.Bytes(), 32)...)
+	enc = append(enc, common.LeftPadBytes(l.Token.Bytes(), 32)...)
+	enc = append(enc, common.LeftPadBytes(l.CumulativeAmount.Bytes(), 32)...)
+	return crypto.Keccak256Hash(crypto.Keccak256(enc))
+}
+
+// hashPair hashes two nodes in sorted order, as OpenZeppelin's
+// MerkleProof.verify expects
+func hashPair(a, b common.Hash) common.Hash {
+	if bytes.Compare(a.Bytes(), b.Bytes()) > 0 {
+		a, b = b, a
+	}
+	return crypto.Keccak256Hash(a.Bytes(), b.Bytes())
+}
+
+// merkleTree is a merkle tree of claim leaves. Leaves are sorted by
+// hash, a node without sibling is moved up unchanged.
+type merkleTree struct {
+	leaves []ClaimLeaf
+	// layers[0] are the leaf hashes, the last layer is the root
+	layers [][]common.Hash
+}
+
+func newMerkleTree(leaves []ClaimLeaf) *merkleTree {
+	t := &merkleTree{leaves: append([]ClaimLeaf(nil), leaves...)}
+	hashes := make([]common.Hash, len(t.leaves))
+	for k, l := range t.leaves {
+		hashes[k] = l.Hash()
+	}
+	sort.Sort(byHash{t.leaves, hashes})
+	t.layers = [][]common.Hash{hashes}
+	for layer := hashes; len(layer) > 1; {
+		next := make([]common.Hash, 0, (len(layer)+1)/2)
+		for k := 0; k < len(layer); k += 2 {
+			if k+1 == len(layer) {
+				next = append(next, layer[k])
+				continue
+			}
+			next = append(next, hashPair(layer[k], layer[k+1]))
+		}
+		t.layers = append(t.layers, next)
+		layer = next
+	}
+	return t
+}
+
+// Root returns the root of the tree, zero for an empty tree
+func (t *merkleTree) Root() common.Hash {
+	top := t.layers[len(t.layers)-1]
+	if len(top) == 0 {
+		return common.Hash{}
+	}
+	return top[0]
+}
+
+// proof returns the sibling hashes from leaf k to the root
+func (t *merkleTree) proof(k int) []common.Hash {
+	var proof []common.Hash
+	for _, layer := range t.layers[:len(t.layers)-1] {
+		sibling := k ^ 1
+		if sibling < len(layer) {
+			proof = append(proof, layer[sibling])
+		}
+		k /= 2
+	}
+	return proof
+}
+
+// byHash sorts leaves and their hashes by hash
+type byHash struct {
+	leaves []ClaimLeaf
+	hashes []common.Hash
+}
+
+func (s byHash) Len() int { return len(s.hashes) }
+func (s byHash) Less(i, j int) bool {
+	return bytes.Compare(s.hashes[i].Bytes(), s.hashes[j].Bytes()) < 0
+}
+func (s byHash) Swap(i, j int) {
+	s.leaves[i], s.leaves[j] = s.leaves[j], s.leaves[i]
+	s.hashes[i], s.hashes[j] = s.hashes[j], s.hashes[i]
+}
+
+// VerifyClaim returns true if proof proves that leaf is part of the
+// claim tree with the given root
+func VerifyClaim(root common.Hash, leaf ClaimLeaf, proof []common.Hash) bool {
+	h := leaf.Hash()
+	for _, sibling := range proof {
+		h = hashPair(h, sibling)
+	}
+	return h == root
+}
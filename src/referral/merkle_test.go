@@ -0,0 +1,49 @@
+package referral
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestMerkleTree(t *testing.T) {
+	token := common.HexToAddress("0x0000000000000000000000000000000000000b0b")
+	if root := newMerkleTree(nil).Root(); root != (common.Hash{}) {
+		t.Errorf("expected zero root of empty tree, got %s", root.Hex())
+	}
+	var leaves []ClaimLeaf
+	for n := 1; n <= 7; n++ {
+		leaves = append(leaves, ClaimLeaf{
+			Payee:            common.BigToAddress(big.NewInt(int64(0xa0 + n))),
+			Token:            token,
+			CumulativeAmount: big.NewInt(int64(1000 * n)),
+		})
+		tree := newMerkleTree(leaves)
+		if n == 1 && tree.Root() != leaves[0].Hash() {
+			t.Errorf("expected root of single leaf tree to be the leaf hash")
+		}
+		for k, l := range tree.leaves {
+			if !VerifyClaim(tree.Root(), l, tree.proof(k)) {
+				t.Fatalf("%d leaves: proof of leaf %d not valid", n, k)
+			}
+		}
+		// the tree does not depend on the order of the leaves
+		reversed := make([]ClaimLeaf, len(leaves))
+		for k, l := range leaves {
+			reversed[len(leaves)-1-k] = l
+		}
+		if newMerkleTree(reversed).Root() != tree.Root() {
+			t.Errorf("%d leaves: root depends on leaf order", n)
+		}
+	}
+	tree := newMerkleTree(leaves)
+	forged := tree.leaves[2]
+	forged.CumulativeAmount = new(big.Int).Add(forged.CumulativeAmount, big.NewInt(1))
+	if VerifyClaim(tree.Root(), forged, tree.proof(2)) {
+		t.Errorf("expected proof of forged amount to be invalid")
+	}
+	if VerifyClaim(tree.Root(), tree.leaves[2], tree.proof(3)) {
+		t.Errorf("expected proof of another leaf to be invalid")
+	}
+}
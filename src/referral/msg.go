@@ -1,10 +1,16 @@
 package referral
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"math/big"
 	"math/rand"
 	"regexp"
 	"strconv"
 	"strings"
+
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
 // obstruction pad
@@ -139,3 +145,216 @@ func isV0Pattern(msg string) bool {
 	regex := regexp.MustCompile(pattern)
 	return regex.MatchString(msg)
 }
+
+// MANIFEST_VERSION is the encoding version of messages of
+// payments that pay several traders in one transaction
+const MANIFEST_VERSION = 2
+
+// manifestEntry is the payment of one trader in an aggregated
+// payment. PayeeIdx are the indices into the payees of the
+// transaction, ordered by level (trader first)
+type manifestEntry struct {
+	PoolId     uint32
+	Code       string
+	PayeeIdx   []int
+	AmountDecN []*big.Int
+}
+
+// encodeManifest encodes the onchain message of an aggregated payment
+// batchTs.<version>.<entry>|<entry>... where an entry is
+// <poolId>:<obstructed code>:<payeeIdx>=<amount>,... with base 36 amounts
+func encodeManifest(batchTs string, entries []manifestEntry) string {
+	encoded := make([]string, len(entries))
+	for k, e := range entries {
+		pays := make([]string, len(e.PayeeIdx))
+		for j := range e.PayeeIdx {
+			pays[j] = strconv.Itoa(e.PayeeIdx[j]) + "=" + e.AmountDecN[j].Text(36)
+		}
+		encoded[k] = strconv.Itoa(int(e.PoolId)) + ":" + obstructCode(e.Code) + ":" + strings.Join(pays, ",")
+	}
+	return batchTs + "." + strconv.Itoa(MANIFEST_VERSION) + "." + strings.Join(encoded, "|")
+}
+
+// decodeManifest decodes a message encoded with encodeManifest
+// into the batch timestamp and the entries
+func decodeManifest(msg string) (string, []manifestEntry, error) {
+	if !isV2Pattern(msg) {
+		return "", nil, errors.New("message is not a payment manifest")
+	}
+	s := strings.SplitN(msg, ".", 3)
+	var entries []manifestEntry
+	for _, enc := range strings.Split(s[2], "|") {
+		parts := strings.Split(enc, ":")
+		poolId, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return "", nil, errors.New("invalid pool id in manifest")
+		}
+		e := manifestEntry{PoolId: uint32(poolId), Code: deObstructCode(parts[1])}
+		for _, pay := range strings.Split(parts[2], ",") {
+			idxAmount := strings.Split(pay, "=")
+			idx, err := strconv.Atoi(idxAmount[0])
+			if err != nil {
+				return "", nil, errors.New("invalid payee index in manifest")
+			}
+			amount, ok := new(big.Int).SetString(idxAmount[1], 36)
+			if !ok {
+				return "", nil, errors.New("invalid amount in manifest")
+			}
+			e.PayeeIdx = append(e.PayeeIdx, idx)
+			e.AmountDecN = append(e.AmountDecN, amount)
+		}
+		entries = append(entries, e)
+	}
+	return s[0], entries, nil
+}
+
+func isV2Pattern(msg string) bool {
+	//batchTs.2.<poolId>:<code>:<idx>=<amount>,...|...
+	entry := `\d+:[A-Z0-9_-]+:\d+=[0-9a-z]+(,\d+=[0-9a-z]+)*`
+	pattern := `^\d+\.` + strconv.Itoa(MANIFEST_VERSION) + `\.` + entry + `(\|` + entry + `)*$`
+	regex := regexp.MustCompile(pattern)
+	return regex.MatchString(msg)
+}
+
+// PAYMENT_MSG_VERSION is the encoding version of the messages of new
+// payments: batchTs.<version>.<broker id>.<entry>|<entry>....<integrity checksum>
+// (version 2 are the manifests above)
+const PAYMENT_MSG_VERSION = 3
+
+// paymentMsg is a decoded onchain message
+type paymentMsg struct {
+	Version int
+	BatchTs string
+	// broker id, empty before version 3
+	BrokerId string
+	// payments per trader. A single entry without PayeeIdx pays all
+	// payees of the transaction (versions 0 and 1)
+	Entries []manifestEntry
+}
+
+// msgCodec decodes the messages of one encoding version
+type msgCodec struct {
+	version int
+	matches func(msg string) bool
+	decode  func(msg string) (paymentMsg, error)
+}
+
+// msgCodecs are the known message encodings, the latest first
+var msgCodecs = []msgCodec{
+	{version: PAYMENT_MSG_VERSION, matches: isV3Pattern, decode: decodePaymentMsgV3},
+	{version: MANIFEST_VERSION, matches: isV2Pattern, decode: decodeManifestMsg},
+	{version: ENCODING_VERSION, matches: isV1Pattern, decode: decodeSingleMsg},
+	{version: 0, matches: isV0Pattern, decode: decodeSingleMsg},
+}
+
+// decodePaymentMsg decodes an onchain message of any known version
+func decodePaymentMsg(msg string) (paymentMsg, error) {
+	for _, c := range msgCodecs {
+		if !c.matches(msg) {
+			continue
+		}
+		res, err := c.decode(msg)
+		res.Version = c.version
+		return res, err
+	}
+	return paymentMsg{}, errors.New("event message not in expected format")
+}
+
+// decodeSingleMsg decodes the message of a single payment (versions 0 and 1)
+func decodeSingleMsg(msg string) (paymentMsg, error) {
+	s := decodePaymentInfo(msg)
+	if s == nil {
+		return paymentMsg{}, errors.New("event message not in expected format")
+	}
+	poolId, err := strconv.Atoi(s[2])
+	if err != nil {
+		return paymentMsg{}, errors.New("event message pool id not in expected format")
+	}
+	return paymentMsg{BatchTs: s[0], Entries: []manifestEntry{{PoolId: uint32(poolId), Code: s[1]}}}, nil
+}
+
+// decodeManifestMsg decodes a manifest (version 2)
+func decodeManifestMsg(msg string) (paymentMsg, error) {
+	batchTs, entries, err := decodeManifest(msg)
+	return paymentMsg{BatchTs: batchTs, Entries: entries}, err
+}
+
+// encodePaymentMsg encodes the onchain message of the payments of a
+// broker. Codes and the broker id are base64url encoded, the integrity
+// checksum are the first 4 bytes of the keccak256 hash of the message
+// before it. The checksum only detects corrupted messages, it is not keyed
+// and does not authenticate the broker id (see isBrokerSender).
+func encodePaymentMsg(batchTs, brokerId string, entries []manifestEntry) string {
+	encoded := make([]string, len(entries))
+	for k, e := range entries {
+		pays := make([]string, len(e.PayeeIdx))
+		for j := range e.PayeeIdx {
+			pays[j] = strconv.Itoa(e.PayeeIdx[j]) + "=" + e.AmountDecN[j].Text(36)
+		}
+		encoded[k] = strconv.Itoa(int(e.PoolId)) + ":" + base64.RawURLEncoding.EncodeToString([]byte(e.Code)) + ":" +
+			strings.Join(pays, ",")
+	}
+	msg := batchTs + "." + strconv.Itoa(PAYMENT_MSG_VERSION) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(brokerId)) + "." + strings.Join(encoded, "|")
+	return msg + "." + msgIntegrityChecksum(msg)
+}
+
+// decodePaymentMsgV3 decodes a message encoded with encodePaymentMsg
+// and rejects it if the integrity checksum does not match
+func decodePaymentMsgV3(msg string) (paymentMsg, error) {
+	if !isV3Pattern(msg) {
+		return paymentMsg{}, errors.New("message is not a version 3 payment message")
+	}
+	idx := strings.LastIndex(msg, ".")
+	if msgIntegrityChecksum(msg[:idx]) != msg[idx+1:] {
+		return paymentMsg{}, errors.New("message integrity checksum mismatch")
+	}
+	s := strings.SplitN(msg[:idx], ".", 4)
+	brokerId, err := base64.RawURLEncoding.DecodeString(s[2])
+	if err != nil {
+		return paymentMsg{}, errors.New("invalid broker id in message")
+	}
+	res := paymentMsg{BatchTs: s[0], BrokerId: string(brokerId)}
+	for _, enc := range strings.Split(s[3], "|") {
+		parts := strings.Split(enc, ":")
+		poolId, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return paymentMsg{}, errors.New("invalid pool id in message")
+		}
+		code, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return paymentMsg{}, errors.New("invalid code in message")
+		}
+		e := manifestEntry{PoolId: uint32(poolId), Code: string(code)}
+		for _, pay := range strings.Split(parts[2], ",") {
+			idxAmount := strings.Split(pay, "=")
+			payeeIdx, err := strconv.Atoi(idxAmount[0])
+			if err != nil {
+				return paymentMsg{}, errors.New("invalid payee index in message")
+			}
+			amount, ok := new(big.Int).SetString(idxAmount[1], 36)
+			if !ok {
+				return paymentMsg{}, errors.New("invalid amount in message")
+			}
+			e.PayeeIdx = append(e.PayeeIdx, payeeIdx)
+			e.AmountDecN = append(e.AmountDecN, amount)
+		}
+		res.Entries = append(res.Entries, e)
+	}
+	return res, nil
+}
+
+// msgIntegrityChecksum returns the hex encoded first 4 bytes of the
+// keccak256 hash of msg. Anyone can compute it: it detects corrupted
+// messages, not forged ones
+func msgIntegrityChecksum(msg string) string {
+	return hex.EncodeToString(crypto.Keccak256([]byte(msg))[:4])
+}
+
+func isV3Pattern(msg string) bool {
+	//batchTs.3.<broker id>.<poolId>:<code>:<idx>=<amount>,...|....<integrity checksum>
+	entry := `\d+:[A-Za-z0-9_-]*:\d+=[0-9a-z]+(,\d+=[0-9a-z]+)*`
+	pattern := `^\d+\.` + strconv.Itoa(PAYMENT_MSG_VERSION) + `\.[A-Za-z0-9_-]*\.` + entry + `(\|` + entry + `)*\.[0-9a-f]{8}$`
+	regex := regexp.MustCompile(pattern)
+	return regex.MatchString(msg)
+}
@@ -2,7 +2,9 @@ package referral
 
 import (
 	"fmt"
+	"math/big"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -76,3 +78,91 @@ func TestEncodePatternInfo(t *testing.T) {
 		t.Error("pattern 0 failed")
 	}
 }
+
+func TestEncodeManifest(t *testing.T) {
+	entries := []manifestEntry{
+		{PoolId: 1, Code: "HELLO-123_", PayeeIdx: []int{0, 1, 2}, AmountDecN: []*big.Int{big.NewInt(0), big.NewInt(1_250_000), big.NewInt(36)}},
+		{PoolId: 3, Code: "DEFAULT", PayeeIdx: []int{3, 1}, AmountDecN: []*big.Int{big.NewInt(0), new(big.Int).Lsh(big.NewInt(1), 70)}},
+	}
+	msg := encodeManifest("1699702424", entries)
+	if isV1Pattern(msg) || isV0Pattern(msg) || decodePaymentInfo(msg) != nil {
+		t.Errorf("manifest %s must not match single payment patterns", msg)
+	}
+	batchTs, decoded, err := decodeManifest(msg)
+	if err != nil {
+		t.Fatalf("decode %s: %v", msg, err)
+	}
+	if batchTs != "1699702424" || len(decoded) != len(entries) {
+		t.Fatalf("unexpected manifest %s %+v", batchTs, decoded)
+	}
+	for k, e := range entries {
+		d := decoded[k]
+		if d.PoolId != e.PoolId || d.Code != e.Code || len(d.PayeeIdx) != len(e.PayeeIdx) {
+			t.Errorf("entry %d: expected %+v, got %+v", k, e, d)
+			continue
+		}
+		for j := range e.PayeeIdx {
+			if d.PayeeIdx[j] != e.PayeeIdx[j] || d.AmountDecN[j].Cmp(e.AmountDecN[j]) != 0 {
+				t.Errorf("entry %d payee %d: expected %d=%s, got %d=%s", k, j, e.PayeeIdx[j], e.AmountDecN[j], d.PayeeIdx[j], d.AmountDecN[j])
+			}
+		}
+	}
+	// single payment messages are no manifests
+	if _, _, err := decodeManifest(encodePaymentInfo("1699702424", "HELLO", 1)); err == nil {
+		t.Errorf("expected error for single payment message")
+	}
+}
+
+func TestEncodePaymentMsg(t *testing.T) {
+	entries := []manifestEntry{
+		{PoolId: 1, Code: "hello&^*.:|", PayeeIdx: []int{0, 1, 2}, AmountDecN: []*big.Int{big.NewInt(0), big.NewInt(1_250_000), big.NewInt(36)}},
+		{PoolId: 3, Code: "ÜBER-CODE", PayeeIdx: []int{3, 1}, AmountDecN: []*big.Int{big.NewInt(0), new(big.Int).Lsh(big.NewInt(1), 70)}},
+	}
+	msg := encodePaymentMsg("1699702424", "broker.1", entries)
+	if isV2Pattern(msg) || isV1Pattern(msg) || isV0Pattern(msg) {
+		t.Errorf("message %s must not match older patterns", msg)
+	}
+	decoded, err := decodePaymentMsg(msg)
+	if err != nil {
+		t.Fatalf("decode %s: %v", msg, err)
+	}
+	if decoded.Version != PAYMENT_MSG_VERSION || decoded.BatchTs != "1699702424" || decoded.BrokerId != "broker.1" {
+		t.Errorf("unexpected message %+v", decoded)
+	}
+	if len(decoded.Entries) != len(entries) {
+		t.Fatalf("expected %d entries, got %d", len(entries), len(decoded.Entries))
+	}
+	for k, e := range entries {
+		d := decoded.Entries[k]
+		if d.PoolId != e.PoolId || d.Code != e.Code || len(d.PayeeIdx) != len(e.PayeeIdx) {
+			t.Errorf("entry %d: expected %+v, got %+v", k, e, d)
+			continue
+		}
+		for j := range e.PayeeIdx {
+			if d.PayeeIdx[j] != e.PayeeIdx[j] || d.AmountDecN[j].Cmp(e.AmountDecN[j]) != 0 {
+				t.Errorf("entry %d payee %d: expected %d=%s, got %d=%s", k, j, e.PayeeIdx[j], e.AmountDecN[j], d.PayeeIdx[j], d.AmountDecN[j])
+			}
+		}
+	}
+	// tampered messages are rejected
+	tampered := strings.Replace(msg, ":0=0,1=", ":0=0,1=1", 1)
+	if _, err := decodePaymentMsg(tampered); err == nil {
+		t.Errorf("expected integrity checksum error for %s", tampered)
+	}
+
+	// older messages are decoded with their version
+	old := map[string]int{
+		"1699702424.ABRAKADABRA-_--7.1":             0,
+		encodePaymentInfo("1699702424", "HELLO", 2): ENCODING_VERSION,
+		encodeManifest("1699702424", []manifestEntry{{PoolId: 3, Code: "DEFAULT", PayeeIdx: []int{1}, AmountDecN: []*big.Int{big.NewInt(5)}}}): MANIFEST_VERSION,
+	}
+	for m, v := range old {
+		d, err := decodePaymentMsg(m)
+		if err != nil || d.Version != v || d.BatchTs != "1699702424" || d.BrokerId != "" {
+			t.Errorf("%s: expected version %d, got %+v (%v)", m, v, d, err)
+		}
+	}
+	if _, err := decodePaymentMsg("rubbish"); err == nil {
+		t.Errorf("expected error for invalid message")
+	}
+}
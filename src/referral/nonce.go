@@ -0,0 +1,161 @@
+package referral
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// nonceManager hands out the nonces of an executor on a chain. Nonces
+// are assigned locally so that several payments can be in flight at once,
+// the rpc is only queried to (re-)synchronize. Nonces of transactions that
+// could not be sent are reused first.
+type nonceManager struct {
+	mu     sync.Mutex
+	next   uint64
+	synced bool
+	// unused nonces below next, sorted
+	gaps []uint64
+	// nonces handed out whose transaction is not sent yet
+	inflight map[uint64]bool
+	// latest transaction sent per nonce, to re-broadcast
+	sent map[uint64]*types.Transaction
+}
+
+// nonceManagers holds a nonceManager per chain and executor address,
+// brokers served by one instance can share the executor
+var nonceManagers sync.Map
+
+// executorNonces returns the nonce manager of the executor on the chain
+func executorNonces(chainId int64, executor common.Address) *nonceManager {
+	key := strconv.FormatInt(chainId, 10) + ":" + strings.ToLower(executor.Hex())
+	nm, _ := nonceManagers.LoadOrStore(key, &nonceManager{
+		inflight: make(map[uint64]bool),
+		sent:     make(map[uint64]*types.Transaction),
+	})
+	return nm.(*nonceManager)
+}
+
+// acquire returns the nonce for the next transaction of the executor
+func (nm *nonceManager) acquire(client *ethclient.Client, executor common.Address) (uint64, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if !nm.synced {
+		pending, err := client.PendingNonceAt(context.Background(), executor)
+		if err != nil {
+			return 0, err
+		}
+		nm.sync(pending)
+	}
+	if len(nm.gaps) > 0 {
+		nonce := nm.gaps[0]
+		nm.gaps = nm.gaps[1:]
+		nm.inflight[nonce] = true
+		return nonce, nil
+	}
+	nonce := nm.next
+	nm.next++
+	nm.inflight[nonce] = true
+	return nonce, nil
+}
+
+// sync aligns the manager with the pending nonce of the rpc. We never
+// go back below nonces we handed out: transactions that a (new) rpc
+// does not know yet are re-broadcast or replaced when they time out.
+func (nm *nonceManager) sync(pending uint64) {
+	if pending > nm.next {
+		nm.next = pending
+	}
+	// nonces below pending are used by transactions the rpc knows
+	gaps := nm.gaps[:0]
+	for _, n := range nm.gaps {
+		if n >= pending {
+			gaps = append(gaps, n)
+		}
+	}
+	nm.gaps = gaps
+	nm.synced = true
+}
+
+// resync makes the manager query the rpc before it hands out the
+// next nonce, e.g. after an rpc failover
+func (nm *nonceManager) resync() {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	nm.synced = false
+}
+
+// release returns the nonce of a transaction that could not be sent
+// because of err
+func (nm *nonceManager) release(nonce uint64, err error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	delete(nm.inflight, nonce)
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "nonce too low"):
+		// used by a transaction we do not know of
+		nm.synced = false
+		return
+	case strings.Contains(msg, "already known") || strings.Contains(msg, "underpriced"):
+		// a transaction with this nonce is pending
+		return
+	}
+	if nonce >= nm.next {
+		return
+	}
+	idx := sort.Search(len(nm.gaps), func(k int) bool { return nm.gaps[k] >= nonce })
+	if idx < len(nm.gaps) && nm.gaps[idx] == nonce {
+		return
+	}
+	nm.gaps = append(nm.gaps, 0)
+	copy(nm.gaps[idx+1:], nm.gaps[idx:])
+	nm.gaps[idx] = nonce
+	// gaps at the end are not handed out yet
+	for len(nm.gaps) > 0 && nm.gaps[len(nm.gaps)-1] == nm.next-1 {
+		nm.gaps = nm.gaps[:len(nm.gaps)-1]
+		nm.next--
+	}
+}
+
+// sentTx records the latest transaction sent with its nonce
+func (nm *nonceManager) sentTx(tx *types.Transaction) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	delete(nm.inflight, tx.Nonce())
+	nm.sent[tx.Nonce()] = tx
+}
+
+// outstanding returns the gaps from mined on and the transactions we
+// sent with the other nonces from mined on. Returned gaps are no longer
+// handed out.
+func (nm *nonceManager) outstanding(mined uint64) ([]uint64, []*types.Transaction) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	var unsent []uint64
+	var sent []*types.Transaction
+	gaps := make(map[uint64]bool, len(nm.gaps))
+	for _, n := range nm.gaps {
+		gaps[n] = true
+	}
+	for n := mined; n < nm.next; n++ {
+		if gaps[n] {
+			unsent = append(unsent, n)
+		} else if tx, exists := nm.sent[n]; exists && !nm.inflight[n] {
+			sent = append(sent, tx)
+		}
+	}
+	for n := range nm.sent {
+		if n < mined {
+			delete(nm.sent, n)
+		}
+	}
+	nm.gaps = nil
+	return unsent, sent
+}
@@ -0,0 +1,79 @@
+package referral
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestNonceManager(t *testing.T) {
+	nm := &nonceManager{inflight: make(map[uint64]bool)}
+	nm.sync(5)
+	for _, expected := range []uint64{5, 6, 7} {
+		if n, _ := nm.acquire(nil, common.Address{}); n != expected {
+			t.Fatalf("expected nonce %d, got %d", expected, n)
+		}
+	}
+	// unsent nonce below the last one is reused first
+	nm.release(6, errors.New("connection refused"))
+	if n, _ := nm.acquire(nil, common.Address{}); n != 6 {
+		t.Fatalf("expected gap 6 to be reused, got %d", n)
+	}
+	// the last nonce is handed out again
+	nm.release(7, errors.New("connection refused"))
+	if nm.next != 7 || len(nm.gaps) != 0 {
+		t.Fatalf("expected next nonce 7 without gaps, got %d %v", nm.next, nm.gaps)
+	}
+	// pending transaction with the nonce
+	nm.acquire(nil, common.Address{})
+	nm.acquire(nil, common.Address{})
+	nm.release(7, errors.New("already known"))
+	if len(nm.gaps) != 0 || !nm.synced {
+		t.Fatalf("expected nonce 7 to be used, got gaps %v", nm.gaps)
+	}
+	// nonce used elsewhere: synchronize, never go back
+	nm.release(8, errors.New("nonce too low: next nonce 12"))
+	if nm.synced {
+		t.Fatalf("expected resync after nonce too low")
+	}
+	nm.sync(12)
+	if n, _ := nm.acquire(nil, common.Address{}); n != 12 {
+		t.Fatalf("expected nonce 12 after sync, got %d", n)
+	}
+	nm.release(12, errors.New("timeout"))
+	nm.sync(3)
+	if nm.next != 12 {
+		t.Fatalf("expected sync with a lagging rpc to keep nonce 12, got %d", nm.next)
+	}
+	// gaps below the pending nonce are dropped
+	nm.gaps = []uint64{9, 10}
+	nm.sync(10)
+	if len(nm.gaps) != 1 || nm.gaps[0] != 10 {
+		t.Fatalf("expected gap 10, got %v", nm.gaps)
+	}
+}
+
+func TestReleaseNonce(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	exc := &basePayExec{ExecPrivKey: key, ChainId: 31337}
+	nm := exc.nonces()
+	nm.sync(5)
+	for _, expected := range []uint64{5, 6, 7} {
+		if n, _ := nm.acquire(nil, common.Address{}); n != expected {
+			t.Fatalf("expected nonce %d, got %d", expected, n)
+		}
+	}
+	// a signed transaction might be broadcast: the nonce stays taken
+	exc.releaseNonce(6, fmt.Errorf("pay: %w", &sendError{err: errors.New("timeout")}))
+	if len(nm.gaps) != 0 {
+		t.Fatalf("expected nonce 6 to stay reserved, got gaps %v", nm.gaps)
+	}
+	// failed before signing
+	exc.releaseNonce(6, errors.New("could not estimate gas"))
+	if len(nm.gaps) != 1 || nm.gaps[0] != 6 {
+		t.Fatalf("expected gap 6, got %v", nm.gaps)
+	}
+}
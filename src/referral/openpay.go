@@ -1,13 +1,13 @@
 package referral
 
 import (
-	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"log/slog"
 	"math/big"
 	"referral-system/env"
+	"referral-system/src/metrics"
 	"referral-system/src/utils"
 	"strconv"
 	"strings"
@@ -15,17 +15,23 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 )
 
+// confirmPaymentDelay is the time we wait after a batch
+// before we query the payment transaction status
+var confirmPaymentDelay = 2 * time.Minute
+
 type AggregatedFeesRow struct {
 	PoolId              uint32
 	TraderAddr          string
 	Code                string
 	BrokerFeeABDKCC     *big.Int
+	VolumeABDKCC        *big.Int
 	LastTradeConsidered time.Time
 	TokenAddr           string
 	TokenDecimals       uint8
+	// batch time of the oldest fees carried forward, zero if none
+	CarriedSince time.Time
 }
 
 func (a *App) OpenPay(traderAddr string) (utils.APIResponseOpenEarnings, error) {
@@ -33,6 +39,7 @@ func (a *App) OpenPay(traderAddr string) (utils.APIResponseOpenEarnings, error)
 		PoolId              uint32
 		Code                string
 		BrokerFeeCc         string
+		VolumeCc            string
 		LastTradeConsidered time.Time
 		TokenName           string
 		TokenDecimals       uint8
@@ -41,7 +48,7 @@ func (a *App) OpenPay(traderAddr string) (utils.APIResponseOpenEarnings, error)
 	// get aggregated fees per pool and associated margin token info
 	// for the given trader
 	query := `SELECT 
-				mti.pool_id, rafpt.code, rafpt.broker_fee_cc, 
+				mti.pool_id, rafpt.code, rafpt.broker_fee_cc, rafpt.volume_cc,
 				rafpt.last_trade_considered_ts, 
 				mti.token_name, mti.token_decimals
 			FROM referral_aggr_fees_per_trader rafpt
@@ -59,43 +66,93 @@ func (a *App) OpenPay(traderAddr string) (utils.APIResponseOpenEarnings, error)
 		return utils.APIResponseOpenEarnings{}, errors.New("unable to query payment")
 	}
 	defer rows.Close()
+	// fees carried forward by earlier batches, per pool and code
+	carried, err := a.dbGetCarriedFees(traderAddr)
+	if err != nil {
+		slog.Error("Error for open pay" + err.Error())
+		return utils.APIResponseOpenEarnings{}, errors.New("unable to query payment")
+	}
+	carriedKey := func(poolId uint32, code string) string {
+		return strconv.Itoa(int(poolId)) + "." + code
+	}
+	carriedFees := make(map[string]carriedFee, len(carried))
+	for _, el := range carried {
+		carriedFees[carriedKey(el.PoolId, el.Code)] = el
+	}
 	var payments []utils.OpenPay
-	var codeChain DbReferralChainOfChild
 	var res utils.APIResponseOpenEarnings
+	var lastTrade time.Time
+	chains := a.newCodeChains()
 	for rows.Next() {
 		var el AggrFees
-		rows.Scan(&el.PoolId, &el.Code, &el.BrokerFeeCc,
+		rows.Scan(&el.PoolId, &el.Code, &el.BrokerFeeCc, &el.VolumeCc,
 			&el.LastTradeConsidered, &el.TokenName, &el.TokenDecimals)
+		volumeABDK, _ := new(big.Int).SetString(el.VolumeCc, 10)
+		volume := utils.ABDKToFloat(volumeABDK)
+		// trades are attributed to the code selected at trade time,
+		// the code of the latest trade is reported as the trader's code
+		if el.LastTradeConsidered.After(lastTrade) {
+			lastTrade = el.LastTradeConsidered
+			res.Code = el.Code
+			if el.Code == env.DEFAULT_CODE {
+				res.Code = ""
+			}
+		}
 		if el.Code == env.DEFAULT_CODE {
 			// no code, hence no rebate
 			var op = utils.OpenPay{
 				PoolId:    el.PoolId,
+				Code:      el.Code,
 				Amount:    0,
 				TokenName: el.TokenName,
+				Volume:    volume,
 			}
 			payments = append(payments, op)
 			continue
 		}
-		if res.Code != el.Code {
-			chain, err := a.DbGetReferralChainForCode(el.Code)
-			if err != nil {
-				slog.Error("Error in OpenPay" + err.Error())
-				return utils.APIResponseOpenEarnings{}, errors.New("unable to query payment")
-			}
-			codeChain = chain[len(chain)-1]
-			res.Code = el.Code
+		chain, tier, err := chains.get(el.Code, volume)
+		if err != nil {
+			slog.Error("Error in OpenPay" + err.Error())
+			return utils.APIResponseOpenEarnings{}, errors.New("unable to query payment")
 		}
+		codeChain := chain[len(chain)-1]
 		fee := new(big.Int)
 		fee.SetString(el.BrokerFeeCc, 10)
 		amount := utils.ABDKToFloat(fee)
 		amount = amount * codeChain.ChildAvail
 		var op = utils.OpenPay{
 			PoolId:    el.PoolId,
+			Code:      el.Code,
 			Amount:    amount,
 			TokenName: el.TokenName,
+			Volume:    volume,
+		}
+		if c, exists := carriedFees[carriedKey(el.PoolId, el.Code)]; exists {
+			op.Carried = utils.ABDKToFloat(c.FeeABDKCC) * codeChain.ChildAvail
+			delete(carriedFees, carriedKey(el.PoolId, el.Code))
+		}
+		if tier != nil {
+			op.Tier = &utils.APICodeTier{MinVolume: tier.MinVolume, RebatePerc: codeChain.ChildAvail * 100}
 		}
 		payments = append(payments, op)
 	}
+	// carried fees without trades in the current period
+	for _, c := range carried {
+		if _, exists := carriedFees[carriedKey(c.PoolId, c.Code)]; !exists || c.Code == env.DEFAULT_CODE {
+			continue
+		}
+		chain, _, err := chains.get(c.Code, 0)
+		if err != nil {
+			slog.Error("Error in OpenPay" + err.Error())
+			return utils.APIResponseOpenEarnings{}, errors.New("unable to query payment")
+		}
+		payments = append(payments, utils.OpenPay{
+			PoolId:    c.PoolId,
+			Code:      c.Code,
+			Carried:   utils.ABDKToFloat(c.FeeABDKCC) * chain[len(chain)-1].ChildAvail,
+			TokenName: c.TokenName,
+		})
+	}
 	res.OpenPay = payments
 	return res, nil
 }
@@ -197,6 +254,12 @@ func (a *App) DetermineScalingFactor() (map[uint32]float64, error) {
 // ManagePayments determins how much to pay and ultimately delegates
 // payment execution to payexec
 func (a *App) ManagePayments() {
+	if !a.batchMu.TryLock() {
+		slog.Info("Payment batch running, scheduling next payment")
+		a.SchedulePayment()
+		return
+	}
+	a.batchPaused.Store(a.dbGetBatchPaused())
 	// Filter blockchain events to confirm payments
 	slog.Info("Reading onchain payments ...")
 	var err error = nil
@@ -208,19 +271,27 @@ func (a *App) ManagePayments() {
 		}
 		// switch RPC
 		a.CreateRpcClient()
-		err = a.SavePayments()
+		err = a.readPayments()
 		if err == nil {
 			break
 		}
 		slog.Info("Reading onchain payments failed:" + err.Error())
+		a.countRpcError()
 	}
 	if err != nil {
 		slog.Info("Reading onchain payments failed: rescheduling payments")
+		a.batchMu.Unlock()
 		a.SchedulePayment()
 		return
 	}
 	slog.Info("Reading onchain payments completed, purging unconfirmed payments")
 	a.PurgeUnconfirmedPayments(nil)
+	if a.batchPaused.Load() {
+		slog.Info("Payments paused, scheduling next payment")
+		a.batchMu.Unlock()
+		a.SchedulePayment()
+		return
+	}
 	// Create a token bucket with a limit of 5 tokens and a refill rate of 3 tokens per second
 	a.PaymentExecutor.NewTokenBucket(5, 3)
 	// determine batch timestamp
@@ -241,6 +312,7 @@ func (a *App) ManagePayments() {
 		slog.Info("Payment is due, batch " + batchTs)
 		err = a.DbSetPaymentExecFinished(batchTs, false)
 		if err == nil {
+			a.notify(WEBHOOK_EVENT_BATCH_STARTED, webhookBatch{BatchTs: currentTime})
 			err = a.processPayments(batchTs)
 		}
 	} else {
@@ -249,6 +321,7 @@ func (a *App) ManagePayments() {
 	if err != nil {
 		slog.Error("Error processing payments:" + err.Error())
 	}
+	a.batchMu.Unlock()
 	// schedule next payments
 	a.SchedulePayment()
 }
@@ -269,23 +342,47 @@ func (a *App) processPayments(batchTs string) error {
 	if err != nil {
 		return errors.New("ProcessAllPayments: Failed to update token holdings " + err.Error())
 	}
+	err = a.CreateRpcClient()
+	if err != nil {
+		slog.Info("Could not switch rpc client, ignoring")
+	}
+	a.PaymentExecutor.SetClient(a.rpcClient())
+	redirects, err := a.dbGetPayoutAddrs()
+	if err != nil {
+		slog.Error("could not load payout addresses: " + err.Error())
+		return err
+	}
+	denied, err := a.dbGetDenyList()
+	if err != nil {
+		slog.Error("could not load deny list: " + err.Error())
+		return err
+	}
+	// retry failed payments of earlier batches first, the scaling
+	// factor considers the balance left
+	if a.Settings.PayoutMode == PAYOUT_MODE_PUSH && a.retryFailedPayments(redirects, denied) {
+		slog.Info("Payments paused, batch " + batchTs + " remains unfinished")
+		return nil
+	}
+	if a.Settings.PayoutMode == PAYOUT_MODE_CLAIM {
+		// allocations settle their trades once the root is on-chain
+		err = a.confirmClaimRoots()
+		if err != nil {
+			slog.Error("Could not confirm claim roots: " + err.Error())
+			return err
+		}
+	}
 	// query snapshot of open pay view
-	query := `SELECT agfpt.pool_id, agfpt.trader_addr, agfpt.code, 
-				agfpt.broker_fee_cc, agfpt.last_trade_considered_ts,
-				mti.token_addr, mti.token_decimals
-			  FROM referral_aggr_fees_per_trader agfpt
-			  JOIN margin_token_info mti
-			  	ON mti.pool_id = agfpt.pool_id
-			  JOIN referral_settings rs
-			  	ON rs.property='broker_addr'
-			  	AND rs.broker_id = $1
-			  WHERE LOWER(agfpt.broker_addr)=LOWER(rs.value)`
-	rows, err := a.Db.Query(query, a.Settings.BrokerId)
+	feeRows, err := a.dbGetAggregatedFees()
+	if err != nil {
+		slog.Error("Error for process pay" + err.Error())
+		return err
+	}
+	// carried fees without fees of the pay period
+	feeRows, err = a.withCarriedOnlyRows(feeRows, batchTime(batchTs))
 	if err != nil {
 		slog.Error("Error for process pay" + err.Error())
 		return err
 	}
-	defer rows.Close()
 	// in case we have less balance than fee earnings,
 	// fee redistribution must be scaled
 	scale, err := a.DetermineScalingFactor()
@@ -293,47 +390,92 @@ func (a *App) processPayments(batchTs string) error {
 		slog.Error("Error for process pay" + err.Error())
 		return err
 	}
-	codePaths := make(map[string][]DbReferralChainOfChild)
-	for rows.Next() {
-		var el AggregatedFeesRow
-		var fee string
-		rows.Scan(&el.PoolId, &el.TraderAddr, &el.Code, &fee,
-			&el.LastTradeConsidered, &el.TokenAddr, &el.TokenDecimals)
-		el.BrokerFeeABDKCC = new(big.Int)
-		el.BrokerFeeABDKCC.SetString(fee, 10)
+	chains := a.newCodeChains()
+	var payments []PaymentExecution
+	for _, el := range feeRows {
+		if a.batchPaused.Load() {
+			slog.Info("Payments paused, batch " + batchTs + " remains unfinished")
+			return nil
+		}
 		fmt.Println("fee=", el.BrokerFeeABDKCC)
 
-		// determine referralchain for the code
-		if _, exists := codePaths[el.Code]; !exists {
-			chain, err := a.DbGetReferralChainForCode(el.Code)
-			if err != nil {
-				slog.Error("could not find referral chain for code " + el.Code + ": " + err.Error())
-				continue
-			}
-			codePaths[el.Code] = chain
+		// determine referralchain for the code and the volume tier of the trader
+		chain, tier, err := chains.get(el.Code, utils.ABDKToFloat(el.VolumeABDKCC))
+		if err != nil {
+			slog.Error("could not find referral chain for code " + el.Code + ": " + err.Error())
+			continue
+		}
+		if tier != nil {
+			slog.Info(fmt.Sprintf("Trader %s reached volume tier %.0f of code %s", el.TraderAddr, tier.MinVolume, el.Code))
 		}
-		// process
-		scalingFactor := scale[el.PoolId]
-		err = a.payBatch(el, codePaths[el.Code], batchTs, scalingFactor)
+		p, submit := a.planBatchPayment(el, chain, batchTs, scale[el.PoolId])
+		if submit {
+			p = withPayoutAddrs(p, redirects)
+			payments = append(payments, a.withholdDeniedPayment(batchTs, p, denied))
+		}
+	}
+	if a.Settings.PayoutMode == PAYOUT_MODE_CLAIM {
+		// payees claim themselves
+		err = a.publishClaims(batchTs, payments)
 		if err != nil {
-			slog.Info("aborting payments...")
-			break
+			slog.Error("Could not publish claims: " + err.Error())
+			return err
 		}
+	} else if a.payAggregated(batchTs, aggregatePayments(batchTs, a.Settings.BrokerId, payments)) {
+		// pay many traders per transaction
+		slog.Info("Payments paused, batch " + batchTs + " remains unfinished")
+		return nil
 	}
 	err = a.DbSetPaymentExecFinished(batchTs, true)
 	if err != nil {
 		slog.Error("could not set payment status to finished, but finished:" + err.Error())
 	}
+	a.notify(WEBHOOK_EVENT_BATCH_FINISHED, webhookBatch{BatchTs: batchTime(batchTs).Unix()})
 	slog.Info("Payment execution done, waiting before confirming payments...")
 	// wait before we aim to confirm payments
-	time.Sleep(2 * time.Minute)
+	time.Sleep(confirmPaymentDelay)
 	// Filter blockchain events to confirm payments
 	slog.Info("Confirming payments")
 	a.ConfirmPaymentTxs()
 	return nil
 }
 
-func (a *App) payBatch(row AggregatedFeesRow, chain []DbReferralChainOfChild, batchTs string, scaling float64) error {
+// dbGetAggregatedFees returns a snapshot of the open pay view
+// (referral_aggr_fees_per_trader) for the current broker
+func (a *App) dbGetAggregatedFees() ([]AggregatedFeesRow, error) {
+	query := `SELECT agfpt.pool_id, agfpt.trader_addr, agfpt.code, 
+				agfpt.broker_fee_cc, agfpt.volume_cc, agfpt.last_trade_considered_ts,
+				mti.token_addr, mti.token_decimals
+			  FROM referral_aggr_fees_per_trader agfpt
+			  JOIN margin_token_info mti
+			  	ON mti.pool_id = agfpt.pool_id
+			  JOIN referral_settings rs
+			  	ON rs.property='broker_addr'
+			  	AND rs.broker_id = $1
+			  WHERE LOWER(agfpt.broker_addr)=LOWER(rs.value)`
+	rows, err := a.Db.Query(query, a.Settings.BrokerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []AggregatedFeesRow
+	for rows.Next() {
+		var el AggregatedFeesRow
+		var fee, volume string
+		rows.Scan(&el.PoolId, &el.TraderAddr, &el.Code, &fee, &volume,
+			&el.LastTradeConsidered, &el.TokenAddr, &el.TokenDecimals)
+		el.BrokerFeeABDKCC = new(big.Int)
+		el.BrokerFeeABDKCC.SetString(fee, 10)
+		el.VolumeABDKCC = new(big.Int)
+		el.VolumeABDKCC.SetString(volume, 10)
+		res = append(res, el)
+	}
+	return res, nil
+}
+
+// planPayment determines payees and amounts for a row of the
+// open pay view. No transaction is sent.
+func (a *App) planPayment(row AggregatedFeesRow, chain []DbReferralChainOfChild, batchTs string, scaling float64) PaymentExecution {
 	totalDecN := utils.ABDKToDecN(row.BrokerFeeABDKCC, row.TokenDecimals)
 	// scale
 	if scaling < 1 {
@@ -363,52 +505,141 @@ func (a *App) payBatch(row AggregatedFeesRow, chain []DbReferralChainOfChild, ba
 	if distributed.Cmp(totalDecN) < 0 {
 		totalDecN = distributed
 	}
-	// encode message: batchTs.<code>.<poolId>.<encodingversion>
-	msg := encodePaymentInfo(batchTs, row.Code, int(row.PoolId))
-	// id = lastTradeConsideredTs in seconds
-	id := row.LastTradeConsidered.Unix()
-	// switch rpc
-	err := a.CreateRpcClient()
+	// message of the payment if it is sent alone
+	entry := manifestEntry{PoolId: row.PoolId, Code: row.Code, AmountDecN: amounts}
+	for k := range payees {
+		entry.PayeeIdx = append(entry.PayeeIdx, k)
+	}
+	return PaymentExecution{
+		TraderAddr:    row.TraderAddr,
+		Code:          row.Code,
+		PoolId:        row.PoolId,
+		TokenAddr:     row.TokenAddr,
+		TokenDecimals: row.TokenDecimals,
+		PayeeAddr:     payees,
+		AmountDecN:    amounts,
+		TotalDecN:     totalDecN,
+		Msg:           encodePaymentMsg(batchTs, a.Settings.BrokerId, []manifestEntry{entry}),
+		// id = lastTradeConsideredTs in seconds
+		Id:                  row.LastTradeConsidered.Unix(),
+		LastTradeConsidered: row.LastTradeConsidered,
+	}
+}
+
+// planBatchPayment plans the payment of a row of the open pay view
+// including the fees carried forward by earlier batches. Returns false
+// if the payment is not to be sent: carried forward, already paid or
+// unclear
+func (a *App) planBatchPayment(row AggregatedFeesRow, chain []DbReferralChainOfChild, batchTs string, scaling float64) (PaymentExecution, bool) {
+	total, err := a.withCarriedFee(row, batchTime(batchTs))
 	if err != nil {
-		slog.Info("Could not switch rpc client, ignoring")
+		slog.Error("Skipping payment for trader " + row.TraderAddr + ": " + err.Error())
+		return PaymentExecution{}, false
+	}
+	p := a.planPayment(total, chain, batchTs, scaling)
+	if a.isBelowMinPayout(p, row.TokenDecimals) && !a.isCarryDue(total, batchTime(batchTs)) {
+		// dust: carry the fees of this period forward
+		slog.Info("Payment for trader " + row.TraderAddr + " below minimal payout, carrying forward")
+		if row.BrokerFeeABDKCC.Sign() > 0 {
+			a.dbAccrueFee(batchTs, row, row.BrokerFeeABDKCC)
+		}
+		return p, false
+	}
+	// never pay twice: check the payment intent first
+	submit, err := a.checkPaymentIntent(batchTs, p)
+	if err != nil {
+		slog.Error("Skipping payment for trader " + p.TraderAddr + ": " + err.Error())
+		return p, false
 	}
-	a.PaymentExecutor.SetClient(a.RpcClient)
+	return p, submit
+}
 
-	txHash, err := a.PaymentExecutor.TransactPayment(common.HexToAddress(row.TokenAddr), totalDecN, amounts, payees, id, msg, row.Code, a.RpcClient)
+// payBatch sends the aggregated payment ap and records the
+// payments per trader. Receipt queries are limited by bucket.
+func (a *App) payBatch(ap aggregatedPayment, batchTs string, bucket *TokenBucket) error {
+	for _, p := range ap.Payments {
+		err := a.dbSetPaymentIntent(batchTs, p, INTENT_PENDING, "", "")
+		if err != nil {
+			slog.Error("Skipping payment for trader " + p.TraderAddr + " and " +
+				strconv.Itoa(len(ap.Payments)-1) + " others: could not record intent")
+			return nil
+		}
+	}
+	// the deny list may have changed since the payments were planned
+	if err := a.checkDenied(DENY_ACTION_PAY_BATCH, paidAddrs(ap)...); err != nil {
+		slog.Error("Skipping payment for trader " + ap.Payments[0].TraderAddr + " and " +
+			strconv.Itoa(len(ap.Payments)-1) + " others: " + err.Error())
+		return nil
+	}
+	client := a.rpcClient()
+	onSigned := a.paymentSignedFunc(batchTs, ap.Payments...)
+	signed := false
+	txHash, err := a.PaymentExecutor.TransactPayment(common.HexToAddress(ap.TokenAddr), ap.TotalDecN, ap.AmountDecN, ap.PayeeAddr, ap.Id, ap.Msg,
+		strconv.Itoa(len(ap.Payments))+" traders", client, func(tx *types.Transaction, digest common.Hash) error {
+			err := onSigned(tx, digest)
+			signed = err == nil
+			return err
+		})
 	if err != nil {
 		slog.Error(err.Error())
+		a.countRpcError()
+		// before signing the payments were not sent and a later batch
+		// pays the carried fees. A signed transaction may have been
+		// broadcast, checkPaymentIntent decides when the batch continues
+		if !signed {
+			for _, p := range ap.Payments {
+				a.dbReleaseAccruals(batchTs, p)
+			}
+		}
 		if strings.Contains(err.Error(), "insufficient funds") {
 			return err
-		} else {
-			return nil
 		}
+		a.failoverRpc(client)
+		return nil
 	}
-	_, err = waitForReceipt(a.RpcClient, txHash)
+	token := strings.ToLower(ap.TokenAddr)
+	for _, p := range ap.Payments {
+		pool := strconv.Itoa(int(p.PoolId))
+		metrics.Payments.WithLabelValues(a.chainLabel(), a.Settings.BrokerId, metrics.PAYMENT_SUBMITTED, pool, token).Inc()
+	}
+	receipt, txHash, err := a.waitForPayment(txHash, bucket)
 	if err != nil {
 		slog.Info("Could not wait for receipt:" + err.Error())
+		a.countRpcError()
+	}
+	if receipt != nil {
+		a.dbInsertPaymentGas(batchTime(batchTs), ap.TokenAddr, receipt)
 	}
 	brokerAddr := a.PaymentExecutor.GetBrokerAddr().Hex()
-	a.dbWriteTx(row.TraderAddr, brokerAddr, row.Code, amounts, payees, batchTs, row.PoolId, txHash.Hex())
-	return nil
-}
-
-func waitForReceipt(client *ethclient.Client, txHash common.Hash) (*types.Receipt, error) {
-	ctx := context.Background()
-	for {
-		receipt, err := client.TransactionReceipt(ctx, txHash)
-		if err != nil {
-			return nil, err
+	for _, p := range ap.Payments {
+		a.dbWriteTx(p.TraderAddr, brokerAddr, p.Code, p.AmountDecN, p.PayeeAddr, p.PayoutAddr, batchTs, p.PoolId, txHash.Hex())
+		if receipt == nil {
+			continue
 		}
-		if receipt != nil {
-			return receipt, nil
+		pool := strconv.Itoa(int(p.PoolId))
+		status := INTENT_MINED
+		if receipt.Status == types.ReceiptStatusSuccessful {
+			metrics.Payments.WithLabelValues(a.chainLabel(), a.Settings.BrokerId, metrics.PAYMENT_CONFIRMED, pool, token).Inc()
+			metrics.PaidAmount.WithLabelValues(a.chainLabel(), a.Settings.BrokerId, pool, token).Add(utils.DecNToFloat(p.TotalDecN, p.TokenDecimals))
+		} else {
+			status = INTENT_FAILED
+			metrics.Payments.WithLabelValues(a.chainLabel(), a.Settings.BrokerId, metrics.PAYMENT_FAILED, pool, token).Inc()
 		}
-		time.Sleep(2 * time.Second)
+		a.dbSetPaymentIntentStatus(batchTs, p, status)
 	}
+	return nil
 }
 
 // DbGetReferralChainForCode gets the entire chain of referrals
 // for a code, calculating what each participant earns (percent)
 func (a *App) DbGetReferralChainForCode(code string) ([]DbReferralChainOfChild, error) {
+	return a.referralChainForCode(code, nil)
+}
+
+// referralChainForCode gets the chain of referrals for a code. The cut
+// of a referrer without agency is based on its balance in holdings if
+// present, on the holdings stored in the database otherwise.
+func (a *App) referralChainForCode(code string, holdings map[string]*big.Int) ([]DbReferralChainOfChild, error) {
 	if code == env.DEFAULT_CODE {
 		res := make([]DbReferralChainOfChild, 1)
 		res[0] = DbReferralChainOfChild{
@@ -431,7 +662,7 @@ func (a *App) DbGetReferralChainForCode(code string) ([]DbReferralChainOfChild,
 	}
 	traderCut = traderCut / 100
 
-	chain, _, err := a.DbGetReferralChainFromChild(refAddr, nil)
+	chain, _, err := a.DbGetReferralChainFromChild(refAddr, holdings[refAddr])
 	if err != nil {
 		return []DbReferralChainOfChild{}, errors.New("DbGetReferralChainForCode:" + err.Error())
 	}
@@ -2,6 +2,7 @@ package referral
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/json"
 	"errors"
@@ -15,10 +16,13 @@ import (
 	"referral-system/src/contracts"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/D8-X/d8x-futures-go-sdk/pkg/d8x_futures"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/go-resty/resty/v2"
@@ -33,12 +37,24 @@ type PayExec interface {
 	// assign private key and remote broker address
 	Init(viper *viper.Viper, multiPayAddr string) error
 	GetBrokerAddr() common.Address
-	TransactPayment(tokenAddr common.Address, total *big.Int, amounts []*big.Int, payees []common.Address, id int64, msg, code string, rpc *ethclient.Client) (common.Hash, error)
+	TransactPayment(tokenAddr common.Address, total *big.Int, amounts []*big.Int, payees []common.Address, id int64, msg, code string, rpc *ethclient.Client, onSigned PaymentSigned) (common.Hash, error)
 	GetExecutorAddrHex() string
 	SetClient(client *ethclient.Client)
 	NewTokenBucket(tokens int, refillRate float64)
+	SetGasPolicy(policy GasPolicy)
+	// ReplaceTransaction sends a sent transaction again with the same nonce
+	// and bumped fees. onSigned is called before the replacement is sent.
+	ReplaceTransaction(txHash common.Hash, onSigned PaymentSigned) (common.Hash, error)
+	// FillNonceGaps re-broadcasts the pending transactions of the executor
+	// and fills nonces that were handed out but never sent
+	FillNonceGaps() error
 }
 
+// PaymentSigned is called with the signed payment transaction and the
+// MultiPay payment digest (zero for direct payments) before the
+// transaction is sent. If it returns an error, the transaction is not sent.
+type PaymentSigned func(tx *types.Transaction, digest common.Hash) error
+
 type PaySummaryAux struct {
 	Payer         string `json:"payer"`
 	Executor      string `json:"executor"`
@@ -63,6 +79,11 @@ type basePayExec struct {
 	ChainId           int64
 	Client            *ethclient.Client
 	RPCTokenBucket    TokenBucket
+	GasPolicy         GasPolicy
+	// mu guards Client and sentTxs, payments are sent concurrently
+	mu sync.Mutex
+	// sent transactions by hash, for replacements
+	sentTxs map[common.Hash]*types.Transaction
 }
 
 type RemotePayExec struct {
@@ -70,12 +91,52 @@ type RemotePayExec struct {
 	RemoteBrkrUrl string
 }
 
+// payment executor modes, configured via env.PAY_EXEC_MODE
+const (
+	PAY_EXEC_REMOTE = "remote"
+	PAY_EXEC_LOCAL  = "local"
+)
+
+// NewPayExec returns the payment executor for the given mode
+func NewPayExec(mode string) (PayExec, error) {
+	switch strings.ToLower(mode) {
+	case "", PAY_EXEC_REMOTE:
+		return &RemotePayExec{}, nil
+	case PAY_EXEC_LOCAL:
+		return &LocalPayExec{}, nil
+	}
+	return nil, errors.New("unknown payment executor mode " + mode)
+}
+
 func (exc *basePayExec) GetBrokerAddr() common.Address {
 	return exc.BrokerAddr
 }
 
+// SetClient sets the rpc client. A new client (rpc failover) makes the
+// nonce manager synchronize with the new rpc.
 func (exc *basePayExec) SetClient(client *ethclient.Client) {
+	exc.mu.Lock()
+	changed := exc.Client != nil && exc.Client != client
 	exc.Client = client
+	exc.mu.Unlock()
+	if changed {
+		exc.nonces().resync()
+	}
+}
+
+func (exc *basePayExec) client() *ethclient.Client {
+	exc.mu.Lock()
+	defer exc.mu.Unlock()
+	return exc.Client
+}
+
+// nonces returns the nonce manager of the executor
+func (exc *basePayExec) nonces() *nonceManager {
+	return executorNonces(exc.ChainId, crypto.PubkeyToAddress(exc.ExecPrivKey.PublicKey))
+}
+
+func (exc *basePayExec) SetGasPolicy(policy GasPolicy) {
+	exc.GasPolicy = policy
 }
 
 func (exc *basePayExec) NewTokenBucket(capacity int, refillRate float64) {
@@ -136,7 +197,7 @@ func logPaymentIntent(tokenAddr common.Address, amounts []*big.Int, payees []com
 	}
 }
 
-func (exc *RemotePayExec) GetExecutorAddrHex() string {
+func (exc *basePayExec) GetExecutorAddrHex() string {
 	execAddr, _ := privateKeyToAddress(exc.ExecPrivKey)
 	return execAddr
 }
@@ -148,7 +209,8 @@ func (exc *RemotePayExec) TransactPayment(tokenAddr common.Address,
 	id int64,
 	msg,
 	code string,
-	rpc *ethclient.Client) (common.Hash, error) {
+	rpc *ethclient.Client,
+	onSigned PaymentSigned) (common.Hash, error) {
 
 	logPaymentIntent(tokenAddr, amounts, payees, id, msg, code)
 	if len(amounts) != len(payees) {
@@ -168,7 +230,7 @@ func (exc *RemotePayExec) TransactPayment(tokenAddr common.Address,
 		MultiPayCtrct: common.HexToAddress(exc.MultipayCtrctAddr),
 	}
 
-	sig, err := exc.remoteGetSignature(payment, rpc)
+	digest, sig, err := exc.remoteGetSignature(payment, rpc)
 	if err != nil {
 		return common.Hash{}, err
 	}
@@ -184,7 +246,7 @@ func (exc *RemotePayExec) TransactPayment(tokenAddr common.Address,
 		return common.Hash{}, errors.New("payer address must be signer address")
 	}
 	slog.Info("Signature ok")
-	txHash, err := exc.Pay(payment, sig, amounts, payees, msg)
+	txHash, err := exc.Pay(payment, digest, sig, amounts, payees, msg, onSigned)
 	if err != nil {
 		slog.Error("Unable to pay:" + err.Error())
 		return common.Hash{}, err
@@ -194,18 +256,22 @@ func (exc *RemotePayExec) TransactPayment(tokenAddr common.Address,
 }
 
 // remoteGetSignature signs the payment data locally with the executor address and
-// retrieves the remote-broker signature via REST API. Returns the signature
-// as hex-string
-func (exc *RemotePayExec) remoteGetSignature(paydata d8x_futures.PaySummary, rpc *ethclient.Client) (string, error) {
+// retrieves the remote-broker signature via REST API. Returns the payment digest
+// of the sdk and the signature as hex-string
+func (exc *RemotePayExec) remoteGetSignature(paydata d8x_futures.PaySummary, rpc *ethclient.Client) (common.Hash, string, error) {
 	pk := fmt.Sprintf("%x", exc.ExecPrivKey.D)
 
 	execWallet, err := d8x_futures.NewWallet(pk, paydata.ChainId, rpc)
 	if err != nil {
-		return "", errors.New("error creating wallet:" + err.Error())
+		return common.Hash{}, "", errors.New("error creating wallet:" + err.Error())
+	}
+	dgst, sg, err := d8x_futures.RawCreatePaymentBrokerSignature(&paydata, execWallet)
+	if err != nil {
+		return common.Hash{}, "", errors.New("error creating signature:" + err.Error())
 	}
-	_, sg, err := d8x_futures.RawCreatePaymentBrokerSignature(&paydata, execWallet)
+	digest, err := sdkPaymentDigest(dgst)
 	if err != nil {
-		return "", errors.New("error creating signature:" + err.Error())
+		return common.Hash{}, "", err
 	}
 	slog.Info("Querying broker signature...")
 	slog.Info("Token    = " + paydata.Token.String())
@@ -229,20 +295,20 @@ func (exc *RemotePayExec) remoteGetSignature(paydata d8x_futures.PaySummary, rpc
 	payload, err := json.Marshal(p)
 	if err != nil {
 		slog.Error("Error marshaling JSON:" + err.Error())
-		return "", err
+		return common.Hash{}, "", err
 	}
 	url := exc.RemoteBrkrUrl + "/sign-payment"
 	// Send a POST request with the JSON payload
 	resp, err := http.Post(url, "application/json", bytes.NewBuffer(payload))
 	if err != nil {
 		slog.Error("Error sending POST request:" + err.Error())
-		return "", err
+		return common.Hash{}, "", err
 	}
 	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		slog.Error("Error reading response body:" + err.Error())
-		return "", err
+		return common.Hash{}, "", err
 	}
 	slog.Info("Remote broker response obtained from " + exc.RemoteBrkrUrl)
 	type Response struct {
@@ -252,21 +318,23 @@ func (exc *RemotePayExec) remoteGetSignature(paydata d8x_futures.PaySummary, rpc
 	var responseData Response
 	if err := json.Unmarshal(body, &responseData); err != nil {
 		slog.Error("Error unmarshaling JSON:" + err.Error())
-		return "", err
+		return common.Hash{}, "", err
 	}
 	if resp.StatusCode != http.StatusOK {
 		slog.Error("Error: Non-200 status code received, " + responseData.Error)
-		return "", errors.New("error: Non-200 status code received")
+		return common.Hash{}, "", errors.New("error: Non-200 status code received")
 	}
 
 	if responseData.Error != "" {
 		slog.Error("error response:" + responseData.Error)
-		return "", errors.New(responseData.Error)
+		return common.Hash{}, "", errors.New(responseData.Error)
 	}
-	return responseData.BrokerSignature, nil
+	return digest, responseData.BrokerSignature, nil
 }
 
-func (exc *RemotePayExec) Pay(payment d8x_futures.PaySummary, sig string, amounts []*big.Int, payees []common.Address, msg string) (common.Hash, error) {
+// Pay executes the payment via MultiPay.DelegatedPay using the
+// payer signature sig of the payment digest
+func (exc *basePayExec) Pay(payment d8x_futures.PaySummary, digest common.Hash, sig string, amounts []*big.Int, payees []common.Address, msg string, onSigned PaymentSigned) (txHash common.Hash, err error) {
 	// check pre-condition
 	t := new(big.Int).Set(amounts[0])
 	for i := 1; i < len(amounts); i++ {
@@ -281,11 +349,16 @@ func (exc *RemotePayExec) Pay(payment d8x_futures.PaySummary, sig string, amount
 		slog.Error("Pay: Could not create auth: " + err.Error())
 		return common.Hash{}, err
 	}
+	defer func() {
+		if err != nil {
+			exc.releaseNonce(auth.Nonce.Uint64(), err)
+		}
+	}()
 	if auth.From.String() != payment.Executor.String() {
 		return common.Hash{}, errors.New("payment executor must transaction sender")
 	}
 	exc.RPCTokenBucket.WaitForToken("auth", false)
-	mpay, err := contracts.NewMultiPay(common.HexToAddress(exc.MultipayCtrctAddr), exc.Client)
+	mpay, err := contracts.NewMultiPay(common.HexToAddress(exc.MultipayCtrctAddr), exc.client())
 	if err != nil {
 		return common.Hash{}, errors.New("Failed to instantiate Proxy contract: " + err.Error())
 	}
@@ -299,16 +372,215 @@ func (exc *RemotePayExec) Pay(payment d8x_futures.PaySummary, sig string, amount
 		TotalAmount: payment.TotalAmount,
 	}
 	auth.GasLimit = 5000000
+	auth.NoSend = true
 	sigTrim := strings.TrimPrefix(sig, "0x")
 	exc.RPCTokenBucket.WaitForToken("DelegatedPay", false)
 	tx, err := mpay.DelegatedPay(auth, s, common.Hex2Bytes(sigTrim), amounts, payees, msg)
 
+	if err != nil {
+		return common.Hash{}, err
+	}
+	err = exc.sendSigned(tx, digest, onSigned)
 	if err != nil {
 		return common.Hash{}, err
 	}
 	return tx.Hash(), nil
 }
 
+// sendSigned hands the signed transaction to onSigned and sends it.
+// Once onSigned accepted the transaction it might reach the chain, also
+// if sending fails (e.g. a timeout): its nonce stays reserved and the
+// error is a sendError
+func (exc *basePayExec) sendSigned(tx *types.Transaction, digest common.Hash, onSigned PaymentSigned) error {
+	if onSigned != nil {
+		err := onSigned(tx, digest)
+		if err != nil {
+			return errors.New("payment not sent: " + err.Error())
+		}
+	}
+	exc.RPCTokenBucket.WaitForToken("SendTransaction", false)
+	err := exc.client().SendTransaction(context.Background(), tx)
+	if err != nil && strings.Contains(strings.ToLower(err.Error()), "nonce too low") {
+		// the nonce is used by another transaction, this one is never mined
+		exc.nonces().release(tx.Nonce(), err)
+		return &sendError{err: err}
+	}
+	exc.mu.Lock()
+	if exc.sentTxs == nil {
+		exc.sentTxs = make(map[common.Hash]*types.Transaction)
+	}
+	exc.sentTxs[tx.Hash()] = tx
+	exc.mu.Unlock()
+	// re-broadcast or replaced if it is not mined
+	exc.nonces().sentTx(tx)
+	if err != nil {
+		return &sendError{err: err}
+	}
+	return nil
+}
+
+// sendError is the error of a signed transaction that could not be
+// sent, its nonce must not be released
+type sendError struct {
+	err error
+}
+
+func (e *sendError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sendError) Unwrap() error {
+	return e.err
+}
+
+// releaseNonce releases the nonce of a transaction that failed with
+// err before it was signed
+func (exc *basePayExec) releaseNonce(nonce uint64, err error) {
+	var se *sendError
+	if errors.As(err, &se) {
+		return
+	}
+	exc.nonces().release(nonce, err)
+}
+
+// FillNonceGaps re-broadcasts the transactions the executor sent with
+// nonces that are not mined yet, a new rpc might not know them. Nonces
+// that were handed out but never sent block all later transactions, they
+// are filled with zero-value transfers to the executor.
+func (exc *basePayExec) FillNonceGaps() error {
+	client := exc.client()
+	if client == nil {
+		return errors.New("FillNonceGaps: rpc client is nil")
+	}
+	executor := crypto.PubkeyToAddress(exc.ExecPrivKey.PublicKey)
+	exc.RPCTokenBucket.WaitForToken("NonceAt", false)
+	mined, err := client.NonceAt(context.Background(), executor, nil)
+	if err != nil {
+		return err
+	}
+	nm := exc.nonces()
+	gaps, pending := nm.outstanding(mined)
+	for _, tx := range pending {
+		exc.RPCTokenBucket.WaitForToken("SendTransaction", false)
+		err := client.SendTransaction(context.Background(), tx)
+		if err != nil && !strings.Contains(err.Error(), "already known") {
+			slog.Info(fmt.Sprintf("Could not re-broadcast tx %s (nonce %d): %s", tx.Hash().Hex(), tx.Nonce(), err.Error()))
+		}
+	}
+	for _, nonce := range gaps {
+		slog.Info(fmt.Sprintf("Filling nonce gap %d of executor %s", nonce, executor.Hex()))
+		err := exc.fillNonce(client, executor, nonce)
+		if err != nil {
+			exc.releaseNonce(nonce, err)
+			return errors.New("could not fill nonce gap " + strconv.FormatUint(nonce, 10) + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// fillNonce sends a zero-value transfer from the executor to itself
+// with the given nonce
+func (exc *basePayExec) fillNonce(client *ethclient.Client, executor common.Address, nonce uint64) error {
+	auth := &bind.TransactOpts{}
+	exc.RPCTokenBucket.WaitForToken("fees", false)
+	err := exc.setFees(client, auth)
+	if err != nil {
+		return err
+	}
+	var inner types.TxData
+	if auth.GasFeeCap != nil {
+		inner = &types.DynamicFeeTx{
+			ChainID:   big.NewInt(exc.ChainId),
+			Nonce:     nonce,
+			GasTipCap: auth.GasTipCap,
+			GasFeeCap: auth.GasFeeCap,
+			Gas:       21000,
+			To:        &executor,
+			Value:     big.NewInt(0),
+		}
+	} else {
+		inner = &types.LegacyTx{
+			Nonce:    nonce,
+			GasPrice: auth.GasPrice,
+			Gas:      21000,
+			To:       &executor,
+			Value:    big.NewInt(0),
+		}
+	}
+	tx, err := types.SignNewTx(exc.ExecPrivKey, types.LatestSignerForChainID(big.NewInt(exc.ChainId)), inner)
+	if err != nil {
+		return err
+	}
+	return exc.sendSigned(tx, common.Hash{}, nil)
+}
+
+// ReplaceTransaction sends the transaction with hash txHash again with the same
+// nonce and fees bumped according to the gas policy
+func (exc *basePayExec) ReplaceTransaction(txHash common.Hash, onSigned PaymentSigned) (common.Hash, error) {
+	exc.mu.Lock()
+	tx, exists := exc.sentTxs[txHash]
+	exc.mu.Unlock()
+	if !exists {
+		return common.Hash{}, errors.New("transaction " + txHash.Hex() + " was not sent by the executor")
+	}
+	var inner types.TxData
+	if tx.Type() == types.DynamicFeeTxType {
+		feeCap, err := exc.GasPolicy.bump(tx.GasFeeCap())
+		if err != nil {
+			return common.Hash{}, err
+		}
+		tipCap, err := exc.GasPolicy.bump(tx.GasTipCap())
+		if err != nil || tipCap.Cmp(feeCap) > 0 {
+			tipCap = feeCap
+		}
+		inner = &types.DynamicFeeTx{
+			ChainID:   tx.ChainId(),
+			Nonce:     tx.Nonce(),
+			GasTipCap: tipCap,
+			GasFeeCap: feeCap,
+			Gas:       tx.Gas(),
+			To:        tx.To(),
+			Value:     tx.Value(),
+			Data:      tx.Data(),
+		}
+	} else {
+		gasPrice, err := exc.GasPolicy.bump(tx.GasPrice())
+		if err != nil {
+			return common.Hash{}, err
+		}
+		inner = &types.LegacyTx{
+			Nonce:    tx.Nonce(),
+			GasPrice: gasPrice,
+			Gas:      tx.Gas(),
+			To:       tx.To(),
+			Value:    tx.Value(),
+			Data:     tx.Data(),
+		}
+	}
+	signer := types.LatestSignerForChainID(big.NewInt(exc.ChainId))
+	replacement, err := types.SignNewTx(exc.ExecPrivKey, signer, inner)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	slog.Info(fmt.Sprintf("Replacing tx %s with %s (nonce %d)", txHash.Hex(), replacement.Hash().Hex(), tx.Nonce()))
+	err = exc.sendSigned(replacement, common.Hash{}, onSigned)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return replacement.Hash(), nil
+}
+
+// sdkPaymentDigest parses the digest that the sdk signs, MultiPay
+// registers executed delegated payments under this digest (see
+// executedPaymentDigests)
+func sdkPaymentDigest(dgst string) (common.Hash, error) {
+	b := common.FromHex(dgst)
+	if len(b) != common.HashLength {
+		return common.Hash{}, errors.New("invalid payment digest '" + dgst + "'")
+	}
+	return common.BytesToHash(b), nil
+}
+
 func privateKeyToAddress(k *ecdsa.PrivateKey) (string, error) {
 	publicKey := k.Public()
 	publicKeyECDSA, ok := publicKey.(*ecdsa.PublicKey)
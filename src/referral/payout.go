@@ -0,0 +1,229 @@
+package referral
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"referral-system/src/utils"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// payees from this level on (agencies and referrers) can register a payout
+// address; level 0 is the trader, level 1 the broker payout address
+const PAYOUT_REDIRECT_MIN_LEVEL = 2
+
+// payoutRegistration is a row of referral_payout_addr
+type payoutRegistration struct {
+	Addr       common.Address
+	PayoutAddr common.Address
+	CreatedOn  time.Time
+}
+
+// SetPayoutAddr registers the payout address of an agency or referrer.
+// The signature has been checked by the caller.
+func (a *App) SetPayoutAddr(pl utils.APIPayoutAddrPayload) error {
+	addr := strings.ToLower(pl.Addr)
+	payoutAddr := strings.ToLower(pl.PayoutAddr)
+	if !a.isPayoutParticipant(addr) {
+		return errors.New("not an agency or referrer")
+	}
+	if err := a.checkDenied(DENY_ACTION_PAYOUT_ADDR, addr, payoutAddr); err != nil {
+		return err
+	}
+	if payoutAddr != addr {
+		// payments rebuilt from events map the payout address back
+		// to the participant, it must be unique
+		if a.isPayoutParticipant(payoutAddr) || strings.EqualFold(payoutAddr, a.Settings.BrokerPayoutAddr.Hex()) {
+			return errors.New("payout address is a participant")
+		}
+	}
+	createdOn := time.Unix(int64(pl.CreatedOn), 0)
+	err := a.dbInsertPayoutAddr(addr, payoutAddr, createdOn)
+	if err != nil {
+		return err
+	}
+	slog.Info("Payout address of " + addr + " set to " + payoutAddr)
+	return nil
+}
+
+// dbInsertPayoutAddr stores a payout address registration. The checks
+// against the current registrations and the insert run in one transaction
+// that locks out concurrent registrations, so that two participants cannot
+// claim the same payout address.
+func (a *App) dbInsertPayoutAddr(addr, payoutAddr string, createdOn time.Time) error {
+	tx, err := a.Db.Begin()
+	if err != nil {
+		slog.Error("dbInsertPayoutAddr: " + err.Error())
+		return errors.New("failed to set payout address")
+	}
+	defer tx.Rollback()
+	// conflicts with itself but not with readers
+	_, err = tx.Exec(`LOCK TABLE referral_payout_addr IN SHARE ROW EXCLUSIVE MODE`)
+	if err != nil {
+		slog.Error("dbInsertPayoutAddr: " + err.Error())
+		return errors.New("failed to set payout address")
+	}
+	query := `SELECT MAX(created_on) FROM referral_payout_addr
+		WHERE broker_id = $1 AND addr = $2`
+	var latest sql.NullTime
+	err = tx.QueryRow(query, a.Settings.BrokerId, addr).Scan(&latest)
+	if err != nil {
+		slog.Error("dbInsertPayoutAddr: " + err.Error())
+		return errors.New("failed to set payout address")
+	}
+	if latest.Valid && !createdOn.After(latest.Time) {
+		return errors.New("newer payout address registered")
+	}
+	if payoutAddr != addr {
+		// latest registration per participant, as in dbGetPayoutAddrs
+		query = `SELECT addr FROM (
+				SELECT DISTINCT ON (addr) addr, payout_addr
+				FROM referral_payout_addr
+				WHERE broker_id = $1
+				ORDER BY addr, created_on DESC
+			) active
+			WHERE payout_addr = $2 AND addr <> $3
+			LIMIT 1`
+		var other string
+		err = tx.QueryRow(query, a.Settings.BrokerId, payoutAddr, addr).Scan(&other)
+		if err == nil {
+			return errors.New("payout address used by another participant")
+		}
+		if err != sql.ErrNoRows {
+			slog.Error("dbInsertPayoutAddr: " + err.Error())
+			return errors.New("failed to set payout address")
+		}
+	}
+	query = `INSERT INTO referral_payout_addr (broker_id, addr, payout_addr, created_on)
+		VALUES ($1, $2, $3, $4)`
+	_, err = tx.Exec(query, a.Settings.BrokerId, addr, payoutAddr, createdOn)
+	if err != nil {
+		slog.Error("dbInsertPayoutAddr: " + err.Error())
+		return errors.New("failed to set payout address")
+	}
+	err = tx.Commit()
+	if err != nil {
+		slog.Error("dbInsertPayoutAddr: " + err.Error())
+		return errors.New("failed to set payout address")
+	}
+	return nil
+}
+
+// isPayoutParticipant returns true if addr is an agency (not the broker)
+// or the referrer of a code of the broker
+func (a *App) isPayoutParticipant(addr string) bool {
+	if isAgency, isBroker := a.IsAgency(addr); isAgency && !isBroker {
+		return true
+	}
+	query := `SELECT 1 FROM referral_code
+		WHERE LOWER(referrer_addr) = $1 AND broker_id = $2
+		LIMIT 1`
+	var one int
+	err := a.Db.QueryRow(query, addr, a.Settings.BrokerId).Scan(&one)
+	return err == nil
+}
+
+// dbGetPayoutAddrs returns the active payout address per participant
+// that redirects its earnings
+func (a *App) dbGetPayoutAddrs() (map[common.Address]common.Address, error) {
+	history, err := a.dbGetPayoutHistory()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[common.Address]common.Address)
+	for _, r := range history {
+		// sorted by created_on: the latest registration wins
+		if r.PayoutAddr == r.Addr {
+			delete(res, r.Addr)
+			continue
+		}
+		res[r.Addr] = r.PayoutAddr
+	}
+	return res, nil
+}
+
+// dbGetPayoutHistory returns all payout address registrations of the
+// broker sorted by registration time
+func (a *App) dbGetPayoutHistory() ([]payoutRegistration, error) {
+	query := `SELECT addr, payout_addr, created_on
+		FROM referral_payout_addr
+		WHERE broker_id = $1
+		ORDER BY created_on`
+	rows, err := a.Db.Query(query, a.Settings.BrokerId)
+	if err != nil {
+		return nil, errors.New("dbGetPayoutHistory: " + err.Error())
+	}
+	defer rows.Close()
+	var res []payoutRegistration
+	for rows.Next() {
+		var addr, payoutAddr string
+		var r payoutRegistration
+		err = rows.Scan(&addr, &payoutAddr, &r.CreatedOn)
+		if err != nil {
+			return nil, errors.New("dbGetPayoutHistory: " + err.Error())
+		}
+		r.Addr = common.HexToAddress(addr)
+		r.PayoutAddr = common.HexToAddress(payoutAddr)
+		res = append(res, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.New("dbGetPayoutHistory: " + err.Error())
+	}
+	return res, nil
+}
+
+// withPayoutAddrs sets the addresses that receive the amounts of the
+// payment according to the registered payout addresses
+func withPayoutAddrs(p PaymentExecution, redirects map[common.Address]common.Address) PaymentExecution {
+	p.PayoutAddr = nil
+	for k := PAYOUT_REDIRECT_MIN_LEVEL; k < len(p.PayeeAddr); k++ {
+		payout, exists := redirects[p.PayeeAddr[k]]
+		if !exists {
+			continue
+		}
+		if p.PayoutAddr == nil {
+			p.PayoutAddr = append([]common.Address(nil), p.PayeeAddr...)
+		}
+		p.PayoutAddr[k] = payout
+	}
+	return p
+}
+
+// payoutAddr returns the address that receives the amount of payee k
+func (p PaymentExecution) payoutAddr(k int) common.Address {
+	if p.PayoutAddr == nil {
+		return p.PayeeAddr[k]
+	}
+	return p.PayoutAddr[k]
+}
+
+// payeeIdentity returns the participant that received an amount at
+// payout address addr at time ts, or addr if it was not redirected
+func payeeIdentity(history []payoutRegistration, addr common.Address, ts time.Time) common.Address {
+	// registrations active at ts
+	active := make(map[common.Address]common.Address)
+	for _, r := range history {
+		if r.CreatedOn.After(ts) {
+			break
+		}
+		active[r.Addr] = r.PayoutAddr
+	}
+	var participants []common.Address
+	for participant, payout := range active {
+		if payout == addr && participant != addr {
+			participants = append(participants, participant)
+		}
+	}
+	if len(participants) == 0 {
+		return addr
+	}
+	// payout addresses are unique, sort for a deterministic result anyway
+	sort.Slice(participants, func(i, j int) bool {
+		return participants[i].Hex() < participants[j].Hex()
+	})
+	return participants[0]
+}
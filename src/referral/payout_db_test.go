@@ -0,0 +1,69 @@
+//go:build integration
+
+package referral
+
+import (
+	"referral-system/src/utils"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSetPayoutAddrUnique registers the same payout address for two
+// referrers concurrently, only one registration may succeed
+func TestSetPayoutAddrUnique(t *testing.T) {
+	s := newSimDbApp(t, false)
+	a := s.app
+	referrers := []string{
+		strings.ToLower(s.referrer.Hex()),
+		"0x00000000000000000000000000000000000000a1",
+	}
+	for k, referrer := range referrers {
+		code := "PAYOUT" + string(rune('A'+k))
+		if err := a.UpsertCode(utils.APICodePayload{Code: code, ReferrerAddr: referrer, PassOnPercTDF: 1000}); err != nil {
+			t.Fatalf("upsert: %v", err)
+		}
+	}
+	payoutAddr := "0x00000000000000000000000000000000000000b2"
+	now := uint32(time.Now().Unix())
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(referrers))
+	for k, referrer := range referrers {
+		wg.Add(1)
+		go func(k int, referrer string) {
+			defer wg.Done()
+			pl := utils.APIPayoutAddrPayload{Addr: referrer, PayoutAddr: payoutAddr, CreatedOn: now}
+			errs[k] = a.SetPayoutAddr(pl)
+		}(k, referrer)
+	}
+	wg.Wait()
+	winner := -1
+	for k, err := range errs {
+		if err == nil {
+			if winner >= 0 {
+				t.Fatalf("expected one registration of the payout address, got two")
+			}
+			winner = k
+		}
+	}
+	if winner < 0 {
+		t.Fatalf("expected one registration of the payout address, got %v", errs)
+	}
+	current, err := a.dbGetPayoutAddrs()
+	if err != nil || len(current) != 1 {
+		t.Fatalf("expected one active payout address, got %v (%v)", current, err)
+	}
+
+	// once the winner ends the redirection the address is free
+	winnerAddr, loser := referrers[winner], referrers[1-winner]
+	pl := utils.APIPayoutAddrPayload{Addr: winnerAddr, PayoutAddr: winnerAddr, CreatedOn: now + 1}
+	if err := a.SetPayoutAddr(pl); err != nil {
+		t.Fatalf("end redirection: %v", err)
+	}
+	pl = utils.APIPayoutAddrPayload{Addr: loser, PayoutAddr: payoutAddr, CreatedOn: now + 2}
+	if err := a.SetPayoutAddr(pl); err != nil {
+		t.Fatalf("expected freed payout address registered, got %v", err)
+	}
+}
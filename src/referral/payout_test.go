@@ -0,0 +1,61 @@
+package referral
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestPayoutAddrs(t *testing.T) {
+	trader := common.HexToAddress("0x01")
+	broker := common.HexToAddress("0xb0")
+	agency := common.HexToAddress("0xaa")
+	referrer := common.HexToAddress("0xbb")
+	payout := common.HexToAddress("0xcc")
+	p := PaymentExecution{
+		TraderAddr: trader.Hex(),
+		Code:       "ABC",
+		PoolId:     1,
+		TokenAddr:  "0xt1",
+		PayeeAddr:  []common.Address{trader, broker, agency, referrer},
+		AmountDecN: []*big.Int{big.NewInt(1), big.NewInt(2), big.NewInt(3), big.NewInt(4)},
+	}
+	// trader and broker are never redirected
+	redirects := map[common.Address]common.Address{trader: payout, broker: payout, referrer: payout}
+	p = withPayoutAddrs(p, redirects)
+	if p.payoutAddr(0) != trader || p.payoutAddr(1) != broker || p.payoutAddr(2) != agency || p.payoutAddr(3) != payout {
+		t.Fatalf("unexpected payout addresses %v", p.PayoutAddr)
+	}
+	if p.PayeeAddr[3] != referrer {
+		t.Errorf("payee changed to %s", p.PayeeAddr[3].Hex())
+	}
+	if q := withPayoutAddrs(p, nil); q.PayoutAddr != nil || q.payoutAddr(3) != referrer {
+		t.Errorf("expected no payout addresses, got %v", q.PayoutAddr)
+	}
+	// the payout address receives the amount
+	ap := aggregatePayments("1700000000", "sim", []PaymentExecution{p})[0]
+	if ap.PayeeAddr[3] != payout || ap.AmountDecN[3].Int64() != 4 {
+		t.Errorf("expected payment to payout address, got %v", ap.PayeeAddr)
+	}
+
+	// events are mapped back to the participant registered at block time
+	t0 := time.Unix(1700000000, 0)
+	history := []payoutRegistration{
+		{Addr: referrer, PayoutAddr: payout, CreatedOn: t0},
+		{Addr: referrer, PayoutAddr: referrer, CreatedOn: t0.Add(time.Hour)},
+	}
+	if a := payeeIdentity(history, payout, t0.Add(-time.Minute)); a != payout {
+		t.Errorf("expected %s before registration, got %s", payout.Hex(), a.Hex())
+	}
+	if a := payeeIdentity(history, payout, t0.Add(time.Minute)); a != referrer {
+		t.Errorf("expected %s, got %s", referrer.Hex(), a.Hex())
+	}
+	if a := payeeIdentity(history, payout, t0.Add(2*time.Hour)); a != payout {
+		t.Errorf("expected %s after reset, got %s", payout.Hex(), a.Hex())
+	}
+	if a := payeeIdentity(history, referrer, t0.Add(2*time.Hour)); a != referrer {
+		t.Errorf("expected %s, got %s", referrer.Hex(), a.Hex())
+	}
+}
@@ -0,0 +1,61 @@
+package referral
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// paymentWorkers is the number of payment transactions
+// submitted concurrently
+func (s Settings) paymentWorkers() int {
+	if s.PaymentWorkers < 1 {
+		return 1
+	}
+	return s.PaymentWorkers
+}
+
+// payAggregated submits the aggregated payments with up to
+// Settings.PaymentWorkers transactions in flight. Returns true if
+// payments were paused before all payments were submitted.
+func (a *App) payAggregated(batchTs string, aps []aggregatedPayment) bool {
+	// receipt queries of all workers share the rate limit
+	bucket := NewTokenBucket(5, 3)
+	jobs := make(chan aggregatedPayment)
+	var aborted atomic.Bool
+	var wg sync.WaitGroup
+	for w := 0; w < a.Settings.paymentWorkers(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ap := range jobs {
+				err := a.payBatch(ap, batchTs, bucket)
+				if err != nil {
+					aborted.Store(true)
+				}
+			}
+		}()
+	}
+	paused := false
+	for _, ap := range aps {
+		if a.batchPaused.Load() {
+			paused = true
+			break
+		}
+		if aborted.Load() {
+			slog.Info("aborting payments...")
+			break
+		}
+		slog.Info(fmt.Sprintf("Paying %d traders with %d payees in one transaction", len(ap.Payments), len(ap.PayeeAddr)))
+		jobs <- ap
+	}
+	close(jobs)
+	wg.Wait()
+	// nonces of payments that could not be sent block later transactions
+	err := a.PaymentExecutor.FillNonceGaps()
+	if err != nil {
+		slog.Error("Could not fill nonce gaps: " + err.Error())
+	}
+	return paused
+}
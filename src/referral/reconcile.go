@@ -0,0 +1,363 @@
+package referral
+
+import (
+	"errors"
+	"log/slog"
+	"math/big"
+	"referral-system/src/contracts"
+	"referral-system/src/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// kinds of reconciliation mismatches
+const (
+	RECON_MISSING = "missing" // on-chain, not in the database
+	RECON_EXTRA   = "extra"   // in the database, not on-chain
+	RECON_AMOUNT  = "amount"  // amounts differ
+	RECON_PAYEE   = "payee"   // receiving addresses differ
+)
+
+// reconPayment is the amount of one level of a payment, either
+// from referral_payment or from a payment event
+type reconPayment struct {
+	TxHash     string
+	TraderAddr string
+	PoolId     uint32
+	Level      int
+	BatchTs    int64
+	// address that received the amount
+	Payee  string
+	Amount *big.Int
+}
+
+type reconKey struct {
+	TxHash     string
+	TraderAddr string
+	PoolId     uint32
+	Level      int
+}
+
+func (p reconPayment) key() reconKey {
+	return reconKey{
+		TxHash:     strings.ToLower(p.TxHash),
+		TraderAddr: strings.ToLower(p.TraderAddr),
+		PoolId:     p.PoolId,
+		Level:      p.Level,
+	}
+}
+
+// Reconcile compares the payment events of the broker with the payments
+// in the database for the batches of the last days (default: the
+// payment lookback), stores and returns the result
+func (a *App) Reconcile(days int) (utils.APIReconciliation, error) {
+	if days <= 0 {
+		days = a.Settings.PaymentMaxLookBackDays
+	}
+	runTs := time.Now().Unix()
+	fromTs := runTs - int64(days*86400)
+	// a payment is mined after its batch timestamp: the events of the
+	// batches since fromTs are in the blocks since fromTs
+	fromBlock, _, err := contracts.FindBlockWithTs(a.RpcClient, uint64(fromTs))
+	if err != nil {
+		slog.Error("Reconcile: " + err.Error())
+		return utils.APIReconciliation{}, errors.New("failed to find start block")
+	}
+	logs, err := FilterPayments(a.MultipayCtrct, a.RpcClient, fromBlock, 0)
+	if err != nil {
+		slog.Error("Reconcile: " + err.Error())
+		return utils.APIReconciliation{}, errors.New("failed to read payment events")
+	}
+	chainRows := chainReconPayments(logs, a.BrokerAddr, a.Settings.BrokerId, fromTs)
+	dbRows, err := a.dbGetReconPayments(fromTs)
+	if err != nil {
+		slog.Error("Reconcile: " + err.Error())
+		return utils.APIReconciliation{}, errors.New("failed to query payments")
+	}
+	mismatches := reconcilePayments(dbRows, chainRows)
+	res := utils.APIReconciliation{
+		RunTs:      runTs,
+		FromTs:     fromTs,
+		Batches:    reconcileBatches(dbRows, chainRows, mismatches),
+		Mismatches: mismatches,
+	}
+	slog.Info("Reconciled " + strconv.Itoa(len(res.Batches)) + " batches since " + strconv.FormatInt(fromTs, 10) +
+		": " + strconv.Itoa(len(res.Mismatches)) + " mismatches")
+	err = a.dbInsertReconciliation(res)
+	if err != nil {
+		slog.Error("Reconcile: " + err.Error())
+		return utils.APIReconciliation{}, errors.New("failed to store reconciliation")
+	}
+	return res, nil
+}
+
+// chainReconPayments returns the amounts of the payment events sent by
+// the broker for batches since fromTs
+func chainReconPayments(logs []PaymentLog, brokerAddr, brokerId string, fromTs int64) []reconPayment {
+	var res []reconPayment
+	for _, p := range logs {
+		if !strings.EqualFold(p.BrokerAddr, brokerAddr) || int64(p.BatchTimestamp) < fromTs {
+			continue
+		}
+		if p.BrokerId != "" && p.BrokerId != brokerId {
+			continue
+		}
+		for k, payee := range p.PayeeAddr {
+			if p.AmountDecN[k].Sign() == 0 {
+				// zero amounts are not stored
+				continue
+			}
+			res = append(res, reconPayment{
+				TxHash:     p.TxHash,
+				TraderAddr: p.PayeeAddr[0].Hex(),
+				PoolId:     p.PoolId,
+				Level:      k,
+				BatchTs:    int64(p.BatchTimestamp),
+				Payee:      payee.Hex(),
+				Amount:     p.AmountDecN[k],
+			})
+		}
+	}
+	return res
+}
+
+// dbGetReconPayments returns the confirmed payments of the broker for
+// batches since fromTs. Unconfirmed payments are still checked by
+// ConfirmPaymentTxs.
+func (a *App) dbGetReconPayments(fromTs int64) ([]reconPayment, error) {
+	query := `SELECT tx_hash, trader_addr, pool_id, level, batch_ts,
+			COALESCE(payout_addr, payee_addr), paid_amount_cc
+		FROM referral_payment
+		WHERE lower(broker_addr) = lower($1)
+			AND batch_ts >= $2
+			AND tx_confirmed = true`
+	rows, err := a.Db.Query(query, a.BrokerAddr, time.Unix(fromTs, 0))
+	if err != nil {
+		return nil, errors.New("dbGetReconPayments: " + err.Error())
+	}
+	defer rows.Close()
+	var res []reconPayment
+	for rows.Next() {
+		var p reconPayment
+		var batchTs time.Time
+		var amount string
+		err = rows.Scan(&p.TxHash, &p.TraderAddr, &p.PoolId, &p.Level, &batchTs, &p.Payee, &amount)
+		if err != nil {
+			return nil, errors.New("dbGetReconPayments: " + err.Error())
+		}
+		p.BatchTs = batchTs.Unix()
+		p.Amount, _ = new(big.Int).SetString(amount, 10)
+		if p.Amount == nil {
+			p.Amount = new(big.Int)
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+// reconcilePayments compares the payments of the database with the
+// payments on-chain per transaction, trader, pool and level
+func reconcilePayments(dbRows, chainRows []reconPayment) []utils.APIReconciliationMismatch {
+	chain := make(map[reconKey]reconPayment, len(chainRows))
+	for _, p := range chainRows {
+		chain[p.key()] = p
+	}
+	res := []utils.APIReconciliationMismatch{}
+	seen := make(map[reconKey]bool, len(dbRows))
+	for _, d := range dbRows {
+		k := d.key()
+		seen[k] = true
+		c, exists := chain[k]
+		if !exists {
+			res = append(res, reconMismatch(RECON_EXTRA, &d, nil))
+			continue
+		}
+		if !strings.EqualFold(d.Payee, c.Payee) {
+			res = append(res, reconMismatch(RECON_PAYEE, &d, &c))
+		}
+		if d.Amount.Cmp(c.Amount) != 0 {
+			res = append(res, reconMismatch(RECON_AMOUNT, &d, &c))
+		}
+	}
+	for _, c := range chainRows {
+		if !seen[c.key()] {
+			res = append(res, reconMismatch(RECON_MISSING, nil, &c))
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].BatchTs != res[j].BatchTs {
+			return res[i].BatchTs < res[j].BatchTs
+		}
+		if res[i].TxHash != res[j].TxHash {
+			return res[i].TxHash < res[j].TxHash
+		}
+		if res[i].TraderAddr != res[j].TraderAddr {
+			return res[i].TraderAddr < res[j].TraderAddr
+		}
+		if res[i].PoolId != res[j].PoolId {
+			return res[i].PoolId < res[j].PoolId
+		}
+		return res[i].Level < res[j].Level
+	})
+	return res
+}
+
+// reconMismatch returns the mismatch of kind for the database payment d
+// and the on-chain payment c, either of which can be nil
+func reconMismatch(kind string, d, c *reconPayment) utils.APIReconciliationMismatch {
+	p := d
+	if p == nil {
+		p = c
+	}
+	m := utils.APIReconciliationMismatch{
+		BatchTs:    p.BatchTs,
+		Kind:       kind,
+		TxHash:     strings.ToLower(p.TxHash),
+		TraderAddr: strings.ToLower(p.TraderAddr),
+		PoolId:     p.PoolId,
+		Level:      p.Level,
+	}
+	if d != nil {
+		m.DbPayee = strings.ToLower(d.Payee)
+		m.DbAmountDecN = d.Amount.String()
+	}
+	if c != nil {
+		m.ChainPayee = strings.ToLower(c.Payee)
+		m.ChainAmountDecN = c.Amount.String()
+	}
+	return m
+}
+
+// reconcileBatches counts the payments and mismatches per batch
+func reconcileBatches(dbRows, chainRows []reconPayment, mismatches []utils.APIReconciliationMismatch) []utils.APIReconciliationBatch {
+	batches := make(map[int64]*utils.APIReconciliationBatch)
+	get := func(ts int64) *utils.APIReconciliationBatch {
+		if batches[ts] == nil {
+			batches[ts] = &utils.APIReconciliationBatch{BatchTs: ts}
+		}
+		return batches[ts]
+	}
+	for _, p := range dbRows {
+		get(p.BatchTs).DbPayments++
+	}
+	for _, p := range chainRows {
+		get(p.BatchTs).ChainPayments++
+	}
+	for _, m := range mismatches {
+		b := get(m.BatchTs)
+		switch m.Kind {
+		case RECON_MISSING:
+			b.Missing++
+		case RECON_EXTRA:
+			b.Extra++
+		case RECON_AMOUNT:
+			b.AmountDiffers++
+		case RECON_PAYEE:
+			b.PayeeDiffers++
+		}
+	}
+	res := make([]utils.APIReconciliationBatch, 0, len(batches))
+	for _, b := range batches {
+		res = append(res, *b)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].BatchTs < res[j].BatchTs
+	})
+	return res
+}
+
+// dbInsertReconciliation stores the result of a reconciliation run
+func (a *App) dbInsertReconciliation(r utils.APIReconciliation) error {
+	tx, err := a.Db.Begin()
+	if err != nil {
+		return errors.New("dbInsertReconciliation: " + err.Error())
+	}
+	defer tx.Rollback()
+	runTs := time.Unix(r.RunTs, 0)
+	query := `INSERT INTO referral_reconciliation_batch
+			(broker_id, run_ts, from_ts, batch_ts, db_payments, chain_payments, missing, extra, amount_differs, payee_differs)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	for _, b := range r.Batches {
+		_, err = tx.Exec(query, a.Settings.BrokerId, runTs, time.Unix(r.FromTs, 0), time.Unix(b.BatchTs, 0), b.DbPayments, b.ChainPayments,
+			b.Missing, b.Extra, b.AmountDiffers, b.PayeeDiffers)
+		if err != nil {
+			return errors.New("dbInsertReconciliation: " + err.Error())
+		}
+	}
+	query = `INSERT INTO referral_reconciliation_mismatch
+			(broker_id, run_ts, batch_ts, kind, tx_hash, trader_addr, pool_id, level,
+			 db_payee, chain_payee, db_amount_cc, chain_amount_cc)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NULLIF($11, '')::DECIMAL, NULLIF($12, '')::DECIMAL)`
+	for _, m := range r.Mismatches {
+		_, err = tx.Exec(query, a.Settings.BrokerId, runTs, time.Unix(m.BatchTs, 0), m.Kind, m.TxHash, m.TraderAddr,
+			m.PoolId, m.Level, m.DbPayee, m.ChainPayee, m.DbAmountDecN, m.ChainAmountDecN)
+		if err != nil {
+			return errors.New("dbInsertReconciliation: " + err.Error())
+		}
+	}
+	return tx.Commit()
+}
+
+// LastReconciliation returns the stored result of the latest
+// reconciliation run
+func (a *App) LastReconciliation() (utils.APIReconciliation, error) {
+	res := utils.APIReconciliation{
+		Batches:    []utils.APIReconciliationBatch{},
+		Mismatches: []utils.APIReconciliationMismatch{},
+	}
+	query := `SELECT run_ts, from_ts, batch_ts, db_payments, chain_payments, missing, extra, amount_differs, payee_differs
+		FROM referral_reconciliation_batch
+		WHERE broker_id = $1
+			AND run_ts = (SELECT MAX(run_ts) FROM referral_reconciliation_batch WHERE broker_id = $1)
+		ORDER BY batch_ts`
+	rows, err := a.Db.Query(query, a.Settings.BrokerId)
+	if err != nil {
+		slog.Error("LastReconciliation: " + err.Error())
+		return res, errors.New("failed to query reconciliation")
+	}
+	defer rows.Close()
+	var runTs, fromTs time.Time
+	for rows.Next() {
+		var b utils.APIReconciliationBatch
+		var batchTs time.Time
+		err = rows.Scan(&runTs, &fromTs, &batchTs, &b.DbPayments, &b.ChainPayments, &b.Missing, &b.Extra,
+			&b.AmountDiffers, &b.PayeeDiffers)
+		if err != nil {
+			slog.Error("LastReconciliation: " + err.Error())
+			return res, errors.New("failed to query reconciliation")
+		}
+		b.BatchTs = batchTs.Unix()
+		res.Batches = append(res.Batches, b)
+	}
+	if len(res.Batches) == 0 {
+		return res, nil
+	}
+	res.RunTs = runTs.Unix()
+	res.FromTs = fromTs.Unix()
+	query = `SELECT batch_ts, kind, tx_hash, trader_addr, pool_id, level, db_payee, chain_payee,
+			COALESCE(db_amount_cc::TEXT, ''), COALESCE(chain_amount_cc::TEXT, '')
+		FROM referral_reconciliation_mismatch
+		WHERE broker_id = $1 AND run_ts = $2
+		ORDER BY id`
+	rows2, err := a.Db.Query(query, a.Settings.BrokerId, runTs)
+	if err != nil {
+		slog.Error("LastReconciliation: " + err.Error())
+		return res, errors.New("failed to query reconciliation")
+	}
+	defer rows2.Close()
+	for rows2.Next() {
+		var m utils.APIReconciliationMismatch
+		var batchTs time.Time
+		err = rows2.Scan(&batchTs, &m.Kind, &m.TxHash, &m.TraderAddr, &m.PoolId, &m.Level, &m.DbPayee, &m.ChainPayee,
+			&m.DbAmountDecN, &m.ChainAmountDecN)
+		if err != nil {
+			slog.Error("LastReconciliation: " + err.Error())
+			return res, errors.New("failed to query reconciliation")
+		}
+		m.BatchTs = batchTs.Unix()
+		res.Mismatches = append(res.Mismatches, m)
+	}
+	return res, nil
+}
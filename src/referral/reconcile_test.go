@@ -0,0 +1,85 @@
+package referral
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestReconcilePayments(t *testing.T) {
+	broker := common.HexToAddress("0xb0")
+	trader := common.HexToAddress("0x01")
+	trader2 := common.HexToAddress("0x02")
+	brokerPayout := common.HexToAddress("0xb1")
+	referrer := common.HexToAddress("0xbb")
+	payout := common.HexToAddress("0xcc")
+	logs := []PaymentLog{
+		{
+			BatchTimestamp: 1700000000, PoolId: 1, BrokerAddr: broker.Hex(), TxHash: "0xAA",
+			PayeeAddr:  []common.Address{trader, brokerPayout, referrer},
+			AmountDecN: []*big.Int{big.NewInt(0), big.NewInt(5), big.NewInt(7)},
+		},
+		{
+			BatchTimestamp: 1700000000, PoolId: 1, BrokerAddr: broker.Hex(), TxHash: "0xbb",
+			PayeeAddr:  []common.Address{trader2, brokerPayout, payout},
+			AmountDecN: []*big.Int{big.NewInt(1), big.NewInt(2), big.NewInt(3)},
+		},
+		// other broker and batch before the reconciled period
+		{BatchTimestamp: 1700000000, PoolId: 1, BrokerAddr: "0xb9", TxHash: "0xcc",
+			PayeeAddr: []common.Address{trader}, AmountDecN: []*big.Int{big.NewInt(1)}},
+		{BatchTimestamp: 1600000000, PoolId: 1, BrokerAddr: broker.Hex(), TxHash: "0xdd",
+			PayeeAddr: []common.Address{trader}, AmountDecN: []*big.Int{big.NewInt(1)}},
+	}
+	chainRows := chainReconPayments(logs, broker.Hex(), "sim", 1690000000)
+	if len(chainRows) != 5 {
+		t.Fatalf("expected 5 on-chain amounts, got %d", len(chainRows))
+	}
+	dbRows := []reconPayment{
+		// matches, hashes and addresses in lower case
+		{TxHash: "0xaa", TraderAddr: "0x0000000000000000000000000000000000000001", PoolId: 1, Level: 1, BatchTs: 1700000000,
+			Payee: "0x00000000000000000000000000000000000000b1", Amount: big.NewInt(5)},
+		// amount differs
+		{TxHash: "0xaa", TraderAddr: trader.Hex(), PoolId: 1, Level: 2, BatchTs: 1700000000,
+			Payee: referrer.Hex(), Amount: big.NewInt(8)},
+		// payee differs: paid to the referrer instead of its payout address
+		{TxHash: "0xbb", TraderAddr: trader2.Hex(), PoolId: 1, Level: 2, BatchTs: 1700000000,
+			Payee: referrer.Hex(), Amount: big.NewInt(3)},
+		// not on chain
+		{TxHash: "0xee", TraderAddr: trader.Hex(), PoolId: 2, Level: 1, BatchTs: 1700086400,
+			Payee: brokerPayout.Hex(), Amount: big.NewInt(4)},
+	}
+	// levels 0 and 1 of 0xbb are missing
+	mismatches := reconcilePayments(dbRows, chainRows)
+	kinds := []string{RECON_AMOUNT, RECON_MISSING, RECON_MISSING, RECON_PAYEE, RECON_EXTRA}
+	if len(mismatches) != len(kinds) {
+		t.Fatalf("expected %d mismatches, got %+v", len(kinds), mismatches)
+	}
+	for k, m := range mismatches {
+		if m.Kind != kinds[k] {
+			t.Errorf("mismatch %d: expected %s, got %+v", k, kinds[k], m)
+		}
+	}
+	if m := mismatches[0]; m.DbAmountDecN != "8" || m.ChainAmountDecN != "7" || m.Level != 2 {
+		t.Errorf("unexpected amount mismatch %+v", m)
+	}
+	if m := mismatches[3]; m.DbPayee != strings.ToLower(referrer.Hex()) || m.ChainPayee != strings.ToLower(payout.Hex()) {
+		t.Errorf("unexpected payee mismatch %+v", m)
+	}
+	if m := mismatches[4]; m.ChainAmountDecN != "" || m.DbAmountDecN != "4" {
+		t.Errorf("unexpected extra payment %+v", m)
+	}
+
+	batches := reconcileBatches(dbRows, chainRows, mismatches)
+	if len(batches) != 2 {
+		t.Fatalf("expected 2 batches, got %+v", batches)
+	}
+	b := batches[0]
+	if b.BatchTs != 1700000000 || b.DbPayments != 3 || b.ChainPayments != 5 || b.Missing != 2 || b.AmountDiffers != 1 || b.PayeeDiffers != 1 || b.Extra != 0 {
+		t.Errorf("unexpected batch %+v", b)
+	}
+	if b := batches[1]; b.Extra != 1 || b.ChainPayments != 0 {
+		t.Errorf("unexpected batch %+v", b)
+	}
+}
@@ -10,9 +10,12 @@ import (
 	"os"
 	"referral-system/env"
 	"referral-system/src/contracts"
+	"referral-system/src/metrics"
 	"referral-system/src/utils"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/D8-X/d8x-futures-go-sdk/config"
@@ -30,6 +33,13 @@ type App struct {
 	RpcClient       *ethclient.Client
 	MultipayCtrct   *contracts.MultiPay
 	BrokerAddr      string
+	rpcEndpoint     string      // host of the current rpc, for metrics
+	rpcIdx          int         // index of the current rpc in Rpc
+	rpcMu           sync.Mutex  // guards RpcClient, rpcEndpoint and rpcIdx
+	failoverMu      sync.Mutex  // held while the rpc is switched
+	batchMu         sync.Mutex  // held while a payment batch is processed
+	batchPaused     atomic.Bool // payments are paused by an admin
+	indexMu         sync.Mutex  // held while the indexer processes a block range
 }
 
 type Settings struct {
@@ -43,6 +53,30 @@ type Settings struct {
 	ReferrerCut      [][]float64    `json:"referrerCutPercentForTokenXHolding"`
 	BrokerPayoutAddr common.Address `json:"brokerPayoutAddr"`
 	BrokerId         string         `json:"brokerId"`
+	// minimal payout amount per margin token address, smaller
+	// payments are carried forward to a later batch
+	MinPayout map[string]float64 `json:"minPayoutPerToken"`
+	// days after which carried fees are paid regardless of the
+	// minimal payout, default 30
+	MaxCarryDays int       `json:"maxCarryDays"`
+	GasPolicy    GasPolicy `json:"gasPolicy"`
+	// price of the native token of the chain in units of the margin
+	// token, per margin token address, for the gas share of the cost
+	// reports
+	GasTokenPrice map[string]float64 `json:"gasTokenPricePerToken"`
+	// number of payment transactions submitted concurrently, default 1
+	PaymentWorkers int `json:"paymentWorkers"`
+	// PAYOUT_MODE_PUSH (default) or PAYOUT_MODE_CLAIM
+	PayoutMode string `json:"payoutMode"`
+	// claim distributor contract in payout mode claim, claim
+	// allocations are settled once their root is set on it
+	ClaimDistributorAddr string `json:"claimDistributorAddr"`
+	// retries of failed payments
+	RetryPolicy RetryPolicy `json:"retryPolicy"`
+	// continuous payment event indexer
+	Indexer IndexerSettings `json:"indexer"`
+	// webhook notifications of partners
+	Webhooks WebhookSettings `json:"webhooks"`
 }
 
 type Rpc struct {
@@ -82,17 +116,30 @@ type PaymentLog struct {
 	BrokerAddr     string
 	TxHash         string
 	BlockNumber    uint64
+	BlockHash      string
 	BlockTs        uint64
 	PayeeAddr      []common.Address
 	AmountDecN     []*big.Int
+	// broker id of the message, empty before message version 3
+	BrokerId string
 }
 
 type PaymentExecution struct {
-	Code       string
-	PoolId     uint32
-	TokenAddr  string
-	PayeeAddr  []common.Address
+	TraderAddr    string
+	Code          string
+	PoolId        uint32
+	TokenAddr     string
+	TokenDecimals uint8
+	PayeeAddr     []common.Address
+	// addresses that receive the amounts if a payee registered a
+	// payout address, nil otherwise
+	PayoutAddr []common.Address
 	AmountDecN []*big.Int
+	TotalDecN  *big.Int
+	Msg        string
+	Id         int64
+	// last trade considered by the payment (Id in full precision)
+	LastTradeConsidered time.Time
 }
 
 type DbPayment struct {
@@ -127,7 +174,10 @@ func (a *App) New(viper *viper.Viper) error {
 	}
 	a.Rpc = rpcs
 
-	a.PaymentExecutor = &RemotePayExec{}
+	a.PaymentExecutor, err = NewPayExec(viper.GetString(env.PAY_EXEC_MODE))
+	if err != nil {
+		return err
+	}
 	slog.Info("Init PaymentExecutor")
 	mAddr, err := config.GetMultiPayAddr(int64(a.Settings.ChainId))
 	if err != nil {
@@ -138,8 +188,12 @@ func (a *App) New(viper *viper.Viper) error {
 	if err != nil {
 		return err
 	}
+	a.PaymentExecutor.SetGasPolicy(a.Settings.GasPolicy)
+	a.BrokerAddr = strings.ToLower(a.PaymentExecutor.GetBrokerAddr().String())
 
-	if strings.EqualFold(a.PaymentExecutor.GetExecutorAddrHex(), a.PaymentExecutor.GetBrokerAddr().String()) {
+	// the local executor can pay directly as broker
+	_, isLocal := a.PaymentExecutor.(*LocalPayExec)
+	if !isLocal && strings.EqualFold(a.PaymentExecutor.GetExecutorAddrHex(), a.PaymentExecutor.GetBrokerAddr().String()) {
 		return errors.New("executor address and broker address must differ")
 	}
 	if strings.EqualFold(a.Settings.BrokerPayoutAddr.String(), a.PaymentExecutor.GetBrokerAddr().String()) {
@@ -185,35 +239,94 @@ func (a *App) New(viper *viper.Viper) error {
 }
 
 // loadConfig loads the configuration file from the file system
-// and returns the Setting struct
+// and returns the Setting struct of the configured chain and broker.
+// Without BROKER_ID the first setting of the chain is used.
 func loadConfig(v *viper.Viper) (Settings, error) {
+	settings, err := loadChainConfigs(v)
+	if err != nil {
+		return Settings{}, err
+	}
+	targetChain := v.GetInt(env.CHAIN_ID)
+	brokerId := v.GetString(env.BROKER_ID)
+	for k := 0; k < len(settings); k++ {
+		if brokerId == "" || settings[k].BrokerId == brokerId {
+			setting := settings[k]
+			setting.TokenX.Address = strings.ToLower(setting.TokenX.Address)
+			minPayout := make(map[string]float64, len(setting.MinPayout))
+			for token, amount := range setting.MinPayout {
+				minPayout[strings.ToLower(token)] = amount
+			}
+			setting.MinPayout = minPayout
+			gasTokenPrice := make(map[string]float64, len(setting.GasTokenPrice))
+			for token, price := range setting.GasTokenPrice {
+				gasTokenPrice[strings.ToLower(token)] = price
+			}
+			setting.GasTokenPrice = gasTokenPrice
+			setting.PayoutMode = strings.ToLower(setting.PayoutMode)
+			switch setting.PayoutMode {
+			case "":
+				setting.PayoutMode = PAYOUT_MODE_PUSH
+			case PAYOUT_MODE_PUSH, PAYOUT_MODE_CLAIM:
+			default:
+				return Settings{}, errors.New("unknown payout mode " + setting.PayoutMode)
+			}
+			if setting.PayoutMode == PAYOUT_MODE_CLAIM && !common.IsHexAddress(setting.ClaimDistributorAddr) {
+				return Settings{}, errors.New("payout mode claim requires claimDistributorAddr")
+			}
+			return setting, nil
+		}
+	}
+	return Settings{}, errors.New("No setting found for broker " + brokerId + " on chain id " + strconv.Itoa(targetChain))
+}
+
+// LoadBrokerIds returns the ids of the brokers configured for
+// the chain, in the order of the configuration file
+func LoadBrokerIds(v *viper.Viper) ([]string, error) {
+	settings, err := loadChainConfigs(v)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(settings))
+	for k := 0; k < len(settings); k++ {
+		ids = append(ids, settings[k].BrokerId)
+	}
+	return ids, nil
+}
+
+// loadChainConfigs loads the configuration file from the file system
+// and returns all settings of the configured chain, one per broker
+func loadChainConfigs(v *viper.Viper) ([]Settings, error) {
 	fileName := v.GetString(env.CONFIG_PATH)
 	var settings []Settings
 	data, err := os.ReadFile(fileName)
 	if err != nil {
-		return Settings{}, err
+		return nil, err
 	}
 	err = json.Unmarshal(data, &settings)
 	if err != nil {
-		return Settings{}, err
+		return nil, err
 	}
-	// pick correct setting by chain id
-	var setting Settings = Settings{}
+	// pick settings by chain id
 	targetChain := v.GetInt(env.CHAIN_ID)
+	var chainSettings []Settings
+	brokers := make(map[string]bool)
 	for k := 0; k < len(settings); k++ {
-		if settings[k].ChainId == targetChain {
-			setting = settings[k]
-			if setting.BrokerId == "" {
-				return Settings{}, errors.New("brokerId missing in referralSettings.json")
-			}
-			break
+		if settings[k].ChainId != targetChain {
+			continue
+		}
+		if settings[k].BrokerId == "" {
+			return nil, errors.New("brokerId missing in referralSettings.json")
 		}
+		if brokers[settings[k].BrokerId] {
+			return nil, errors.New("brokerId " + settings[k].BrokerId + " configured twice for chain id " + strconv.Itoa(targetChain))
+		}
+		brokers[settings[k].BrokerId] = true
+		chainSettings = append(chainSettings, settings[k])
 	}
-	if setting.ChainId != targetChain {
-		return Settings{}, errors.New("No setting found for chain id " + strconv.Itoa(targetChain))
+	if len(chainSettings) == 0 {
+		return nil, errors.New("No setting found for chain id " + strconv.Itoa(targetChain))
 	}
-	setting.TokenX.Address = strings.ToLower(setting.TokenX.Address)
-	return setting, nil
+	return chainSettings, nil
 }
 
 // loadRPCConfig loads the RPC list for the
@@ -364,13 +477,24 @@ func (a *App) confirmPaymentTrial() bool {
 
 	for _, tx := range txs {
 		bucket.WaitForToken("ConfirmPaymentTxs", false)
-		status := QueryTxStatus(a.RpcClient, tx)
+		// confirm the transaction that was mined if tx was replaced
+		receipt, minedHash := a.queryTxFamilyReceipt(tx)
+		status := receiptTxStatus(receipt)
+		if receipt != nil {
+			a.dbInsertPaymentGas(time.Unix(ts, 0), a.dbGetPaymentTxToken(tx), receipt)
+		}
 		if status == TxFailed {
+			// notify before the payments are purged
+			a.notifyPayment(WEBHOOK_EVENT_PAYMENT_FAILED, tx, ts)
 			fail = append(fail, tx)
 			continue
 		}
 		if status == TxConfirmed {
-			success = append(success, tx)
+			if minedHash != tx {
+				a.dbSetPaymentTxHash(tx, minedHash)
+			}
+			a.notifyPayment(WEBHOOK_EVENT_PAYMENT_CONFIRMED, minedHash, ts)
+			success = append(success, minedHash)
 			continue
 		}
 		hasTxNotFound = true
@@ -395,18 +519,26 @@ func (a *App) confirmPaymentTrial() bool {
 }
 
 // DBGetUnconfirmedPayTxForLastBatch assembles an array of tx-ids ([]string)
-// for payments that have not been confirmed (in table referral_payment)
-// returns the tx-id string array and the timestamp of the batch
+// for payments of the broker that have not been confirmed (in table referral_payment)
+// in the last batch of the broker, returns the tx-id string array and the timestamp of the batch
 func (a *App) DBGetUnconfirmedPayTxForLastBatch() ([]string, int64) {
 	query := `SELECT distinct(tx_hash),
 				rp.batch_ts
 				FROM referral_payment rp 
+				join referral_settings rs 
+				ON rs.property = 'broker_addr'
+				AND rs.broker_id = $1
+				AND lower(rs.value) = lower(rp.broker_addr)
 				WHERE rp.tx_confirmed = false 
 				AND batch_ts IN (
 					SELECT max(rp2.batch_ts) as max_ts
 					FROM referral_payment rp2 
+					join referral_settings rs2 
+					ON rs2.property = 'broker_addr'
+					AND rs2.broker_id = $1
+					AND lower(rs2.value) = lower(rp2.broker_addr)
 				)`
-	rows, err := a.Db.Query(query)
+	rows, err := a.Db.Query(query, a.Settings.BrokerId)
 	if err != nil {
 		slog.Error("Error in DBGetUnconfirmedPayTxForLastBatch:" + err.Error())
 		return []string{}, 0
@@ -458,13 +590,48 @@ func (a *App) SavePayments() error {
 		return err
 	}
 	slog.Info(fmt.Sprintf("found %d payments to process", len(payments)))
+	return a.savePaymentLogs(payments)
+}
+
+// isBrokerSender returns true if the payment was sent by the broker
+// address. The sender of the event is the only authenticated part of a
+// payment: the integrity checksum of the message is not keyed and
+// messages before version 3 carry no broker id at all, anyone can send
+// a payment with the message of another broker.
+func isBrokerSender(p PaymentLog, brokerAddr string) bool {
+	return strings.EqualFold(p.BrokerAddr, brokerAddr)
+}
+
+// savePaymentLogs updates or inserts the database entries of the
+// payment events
+func (a *App) savePaymentLogs(payments []PaymentLog) error {
+	// payments to payout addresses are stored under the participant
+	history, err := a.dbGetPayoutHistory()
+	if err != nil {
+		return err
+	}
 	for _, p := range payments {
+		if p.BrokerId != "" && p.BrokerId != a.Settings.BrokerId {
+			slog.Info("Ignoring payment of broker " + p.BrokerId + " in tx " + p.TxHash)
+			continue
+		}
+		if !isBrokerSender(p, a.BrokerAddr) {
+			slog.Warn("Ignoring payment sent by " + p.BrokerAddr + " in tx " + p.TxHash + ", not the broker address")
+			continue
+		}
 		// key = trader_addr, payee_addr, pool_id, batch_timestamp
 		traderAddr := p.PayeeAddr[0].String()
+		blockTime := time.Unix(int64(p.BlockTs), 0)
 		for k, payee := range p.PayeeAddr {
 			result := p.AmountDecN[k].Cmp(big.NewInt(0))
 			if result != 0 {
-				err := a.writeDbPayment(traderAddr, payee.String(), p, k)
+				payout := ""
+				if k >= PAYOUT_REDIRECT_MIN_LEVEL {
+					if identity := payeeIdentity(history, payee, blockTime); identity != payee {
+						payout, payee = payee.String(), identity
+					}
+				}
+				err := a.writeDbPayment(traderAddr, payee.String(), payout, p, k)
 				if err != nil {
 					slog.Error(err.Error())
 				}
@@ -477,7 +644,7 @@ func (a *App) SavePayments() error {
 
 // PurgeUnconfirmedPayments deletes records from the database that could not be
 // confirmed on-chain and are in txs list, adds them to failed payments table
-// If txs is nil, all unconfirmed payments (tx_confirmed = false) will be deleted
+// If txs is nil, all unconfirmed payments (tx_confirmed = false) of the broker will be deleted
 func (a *App) PurgeUnconfirmedPayments(txs []string) error {
 	query := `SELECT trader_addr, payee_addr, 
 					code, level, pool_id, batch_ts, paid_amount_cc, 
@@ -495,6 +662,9 @@ func (a *App) PurgeUnconfirmedPayments(txs []string) error {
 	defer rows.Close()
 	var row DbPayment
 	var idx = 0
+	purged := make(map[string]bool)
+	var failed []failedPaymentKey
+	isFailed := make(map[failedPaymentKey]bool)
 	for rows.Next() {
 		inDeleteList := txs == nil
 		rows.Scan(&row.TraderAddr, &row.PayeeAddr, &row.Code, &row.Level, &row.PoolId, &row.BatchTs, &row.PaidAmountCC,
@@ -509,6 +679,10 @@ func (a *App) PurgeUnconfirmedPayments(txs []string) error {
 			continue
 		}
 		slog.Info("Moving to failed payments tx hash = " + row.TxHash)
+		if !purged[row.TxHash] {
+			purged[row.TxHash] = true
+			metrics.Payments.WithLabelValues(a.chainLabel(), a.Settings.BrokerId, metrics.PAYMENT_PURGED, strconv.Itoa(row.PoolId), a.poolTokenAddr(uint32(row.PoolId))).Inc()
+		}
 		query = `INSERT INTO referral_failed_payment
 			(trader_addr, payee_addr, code, level, pool_id, batch_ts, paid_amount_cc, tx_hash, ts)
 			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
@@ -518,14 +692,25 @@ func (a *App) PurgeUnconfirmedPayments(txs []string) error {
 		if err != nil {
 			slog.Error("could not insert tx to failed tx " + row.TxHash + ": " + err.Error())
 		}
+		k := failedPaymentKey{TraderAddr: row.TraderAddr, PoolId: row.PoolId, Code: row.Code, BatchTs: row.BatchTs, TxHash: row.TxHash}
+		if !isFailed[k] {
+			isFailed[k] = true
+			failed = append(failed, k)
+		}
 		query = `DELETE FROM referral_payment rp
-			WHERE tx_hash=$1`
-		_, err = a.Db.Query(query, row.TxHash)
+			USING referral_settings rs
+			WHERE rp.tx_hash=$1
+				AND rs.property = 'broker_addr'
+				AND rs.broker_id = $2
+				AND lower(rs.value) = lower(rp.broker_addr)`
+		_, err = a.Db.Exec(query, row.TxHash, a.Settings.BrokerId)
 		if err != nil {
 			slog.Error("Could not delete unconfirmed payments:" + err.Error())
 		}
 	}
-
+	for _, k := range failed {
+		a.scheduleRetry(k)
+	}
 	return nil
 }
 
@@ -669,17 +854,23 @@ func (a *App) IsAgency(addr string) (bool, bool) {
 }
 
 // dbWriteTx write info about the payment transaction into referral_payment
-func (a *App) dbWriteTx(traderAddr, brokerAddr, code string, amounts []*big.Int, payees []common.Address, batchTs string, poolId uint32, tx string) {
+// payouts are the addresses that received the amounts, nil if no payee
+// registered a payout address
+func (a *App) dbWriteTx(traderAddr, brokerAddr, code string, amounts []*big.Int, payees, payouts []common.Address, batchTs string, poolId uint32, tx string) {
 	slog.Info("Inserting Payment TX in DB")
 	t, _ := strconv.Atoi(batchTs)
 	ts := time.Unix(int64(t), 0)
-	query := `INSERT INTO referral_payment (trader_addr, payee_addr, code, level, pool_id, batch_ts, paid_amount_cc, tx_hash, broker_addr)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	query := `INSERT INTO referral_payment (trader_addr, payee_addr, code, level, pool_id, batch_ts, paid_amount_cc, tx_hash, broker_addr, payout_addr)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
 	for k := 0; k < len(payees); k++ {
 		if amounts[k].BitLen() == 0 {
 			// we don't write 0 amounts to the database
 			continue
 		}
+		var payout sql.NullString
+		if payouts != nil && payouts[k] != payees[k] {
+			payout = sql.NullString{String: strings.ToLower(payouts[k].String()), Valid: true}
+		}
 		_, err := a.Db.Exec(query,
 			strings.ToLower(traderAddr),
 			strings.ToLower(payees[k].String()),
@@ -689,7 +880,8 @@ func (a *App) dbWriteTx(traderAddr, brokerAddr, code string, amounts []*big.Int,
 			ts,
 			amounts[k].String(),
 			tx,
-			strings.ToLower(brokerAddr))
+			strings.ToLower(brokerAddr),
+			payout)
 		if err != nil {
 			slog.Error(fmt.Sprintf("dbWriteTx: could not insert tx to db for trader %s and broker %s, lvl %d, code %s: %s", traderAddr, brokerAddr, k, code, err.Error()))
 		}
@@ -698,8 +890,9 @@ func (a *App) dbWriteTx(traderAddr, brokerAddr, code string, amounts []*big.Int,
 
 // writeDbPayment writes data from multipay contract into the database
 // if there is already an entry for a given record which is not confirmed, it sets the confirmed flag to true
-// db keys are trader_addr, payee_addr, pool_id and batch_ts
-func (a *App) writeDbPayment(traderAddr string, payeeAddr string, p PaymentLog, payIdx int) error {
+// db keys are trader_addr, payee_addr, pool_id, code, batch_ts and level
+// payoutAddr is the address that received the amount if it is not the payee
+func (a *App) writeDbPayment(traderAddr string, payeeAddr string, payoutAddr string, p PaymentLog, payIdx int) error {
 	if a.Db == nil {
 		return errors.New("db not initialized")
 	}
@@ -712,7 +905,8 @@ func (a *App) writeDbPayment(traderAddr string, payeeAddr string, p PaymentLog,
 			  	AND lower(payee_addr) = lower($2) 
 				AND batch_ts = $3 
 				AND pool_id=$4
-				AND level=$5`
+				AND level=$5
+				AND code=$6`
 	// we are not adding AND broker_addr=brokerAddr in this query because after db migration the entry broker_addr is empty.
 	// the risk that we have two exact same entries but for the brokerAddr is very very low. Not adding it above ensures
 	// we fill the table historically with the broker_addr
@@ -721,14 +915,14 @@ func (a *App) writeDbPayment(traderAddr string, payeeAddr string, p PaymentLog,
 	var utcBlockTimeDb time.Time
 	var blockNrDb sql.NullInt64
 	var blockNr int64
-	err := a.Db.QueryRow(query, traderAddr, payeeAddr, utcBatchTime, p.PoolId, payIdx).Scan(&isConfirmed, &dbBrokerAddr, &blockNrDb, &utcBlockTimeDb)
+	err := a.Db.QueryRow(query, traderAddr, payeeAddr, utcBatchTime, p.PoolId, payIdx, p.Code).Scan(&isConfirmed, &dbBrokerAddr, &blockNrDb, &utcBlockTimeDb)
 	if err == sql.ErrNoRows {
 		// insert
 		query = `INSERT INTO referral_payment 
 			(trader_addr, payee_addr, code, level, 
 			 pool_id, batch_ts, paid_amount_cc, tx_hash, 
-			 block_nr, block_ts, tx_confirmed, broker_addr)
-          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+			 block_nr, block_ts, tx_confirmed, broker_addr, payout_addr)
+          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, NULLIF($13, ''))`
 		_, err := a.Db.Exec(query,
 			traderAddr,
 			payeeAddr,
@@ -741,10 +935,12 @@ func (a *App) writeDbPayment(traderAddr string, payeeAddr string, p PaymentLog,
 			p.BlockNumber,
 			utcBlockTime,
 			true,
-			brokerAddr)
+			brokerAddr,
+			strings.ToLower(payoutAddr))
 		if err != nil {
 			return errors.New("Failed to insert data: " + err.Error())
 		}
+		return nil
 	}
 	if err != nil {
 		return err
@@ -761,9 +957,11 @@ func (a *App) writeDbPayment(traderAddr string, payeeAddr string, p PaymentLog,
 				WHERE lower(trader_addr) = lower($1) 
 					AND lower(payee_addr) = lower($2) 
 					AND batch_ts = $3
-					AND level = $4`
+					AND level = $4
+					AND pool_id = $8
+					AND code = $9`
 		fmt.Printf("updating referral payment db entry at block %d time %s\n", p.BlockNumber, utcBlockTime.Format(time.RFC3339))
-		_, err := a.Db.Exec(query, traderAddr, payeeAddr, utcBatchTime, payIdx, p.BlockNumber, utcBlockTime, brokerAddr)
+		_, err := a.Db.Exec(query, traderAddr, payeeAddr, utcBatchTime, payIdx, p.BlockNumber, utcBlockTime, brokerAddr, p.PoolId, p.Code)
 		if err != nil {
 			return errors.New("failed to insert data: " + err.Error())
 		}
@@ -794,14 +992,18 @@ func (a *App) HasLoopOnChainAddition(parent string, newChild string) (bool, erro
 // before. The error message returned (if any) is exposed to the API
 func (a *App) SelectCode(csp utils.APICodeSelectionPayload) error {
 	csp.TraderAddr = strings.ToLower(csp.TraderAddr)
+	if err := a.checkDenied(DENY_ACTION_SELECT_CODE, csp.TraderAddr); err != nil {
+		return err
+	}
 	timeNow := time.Now().Unix()
 	// code exists?
-	query := `SELECT expiry
+	query := `SELECT expiry, valid_from, LOWER(referrer_addr)
 		FROM referral_code
 		WHERE code=$1
 		AND broker_id=$2`
-	var ts time.Time
-	err := a.Db.QueryRow(query, csp.Code, a.Settings.BrokerId).Scan(&ts)
+	var ts, validFrom time.Time
+	var referrerAddr string
+	err := a.Db.QueryRow(query, csp.Code, a.Settings.BrokerId).Scan(&ts, &validFrom, &referrerAddr)
 	if err != sql.ErrNoRows && err != nil {
 		slog.Info("Failed to search for code:" + err.Error())
 		return errors.New("Failed")
@@ -813,6 +1015,10 @@ func (a *App) SelectCode(csp utils.APICodeSelectionPayload) error {
 		slog.Info("Code " + csp.Code + " expired")
 		return errors.New("code expired")
 	}
+	if validFrom.After(time.Unix(timeNow, 0)) {
+		slog.Info("Code " + csp.Code + " not yet valid")
+		return errors.New("code not yet valid")
+	}
 
 	// first reset valid until for code
 	type SQLResponse struct {
@@ -860,42 +1066,111 @@ func (a *App) SelectCode(csp utils.APICodeSelectionPayload) error {
 		slog.Error("Failed to insert data: " + err.Error())
 		return errors.New("failed inserting new code")
 	}
+	a.notify(WEBHOOK_EVENT_CODE_SELECTED, webhookCodeSelected{
+		TraderAddr:   csp.TraderAddr,
+		Code:         csp.Code,
+		ReferrerAddr: referrerAddr,
+	}, csp.TraderAddr, referrerAddr)
 	return nil
 }
 
-// UpsertCode inserts new codes and updates the code rebate
+// UpsertCode inserts new codes and updates the code rebate and
+// validity in one transaction
 func (a *App) UpsertCode(csp utils.APICodePayload) error {
 	var passOn float32 = float32(csp.PassOnPercTDF) / 100.0
+	if err := a.checkDenied(DENY_ACTION_UPSERT_CODE, csp.ReferrerAddr); err != nil {
+		return err
+	}
+	tx, err := a.Db.Begin()
+	if err != nil {
+		slog.Error("Failed to start code upsert:" + err.Error())
+		return errors.New("Failed")
+	}
+	defer tx.Rollback()
 	// check whether code exists
-	query := `SELECT referrer_addr 
+	query := `SELECT referrer_addr, valid_from, expiry
 		FROM referral_code
 		WHERE code=$1
-		AND broker_id=$2`
+		AND broker_id=$2
+		FOR UPDATE`
 	var refAddr string
-	err := a.Db.QueryRow(query, csp.Code, a.Settings.BrokerId).Scan(&refAddr)
+	var validFrom, expiry time.Time
+	err = tx.QueryRow(query, csp.Code, a.Settings.BrokerId).Scan(&refAddr, &validFrom, &expiry)
 	if err != sql.ErrNoRows && err != nil {
 		slog.Info("Failed to query latest code:" + err.Error())
 		return errors.New("Failed")
 	} else if err == sql.ErrNoRows {
 		// not found, we can insert
 		query = `INSERT INTO referral_code (code, referrer_addr, trader_rebate_perc, broker_id)
-          VALUES ($1, $2, $3, $4)`
-		_, err := a.Db.Exec(query, csp.Code, csp.ReferrerAddr, passOn, a.Settings.BrokerId)
+          VALUES ($1, $2, $3, $4)
+          RETURNING valid_from, expiry`
+		err := tx.QueryRow(query, csp.Code, csp.ReferrerAddr, passOn, a.Settings.BrokerId).Scan(&validFrom, &expiry)
 		if err != nil {
 			slog.Error("Failed to insert code" + err.Error())
 			return errors.New("failed to insert code")
 		}
+	} else {
+		// found, we check whether the referral addr is correct
+		if strings.ToLower(refAddr) != csp.ReferrerAddr {
+			return errors.New("not code owner")
+		}
+		query = `UPDATE referral_code SET trader_rebate_perc = $1
+			 WHERE code = $2 AND broker_id=$3`
+		_, err = tx.Exec(query, passOn, csp.Code, a.Settings.BrokerId)
+		if err != nil {
+			return errors.New("Failed to insert data: " + err.Error())
+		}
+	}
+	if err := a.dbSetCodeValidity(tx, csp, validFrom, expiry); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		slog.Error("Failed to commit code upsert:" + err.Error())
+		return errors.New("failed to upsert code")
+	}
+	a.notify(WEBHOOK_EVENT_CODE_UPSERTED, webhookCodeUpserted{
+		Code:             csp.Code,
+		ReferrerAddr:     strings.ToLower(csp.ReferrerAddr),
+		TraderRebatePerc: passOn,
+	}, csp.ReferrerAddr)
+	return nil
+}
+
+// dbSetCodeValidity sets the validity window of a code if it is part
+// of the payload. Fields that are not set keep the stored validFrom and
+// expiry, the resulting expiry must be after the start. Expiry
+// CODE_EXPIRY_NONE resets the expiry to the default (no expiry).
+func (a *App) dbSetCodeValidity(tx *sql.Tx, csp utils.APICodePayload, validFrom, expiry time.Time) error {
+	if !csp.HasValidity() {
 		return nil
 	}
-	// found, we check whether the referral addr is correct
-	if strings.ToLower(refAddr) != csp.ReferrerAddr {
-		return errors.New("not code owner")
+	if csp.ValidFrom != 0 {
+		validFrom = time.Unix(int64(csp.ValidFrom), 0)
+	}
+	var err error
+	if csp.Expiry == utils.CODE_EXPIRY_NONE {
+		query := `UPDATE referral_code
+			SET valid_from = $1,
+				expiry = DEFAULT
+			WHERE code = $2 AND broker_id=$3
+			RETURNING expiry`
+		err = tx.QueryRow(query, validFrom, csp.Code, a.Settings.BrokerId).Scan(&expiry)
+	} else {
+		if csp.Expiry != 0 {
+			expiry = time.Unix(int64(csp.Expiry), 0)
+		}
+		query := `UPDATE referral_code
+			SET valid_from = $1,
+				expiry = $2
+			WHERE code = $3 AND broker_id=$4`
+		_, err = tx.Exec(query, validFrom, expiry, csp.Code, a.Settings.BrokerId)
 	}
-	query = `UPDATE referral_code SET trader_rebate_perc = $1
-			 WHERE code = $2 AND broker_id=$3`
-	_, err = a.Db.Exec(query, passOn, csp.Code, a.Settings.BrokerId)
 	if err != nil {
-		return errors.New("Failed to insert data: " + err.Error())
+		slog.Error("Failed to set code validity: " + err.Error())
+		return errors.New("failed to set code validity")
+	}
+	if !expiry.After(validFrom) {
+		return errors.New("expiry not after valid from")
 	}
 	return nil
 }
@@ -909,6 +1184,9 @@ func (a *App) Refer(rpl utils.APIReferPayload) error {
 		return errors.New("not an agency")
 	}
 	rpl.ReferToAddr = strings.ToLower(rpl.ReferToAddr)
+	if err := a.checkDenied(DENY_ACTION_REFER, rpl.ParentAddr, rpl.ReferToAddr); err != nil {
+		return err
+	}
 	h, err := a.HasLoopOnChainAddition(rpl.ParentAddr, rpl.ReferToAddr)
 	if err != nil {
 		slog.Error("HasLoopOnChainAddition failed")
@@ -937,21 +1215,59 @@ func (a *App) Refer(rpl utils.APIReferPayload) error {
 		slog.Error("Failed to insert referral" + err.Error())
 		return errors.New("failed to insert referral")
 	}
+	a.notify(WEBHOOK_EVENT_REFERRAL, webhookReferral{
+		ParentAddr:  rpl.ParentAddr,
+		ReferToAddr: rpl.ReferToAddr,
+		PassOnPerc:  passOn,
+	}, rpl.ParentAddr, rpl.ReferToAddr)
 	return nil
 }
 
+// poolTokenAddr returns the margin token address of the pool
+func (a *App) poolTokenAddr(poolId uint32) string {
+	for _, info := range a.MarginTokenInfo {
+		if info.PoolId == poolId {
+			return strings.ToLower(info.TokenAddr)
+		}
+	}
+	return "unknown"
+}
+
 // DbUpdateTokenHoldings queries balances of TokenX from the blockchain
 // and updates the holdings for active referrers in the database
 func (a *App) DbUpdateTokenHoldings() error {
+	holdings, err := a.referrerHoldings()
+	if err != nil {
+		return err
+	}
+	for addr, amount := range holdings {
+		query := `
+		INSERT INTO referral_token_holdings (referrer_addr, holding_amount_dec_n, token_addr)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (referrer_addr, token_addr) DO UPDATE SET holding_amount_dec_n = EXCLUDED.holding_amount_dec_n`
+		_, err = a.Db.Exec(query, addr, amount.String(), a.Settings.TokenX.Address)
+		if err != nil {
+			slog.Error("Error when trying to upsert token balance:" + err.Error())
+			continue
+		}
+	}
+
+	return nil
+}
+
+// referrerHoldings queries the token balances of the active referrers
+// whose stored balance is outdated, without storing them
+func (a *App) referrerHoldings() (map[string]*big.Int, error) {
 	// select referrers that are no agency (not in referral chain)
 	refAddr, lastUpdate, err := a.DbGetActiveReferrers()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	tkn, err := a.CreateErc20Instance(a.Settings.TokenX.Address)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	res := make(map[string]*big.Int)
 	nowTime := time.Now()
 	for k := 0; k < len(refAddr); k++ {
 		currReferrerAddr := refAddr[k]
@@ -966,18 +1282,9 @@ func (a *App) DbUpdateTokenHoldings() error {
 			slog.Error("Error when trying to get token balance:" + err.Error())
 			continue
 		}
-		query := `
-		INSERT INTO referral_token_holdings (referrer_addr, holding_amount_dec_n, token_addr)
-		VALUES ($1, $2, $3)
-		ON CONFLICT (referrer_addr, token_addr) DO UPDATE SET holding_amount_dec_n = EXCLUDED.holding_amount_dec_n`
-		_, err = a.Db.Exec(query, currReferrerAddr, holdings.String(), a.Settings.TokenX.Address)
-		if err != nil {
-			slog.Error("Error when trying to upsert token balance:" + err.Error())
-			continue
-		}
+		res[currReferrerAddr] = holdings
 	}
-
-	return nil
+	return res, nil
 }
 
 // HistoricEarnings calculates historic earnings of any participant
@@ -0,0 +1,65 @@
+package referral
+
+import (
+	"os"
+	"path/filepath"
+	"referral-system/env"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestLoadConfigBrokers(t *testing.T) {
+	cfg := `[
+		{"chainId": 1101, "brokerId": "alpha", "paymentScheduleCron": "0 08 * * 2"},
+		{"chainId": 42161, "brokerId": "gamma", "paymentScheduleCron": "0 08 * * 3"},
+		{"chainId": 1101, "brokerId": "beta", "paymentScheduleCron": "0 10 * * 2"}
+	]`
+	fileName := filepath.Join(t.TempDir(), "referralSettings.json")
+	if err := os.WriteFile(fileName, []byte(cfg), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	v := viper.New()
+	v.Set(env.CONFIG_PATH, fileName)
+	v.Set(env.CHAIN_ID, 1101)
+	ids, err := LoadBrokerIds(v)
+	if err != nil {
+		t.Fatalf("LoadBrokerIds: %v", err)
+	}
+	if len(ids) != 2 || ids[0] != "alpha" || ids[1] != "beta" {
+		t.Errorf("wrong broker ids %v", ids)
+	}
+	// without broker id the first broker of the chain is used
+	s, err := loadConfig(v)
+	if err != nil || s.BrokerId != "alpha" {
+		t.Errorf("expected broker alpha, got %s (%v)", s.BrokerId, err)
+	}
+	v.Set(env.BROKER_ID, "beta")
+	s, err = loadConfig(v)
+	if err != nil || s.BrokerId != "beta" || s.PayCronSchedule != "0 10 * * 2" {
+		t.Errorf("expected broker beta, got %s (%v)", s.BrokerId, err)
+	}
+	v.Set(env.BROKER_ID, "gamma")
+	if _, err = loadConfig(v); err == nil {
+		t.Errorf("expected error for broker of other chain")
+	}
+}
+
+func TestIsBrokerSender(t *testing.T) {
+	broker := "0x5a09217f6d36e73ee5495b430e889f8c57876ef3"
+	other := "0x863AD9Ce46acF07fD9390147B619893461036194"
+	tests := []struct {
+		p    PaymentLog
+		want bool
+	}{
+		{PaymentLog{BrokerId: "broker.1", BrokerAddr: "0x5A09217F6D36E73EE5495B430E889F8C57876EF3"}, true},
+		{PaymentLog{BrokerId: "broker.1", BrokerAddr: other}, false},
+		{PaymentLog{BrokerId: "", BrokerAddr: broker}, true},
+		{PaymentLog{BrokerId: "", BrokerAddr: other}, false},
+	}
+	for k, tc := range tests {
+		if got := isBrokerSender(tc.p, broker); got != tc.want {
+			t.Errorf("case %d: expected %v, got %v", k, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package referral
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"math/big"
+	"referral-system/src/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// status of a retry of a failed payment
+const (
+	RETRY_SCHEDULED = "scheduled" // waits for the next attempt
+	RETRY_SUBMITTED = "submitted" // retry transaction sent
+	RETRY_PAID      = "paid"      // retry (or the original transaction) mined
+	RETRY_EXHAUSTED = "exhausted" // max. attempts failed, not retried anymore
+)
+
+// RetryPolicy configures the retries of failed payments
+type RetryPolicy struct {
+	// retry transactions sent per failed payment, default 3
+	MaxAttempts int `json:"maxAttempts"`
+	// wait before the first retry, doubled after each failed
+	// attempt, default 60 minutes
+	BackoffMinutes int `json:"backoffMinutes"`
+}
+
+func (r RetryPolicy) maxAttempts() int {
+	if r.MaxAttempts < 1 {
+		return 3
+	}
+	return r.MaxAttempts
+}
+
+// backoff returns the wait before the next attempt after
+// the given number of attempts
+func (r RetryPolicy) backoff(attempts int) time.Duration {
+	wait := time.Duration(r.BackoffMinutes) * time.Minute
+	if r.BackoffMinutes < 1 {
+		wait = time.Hour
+	}
+	for k := 0; k < attempts && k < 16; k++ {
+		wait *= 2
+	}
+	return wait
+}
+
+// failedPaymentKey identifies a payment that was moved to
+// referral_failed_payment
+type failedPaymentKey struct {
+	TraderAddr string
+	PoolId     int
+	Code       string
+	BatchTs    time.Time
+	TxHash     string
+}
+
+// paymentRetry is a row of referral_payment_retry
+type paymentRetry struct {
+	failedPaymentKey
+	Status   string
+	Attempts int
+	// latest retry transaction, empty before the first attempt
+	RetryTxHash         string
+	LastTradeConsidered time.Time
+}
+
+// scheduleRetry schedules the retry of a failed payment, or the next
+// attempt if the failed payment was a retry
+func (a *App) scheduleRetry(k failedPaymentKey) {
+	trader := strings.ToLower(k.TraderAddr)
+	policy := a.Settings.RetryPolicy
+	var attempts int
+	query := `SELECT attempts FROM referral_payment_retry
+		WHERE broker_id=$1 AND batch_ts=$2 AND trader_addr=$3 AND pool_id=$4 AND code=$5`
+	err := a.Db.QueryRow(query, a.Settings.BrokerId, k.BatchTs, trader, k.PoolId, k.Code).Scan(&attempts)
+	if err != nil && err != sql.ErrNoRows {
+		slog.Error("scheduleRetry: " + err.Error())
+		return
+	}
+	if err == nil {
+		// a retry failed
+		a.dbRescheduleRetry(k, attempts, "transaction "+k.TxHash+" failed or not found")
+		return
+	}
+	// the retry takes over the trades the payment considered
+	var lastTrade sql.NullTime
+	query = `SELECT last_trade_considered_ts FROM referral_payment_intent
+		WHERE broker_id=$1 AND batch_ts=$2 AND trader_addr=$3 AND pool_id=$4 AND code=$5`
+	err = a.Db.QueryRow(query, a.Settings.BrokerId, k.BatchTs, trader, k.PoolId, k.Code).Scan(&lastTrade)
+	batchTs := strconv.FormatInt(k.BatchTs.Unix(), 10)
+	if err != nil || !lastTrade.Valid {
+		slog.Info("No retry for failed payment of trader " + trader + " in tx " + k.TxHash +
+			": last trade unknown, paid with the next batch")
+		a.dbReleaseAccruals(batchTs, PaymentExecution{TraderAddr: trader, PoolId: uint32(k.PoolId), Code: k.Code})
+		return
+	}
+	query = `INSERT INTO referral_payment_retry
+			(broker_id, batch_ts, trader_addr, pool_id, code, failed_tx_hash, status, next_attempt_ts, last_trade_considered_ts)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	_, err = a.Db.Exec(query, a.Settings.BrokerId, k.BatchTs, trader, k.PoolId, k.Code, k.TxHash, RETRY_SCHEDULED,
+		time.Now().Add(policy.backoff(0)), lastTrade.Time)
+	if err != nil {
+		slog.Error("scheduleRetry: " + err.Error())
+		return
+	}
+	// the retry pays the carried fees the payment included
+	a.dbSettleAccruals(batchTs, PaymentExecution{TraderAddr: trader, PoolId: uint32(k.PoolId), Code: k.Code})
+	slog.Info("Scheduled retry of failed payment of trader " + trader + " in tx " + k.TxHash)
+}
+
+// dbRescheduleRetry schedules the next attempt of a retry or marks
+// it exhausted after the max. number of attempts
+func (a *App) dbRescheduleRetry(k failedPaymentKey, attempts int, reason string) {
+	policy := a.Settings.RetryPolicy
+	status := RETRY_SCHEDULED
+	if attempts >= policy.maxAttempts() {
+		status = RETRY_EXHAUSTED
+		slog.Error("Retries of payment of trader " + k.TraderAddr + " exhausted: " + reason)
+	}
+	query := `UPDATE referral_payment_retry
+		SET status=$6, next_attempt_ts=$7, last_error=$8, updated_ts=CURRENT_TIMESTAMP
+		WHERE broker_id=$1 AND batch_ts=$2 AND trader_addr=$3 AND pool_id=$4 AND code=$5`
+	_, err := a.Db.Exec(query, a.Settings.BrokerId, k.BatchTs, strings.ToLower(k.TraderAddr), k.PoolId, k.Code,
+		status, time.Now().Add(policy.backoff(attempts)), reason)
+	if err != nil {
+		slog.Error("dbRescheduleRetry: " + err.Error())
+	}
+}
+
+// dbSetRetryStatus sets status and transaction of a retry, attempt
+// is added to the number of attempts
+func (a *App) dbSetRetryStatus(k failedPaymentKey, status, txHash string, attempt int) {
+	query := `UPDATE referral_payment_retry
+		SET status=$6, tx_hash=COALESCE(NULLIF($7, ''), tx_hash), attempts=attempts+$8, updated_ts=CURRENT_TIMESTAMP
+		WHERE broker_id=$1 AND batch_ts=$2 AND trader_addr=$3 AND pool_id=$4 AND code=$5`
+	_, err := a.Db.Exec(query, a.Settings.BrokerId, k.BatchTs, strings.ToLower(k.TraderAddr), k.PoolId, k.Code,
+		status, txHash, attempt)
+	if err != nil {
+		slog.Error("dbSetRetryStatus: " + err.Error())
+	}
+}
+
+// dbConfirmRetries marks submitted retries paid whose payment
+// has been confirmed from the onchain events
+func (a *App) dbConfirmRetries() {
+	query := `UPDATE referral_payment_retry r
+		SET status=$2, updated_ts=CURRENT_TIMESTAMP
+		WHERE r.broker_id=$1 AND r.status=$3
+			AND EXISTS (SELECT 1 FROM referral_payment rp
+				WHERE rp.batch_ts = r.batch_ts
+					AND lower(rp.trader_addr) = r.trader_addr
+					AND rp.pool_id = r.pool_id
+					AND rp.code = r.code
+					AND rp.tx_confirmed)`
+	_, err := a.Db.Exec(query, a.Settings.BrokerId, RETRY_PAID, RETRY_SUBMITTED)
+	if err != nil {
+		slog.Error("dbConfirmRetries: " + err.Error())
+	}
+}
+
+// dbGetDueRetries returns the scheduled retries whose next attempt is due
+func (a *App) dbGetDueRetries() ([]paymentRetry, error) {
+	query := `SELECT batch_ts, trader_addr, pool_id, code, failed_tx_hash, status, attempts, COALESCE(tx_hash, ''),
+			last_trade_considered_ts
+		FROM referral_payment_retry
+		WHERE broker_id=$1 AND status=$2 AND next_attempt_ts <= $3
+		ORDER BY batch_ts, trader_addr`
+	rows, err := a.Db.Query(query, a.Settings.BrokerId, RETRY_SCHEDULED, time.Now())
+	if err != nil {
+		return nil, errors.New("dbGetDueRetries: " + err.Error())
+	}
+	defer rows.Close()
+	var res []paymentRetry
+	for rows.Next() {
+		var r paymentRetry
+		err = rows.Scan(&r.BatchTs, &r.TraderAddr, &r.PoolId, &r.Code, &r.TxHash, &r.Status, &r.Attempts, &r.RetryTxHash,
+			&r.LastTradeConsidered)
+		if err != nil {
+			return nil, errors.New("dbGetDueRetries: " + err.Error())
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// dbGetFailedPayment rebuilds the failed payment of a retry from
+// referral_failed_payment
+func (a *App) dbGetFailedPayment(r paymentRetry) (PaymentExecution, error) {
+	query := `SELECT payee_addr, level, paid_amount_cc::text
+		FROM referral_failed_payment
+		WHERE lower(trader_addr)=$1 AND pool_id=$2 AND code=$3 AND batch_ts=$4 AND tx_hash=$5
+		ORDER BY level`
+	rows, err := a.Db.Query(query, strings.ToLower(r.TraderAddr), r.PoolId, r.Code, r.BatchTs, r.TxHash)
+	if err != nil {
+		return PaymentExecution{}, errors.New("dbGetFailedPayment: " + err.Error())
+	}
+	defer rows.Close()
+	var levels []failedPaymentLevel
+	for rows.Next() {
+		var l failedPaymentLevel
+		var payee, amount string
+		err = rows.Scan(&payee, &l.Level, &amount)
+		if err != nil {
+			return PaymentExecution{}, errors.New("dbGetFailedPayment: " + err.Error())
+		}
+		l.Payee = common.HexToAddress(payee)
+		l.Amount, _ = new(big.Int).SetString(amount, 10)
+		levels = append(levels, l)
+	}
+	if len(levels) == 0 {
+		return PaymentExecution{}, errors.New("no failed payment in tx " + r.TxHash)
+	}
+	var decimals uint8
+	for _, info := range a.MarginTokenInfo {
+		if info.PoolId == uint32(r.PoolId) {
+			decimals = uint8(info.TokenDecimals)
+		}
+	}
+	p := failedPayment(r, levels, a.Settings.BrokerPayoutAddr)
+	p.TokenAddr = a.poolTokenAddr(uint32(r.PoolId))
+	p.TokenDecimals = decimals
+	return p, nil
+}
+
+// failedPaymentLevel is the amount of a payee in a failed payment
+type failedPaymentLevel struct {
+	Payee  common.Address
+	Level  int
+	Amount *big.Int
+}
+
+// failedPayment returns the payment of the amounts of the failed payment
+// levels. Levels without amount (not stored) are paid zero, the trader
+// goes first, the broker payout address second.
+func failedPayment(r paymentRetry, levels []failedPaymentLevel, brokerPayout common.Address) PaymentExecution {
+	n := 2
+	for _, l := range levels {
+		if l.Level+1 > n {
+			n = l.Level + 1
+		}
+	}
+	p := PaymentExecution{
+		TraderAddr:          strings.ToLower(r.TraderAddr),
+		Code:                r.Code,
+		PoolId:              uint32(r.PoolId),
+		PayeeAddr:           make([]common.Address, n),
+		AmountDecN:          make([]*big.Int, n),
+		TotalDecN:           new(big.Int),
+		Id:                  r.LastTradeConsidered.Unix(),
+		LastTradeConsidered: r.LastTradeConsidered,
+	}
+	for k := range p.PayeeAddr {
+		p.PayeeAddr[k] = brokerPayout
+		p.AmountDecN[k] = new(big.Int)
+	}
+	p.PayeeAddr[0] = common.HexToAddress(r.TraderAddr)
+	for _, l := range levels {
+		if l.Level < 2 {
+			// trader and current broker payout address
+			p.AmountDecN[l.Level].Add(p.AmountDecN[l.Level], l.Amount)
+		} else {
+			p.PayeeAddr[l.Level] = l.Payee
+			p.AmountDecN[l.Level].Set(l.Amount)
+		}
+		p.TotalDecN.Add(p.TotalDecN, l.Amount)
+	}
+	return p
+}
+
+// retryFailedPayments sends the retries that are due. Returns true if
+// payments have been paused.
+func (a *App) retryFailedPayments(redirects map[common.Address]common.Address, denied map[common.Address]bool) bool {
+	a.dbConfirmRetries()
+	retries, err := a.dbGetDueRetries()
+	if err != nil {
+		slog.Error(err.Error())
+		return false
+	}
+	if len(retries) == 0 {
+		return false
+	}
+	slog.Info("Retrying " + strconv.Itoa(len(retries)) + " failed payments")
+	var batches []string
+	byBatch := make(map[string][]PaymentExecution)
+	byTrader := make(map[string]paymentRetry)
+	for _, r := range retries {
+		// the failed transaction (or the last retry) may have been mined after all
+		for _, h := range []string{r.TxHash, r.RetryTxHash} {
+			if h == "" {
+				continue
+			}
+			if status, minedHash := a.queryTxFamilyStatus(h); status == TxConfirmed {
+				slog.Info("Payment of trader " + r.TraderAddr + " mined in tx " + minedHash + ", no retry")
+				a.dbSetRetryStatus(r.failedPaymentKey, RETRY_PAID, minedHash, 0)
+				r.Status = RETRY_PAID
+				break
+			}
+		}
+		if r.Status == RETRY_PAID {
+			continue
+		}
+		p, err := a.dbGetFailedPayment(r)
+		if err != nil {
+			slog.Error("Retry of payment of trader " + r.TraderAddr + ": " + err.Error())
+			a.dbRescheduleRetry(r.failedPaymentKey, r.Attempts, err.Error())
+			continue
+		}
+		batchTs := strconv.FormatInt(r.BatchTs.Unix(), 10)
+		p = a.withholdDeniedPayment(batchTs, withPayoutAddrs(p, redirects), denied)
+		if _, exists := byBatch[batchTs]; !exists {
+			batches = append(batches, batchTs)
+		}
+		byBatch[batchTs] = append(byBatch[batchTs], p)
+		byTrader[retryKey(batchTs, p)] = r
+	}
+	// retries are paid with the batch timestamp of the failed payment
+	for _, batchTs := range batches {
+		payments := byBatch[batchTs]
+		paused := a.payAggregated(batchTs, aggregatePayments(batchTs, a.Settings.BrokerId, payments))
+		for _, p := range payments {
+			r := byTrader[retryKey(batchTs, p)]
+			intent, err := a.dbGetPaymentIntent(batchTs, p)
+			switch {
+			case err != nil || intent.Status == INTENT_PENDING:
+				// not sent
+				a.dbRescheduleRetry(r.failedPaymentKey, r.Attempts, "not sent")
+			case intent.Status == INTENT_MINED:
+				a.dbSetRetryStatus(r.failedPaymentKey, RETRY_PAID, intent.TxHash, 1)
+			default:
+				// failed transactions are purged and rescheduled
+				a.dbSetRetryStatus(r.failedPaymentKey, RETRY_SUBMITTED, intent.TxHash, 1)
+			}
+		}
+		if paused {
+			return true
+		}
+	}
+	return false
+}
+
+func retryKey(batchTs string, p PaymentExecution) string {
+	return batchTs + ":" + strings.ToLower(p.TraderAddr) + ":" + strconv.Itoa(int(p.PoolId)) + ":" + p.Code
+}
+
+// PaymentRetries returns the retries of failed payments to the payee
+func (a *App) PaymentRetries(payee string) ([]utils.APIPaymentRetry, error) {
+	query := `SELECT r.trader_addr, r.pool_id, r.code, f.level, f.paid_amount_cc::text, r.batch_ts,
+			r.failed_tx_hash, COALESCE(r.tx_hash, ''), r.attempts, r.status, r.next_attempt_ts
+		FROM referral_payment_retry r
+		JOIN referral_failed_payment f
+			ON f.tx_hash = r.failed_tx_hash
+			AND lower(f.trader_addr) = r.trader_addr
+			AND f.pool_id = r.pool_id
+			AND f.code = r.code
+			AND f.batch_ts = r.batch_ts
+		WHERE r.broker_id = $1 AND lower(f.payee_addr) = $2
+		ORDER BY r.batch_ts DESC, r.trader_addr, f.level`
+	rows, err := a.Db.Query(query, a.Settings.BrokerId, strings.ToLower(payee))
+	if err != nil {
+		slog.Error("PaymentRetries: " + err.Error())
+		return nil, errors.New("unable to query payment retries")
+	}
+	defer rows.Close()
+	res := []utils.APIPaymentRetry{}
+	for rows.Next() {
+		var e utils.APIPaymentRetry
+		var batchTs, nextAttempt time.Time
+		err = rows.Scan(&e.TraderAddr, &e.PoolId, &e.Code, &e.Level, &e.AmountDecN, &batchTs,
+			&e.FailedTxHash, &e.RetryTxHash, &e.Attempts, &e.Status, &nextAttempt)
+		if err != nil {
+			slog.Error("PaymentRetries: " + err.Error())
+			return nil, errors.New("unable to query payment retries")
+		}
+		e.BatchTs = batchTs.Unix()
+		if e.Status == RETRY_SCHEDULED {
+			e.NextAttemptTs = nextAttempt.Unix()
+		}
+		res = append(res, e)
+	}
+	return res, nil
+}
@@ -0,0 +1,53 @@
+package referral
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	var policy RetryPolicy
+	if policy.maxAttempts() != 3 || policy.backoff(0) != time.Hour || policy.backoff(2) != 4*time.Hour {
+		t.Errorf("unexpected defaults %d %s %s", policy.maxAttempts(), policy.backoff(0), policy.backoff(2))
+	}
+	policy = RetryPolicy{MaxAttempts: 5, BackoffMinutes: 10}
+	if policy.maxAttempts() != 5 || policy.backoff(1) != 20*time.Minute {
+		t.Errorf("unexpected policy %d %s", policy.maxAttempts(), policy.backoff(1))
+	}
+	if policy.backoff(100) <= 0 {
+		t.Errorf("backoff overflow %s", policy.backoff(100))
+	}
+}
+
+func TestFailedPayment(t *testing.T) {
+	trader := common.HexToAddress("0x01")
+	oldPayout := common.HexToAddress("0xb0")
+	broker := common.HexToAddress("0xb1")
+	referrer := common.HexToAddress("0xbb")
+	lastTrade := time.Unix(1700000000, 0)
+	r := paymentRetry{
+		failedPaymentKey:    failedPaymentKey{TraderAddr: trader.Hex(), PoolId: 2, Code: "ABC", BatchTs: lastTrade.Add(time.Hour)},
+		LastTradeConsidered: lastTrade,
+	}
+	// level 0 and 2 were not stored (zero amount)
+	levels := []failedPaymentLevel{
+		{Payee: oldPayout, Level: 1, Amount: big.NewInt(5)},
+		{Payee: referrer, Level: 3, Amount: big.NewInt(7)},
+	}
+	p := failedPayment(r, levels, broker)
+	if len(p.PayeeAddr) != 4 || p.PayeeAddr[0] != trader || p.PayeeAddr[1] != broker || p.PayeeAddr[3] != referrer {
+		t.Fatalf("unexpected payees %v", p.PayeeAddr)
+	}
+	expected := []int64{0, 5, 0, 7}
+	for k, amount := range p.AmountDecN {
+		if amount.Int64() != expected[k] {
+			t.Errorf("level %d: expected %d, got %s", k, expected[k], amount)
+		}
+	}
+	if p.TotalDecN.Int64() != 12 || p.PoolId != 2 || p.Code != "ABC" || p.Id != lastTrade.Unix() {
+		t.Errorf("unexpected payment %+v", p)
+	}
+}
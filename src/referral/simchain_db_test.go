@@ -0,0 +1,1201 @@
+//go:build integration
+
+// Integration tests of whole payment batches against a Postgres database
+// and the simulated chain. They need REFERRAL_TEST_DSN and only build with
+// the tag integration:
+//
+//	REFERRAL_TEST_DSN="postgres://..." go test -tags integration ./src/referral/
+
+package referral
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"referral-system/env"
+	"referral-system/src/contracts"
+	"referral-system/src/db"
+	"referral-system/src/simchain"
+	"referral-system/src/utils"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/golang-migrate/migrate/v4"
+	_ "github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+// newSimDbApp creates an app connected to a simulated chain (see
+// newSimApp) and to a fresh schema of the database REFERRAL_TEST_DSN
+func newSimDbApp(t *testing.T, direct bool) *simEnv {
+	if os.Getenv("REFERRAL_TEST_DSN") == "" {
+		t.Fatal("integration tests need REFERRAL_TEST_DSN")
+	}
+	s := newSimApp(t, direct)
+	connectSimDb(t, s.app)
+	return s
+}
+
+// addSimToken registers the token of the simulated chain as margin
+// token of pool 1
+func (s *simEnv) addSimToken(t *testing.T) {
+	_, err := s.app.Db.Exec(`INSERT INTO margin_token_info VALUES (1, $1, 'SIM', 18)`, strings.ToLower(simTokenAddr.Hex()))
+	if err != nil {
+		t.Fatalf("margin token: %v", err)
+	}
+	if err := s.app.DbGetMarginTkn(); err != nil {
+		t.Fatalf("margin token: %v", err)
+	}
+}
+
+// connectSimDb connects the app to the database REFERRAL_TEST_DSN and
+// migrates a fresh schema which is dropped at the end of the test
+func connectSimDb(t *testing.T, a *App) {
+	dsn := os.Getenv("REFERRAL_TEST_DSN")
+	schema := fmt.Sprintf("referral_sim_%d", time.Now().UnixNano())
+	adminDb, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { adminDb.Close() })
+	if _, err := adminDb.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() { adminDb.Exec("DROP SCHEMA " + schema + " CASCADE") })
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	dsn = dsn + sep + "search_path=" + schema
+	if err := a.ConnectDB(dsn); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { a.Db.Close() })
+
+	// history tables maintained by the d8x history service
+	query := `CREATE TABLE trades_history (
+			trader_addr VARCHAR(42) NOT NULL,
+			broker_addr VARCHAR(42) NOT NULL,
+			perpetual_id INTEGER NOT NULL,
+			fee DECIMAL(40,0) NOT NULL,
+			broker_fee_tbps INTEGER NOT NULL,
+			quantity_cc DECIMAL(40,0) NOT NULL,
+			trade_timestamp TIMESTAMPTZ NOT NULL);
+		CREATE TABLE margin_token_info (
+			pool_id INTEGER NOT NULL,
+			token_addr VARCHAR(42) NOT NULL,
+			token_name VARCHAR(42) NOT NULL,
+			token_decimals SMALLINT NOT NULL);`
+	if _, err := a.Db.Exec(query); err != nil {
+		t.Fatalf("history tables: %v", err)
+	}
+	source, err := iofs.New(db.MigrationsFS, "migrations")
+	if err != nil {
+		t.Fatalf("migrations: %v", err)
+	}
+	m, err := migrate.NewWithSourceInstance("MigrationsFS", source, dsn)
+	if err != nil {
+		t.Fatalf("migrations: %v", err)
+	}
+	if err := m.Up(); err != nil {
+		t.Fatalf("migrations: %v", err)
+	}
+	m.Close()
+	if err := a.SettingsToDB(); err != nil {
+		t.Fatalf("settings: %v", err)
+	}
+}
+
+// TestSimBatchDb runs a whole payment batch against a Postgres database,
+// the test works in its own schema which is dropped afterwards.
+func TestSimBatchDb(t *testing.T) {
+	s := newSimDbApp(t, false)
+	a := s.app
+	s.addSimToken(t)
+	// two traders without code, 6 bps broker fee on 10000 tokens = 6 tokens each
+	qty := new(big.Int).Lsh(big.NewInt(10000), 64)
+	traders := []common.Address{s.trader, s.referrer}
+	for _, trader := range traders {
+		_, err := a.Db.Exec(`INSERT INTO trades_history VALUES ($1, $2, 100001, 0, 60, $3, $4)`,
+			strings.ToLower(trader.Hex()), a.BrokerAddr, qty.String(), time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Fatalf("trades: %v", err)
+		}
+	}
+
+	// run the batch
+	confirmPaymentDelay = 0
+	batchTs := fmt.Sprintf("%d", time.Now().Unix())
+	if err := a.DbSetPaymentExecFinished(batchTs, false); err != nil {
+		t.Fatalf("batch: %v", err)
+	}
+	if err := a.processPayments(batchTs); err != nil {
+		t.Fatalf("process payments: %v", err)
+	}
+	if hasFinished, ts := a.dbGetPayBatch(); !hasFinished || fmt.Sprintf("%d", ts) != batchTs {
+		t.Errorf("expected finished batch %s, got %v %d", batchTs, hasFinished, ts)
+	}
+	countPayments := func(cond string) int {
+		var n int
+		if err := a.Db.QueryRow(`SELECT count(*) FROM referral_payment WHERE ` + cond).Scan(&n); err != nil {
+			t.Fatalf("count payments: %v", err)
+		}
+		return n
+	}
+	// DEFAULT code: only the broker payout address receives funds
+	if n := countPayments("tx_confirmed AND payee_addr = '" + strings.ToLower(s.payout.Hex()) + "'"); n != len(traders) {
+		t.Errorf("expected %d confirmed payments, got %d", len(traders), n)
+	}
+	if bal := s.balance(t, s.payout); bal.Cmp(simchain.Ether(12)) != 0 {
+		t.Errorf("expected payout balance 12 tokens, got %s", bal.String())
+	}
+	rows, err := a.dbGetAggregatedFees()
+	if err != nil || len(rows) != 0 {
+		t.Errorf("expected no open payments, got %d (%v)", len(rows), err)
+	}
+
+	// payments are rebuilt from the chain events
+	if _, err := a.Db.Exec(`DELETE FROM referral_payment`); err != nil {
+		t.Fatalf("delete payments: %v", err)
+	}
+	if err := a.SavePayments(); err != nil {
+		t.Fatalf("save payments: %v", err)
+	}
+	if n := countPayments("tx_confirmed"); n != len(traders) {
+		t.Errorf("expected %d payments from events, got %d", len(traders), n)
+	}
+
+	// database and chain agree, then differ
+	rec, err := a.Reconcile(1)
+	if err != nil || len(rec.Mismatches) != 0 || len(rec.Batches) != 1 || rec.Batches[0].ChainPayments != len(traders) {
+		t.Fatalf("expected reconciled batch, got %+v (%v)", rec, err)
+	}
+	_, err = a.Db.Exec(`UPDATE referral_payment SET paid_amount_cc = paid_amount_cc + 1 WHERE lower(trader_addr) = $1`,
+		strings.ToLower(traders[0].Hex()))
+	if err != nil {
+		t.Fatalf("update payment: %v", err)
+	}
+	_, err = a.Db.Exec(`DELETE FROM referral_payment WHERE lower(trader_addr) = $1`, strings.ToLower(traders[1].Hex()))
+	if err != nil {
+		t.Fatalf("delete payment: %v", err)
+	}
+	if _, err = a.Reconcile(1); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	rec, err = a.LastReconciliation()
+	if err != nil || len(rec.Batches) != 1 || rec.Batches[0].AmountDiffers != 1 || rec.Batches[0].Missing != 1 || len(rec.Mismatches) != 2 {
+		t.Errorf("expected amount and missing mismatches, got %+v (%v)", rec, err)
+	}
+	_, err = a.Db.Exec(`UPDATE referral_payment SET paid_amount_cc = paid_amount_cc - 1 WHERE lower(trader_addr) = $1`,
+		strings.ToLower(traders[0].Hex()))
+	if err != nil {
+		t.Fatalf("update payment: %v", err)
+	}
+	if err := a.SavePayments(); err != nil {
+		t.Fatalf("save payments: %v", err)
+	}
+
+	// gas costs of the batch
+	a.Settings.GasTokenPrice = map[string]float64{strings.ToLower(simTokenAddr.Hex()): 2000}
+	report, err := a.GasReport(GAS_PERIOD_BATCH, 1)
+	if err != nil || len(report.Costs) != 1 {
+		t.Fatalf("expected gas costs of one batch, got %+v (%v)", report, err)
+	}
+	cost := report.Costs[0]
+	if cost.Payments != len(traders) || cost.FailedTxs != 0 || cost.GasUsed == 0 || cost.PaidAmount != 12 || cost.GasShare == nil {
+		t.Errorf("unexpected gas costs %+v", cost)
+	}
+	if _, err := a.GasReport("year", 1); err == nil {
+		t.Errorf("expected error for unknown period")
+	}
+
+	// accounting export of the batch
+	day := time.Now().UTC()
+	from, to, _ := ParseExportPeriod(day.AddDate(0, 0, -1).Format(EXPORT_DATE_FORMAT), day.AddDate(0, 0, 1).Format(EXPORT_DATE_FORMAT))
+	exp, err := a.PayoutExport(from, to)
+	if err != nil || len(exp.Transfers) == 0 || len(exp.Totals) != 1 {
+		t.Fatalf("expected transfers of one token, got %+v (%v)", exp, err)
+	}
+	total := exp.Totals[0]
+	if total.TokenName != "SIM" || !total.Confirmed || total.Transfers != len(exp.Transfers) || total.Amount != "12.000000000000000000" {
+		t.Errorf("unexpected export total %+v", total)
+	}
+
+	// failed transactions of the latest batch are moved to the failed payments
+	opts, _ := bind.NewKeyedTransactorWithChainID(s.execKey, big.NewInt(simchain.ChainId))
+	opts.GasLimit = 1_000_000
+	tx, err := a.MultipayCtrct.Pay(opts, 1, simTokenAddr, []*big.Int{simchain.Ether(2000)}, []common.Address{s.trader}, "fail")
+	if err != nil {
+		t.Fatalf("pay: %v", err)
+	}
+	s.sim.Commit()
+	failedBatchTs := fmt.Sprintf("%d", time.Now().Unix()+10)
+	a.dbWriteTx(s.trader.Hex(), a.BrokerAddr, "DEFAULT", []*big.Int{big.NewInt(1)}, []common.Address{s.trader}, nil,
+		failedBatchTs, 1, tx.Hash().Hex())
+	if !a.confirmPaymentTrial() {
+		t.Errorf("expected confirmation to complete")
+	}
+	if n := countPayments("tx_hash = '" + tx.Hash().Hex() + "'"); n != 0 {
+		t.Errorf("expected failed payment to be purged")
+	}
+	var nFailed int
+	a.Db.QueryRow(`SELECT count(*) FROM referral_failed_payment WHERE tx_hash=$1`, tx.Hash().Hex()).Scan(&nFailed)
+	if nFailed != 1 {
+		t.Errorf("expected 1 failed payment, got %d", nFailed)
+	}
+	// the gas of the failed transaction is recorded
+	var token string
+	var status int
+	err = a.Db.QueryRow(`SELECT token_addr, status FROM referral_payment_gas WHERE tx_hash = $1`, tx.Hash().Hex()).Scan(&token, &status)
+	if err != nil || token != strings.ToLower(simTokenAddr.Hex()) || status != 0 {
+		t.Errorf("expected gas of failed tx recorded, got %s %d (%v)", token, status, err)
+	}
+}
+
+// TestSimTenantScopeDb checks that the unconfirmed payments of the last
+// batch and the purge only concern the broker of the app
+func TestSimTenantScopeDb(t *testing.T) {
+	s := newSimDbApp(t, true)
+	a := s.app
+	// another broker in the same database with a later batch
+	otherAddr := "0x00000000000000000000000000000000000000b2"
+	_, err := a.Db.Exec(`INSERT INTO referral_settings (property, value, broker_id) VALUES ('broker_addr', $1, 'other')`, otherAddr)
+	if err != nil {
+		t.Fatalf("settings: %v", err)
+	}
+	batchTs := time.Now().Add(-time.Hour).Unix()
+	amount := []*big.Int{big.NewInt(5)}
+	a.dbWriteTx(s.trader.Hex(), a.BrokerAddr, "DEFAULT", amount, []common.Address{s.trader}, nil,
+		strconv.FormatInt(batchTs, 10), 1, "0xown")
+	a.dbWriteTx(s.trader.Hex(), otherAddr, "DEFAULT", amount, []common.Address{s.trader}, nil,
+		strconv.FormatInt(batchTs+60, 10), 1, "0xother")
+
+	txs, ts := a.DBGetUnconfirmedPayTxForLastBatch()
+	if len(txs) != 1 || txs[0] != "0xown" || ts != batchTs {
+		t.Errorf("expected own tx of batch %d, got %v of batch %d", batchTs, txs, ts)
+	}
+	if err := a.PurgeUnconfirmedPayments(nil); err != nil {
+		t.Fatalf("purge: %v", err)
+	}
+	var own, other int
+	a.Db.QueryRow(`SELECT count(*) FROM referral_payment WHERE tx_hash='0xown'`).Scan(&own)
+	a.Db.QueryRow(`SELECT count(*) FROM referral_payment WHERE tx_hash='0xother'`).Scan(&other)
+	if own != 0 || other != 1 {
+		t.Errorf("expected only own payment purged, got %d own and %d other", own, other)
+	}
+}
+
+func TestSimBatchControl(t *testing.T) {
+	a := newSimDbApp(t, true).app
+	if _, err := a.ResumeBatch("alice"); err == nil {
+		t.Errorf("expected nothing to resume")
+	}
+	if _, err := a.PauseBatch("alice"); err != nil {
+		t.Fatalf("pause: %v", err)
+	}
+	if !a.dbGetBatchPaused() {
+		t.Errorf("expected pause to be stored")
+	}
+	if _, err := a.StartBatch("alice"); err == nil {
+		t.Errorf("expected start to fail while paused")
+	}
+	if _, err := a.ResumeBatch("bob"); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	status, err := a.SkipBatch("bob")
+	if err != nil {
+		t.Fatalf("skip: %v", err)
+	}
+	if !status.Finished || status.Paused || status.Running || status.BatchTs == 0 {
+		t.Errorf("unexpected status %+v", status)
+	}
+	var n int
+	a.Db.QueryRow(`SELECT count(*) FROM referral_batch_action WHERE broker_id=$1 AND admin_name='bob'`, a.Settings.BrokerId).Scan(&n)
+	if n != 2 {
+		t.Errorf("expected 2 recorded actions by bob, got %d", n)
+	}
+}
+
+func TestSimPaymentIntent(t *testing.T) {
+	s := newSimDbApp(t, false)
+	a := s.app
+	batchTs := fmt.Sprintf("%d", time.Now().Unix())
+	p := PaymentExecution{
+		TraderAddr: s.trader.Hex(),
+		Code:       "DEFAULT",
+		PoolId:     1,
+		TokenAddr:  simTokenAddr.Hex(),
+		PayeeAddr:  []common.Address{s.trader, s.payout},
+		AmountDecN: []*big.Int{big.NewInt(0), big.NewInt(5)},
+		TotalDecN:  big.NewInt(5),
+		Msg:        encodePaymentInfo(batchTs, "DEFAULT", 1),
+		Id:         1,
+	}
+	if submit, err := a.checkPaymentIntent(batchTs, p); !submit || err != nil {
+		t.Fatalf("expected new payment to be submitted: %v", err)
+	}
+	// crash after sending: the payment was mined but not written
+	a.dbSetPaymentIntent(batchTs, p, INTENT_PENDING, "", "")
+	txHash, err := a.PaymentExecutor.TransactPayment(simTokenAddr, p.TotalDecN, p.AmountDecN, p.PayeeAddr, p.Id, p.Msg, p.Code,
+		a.RpcClient, a.paymentSignedFunc(batchTs, p))
+	if err != nil {
+		t.Fatalf("transact: %v", err)
+	}
+	intent, err := a.dbGetPaymentIntent(batchTs, p)
+	if err != nil || intent.Status != INTENT_SUBMITTED || intent.TxHash != txHash.Hex() || intent.Digest == "" {
+		t.Fatalf("unexpected intent %+v (%v)", intent, err)
+	}
+	// after the restart the payment is planned with a different amount,
+	// the amount of the mined transaction is recorded
+	replanned := p
+	replanned.AmountDecN = []*big.Int{big.NewInt(0), big.NewInt(7)}
+	replanned.TotalDecN = big.NewInt(7)
+	if submit, err := a.checkPaymentIntent(batchTs, replanned); submit || err != nil {
+		t.Fatalf("expected mined payment not to be submitted again: %v", err)
+	}
+	if intent, _ = a.dbGetPaymentIntent(batchTs, p); intent.Status != INTENT_MINED {
+		t.Errorf("expected mined intent, got %s", intent.Status)
+	}
+	var n int
+	var paid string
+	var confirmed bool
+	a.Db.QueryRow(`SELECT count(*), max(paid_amount_cc)::text, bool_and(tx_confirmed AND block_nr IS NOT NULL)
+		FROM referral_payment WHERE tx_hash=$1`, txHash.Hex()).Scan(&n, &paid, &confirmed)
+	if n != 1 || paid != "5" || !confirmed {
+		t.Errorf("expected recovered confirmed payment of 5 in db, got %d rows, amount %s, confirmed %v", n, paid, confirmed)
+	}
+	// crash after signing: the transaction was never sent
+	a.dbSetPaymentIntent(batchTs, p, INTENT_SUBMITTED, common.HexToHash("0x01").Hex(), common.HexToHash("0x02").Hex())
+	if submit, err := a.checkPaymentIntent(batchTs, p); !submit || err != nil {
+		t.Errorf("expected unknown payment to be resubmitted: %v", err)
+	}
+}
+
+// TestSimCodeValidity checks that codes can only be selected within their
+// validity window and that traders fall back to DEFAULT once a code expired
+func TestSimCodeValidity(t *testing.T) {
+	s := newSimDbApp(t, true)
+	a := s.app
+	now := uint32(time.Now().Unix())
+	referrer := strings.ToLower(s.referrer.Hex())
+	trader := strings.ToLower(s.trader.Hex())
+	code := utils.APICodePayload{Code: "CAMPAIGN", ReferrerAddr: referrer, PassOnPercTDF: 1000,
+		ValidFrom: now + 3600, Expiry: now + 7200}
+	if err := a.UpsertCode(code); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	sel := utils.APICodeSelectionPayload{Code: "CAMPAIGN", TraderAddr: trader}
+	if err := a.SelectCode(sel); err == nil || err.Error() != "code not yet valid" {
+		t.Errorf("expected code not yet valid, got %v", err)
+	}
+	// the owner moves the campaign start, the expiry remains
+	code.ValidFrom, code.Expiry = now-60, 0
+	if err := a.UpsertCode(code); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if err := a.SelectCode(sel); err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	// a start after the stored expiry is rejected and nothing is updated
+	bad := code
+	bad.ValidFrom, bad.PassOnPercTDF = now+10000, 2000
+	if err := a.UpsertCode(bad); err == nil {
+		t.Errorf("expected start after expiry to be rejected")
+	}
+	var perc float64
+	var validFrom time.Time
+	a.Db.QueryRow(`SELECT trader_rebate_perc, valid_from FROM referral_code WHERE code='CAMPAIGN'`).Scan(&perc, &validFrom)
+	if perc != 10 || validFrom.Unix() != int64(now-60) {
+		t.Errorf("expected unchanged code, got rebate %f valid from %d", perc, validFrom.Unix())
+	}
+	query := `INSERT INTO trades_history (trader_addr, broker_addr, perpetual_id, fee, broker_fee_tbps, quantity_cc, trade_timestamp)
+		VALUES ($1, $2, 100001, 1000, 10, 100000, now())`
+	if _, err := a.Db.Exec(query, trader, a.BrokerAddr); err != nil {
+		t.Fatalf("trade: %v", err)
+	}
+	viewCode := func() string {
+		var c string
+		err := a.Db.QueryRow(`SELECT code FROM referral_aggr_fees_per_trader WHERE trader_addr=$1`, trader).Scan(&c)
+		if err != nil {
+			t.Fatalf("fee view: %v", err)
+		}
+		return c
+	}
+	if c := viewCode(); c != "CAMPAIGN" {
+		t.Errorf("expected code CAMPAIGN in fee view, got %s", c)
+	}
+	if _, err := a.Db.Exec(`UPDATE referral_code SET expiry=now() - interval '1 minute' WHERE code='CAMPAIGN'`); err != nil {
+		t.Fatalf("expire: %v", err)
+	}
+	if c := viewCode(); c != env.DEFAULT_CODE {
+		t.Errorf("expected fallback to DEFAULT, got %s", c)
+	}
+	if err := a.SelectCode(sel); err == nil {
+		t.Errorf("expected expired code to be rejected")
+	}
+	// the owner removes the expiry
+	code.ValidFrom, code.Expiry = 0, utils.CODE_EXPIRY_NONE
+	if err := a.UpsertCode(code); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if c := viewCode(); c != "CAMPAIGN" {
+		t.Errorf("expected code CAMPAIGN without expiry, got %s", c)
+	}
+}
+
+// TestSimCodeTiers checks that the trader rebate of a code depends
+// on the trading volume in the pay period
+func TestSimCodeTiers(t *testing.T) {
+	s := newSimDbApp(t, true)
+	a := s.app
+	referrer := strings.ToLower(s.referrer.Hex())
+	trader := strings.ToLower(s.trader.Hex())
+	code := utils.APICodePayload{Code: "TIERED", ReferrerAddr: referrer, PassOnPercTDF: 1000}
+	if err := a.UpsertCode(code); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	tiers := utils.APICodeTiersPayload{Code: "TIERED", ReferrerAddr: trader,
+		Tiers: []utils.APICodeTierPayload{{MinVolume: 5, PassOnPercTDF: 5000}}}
+	if err := a.SetCodeTiers(tiers); err == nil {
+		t.Errorf("expected tiers of other owner to be rejected")
+	}
+	tiers.ReferrerAddr = referrer
+	if err := a.SetCodeTiers(tiers); err != nil {
+		t.Fatalf("set tiers: %v", err)
+	}
+	if err := a.SelectCode(utils.APICodeSelectionPayload{Code: "TIERED", TraderAddr: trader}); err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	// trades of 2 + 4 collateral units (ABDK)
+	query := `INSERT INTO trades_history (trader_addr, broker_addr, perpetual_id, fee, broker_fee_tbps, quantity_cc, trade_timestamp)
+		VALUES ($1, $2, 100001, 1000, 10, $3, now())`
+	for _, q := range []int64{2, -4} {
+		qABDK := new(big.Int).Lsh(big.NewInt(q), 64)
+		if _, err := a.Db.Exec(query, trader, a.BrokerAddr, qABDK.String()); err != nil {
+			t.Fatalf("trade: %v", err)
+		}
+	}
+	rows, err := a.dbGetAggregatedFees()
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("expected one fee row, got %d (%v)", len(rows), err)
+	}
+	volume := utils.ABDKToFloat(rows[0].VolumeABDKCC)
+	if volume < 5.99 || volume > 6.01 {
+		t.Errorf("expected volume 6, got %f", volume)
+	}
+	chain, tier, err := a.newCodeChains().get("TIERED", volume)
+	if err != nil || tier == nil {
+		t.Fatalf("expected tier, got %v (%v)", tier, err)
+	}
+	base, _ := a.DbGetReferralChainForCode("TIERED")
+	if got, want := chain[len(chain)-1].ChildAvail, 5*base[len(base)-1].ChildAvail; got < want-1e-9 || got > want+1e-9 {
+		t.Errorf("expected trader share %f, got %f", want, got)
+	}
+	// removing the tiers restores the rebate of the code
+	tiers.Tiers = nil
+	if err := a.SetCodeTiers(tiers); err != nil {
+		t.Fatalf("remove tiers: %v", err)
+	}
+	if _, tier, _ := a.newCodeChains().get("TIERED", volume); tier != nil {
+		t.Errorf("expected no tier after removal")
+	}
+}
+
+// TestSimCodeSwitch checks that trades are attributed to the code
+// that was selected at trade time
+func TestSimCodeSwitch(t *testing.T) {
+	s := newSimDbApp(t, true)
+	a := s.app
+	referrer := strings.ToLower(s.referrer.Hex())
+	trader := strings.ToLower(s.trader.Hex())
+	for _, code := range []string{"FIRST", "SECOND"} {
+		if err := a.UpsertCode(utils.APICodePayload{Code: code, ReferrerAddr: referrer, PassOnPercTDF: 1000}); err != nil {
+			t.Fatalf("upsert: %v", err)
+		}
+	}
+	// FIRST selected until an hour ago, then SECOND
+	query := `INSERT INTO referral_code_usage (trader_addr, code, valid_from, valid_to, broker_id) VALUES
+		($1, 'FIRST', now() - interval '3 hours', now() - interval '1 hour', $2),
+		($1, 'SECOND', now() - interval '1 hour', DEFAULT, $2)`
+	if _, err := a.Db.Exec(query, trader, a.Settings.BrokerId); err != nil {
+		t.Fatalf("code usage: %v", err)
+	}
+	query = `INSERT INTO trades_history (trader_addr, broker_addr, perpetual_id, fee, broker_fee_tbps, quantity_cc, trade_timestamp)
+		VALUES ($1, $2, 100001, 1000, 10, $3, now() - $4::interval)`
+	for _, trade := range []struct {
+		q   int64
+		ago string
+	}{{1, "5 hours"}, {2, "2 hours"}, {3, "90 minutes"}, {4, "30 minutes"}} {
+		qABDK := new(big.Int).Lsh(big.NewInt(trade.q), 64)
+		if _, err := a.Db.Exec(query, trader, a.BrokerAddr, qABDK.String(), trade.ago); err != nil {
+			t.Fatalf("trade: %v", err)
+		}
+	}
+	rows, err := a.dbGetAggregatedFees()
+	if err != nil {
+		t.Fatalf("fees: %v", err)
+	}
+	volumes := make(map[string]float64)
+	for _, row := range rows {
+		volumes[row.Code] += utils.ABDKToFloat(row.VolumeABDKCC)
+	}
+	for code, want := range map[string]float64{env.DEFAULT_CODE: 1, "FIRST": 5, "SECOND": 4} {
+		if got := volumes[code]; got < want-0.01 || got > want+0.01 {
+			t.Errorf("code %s: expected volume %f, got %f", code, want, got)
+		}
+	}
+	res, err := a.OpenPay(trader)
+	if err != nil {
+		t.Fatalf("open pay: %v", err)
+	}
+	if res.Code != "SECOND" || len(res.OpenPay) != 3 {
+		t.Errorf("unexpected open pay %+v", res)
+	}
+}
+
+// TestSimCodeSwitchPayments writes the payment events of a trader that
+// used two codes in the same batch and pool: each code has its own rows
+// and confirming one code leaves the rows of other codes and pools alone
+func TestSimCodeSwitchPayments(t *testing.T) {
+	s := newSimDbApp(t, true)
+	a := s.app
+	amounts := []*big.Int{big.NewInt(10)}
+	payees := []common.Address{s.trader}
+	// unconfirmed rows of code FIRST in pools 1 and 2
+	a.dbWriteTx(s.trader.Hex(), a.BrokerAddr, "FIRST", amounts, payees, nil, "1000", 1, "0x01")
+	a.dbWriteTx(s.trader.Hex(), a.BrokerAddr, "FIRST", amounts, payees, nil, "1000", 2, "0x02")
+	logs := []PaymentLog{
+		{BatchTimestamp: 1000, Code: "SECOND", PoolId: 1, BrokerAddr: a.BrokerAddr, TxHash: "0x03",
+			BlockNumber: 10, BlockTs: 1100, PayeeAddr: payees, AmountDecN: amounts},
+		{BatchTimestamp: 1000, Code: "FIRST", PoolId: 1, BrokerAddr: a.BrokerAddr, TxHash: "0x01",
+			BlockNumber: 11, BlockTs: 1200, PayeeAddr: payees, AmountDecN: amounts},
+	}
+	if err := a.savePaymentLogs(logs); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	query := `SELECT code, pool_id, tx_confirmed, coalesce(block_nr, 0) FROM referral_payment ORDER BY code, pool_id`
+	rows, err := a.Db.Query(query)
+	if err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	defer rows.Close()
+	type row struct {
+		code      string
+		pool      uint32
+		confirmed bool
+		blockNr   int64
+	}
+	var got []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.code, &r.pool, &r.confirmed, &r.blockNr); err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		got = append(got, r)
+	}
+	want := []row{{"FIRST", 1, true, 11}, {"FIRST", 2, false, 0}, {"SECOND", 1, true, 10}}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected rows %v, got %v", want, got)
+	}
+}
+
+// TestSimMinPayout checks that payments below the minimal payout
+// are carried forward and added to later payments
+func TestSimMinPayout(t *testing.T) {
+	s := newSimDbApp(t, true)
+	a := s.app
+	referrer := strings.ToLower(s.referrer.Hex())
+	trader := strings.ToLower(s.trader.Hex())
+	if err := a.UpsertCode(utils.APICodePayload{Code: "DUST", ReferrerAddr: referrer, PassOnPercTDF: 1000}); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if err := a.SelectCode(utils.APICodeSelectionPayload{Code: "DUST", TraderAddr: trader}); err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	query := `INSERT INTO trades_history (trader_addr, broker_addr, perpetual_id, fee, broker_fee_tbps, quantity_cc, trade_timestamp)
+		VALUES ($1, $2, 100001, 1000, 10, $3, now() - $4::interval)`
+	trade := func(q int64, ago string) {
+		qABDK := new(big.Int).Lsh(big.NewInt(q), 64)
+		if _, err := a.Db.Exec(query, trader, a.BrokerAddr, qABDK.String(), ago); err != nil {
+			t.Fatalf("trade: %v", err)
+		}
+	}
+	trade(1000, "2 hours")
+	rows, err := a.dbGetAggregatedFees()
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("expected one fee row, got %d (%v)", len(rows), err)
+	}
+	fee := rows[0].BrokerFeeABDKCC
+	a.Settings.MinPayout = map[string]float64{strings.ToLower(rows[0].TokenAddr): 1e9}
+	chain, _, err := a.newCodeChains().get("DUST", 0)
+	if err != nil {
+		t.Fatalf("chain: %v", err)
+	}
+	dry, err := a.SimulatePayments()
+	if err != nil || len(dry.Carried) != 1 || len(dry.Payments) != 0 {
+		t.Fatalf("expected dry-run to carry the payment, got %+v (%v)", dry, err)
+	}
+	batchTs := "1000"
+	if _, submit := a.planBatchPayment(rows[0], chain, batchTs, 1); submit {
+		t.Fatalf("expected payment below minimum not to be submitted")
+	}
+	// carried trades are not considered again
+	rows, _ = a.dbGetAggregatedFees()
+	if len(rows) != 0 {
+		t.Errorf("expected no open fees after carrying forward, got %d", len(rows))
+	}
+	res, err := a.OpenPay(trader)
+	if err != nil || len(res.OpenPay) != 1 || res.OpenPay[0].Carried <= 0 || res.OpenPay[0].Amount != 0 {
+		t.Fatalf("expected carried amount in open pay, got %+v (%v)", res, err)
+	}
+	// fees of the next period include the carried fees
+	trade(1000, "1 minute")
+	rows, _ = a.dbGetAggregatedFees()
+	if len(rows) != 1 {
+		t.Fatalf("expected one fee row, got %d", len(rows))
+	}
+	total, err := a.withCarriedFee(rows[0], batchTime("2000"))
+	if err != nil {
+		t.Fatalf("carried: %v", err)
+	}
+	if want := new(big.Int).Add(rows[0].BrokerFeeABDKCC, fee); total.BrokerFeeABDKCC.Cmp(want) != 0 {
+		t.Errorf("expected total fee %s, got %s", want, total.BrokerFeeABDKCC)
+	}
+	res, _ = a.OpenPay(trader)
+	if len(res.OpenPay) != 1 || res.OpenPay[0].Carried <= 0 || res.OpenPay[0].Amount <= 0 {
+		t.Errorf("expected carried and current amount, got %+v", res)
+	}
+	// settled accruals are no longer carried
+	a.dbSettleAccruals("2000", PaymentExecution{TraderAddr: trader, PoolId: rows[0].PoolId, Code: "DUST"})
+	if carried, _, _ := a.dbGetCarriedFee(trader, rows[0].PoolId, "DUST", batchTime("3000")); carried.BitLen() != 0 {
+		t.Errorf("expected no carried fee after settlement, got %s", carried)
+	}
+}
+
+// idleChain does not mine, receipts of submitted payments time out
+type idleChain struct{}
+
+func (idleChain) Commit() common.Hash { return common.Hash{} }
+
+// newSimDustApp creates an app with a database and one trader whose
+// trades earn 6 tokens broker fees each, below the minimal payout of 10
+func newSimDustApp(t *testing.T) (*simEnv, func(ago time.Duration)) {
+	s := newSimDbApp(t, true)
+	a := s.app
+	s.addSimToken(t)
+	a.Settings.MinPayout = map[string]float64{strings.ToLower(simTokenAddr.Hex()): 10}
+	// 6 bps broker fee on 10000 tokens = 6 tokens
+	qty := new(big.Int).Lsh(big.NewInt(10000), 64)
+	trade := func(ago time.Duration) {
+		_, err := a.Db.Exec(`INSERT INTO trades_history VALUES ($1, $2, 100001, 0, 60, $3, $4)`,
+			strings.ToLower(s.trader.Hex()), a.BrokerAddr, qty.String(), time.Now().Add(-ago))
+		if err != nil {
+			t.Fatalf("trades: %v", err)
+		}
+	}
+	return s, trade
+}
+
+// carryDust plans the payment of the only open fee row in the batch and
+// expects it to be carried forward
+func (s *simEnv) carryDust(t *testing.T, batchTs string) {
+	a := s.app
+	rows, err := a.dbGetAggregatedFees()
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("expected one fee row, got %d (%v)", len(rows), err)
+	}
+	chain, _, err := a.newCodeChains().get(rows[0].Code, 0)
+	if err != nil {
+		t.Fatalf("chain: %v", err)
+	}
+	if _, submit := a.planBatchPayment(rows[0], chain, batchTs, 1); submit {
+		t.Fatalf("expected payment below minimum not to be submitted")
+	}
+}
+
+// TestSimMinPayoutReceiptTimeout settles the carried fees of a payment
+// whose receipt timed out, the next batch does not pay them again
+func TestSimMinPayoutReceiptTimeout(t *testing.T) {
+	s, trade := newSimDustApp(t)
+	a := s.app
+	trader := strings.ToLower(s.trader.Hex())
+	now := time.Now().Unix()
+	trade(2 * time.Hour)
+	s.carryDust(t, strconv.FormatInt(now-120, 10))
+
+	// 6 tokens of the period and 6 carried tokens are paid
+	trade(time.Hour)
+	rows, err := a.dbGetAggregatedFees()
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("expected one fee row, got %d (%v)", len(rows), err)
+	}
+	chain, _, _ := a.newCodeChains().get(rows[0].Code, 0)
+	batchTs := strconv.FormatInt(now-60, 10)
+	p, submit := a.planBatchPayment(rows[0], chain, batchTs, 1)
+	if !submit {
+		t.Fatalf("expected payment with carried fees to be submitted")
+	}
+	// the receipt times out
+	exc := a.PaymentExecutor.(*simPayExec)
+	exc.Chain = idleChain{}
+	a.Settings.GasPolicy = GasPolicy{ReceiptTimeoutSec: 1, MaxReplacements: 1}
+	if err := a.payBatch(aggregatePayments(batchTs, a.Settings.BrokerId, []PaymentExecution{p})[0], batchTs, nil); err != nil {
+		t.Fatalf("pay batch: %v", err)
+	}
+	if bal := s.balance(t, s.payout); bal.Sign() != 0 {
+		t.Fatalf("expected pending payment, got balance %s", bal)
+	}
+	// the transaction is mined and confirmed later
+	s.sim.Commit()
+	if !a.confirmPaymentTrial() {
+		t.Fatalf("expected confirmation to complete")
+	}
+	if bal := s.balance(t, s.payout); bal.Cmp(simchain.Ether(12)) != 0 {
+		t.Fatalf("expected payout balance 12 tokens, got %s", bal)
+	}
+	carried, _, err := a.dbGetCarriedFee(trader, 1, rows[0].Code, time.Now())
+	if err != nil || carried.Sign() != 0 {
+		t.Errorf("expected no carried fee after the payment, got %v (%v)", carried, err)
+	}
+	// a payment that was not made carries the fees forward again
+	if err := a.dbReleaseAccruals(batchTs, p); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if carried, _, _ := a.dbGetCarriedFee(trader, 1, rows[0].Code, time.Now()); carried.Sign() == 0 {
+		t.Errorf("expected carried fee after release")
+	}
+}
+
+// sendErrExec broadcasts the payment and reports an error afterwards,
+// like a send that times out
+type sendErrExec struct {
+	*simPayExec
+}
+
+func (exc sendErrExec) TransactPayment(tokenAddr common.Address, total *big.Int, amounts []*big.Int, payees []common.Address,
+	id int64, msg, code string, rpc *ethclient.Client, onSigned PaymentSigned) (common.Hash, error) {
+	if _, err := exc.LocalPayExec.TransactPayment(tokenAddr, total, amounts, payees, id, msg, code, rpc, onSigned); err != nil {
+		return common.Hash{}, err
+	}
+	return common.Hash{}, errors.New("send timed out")
+}
+
+// TestSimMinPayoutSendError keeps the carried fees of a payment that was
+// signed before sending failed: the transaction might be mined
+func TestSimMinPayoutSendError(t *testing.T) {
+	s, trade := newSimDustApp(t)
+	a := s.app
+	trader := strings.ToLower(s.trader.Hex())
+	now := time.Now().Unix()
+	trade(2 * time.Hour)
+	s.carryDust(t, strconv.FormatInt(now-120, 10))
+
+	trade(time.Hour)
+	rows, err := a.dbGetAggregatedFees()
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("expected one fee row, got %d (%v)", len(rows), err)
+	}
+	chain, _, _ := a.newCodeChains().get(rows[0].Code, 0)
+	batchTs := strconv.FormatInt(now-60, 10)
+	p, submit := a.planBatchPayment(rows[0], chain, batchTs, 1)
+	if !submit {
+		t.Fatalf("expected payment with carried fees to be submitted")
+	}
+	exc := a.PaymentExecutor.(*simPayExec)
+	exc.Chain = idleChain{}
+	a.PaymentExecutor = sendErrExec{exc}
+	if err := a.payBatch(aggregatePayments(batchTs, a.Settings.BrokerId, []PaymentExecution{p})[0], batchTs, nil); err != nil {
+		t.Fatalf("pay batch: %v", err)
+	}
+	if carried, _, _ := a.dbGetCarriedFee(trader, 1, rows[0].Code, time.Now()); carried.Sign() != 0 {
+		t.Fatalf("expected the carried fee to stay settled after the send error, got %v", carried)
+	}
+	// the broadcast transaction is mined: the carried fees are paid once
+	s.sim.Commit()
+	if bal := s.balance(t, s.payout); bal.Cmp(simchain.Ether(12)) != 0 {
+		t.Fatalf("expected payout balance 12 tokens, got %s", bal)
+	}
+	intent, err := a.dbGetPaymentIntent(batchTs, p)
+	if err != nil || intent.Status != INTENT_SUBMITTED {
+		t.Fatalf("expected submitted intent, got %+v (%v)", intent, err)
+	}
+	if submit, err := a.checkPaymentIntent(batchTs, p); err != nil || submit {
+		t.Errorf("expected the mined payment not to be sent again (%v)", err)
+	}
+}
+
+// TestSimMinPayoutFlush pays the carried fees of a trader that stopped
+// trading once they are carried longer than the max. carry
+func TestSimMinPayoutFlush(t *testing.T) {
+	s, trade := newSimDustApp(t)
+	a := s.app
+	trade(2 * time.Hour)
+	s.carryDust(t, strconv.FormatInt(time.Now().Add(-48*time.Hour).Unix(), 10))
+
+	confirmPaymentDelay = 0
+	nextBatch := time.Now().Unix()
+	runBatch := func() {
+		nextBatch++
+		batchTs := fmt.Sprintf("%d", nextBatch)
+		if err := a.DbSetPaymentExecFinished(batchTs, false); err != nil {
+			t.Fatalf("batch: %v", err)
+		}
+		if err := a.processPayments(batchTs); err != nil {
+			t.Fatalf("process payments: %v", err)
+		}
+	}
+	// no trades: the carried fees remain below the minimum
+	runBatch()
+	if bal := s.balance(t, s.payout); bal.Sign() != 0 {
+		t.Fatalf("expected carried fees not to be paid, got balance %s", bal)
+	}
+	var n int
+	if err := a.Db.QueryRow(`SELECT count(*) FROM referral_payment_accrual`).Scan(&n); err != nil || n != 1 {
+		t.Errorf("expected one accrual, got %d (%v)", n, err)
+	}
+	// carried longer than a day: paid regardless of the minimum
+	a.Settings.MaxCarryDays = 1
+	dry, err := a.SimulatePayments()
+	if err != nil || len(dry.Payments) != 1 || len(dry.Carried) != 0 {
+		t.Fatalf("expected dry-run to pay the carried fees, got %+v (%v)", dry, err)
+	}
+	runBatch()
+	if bal := s.balance(t, s.payout); bal.Cmp(simchain.Ether(6)) != 0 {
+		t.Errorf("expected payout balance 6 tokens, got %s", bal)
+	}
+	runBatch()
+	if bal := s.balance(t, s.payout); bal.Cmp(simchain.Ether(6)) != 0 {
+		t.Errorf("expected carried fees to be paid once, got balance %s", bal)
+	}
+}
+
+// TestSimClaims publishes a claim tree instead of paying and
+// accumulates the amounts of two batches
+func TestSimClaims(t *testing.T) {
+	s := newSimDbApp(t, false)
+	a := s.app
+	a.Settings.PayoutMode = PAYOUT_MODE_CLAIM
+	a.Settings.ClaimDistributorAddr = simchain.ClaimDistributorAddr.Hex()
+	s.addSimToken(t)
+	// 6 bps broker fee on 10000 tokens = 6 tokens per trade
+	qty := new(big.Int).Lsh(big.NewInt(10000), 64)
+	trade := func(trader common.Address, ago time.Duration) {
+		_, err := a.Db.Exec(`INSERT INTO trades_history VALUES ($1, $2, 100001, 0, 60, $3, $4)`,
+			strings.ToLower(trader.Hex()), a.BrokerAddr, qty.String(), time.Now().Add(-ago))
+		if err != nil {
+			t.Fatalf("trades: %v", err)
+		}
+	}
+	confirmPaymentDelay = 0
+	runBatch := func(batchTs string) {
+		if err := a.DbSetPaymentExecFinished(batchTs, false); err != nil {
+			t.Fatalf("batch: %v", err)
+		}
+		if err := a.processPayments(batchTs); err != nil {
+			t.Fatalf("process payments: %v", err)
+		}
+	}
+	payout := strings.ToLower(s.payout.Hex())
+	checkClaim := func(expected *big.Int) ([32]byte, []common.Hash) {
+		res, err := a.ClaimProofs(payout)
+		if err != nil || len(res.Claims) != 1 {
+			t.Fatalf("expected one claim, got %+v (%v)", res, err)
+		}
+		c := res.Claims[0]
+		if c.CumulativeAmountDecN != expected.String() {
+			t.Errorf("expected cumulative amount %s, got %s", expected, c.CumulativeAmountDecN)
+		}
+		var proof []common.Hash
+		for _, h := range c.Proof {
+			proof = append(proof, common.HexToHash(h))
+		}
+		leaf := ClaimLeaf{Payee: s.payout, Token: common.HexToAddress(c.TokenAddr), CumulativeAmount: expected}
+		if !VerifyClaim(common.HexToHash(res.Root), leaf, proof) {
+			t.Errorf("expected valid proof for root %s", res.Root)
+		}
+		return common.HexToHash(res.Root), proof
+	}
+	// the broker sets the latest root on the distributor
+	setRoot := func() {
+		info, _, err := a.dbGetLatestClaimLeaves("", false)
+		if err != nil || info == nil {
+			t.Fatalf("expected claim tree (%v)", err)
+		}
+		if _, err := s.sim.SetClaimRoot(common.HexToHash(info.Root)); err != nil {
+			t.Fatalf("set root: %v", err)
+		}
+		s.sim.Commit()
+	}
+
+	trade(s.trader, 2*time.Hour)
+	trade(s.referrer, 2*time.Hour)
+	runBatch(fmt.Sprintf("%d", time.Now().Unix()-120))
+	if bal := s.balance(t, s.payout); bal.Sign() != 0 {
+		t.Errorf("expected no payment in claim mode, got %s", bal.String())
+	}
+	// the root is pending: no proofs, the trades are not allocated again
+	if res, err := a.ClaimProofs(payout); err != nil || len(res.Claims) != 0 {
+		t.Errorf("expected no claims before the root is set, got %+v (%v)", res, err)
+	}
+	rows, err := a.dbGetAggregatedFees()
+	if err != nil || len(rows) != 0 {
+		t.Errorf("expected no open payments after allocation, got %d (%v)", len(rows), err)
+	}
+	trade(s.trader, time.Minute)
+	runBatch(fmt.Sprintf("%d", time.Now().Unix()-60))
+	var trees int
+	if err := a.Db.QueryRow(`SELECT count(*) FROM referral_claim_tree`).Scan(&trees); err != nil || trees != 1 {
+		t.Errorf("expected no claim tree while the root is pending, got %d (%v)", trees, err)
+	}
+
+	// the root is set: the allocation is settled and the next batch
+	// allocates the later trade
+	setRoot()
+	runBatch(fmt.Sprintf("%d", time.Now().Unix()))
+	// DEFAULT code: the broker payout address receives everything
+	root, proof := checkClaim(simchain.Ether(12))
+	if _, err := s.sim.FundToken(simchain.ClaimDistributorAddr, simchain.Ether(100)); err != nil {
+		t.Fatalf("fund: %v", err)
+	}
+	dist, _ := contracts.NewClaimDistributor(simchain.ClaimDistributorAddr, s.sim.Client)
+	if onchain, err := dist.MerkleRoot(nil); err != nil || onchain != root {
+		t.Fatalf("expected claimable root %x on-chain, got %x (%v)", root, onchain, err)
+	}
+	opts, _ := bind.NewKeyedTransactorWithChainID(s.execKey, big.NewInt(simchain.ChainId))
+	var proof32 [][32]byte
+	for _, h := range proof {
+		proof32 = append(proof32, h)
+	}
+	if _, err := dist.Claim(opts, s.payout, simTokenAddr, simchain.Ether(12), proof32); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	s.sim.Commit()
+	if bal := s.balance(t, s.payout); bal.Cmp(simchain.Ether(12)) != 0 {
+		t.Errorf("expected claimed balance 12 tokens, got %s", bal)
+	}
+	setRoot()
+	if err := a.confirmClaimRoots(); err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+	checkClaim(simchain.Ether(18))
+}
+
+// TestSimRetry retries a failed payment with the next batch
+func TestSimRetry(t *testing.T) {
+	s := newSimDbApp(t, false)
+	a := s.app
+	s.addSimToken(t)
+	// 6 bps broker fee on 10000 tokens = 6 tokens
+	qty := new(big.Int).Lsh(big.NewInt(10000), 64)
+	tradeTs := time.Now().Add(-time.Hour).Truncate(time.Second)
+	_, err := a.Db.Exec(`INSERT INTO trades_history VALUES ($1, $2, 100001, 0, 60, $3, $4)`,
+		strings.ToLower(s.trader.Hex()), a.BrokerAddr, qty.String(), tradeTs)
+	if err != nil {
+		t.Fatalf("trades: %v", err)
+	}
+
+	// the payment of the trade fails
+	opts, _ := bind.NewKeyedTransactorWithChainID(s.execKey, big.NewInt(simchain.ChainId))
+	opts.GasLimit = 1_000_000
+	tx, err := a.MultipayCtrct.Pay(opts, 1, simTokenAddr, []*big.Int{simchain.Ether(2000)}, []common.Address{s.trader}, "fail")
+	if err != nil {
+		t.Fatalf("pay: %v", err)
+	}
+	s.sim.Commit()
+	failedBatchTs := fmt.Sprintf("%d", time.Now().Unix()-60)
+	p := PaymentExecution{TraderAddr: strings.ToLower(s.trader.Hex()), PoolId: 1, Code: "DEFAULT", LastTradeConsidered: tradeTs}
+	if err := a.dbSetPaymentIntent(failedBatchTs, p, INTENT_SUBMITTED, tx.Hash().Hex(), ""); err != nil {
+		t.Fatalf("intent: %v", err)
+	}
+	a.dbWriteTx(s.trader.Hex(), a.BrokerAddr, "DEFAULT", []*big.Int{big.NewInt(0), simchain.Ether(6)},
+		[]common.Address{s.trader, s.payout}, nil, failedBatchTs, 1, tx.Hash().Hex())
+	a.PurgeUnconfirmedPayments([]string{tx.Hash().Hex()})
+
+	// the retry takes over the trade
+	retries, err := a.PaymentRetries(s.payout.Hex())
+	if err != nil || len(retries) != 1 || retries[0].Status != RETRY_SCHEDULED || retries[0].FailedTxHash != tx.Hash().Hex() {
+		t.Fatalf("expected scheduled retry, got %+v (%v)", retries, err)
+	}
+	rows, err := a.dbGetAggregatedFees()
+	if err != nil || len(rows) != 0 {
+		t.Errorf("expected no open payments, got %d (%v)", len(rows), err)
+	}
+
+	// not due yet
+	confirmPaymentDelay = 0
+	nextBatch := time.Now().Unix()
+	runBatch := func() {
+		nextBatch++
+		batchTs := fmt.Sprintf("%d", nextBatch)
+		if err := a.DbSetPaymentExecFinished(batchTs, false); err != nil {
+			t.Fatalf("batch: %v", err)
+		}
+		if err := a.processPayments(batchTs); err != nil {
+			t.Fatalf("process payments: %v", err)
+		}
+	}
+	runBatch()
+	if bal := s.balance(t, s.payout); bal.Sign() != 0 {
+		t.Fatalf("expected no retry before the backoff, got balance %s", bal)
+	}
+	if _, err := a.Db.Exec(`UPDATE referral_payment_retry SET next_attempt_ts = $1`, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	runBatch()
+	if bal := s.balance(t, s.payout); bal.Cmp(simchain.Ether(6)) != 0 {
+		t.Errorf("expected retry to pay 6 tokens, got %s", bal)
+	}
+	retries, err = a.PaymentRetries(s.payout.Hex())
+	if err != nil || len(retries) != 1 || retries[0].Status != RETRY_PAID || retries[0].Attempts != 1 || retries[0].RetryTxHash == "" {
+		t.Errorf("expected paid retry, got %+v (%v)", retries, err)
+	}
+	// the retry payment does not settle later trades
+	rows, err = a.dbGetAggregatedFees()
+	if err != nil || len(rows) != 0 {
+		t.Errorf("expected no open payments, got %d (%v)", len(rows), err)
+	}
+}
+
+// TestSimIndexer indexes a payment and rolls it back after a reorg
+func TestSimIndexer(t *testing.T) {
+	s := newSimDbApp(t, false)
+	a := s.app
+	s.addSimToken(t)
+	qty := new(big.Int).Lsh(big.NewInt(10000), 64)
+	_, err := a.Db.Exec(`INSERT INTO trades_history VALUES ($1, $2, 100001, 0, 60, $3, $4)`,
+		strings.ToLower(s.trader.Hex()), a.BrokerAddr, qty.String(), time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("trades: %v", err)
+	}
+	confirmPaymentDelay = 0
+	batchTs := fmt.Sprintf("%d", time.Now().Unix())
+	if err := a.DbSetPaymentExecFinished(batchTs, false); err != nil {
+		t.Fatalf("batch: %v", err)
+	}
+	if err := a.processPayments(batchTs); err != nil {
+		t.Fatalf("process payments: %v", err)
+	}
+	var txHash string
+	err = a.Db.QueryRow(`SELECT tx_hash FROM referral_payment WHERE tx_confirmed`).Scan(&txHash)
+	if err != nil {
+		t.Fatalf("payment: %v", err)
+	}
+	receipt, err := s.sim.Client.TransactionReceipt(context.Background(), common.HexToHash(txHash))
+	if err != nil {
+		t.Fatalf("receipt: %v", err)
+	}
+	blockNr := receipt.BlockNumber.Uint64()
+
+	// the indexer restores the payments from the events
+	if _, err := a.Db.Exec(`DELETE FROM referral_payment`); err != nil {
+		t.Fatalf("delete payments: %v", err)
+	}
+	a.Settings.Indexer = IndexerSettings{Enabled: true, Confirmations: 1, DeploymentBlock: 1, MaxBlockRange: 2}
+	s.sim.Commit()
+	if err := a.readPayments(); err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	countConfirmed := func() int {
+		var n int
+		a.Db.QueryRow(`SELECT count(*) FROM referral_payment WHERE tx_confirmed`).Scan(&n)
+		return n
+	}
+	if n := countConfirmed(); n != 1 {
+		t.Fatalf("expected indexed payment, got %d", n)
+	}
+
+	// reorg: the blocks from the payment on are replaced
+	parent, err := s.sim.Client.HeaderByNumber(context.Background(), new(big.Int).SetUint64(blockNr-1))
+	if err != nil {
+		t.Fatalf("header: %v", err)
+	}
+	if err := s.sim.Fork(parent.Hash()); err != nil {
+		t.Fatalf("fork: %v", err)
+	}
+	for k := 0; k < 4; k++ {
+		s.sim.Commit()
+	}
+	if _, err := a.IndexPayments(); err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	if n := countConfirmed(); n != 0 {
+		t.Errorf("expected payment rolled back, got %d confirmed", n)
+	}
+	if err := a.readPayments(); err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	// confirmed again if the transaction was included in the new blocks
+	expected := 0
+	if _, err := s.sim.Client.TransactionReceipt(context.Background(), common.HexToHash(txHash)); err == nil {
+		expected = 1
+	}
+	if n := countConfirmed(); n != expected {
+		t.Errorf("expected %d confirmed payments, got %d", expected, n)
+	}
+	cp, err := a.dbGetIndexerCheckpoint()
+	if err != nil {
+		t.Fatalf("checkpoint: %v", err)
+	}
+	if hash, _ := blockHashAt(s.sim.Client, cp.Nr); hash != cp.Hash {
+		t.Errorf("checkpoint %d not on the canonical chain", cp.Nr)
+	}
+}
+
+// TestSimIndexerTenants rolls back only the payments of the broker
+// whose indexed blocks were reorged, another broker paying from the
+// same address keeps its payments
+func TestSimIndexerTenants(t *testing.T) {
+	s := newSimDbApp(t, false)
+	a := s.app
+	other := &App{Db: a.Db, RpcClient: a.RpcClient, BrokerAddr: a.BrokerAddr, Settings: a.Settings}
+	other.Settings.BrokerId = "sim2"
+
+	// both brokers indexed a payment in block 2, whose hash changed
+	block1, err := blockHashAt(s.sim.Client, 1)
+	if err != nil {
+		t.Fatalf("block: %v", err)
+	}
+	txHashes := map[*App]string{a: "0x" + strings.Repeat("a", 64), other: "0x" + strings.Repeat("b", 64)}
+	for k, app := range []*App{a, other} {
+		txHash := txHashes[app]
+		err := app.dbInsertIndexedBlocks([]indexedBlock{{Nr: 1, Hash: block1}, {Nr: 2, Hash: "0x01", TxHashes: []string{txHash}}})
+		if err != nil {
+			t.Fatalf("blocks: %v", err)
+		}
+		_, err = a.Db.Exec(`INSERT INTO referral_payment
+				(trader_addr, payee_addr, code, pool_id, batch_ts, paid_amount_cc, tx_hash, block_nr, tx_confirmed, broker_addr)
+			VALUES ($1, $2, 'DEFAULT', 1, $3, 1, $4, 2, true, $5)`,
+			strings.ToLower(s.trader.Hex()), strings.ToLower(s.payout.Hex()), time.Unix(int64(1000+k), 0), txHash, a.BrokerAddr)
+		if err != nil {
+			t.Fatalf("payment: %v", err)
+		}
+	}
+	if err := a.rollbackReorg(a.RpcClient); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	confirmed := func(txHash string) bool {
+		var c bool
+		if err := a.Db.QueryRow(`SELECT tx_confirmed FROM referral_payment WHERE tx_hash = $1`, txHash).Scan(&c); err != nil {
+			t.Fatalf("payment: %v", err)
+		}
+		return c
+	}
+	if confirmed(txHashes[a]) {
+		t.Errorf("expected payment of broker %s rolled back", a.Settings.BrokerId)
+	}
+	if !confirmed(txHashes[other]) {
+		t.Errorf("expected payment of broker %s to remain confirmed", other.Settings.BrokerId)
+	}
+	if blocks, _ := other.dbGetIndexedBlocks(); len(blocks) != 2 {
+		t.Errorf("expected indexed blocks of broker %s to remain, got %d", other.Settings.BrokerId, len(blocks))
+	}
+}
@@ -0,0 +1,473 @@
+package referral
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"referral-system/env"
+	"referral-system/src/contracts"
+	"referral-system/src/simchain"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/spf13/viper"
+)
+
+var (
+	simMultiPayAddr = simchain.MultiPayAddr
+	simTokenAddr    = simchain.TokenAddr
+)
+
+type simEnv struct {
+	app      *App
+	sim      *simchain.Backend
+	execKey  *ecdsa.PrivateKey
+	payer    common.Address
+	payout   common.Address
+	referrer common.Address
+	trader   common.Address
+}
+
+// newSimApp creates an app connected to a simulated chain. With direct=true
+// the executor pays, otherwise the executor submits payments signed by a
+// separate broker key.
+func newSimApp(t *testing.T, direct bool) *simEnv {
+	execKey, _ := crypto.GenerateKey()
+	payerKey := execKey
+	if !direct {
+		payerKey, _ = crypto.GenerateKey()
+	}
+	s := &simEnv{
+		execKey:  execKey,
+		payer:    crypto.PubkeyToAddress(payerKey.PublicKey),
+		payout:   common.HexToAddress("0x00000000000000000000000000000000000000a1"),
+		referrer: common.HexToAddress("0x00000000000000000000000000000000000000a2"),
+		trader:   common.HexToAddress("0x00000000000000000000000000000000000000a3"),
+	}
+	sim, err := simchain.New(types.GenesisAlloc{
+		crypto.PubkeyToAddress(execKey.PublicKey): {Balance: simchain.Ether(10)},
+		s.payer: {Balance: simchain.Ether(10)},
+	})
+	if err != nil {
+		t.Fatalf("starting chain: %v", err)
+	}
+	t.Cleanup(func() { sim.Close() })
+	s.sim = sim
+
+	// payer allows MultiPay to spend its tokens
+	if _, err := sim.FundToken(s.payer, simchain.Ether(1000)); err != nil {
+		t.Fatalf("fund: %v", err)
+	}
+	tkn, _ := contracts.NewErc20(simTokenAddr, sim.Client)
+	opts, _ := bind.NewKeyedTransactorWithChainID(payerKey, big.NewInt(simchain.ChainId))
+	if _, err := tkn.Approve(opts, simMultiPayAddr, simchain.Ether(1000)); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	sim.Commit()
+
+	v := viper.New()
+	v.Set(env.CHAIN_ID, simchain.ChainId)
+	v.Set(env.BROKER_KEY, hex.EncodeToString(crypto.FromECDSA(execKey)))
+	if !direct {
+		v.Set(env.LOCAL_BROKER_KEY, hex.EncodeToString(crypto.FromECDSA(payerKey)))
+	}
+	exc := &simPayExec{Chain: sim}
+	if err := exc.Init(v, simMultiPayAddr.Hex()); err != nil {
+		t.Fatalf("init executor: %v", err)
+	}
+	exc.NewTokenBucket(10, 10)
+	exc.SetClient(sim.Client)
+	mpay, _ := contracts.NewMultiPay(simMultiPayAddr, sim.Client)
+	s.app = &App{
+		PaymentExecutor: exc,
+		RpcClient:       sim.Client,
+		MultipayCtrct:   mpay,
+		BrokerAddr:      strings.ToLower(exc.GetBrokerAddr().Hex()),
+		Settings: Settings{
+			ChainId:                simchain.ChainId,
+			PaymentMaxLookBackDays: 14,
+			BrokerPayoutAddr:       s.payout,
+			BrokerId:               "sim",
+		},
+	}
+	s.app.Settings.TokenX.Address = simTokenAddr.Hex()
+	s.app.Settings.TokenX.Decimals = 18
+	return s
+}
+
+func (s *simEnv) balance(t *testing.T, addr common.Address) *big.Int {
+	tkn, _ := contracts.NewErc20(simTokenAddr, s.sim.Client)
+	bal, err := tkn.BalanceOf(nil, addr)
+	if err != nil {
+		t.Fatalf("balance: %v", err)
+	}
+	return bal
+}
+
+func TestSimPayment(t *testing.T) {
+	for _, direct := range []bool{true, false} {
+		t.Run(fmt.Sprintf("direct=%v", direct), func(t *testing.T) {
+			s := newSimApp(t, direct)
+			// 10 tokens of broker fees
+			row := AggregatedFeesRow{
+				PoolId:              1,
+				TraderAddr:          s.trader.Hex(),
+				Code:                "SIM",
+				BrokerFeeABDKCC:     new(big.Int).Lsh(big.NewInt(10), 64),
+				LastTradeConsidered: time.Unix(1700000000, 0),
+				TokenAddr:           simTokenAddr.Hex(),
+				TokenDecimals:       18,
+			}
+			// broker 25%, referrer 60%, trader 15%
+			chain := []DbReferralChainOfChild{
+				{Parent: s.payout.Hex(), Child: s.referrer.Hex(), PassOn: 0.75, ParentPay: 0.25, ChildAvail: 0.75, Lvl: 1},
+				{Parent: s.referrer.Hex(), Child: "SIM", PassOn: 0.2, ParentPay: 0.6, ChildAvail: 0.15, Lvl: 0},
+			}
+			p := s.app.planPayment(row, chain, "1700000100", 1)
+			txHash, err := s.app.PaymentExecutor.TransactPayment(common.HexToAddress(p.TokenAddr), p.TotalDecN,
+				p.AmountDecN, p.PayeeAddr, p.Id, p.Msg, p.Code, s.app.RpcClient, nil)
+			if err != nil {
+				t.Fatalf("transact: %v", err)
+			}
+			if status := QueryTxStatus(s.app.RpcClient, txHash.Hex()); status != TxConfirmed {
+				t.Fatalf("expected confirmed tx, got status %d", status)
+			}
+			expected := map[common.Address]*big.Int{
+				s.trader:   new(big.Int).Div(simchain.Ether(15), big.NewInt(10)),
+				s.payout:   new(big.Int).Div(simchain.Ether(25), big.NewInt(10)),
+				s.referrer: simchain.Ether(6),
+				s.payer:    simchain.Ether(990),
+			}
+			for addr, amount := range expected {
+				if bal := s.balance(t, addr); bal.Cmp(amount) != 0 {
+					t.Errorf("balance of %s: expected %s, got %s", addr.Hex(), amount.String(), bal.String())
+				}
+			}
+
+			logs, err := FilterPayments(s.app.MultipayCtrct, s.app.RpcClient, 0, 0)
+			if err != nil {
+				t.Fatalf("filter payments: %v", err)
+			}
+			if len(logs) != 1 {
+				t.Fatalf("expected 1 payment log, got %d", len(logs))
+			}
+			l := logs[0]
+			if l.BatchTimestamp != 1700000100 || l.Code != "SIM" || l.PoolId != 1 || l.TxHash != txHash.Hex() || l.BlockTs == 0 {
+				t.Errorf("unexpected payment log %+v", l)
+			}
+			if common.HexToAddress(l.BrokerAddr) != s.payer {
+				t.Errorf("expected payer %s, got %s", s.payer.Hex(), l.BrokerAddr)
+			}
+			for k := range p.PayeeAddr {
+				if l.PayeeAddr[k] != p.PayeeAddr[k] || l.AmountDecN[k].Cmp(p.AmountDecN[k]) != 0 {
+					t.Errorf("payee %d: expected %s %s, got %s %s", k, p.PayeeAddr[k].Hex(), p.AmountDecN[k].String(),
+						l.PayeeAddr[k].Hex(), l.AmountDecN[k].String())
+				}
+			}
+
+			// the indexer reads the events of the broker per block range
+			hash, err := blockHashAt(s.app.RpcClient, l.BlockNumber)
+			if err != nil || hash != l.BlockHash {
+				t.Errorf("expected block hash %s, got %s (%v)", l.BlockHash, hash, err)
+			}
+			logs, err = s.app.filterBrokerPayments(l.BlockNumber, l.BlockNumber)
+			if err != nil || len(logs) != 1 || logs[0].TxHash != l.TxHash {
+				t.Errorf("expected payment of the broker, got %+v (%v)", logs, err)
+			}
+			if logs, _ = s.app.filterBrokerPayments(0, l.BlockNumber-1); len(logs) != 0 {
+				t.Errorf("expected no payments before block %d, got %d", l.BlockNumber, len(logs))
+			}
+		})
+	}
+}
+
+func TestSimPaymentSigned(t *testing.T) {
+	for _, direct := range []bool{true, false} {
+		t.Run(fmt.Sprintf("direct=%v", direct), func(t *testing.T) {
+			s := newSimApp(t, direct)
+			amounts := []*big.Int{big.NewInt(1), big.NewInt(2)}
+			payees := []common.Address{s.trader, s.payout}
+			// the transaction is not sent if the callback fails
+			txHash, err := s.app.PaymentExecutor.TransactPayment(simTokenAddr, big.NewInt(3), amounts, payees, 1, "msg", "SIM",
+				s.app.RpcClient, func(tx *types.Transaction, digest common.Hash) error {
+					return errors.New("db down")
+				})
+			if err == nil {
+				t.Fatalf("expected error, got tx %s", txHash.Hex())
+			}
+			if bal := s.balance(t, s.trader); bal.BitLen() != 0 {
+				t.Errorf("expected no payment, trader balance %s", bal.String())
+			}
+			var signed *types.Transaction
+			var signedDigest common.Hash
+			txHash, err = s.app.PaymentExecutor.TransactPayment(simTokenAddr, big.NewInt(3), amounts, payees, 1, "msg", "SIM",
+				s.app.RpcClient, func(tx *types.Transaction, digest common.Hash) error {
+					signed, signedDigest = tx, digest
+					return nil
+				})
+			if err != nil {
+				t.Fatalf("transact: %v", err)
+			}
+			if signed == nil || signed.Hash() != txHash {
+				t.Fatalf("expected callback with tx %s", txHash.Hex())
+			}
+			if direct != (signedDigest == common.Hash{}) {
+				t.Errorf("unexpected digest %s", signedDigest.Hex())
+			}
+			if status := QueryTxStatus(s.app.RpcClient, txHash.Hex()); status != TxConfirmed {
+				t.Errorf("expected confirmed tx, got status %d", status)
+			}
+			// MultiPay records the executed payment under the sdk digest
+			if !direct {
+				executed, err := s.app.MultipayCtrct.ExecutedPaymentDigests(nil, signedDigest)
+				if err != nil || !executed {
+					t.Errorf("expected executed digest %s (%v)", signedDigest.Hex(), err)
+				}
+			}
+		})
+	}
+}
+
+func TestSimTxStatus(t *testing.T) {
+	s := newSimApp(t, true)
+	// paying more than the payer holds reverts
+	opts, _ := bind.NewKeyedTransactorWithChainID(s.execKey, big.NewInt(simchain.ChainId))
+	opts.GasLimit = 1_000_000
+	tx, err := s.app.MultipayCtrct.Pay(opts, 1, simTokenAddr, []*big.Int{simchain.Ether(2000)},
+		[]common.Address{s.trader}, "fail")
+	if err != nil {
+		t.Fatalf("pay: %v", err)
+	}
+	s.sim.Commit()
+	if status := QueryTxStatus(s.app.RpcClient, tx.Hash().Hex()); status != TxFailed {
+		t.Errorf("expected failed tx, got status %d", status)
+	}
+	if status := QueryTxStatus(s.app.RpcClient, common.HexToHash("0x01").Hex()); status != TxNotFound {
+		t.Errorf("expected unknown tx, got status %d", status)
+	}
+}
+
+// TestSimAggregatedPayment pays two traders with one transaction and
+// rebuilds the payments per trader from the event
+func TestSimAggregatedPayment(t *testing.T) {
+	for _, direct := range []bool{true, false} {
+		t.Run(fmt.Sprintf("direct=%v", direct), func(t *testing.T) {
+			s := newSimApp(t, direct)
+			// broker 25%, referrer 60%, trader 15%
+			chain := []DbReferralChainOfChild{
+				{Parent: s.payout.Hex(), Child: s.referrer.Hex(), PassOn: 0.75, ParentPay: 0.25, ChildAvail: 0.75, Lvl: 1},
+				{Parent: s.referrer.Hex(), Child: "SIM", PassOn: 0.2, ParentPay: 0.6, ChildAvail: 0.15, Lvl: 0},
+			}
+			other := common.HexToAddress("0x00000000000000000000000000000000000007e5")
+			var payments []PaymentExecution
+			for k, trader := range []common.Address{s.trader, other} {
+				row := AggregatedFeesRow{
+					PoolId:              1,
+					TraderAddr:          trader.Hex(),
+					Code:                "SIM",
+					BrokerFeeABDKCC:     new(big.Int).Lsh(big.NewInt(int64(10*(k+1))), 64),
+					LastTradeConsidered: time.Unix(1700000000, 0),
+					TokenAddr:           simTokenAddr.Hex(),
+					TokenDecimals:       18,
+				}
+				payments = append(payments, s.app.planPayment(row, chain, "1700000100", 1))
+			}
+			aps := aggregatePayments("1700000100", "sim", payments)
+			if len(aps) != 1 || len(aps[0].PayeeAddr) != 4 {
+				t.Fatalf("expected one transaction with 4 payees, got %d", len(aps))
+			}
+			ap := aps[0]
+			txHash, err := s.app.PaymentExecutor.TransactPayment(common.HexToAddress(ap.TokenAddr), ap.TotalDecN,
+				ap.AmountDecN, ap.PayeeAddr, ap.Id, ap.Msg, "", s.app.RpcClient, nil)
+			if err != nil {
+				t.Fatalf("transact: %v", err)
+			}
+			if status := QueryTxStatus(s.app.RpcClient, txHash.Hex()); status != TxConfirmed {
+				t.Fatalf("expected confirmed tx, got status %d", status)
+			}
+			// 10 + 20 tokens of fees
+			expected := map[common.Address]*big.Int{
+				s.trader:   new(big.Int).Div(simchain.Ether(15), big.NewInt(10)),
+				other:      simchain.Ether(3),
+				s.payout:   new(big.Int).Div(simchain.Ether(75), big.NewInt(10)),
+				s.referrer: simchain.Ether(18),
+				s.payer:    simchain.Ether(970),
+			}
+			for addr, amount := range expected {
+				if bal := s.balance(t, addr); bal.Cmp(amount) != 0 {
+					t.Errorf("balance of %s: expected %s, got %s", addr.Hex(), amount.String(), bal.String())
+				}
+			}
+			logs, err := FilterPayments(s.app.MultipayCtrct, s.app.RpcClient, 0, 0)
+			if err != nil {
+				t.Fatalf("filter payments: %v", err)
+			}
+			if len(logs) != len(payments) {
+				t.Fatalf("expected %d payment logs, got %d", len(payments), len(logs))
+			}
+			for k, p := range payments {
+				l := logs[k]
+				if l.BatchTimestamp != 1700000100 || l.Code != "SIM" || l.PoolId != 1 || l.TxHash != txHash.Hex() || l.BlockTs == 0 {
+					t.Errorf("unexpected payment log %+v", l)
+				}
+				if len(l.PayeeAddr) != len(p.PayeeAddr) {
+					t.Fatalf("log %d: expected %d payees, got %d", k, len(p.PayeeAddr), len(l.PayeeAddr))
+				}
+				for j := range p.PayeeAddr {
+					if l.PayeeAddr[j] != p.PayeeAddr[j] || l.AmountDecN[j].Cmp(p.AmountDecN[j]) != 0 {
+						t.Errorf("log %d payee %d: expected %s %s, got %s %s", k, j, p.PayeeAddr[j].Hex(), p.AmountDecN[j],
+							l.PayeeAddr[j].Hex(), l.AmountDecN[j])
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestSimReplaceTx replaces a pending payment with higher fees and
+// waits for the replacement to be mined
+func TestSimReplaceTx(t *testing.T) {
+	s := newSimApp(t, true)
+	// the plain local executor does not mine
+	exc := &s.app.PaymentExecutor.(*simPayExec).LocalPayExec
+	txHash, err := exc.TransactPayment(simTokenAddr, simchain.Ether(1), []*big.Int{simchain.Ether(1)},
+		[]common.Address{s.trader}, 1, "replace", "", s.app.RpcClient, nil)
+	if err != nil {
+		t.Fatalf("transact: %v", err)
+	}
+	if _, _, err := waitForReceipt(s.app.RpcClient, []common.Hash{txHash}, 0, nil); err == nil {
+		t.Fatalf("expected pending transaction")
+	}
+	newHash, err := exc.ReplaceTransaction(txHash, nil)
+	if err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	orig, repl := exc.sentTxs[txHash], exc.sentTxs[newHash]
+	if repl.Nonce() != orig.Nonce() || repl.Type() != types.DynamicFeeTxType ||
+		repl.GasFeeCap().Cmp(orig.GasFeeCap()) <= 0 || repl.GasTipCap().Cmp(orig.GasTipCap()) <= 0 {
+		t.Fatalf("expected replacement with same nonce and higher fees")
+	}
+	// the pool only keeps the replacement
+	if _, _, err := s.app.RpcClient.TransactionByHash(context.Background(), newHash); err != nil {
+		t.Fatalf("replacement not found: %v", err)
+	}
+	s.sim.Commit()
+	receipt, minedHash, err := waitForReceipt(s.app.RpcClient, []common.Hash{txHash, newHash}, time.Second, nil)
+	if err != nil || minedHash != newHash || receipt.Status != types.ReceiptStatusSuccessful {
+		t.Fatalf("expected replacement %s to be mined, got %s (%v)", newHash.Hex(), minedHash.Hex(), err)
+	}
+	if bal := s.balance(t, s.trader); bal.Cmp(simchain.Ether(1)) != 0 {
+		t.Errorf("expected trader to be paid once, got %s", bal)
+	}
+	if _, err := exc.ReplaceTransaction(common.Hash{}, nil); err == nil {
+		t.Errorf("expected error for unknown transaction")
+	}
+}
+
+// TestSimConcurrentPayments submits payments concurrently and fills
+// the nonce of a payment that could not be sent
+func TestSimConcurrentPayments(t *testing.T) {
+	s := newSimApp(t, true)
+	// the plain local executor does not mine
+	exc := &s.app.PaymentExecutor.(*simPayExec).LocalPayExec
+	const n = 4
+	hashes := make([]common.Hash, n)
+	errs := make(chan error, n)
+	for k := 0; k < n; k++ {
+		go func(k int) {
+			var err error
+			hashes[k], err = exc.TransactPayment(simTokenAddr, simchain.Ether(1), []*big.Int{simchain.Ether(1)},
+				[]common.Address{s.trader}, int64(k+1), "concurrent", "", s.app.RpcClient, nil)
+			errs <- err
+		}(k)
+	}
+	for k := 0; k < n; k++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("transact: %v", err)
+		}
+	}
+	// nonce n is handed out but the payment is not sent
+	auth, err := exc.CreateAuth()
+	if err != nil {
+		t.Fatalf("auth: %v", err)
+	}
+	last, err := exc.TransactPayment(simTokenAddr, simchain.Ether(1), []*big.Int{simchain.Ether(1)},
+		[]common.Address{s.trader}, n+1, "after gap", "", s.app.RpcClient, nil)
+	if err != nil {
+		t.Fatalf("transact: %v", err)
+	}
+	exc.nonces().release(auth.Nonce.Uint64(), errors.New("connection refused"))
+	s.sim.Commit()
+	for _, h := range hashes {
+		if status := QueryTxStatus(s.app.RpcClient, h.Hex()); status != TxConfirmed {
+			t.Fatalf("expected tx %s to be mined, got status %d", h.Hex(), status)
+		}
+	}
+	if _, _, err := waitForReceipt(s.app.RpcClient, []common.Hash{last}, 0, nil); err == nil {
+		t.Fatalf("expected payment after the gap to be pending")
+	}
+	if err := exc.FillNonceGaps(); err != nil {
+		t.Fatalf("fill gaps: %v", err)
+	}
+	s.sim.Commit()
+	if status := QueryTxStatus(s.app.RpcClient, last.Hex()); status != TxConfirmed {
+		t.Fatalf("expected payment after the gap to be mined, got status %d", status)
+	}
+	if bal := s.balance(t, s.trader); bal.Cmp(simchain.Ether(n+1)) != 0 {
+		t.Errorf("expected %d payments, got balance %s", n+1, bal)
+	}
+}
+
+// TestSimClaimDistributor claims with the proofs of a claim tree from
+// the distributor contract
+func TestSimClaimDistributor(t *testing.T) {
+	s := newSimApp(t, true)
+	var leaves []ClaimLeaf
+	for k, payee := range []common.Address{s.payout, s.referrer, s.trader} {
+		leaves = append(leaves, ClaimLeaf{Payee: payee, Token: simTokenAddr, CumulativeAmount: simchain.Ether(int64(k + 1))})
+	}
+	tree := newMerkleTree(leaves)
+	if _, err := s.sim.SetClaimRoot(tree.Root()); err != nil {
+		t.Fatalf("set root: %v", err)
+	}
+	if _, err := s.sim.FundToken(simchain.ClaimDistributorAddr, simchain.Ether(10)); err != nil {
+		t.Fatalf("fund: %v", err)
+	}
+	s.sim.Commit()
+	dist, _ := contracts.NewClaimDistributor(simchain.ClaimDistributorAddr, s.sim.Client)
+	opts, _ := bind.NewKeyedTransactorWithChainID(s.execKey, big.NewInt(simchain.ChainId))
+	opts.GasLimit = 200_000
+	// claim of the k-th leaf of the tree
+	claim := func(k int, amount *big.Int) common.Hash {
+		var proof [][32]byte
+		for _, h := range tree.proof(k) {
+			proof = append(proof, h)
+		}
+		tx, err := dist.Claim(opts, tree.leaves[k].Payee, simTokenAddr, amount, proof)
+		if err != nil {
+			t.Fatalf("claim: %v", err)
+		}
+		s.sim.Commit()
+		return tx.Hash()
+	}
+	for k, l := range tree.leaves {
+		claim(k, l.CumulativeAmount)
+		if bal := s.balance(t, l.Payee); bal.Cmp(l.CumulativeAmount) != 0 {
+			t.Errorf("expected %s to claim %s, got %s", l.Payee.Hex(), l.CumulativeAmount, bal)
+		}
+	}
+	// claimed already, and an amount that is not in the tree
+	for _, tx := range []common.Hash{claim(0, tree.leaves[0].CumulativeAmount), claim(1, simchain.Ether(5))} {
+		if receipt, err := s.sim.Client.TransactionReceipt(context.Background(), tx); err != nil || receipt.Status != types.ReceiptStatusFailed {
+			t.Errorf("expected claim %s to revert (%v)", tx.Hex(), err)
+		}
+	}
+}
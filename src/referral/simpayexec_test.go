@@ -0,0 +1,40 @@
+package referral
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// blockCommitter mines pending transactions, e.g., a
+// simulated chain (see package simchain)
+type blockCommitter interface {
+	Commit() common.Hash
+}
+
+// simPayExec is a LocalPayExec for simulated chains without
+// automatic block production. Every submitted payment is
+// mined right away so that receipts are available.
+type simPayExec struct {
+	LocalPayExec
+	Chain blockCommitter
+}
+
+func (exc *simPayExec) TransactPayment(tokenAddr common.Address,
+	total *big.Int,
+	amounts []*big.Int,
+	payees []common.Address,
+	id int64,
+	msg,
+	code string,
+	rpc *ethclient.Client,
+	onSigned PaymentSigned) (common.Hash, error) {
+
+	txHash, err := exc.LocalPayExec.TransactPayment(tokenAddr, total, amounts, payees, id, msg, code, rpc, onSigned)
+	if err != nil {
+		return txHash, err
+	}
+	exc.Chain.Commit()
+	return txHash, nil
+}
@@ -0,0 +1,213 @@
+package referral
+
+import (
+	"errors"
+	"log/slog"
+	"math/big"
+	"referral-system/env"
+	"referral-system/src/utils"
+	"strings"
+)
+
+// DbCodeTier is a volume tier of a code: traders with at least
+// MinVolume (collateral currency) in a pool and pay period get
+// the trader rebate of the tier instead of the rebate of the code
+type DbCodeTier struct {
+	MinVolume float64
+	TraderCut float64 // rel. trader rebate (0.2 for 20%)
+}
+
+// codeChains caches the referral chain and the volume tiers per code.
+// Referrer balances in holdings replace the stored token holdings.
+type codeChains struct {
+	a        *App
+	chains   map[string][]DbReferralChainOfChild
+	tiers    map[string][]DbCodeTier
+	holdings map[string]*big.Int
+}
+
+func (a *App) newCodeChains() *codeChains {
+	return &codeChains{
+		a:      a,
+		chains: make(map[string][]DbReferralChainOfChild),
+		tiers:  make(map[string][]DbCodeTier),
+	}
+}
+
+// get returns the referral chain of the code for a trader with the given
+// volume in the pay period, and the tier reached (nil if none)
+func (c *codeChains) get(code string, volume float64) ([]DbReferralChainOfChild, *DbCodeTier, error) {
+	chain, exists := c.chains[code]
+	if !exists {
+		var err error
+		chain, err = c.a.referralChainForCode(code, c.holdings)
+		if err != nil {
+			return nil, nil, err
+		}
+		tiers, err := c.a.dbGetCodeTiers(code)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.chains[code] = chain
+		c.tiers[code] = tiers
+	}
+	tier := tierForVolume(c.tiers[code], volume)
+	if tier == nil {
+		return chain, nil, nil
+	}
+	return applyTier(chain, *tier), tier, nil
+}
+
+// tierForVolume returns the highest tier reached with volume,
+// tiers are sorted by MinVolume
+func tierForVolume(tiers []DbCodeTier, volume float64) *DbCodeTier {
+	var res *DbCodeTier
+	for k := range tiers {
+		if tiers[k].MinVolume > volume {
+			break
+		}
+		res = &tiers[k]
+	}
+	return res
+}
+
+// applyTier returns a copy of the referral chain of a code in which
+// the trader gets the rebate of the tier
+func applyTier(chain []DbReferralChainOfChild, tier DbCodeTier) []DbReferralChainOfChild {
+	res := make([]DbReferralChainOfChild, len(chain))
+	copy(res, chain)
+	codeUser := &res[len(res)-1]
+	crumble := codeUser.ParentPay + codeUser.ChildAvail
+	codeUser.PassOn = tier.TraderCut
+	codeUser.ParentPay = crumble * (1 - tier.TraderCut)
+	codeUser.ChildAvail = crumble * tier.TraderCut
+	return res
+}
+
+// CodeRebate returns the rebate of a code and its volume tiers. If
+// traderAddr is not empty, the tiers the trader reached in the current
+// pay period are included.
+// Code has to be "cleaned" outside this function
+func (a *App) CodeRebate(code, traderAddr string) (utils.APIResponseCodeRebate, error) {
+	rebate, err := a.CutPercentageCode(code)
+	if err != nil {
+		return utils.APIResponseCodeRebate{}, err
+	}
+	res := utils.APIResponseCodeRebate{RebatePerc: rebate}
+	chains := a.newCodeChains()
+	chain, _, err := chains.get(code, 0)
+	if err != nil {
+		slog.Error("CodeRebate for code " + code + ": " + err.Error())
+		return utils.APIResponseCodeRebate{}, errors.New("could not identify tiers")
+	}
+	codeUser := chain[len(chain)-1]
+	crumble := codeUser.ParentPay + codeUser.ChildAvail
+	for _, tier := range chains.tiers[code] {
+		res.Tiers = append(res.Tiers, utils.APICodeTier{
+			MinVolume:  tier.MinVolume,
+			RebatePerc: crumble * tier.TraderCut * 100,
+		})
+	}
+	if traderAddr == "" || len(res.Tiers) == 0 {
+		return res, nil
+	}
+	query := `SELECT rafpt.pool_id, rafpt.volume_cc
+			FROM referral_aggr_fees_per_trader rafpt
+			JOIN referral_settings rs
+				ON rs.property='broker_addr'
+				AND rs.broker_id=$2
+			WHERE LOWER(rafpt.trader_addr)=$1
+				AND LOWER(rs.value) = LOWER(rafpt.broker_addr)
+				AND rafpt.code=$3`
+	rows, err := a.Db.Query(query, strings.ToLower(traderAddr), a.Settings.BrokerId, code)
+	if err != nil {
+		slog.Error("CodeRebate volume query failed: " + err.Error())
+		return utils.APIResponseCodeRebate{}, errors.New("could not query trader volume")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var poolId uint32
+		var volumeStr string
+		rows.Scan(&poolId, &volumeStr)
+		volumeABDK, _ := new(big.Int).SetString(volumeStr, 10)
+		el := utils.APITraderTier{
+			PoolId:     poolId,
+			Volume:     utils.ABDKToFloat(volumeABDK),
+			RebatePerc: rebate,
+		}
+		if tier := tierForVolume(chains.tiers[code], el.Volume); tier != nil {
+			el.MinVolume = tier.MinVolume
+			el.RebatePerc = crumble * tier.TraderCut * 100
+		}
+		res.TraderTiers = append(res.TraderTiers, el)
+	}
+	return res, nil
+}
+
+// SetCodeTiers replaces the volume tiers of a code. An empty list
+// removes the tiers. Signature must have been checked before. The error
+// message returned (if any) is exposed to the API
+func (a *App) SetCodeTiers(tp utils.APICodeTiersPayload) error {
+	query := `SELECT referrer_addr
+		FROM referral_code
+		WHERE code=$1
+		AND broker_id=$2`
+	var refAddr string
+	err := a.Db.QueryRow(query, tp.Code, a.Settings.BrokerId).Scan(&refAddr)
+	if err != nil {
+		slog.Info("SetCodeTiers: code " + tp.Code + " not found")
+		return errors.New("code not found")
+	}
+	if strings.ToLower(refAddr) != strings.ToLower(tp.ReferrerAddr) {
+		return errors.New("not code owner")
+	}
+	tx, err := a.Db.Begin()
+	if err != nil {
+		slog.Error("SetCodeTiers: " + err.Error())
+		return errors.New("failed to set tiers")
+	}
+	query = `DELETE FROM referral_code_tier WHERE code=$1 AND broker_id=$2`
+	_, err = tx.Exec(query, tp.Code, a.Settings.BrokerId)
+	if err != nil {
+		tx.Rollback()
+		slog.Error("SetCodeTiers: " + err.Error())
+		return errors.New("failed to set tiers")
+	}
+	query = `INSERT INTO referral_code_tier (broker_id, code, min_volume_cc, trader_rebate_perc)
+		VALUES ($1, $2, $3, $4)`
+	for _, tier := range tp.Tiers {
+		var passOn float32 = float32(tier.PassOnPercTDF) / 100.0
+		_, err = tx.Exec(query, a.Settings.BrokerId, tp.Code, tier.MinVolume, passOn)
+		if err != nil {
+			tx.Rollback()
+			slog.Error("SetCodeTiers: " + err.Error())
+			return errors.New("failed to set tiers")
+		}
+	}
+	return tx.Commit()
+}
+
+// dbGetCodeTiers returns the volume tiers of a code sorted by volume
+func (a *App) dbGetCodeTiers(code string) ([]DbCodeTier, error) {
+	if code == env.DEFAULT_CODE {
+		return nil, nil
+	}
+	query := `SELECT min_volume_cc, trader_rebate_perc
+		FROM referral_code_tier
+		WHERE code=$1 AND broker_id=$2
+		ORDER BY min_volume_cc`
+	rows, err := a.Db.Query(query, code, a.Settings.BrokerId)
+	if err != nil {
+		return nil, errors.New("dbGetCodeTiers:" + err.Error())
+	}
+	defer rows.Close()
+	var tiers []DbCodeTier
+	for rows.Next() {
+		var tier DbCodeTier
+		var traderCut float64
+		rows.Scan(&tier.MinVolume, &traderCut)
+		tier.TraderCut = traderCut / 100
+		tiers = append(tiers, tier)
+	}
+	return tiers, nil
+}
@@ -0,0 +1,48 @@
+package referral
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTierForVolume(t *testing.T) {
+	tiers := []DbCodeTier{{MinVolume: 1000, TraderCut: 0.3}, {MinVolume: 5000, TraderCut: 0.5}}
+	for _, tc := range []struct {
+		volume float64
+		cut    float64
+	}{
+		{0, 0}, {999, 0}, {1000, 0.3}, {4999.5, 0.3}, {5000, 0.5}, {1e9, 0.5},
+	} {
+		tier := tierForVolume(tiers, tc.volume)
+		if tc.cut == 0 {
+			if tier != nil {
+				t.Errorf("volume %f: expected no tier, got %v", tc.volume, *tier)
+			}
+			continue
+		}
+		if tier == nil || tier.TraderCut != tc.cut {
+			t.Errorf("volume %f: expected cut %f, got %v", tc.volume, tc.cut, tier)
+		}
+	}
+	if tierForVolume(nil, 1e9) != nil {
+		t.Errorf("expected no tier without tiers")
+	}
+}
+
+func TestApplyTier(t *testing.T) {
+	// broker -> agency passes on 80%, the code passes on 10% to the trader
+	chain := []DbReferralChainOfChild{
+		{Parent: "broker", Child: "agency", PassOn: 0.8, ParentPay: 0.2, ChildAvail: 0.8, Lvl: 1},
+		{Parent: "agency", Child: "CODE", PassOn: 0.1, ParentPay: 0.72, ChildAvail: 0.08, Lvl: 0},
+	}
+	res := applyTier(chain, DbCodeTier{MinVolume: 1000, TraderCut: 0.5})
+	if chain[1].ChildAvail != 0.08 {
+		t.Errorf("original chain modified")
+	}
+	if math.Abs(res[1].ChildAvail-0.4) > 1e-12 || math.Abs(res[1].ParentPay-0.4) > 1e-12 {
+		t.Errorf("unexpected tier chain %+v", res[1])
+	}
+	if res[0] != chain[0] {
+		t.Errorf("agency level changed")
+	}
+}
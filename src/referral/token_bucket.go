@@ -3,6 +3,7 @@ package referral
 import (
 	"log/slog"
 	"math/rand"
+	"referral-system/src/metrics"
 	"sync"
 	"time"
 )
@@ -35,8 +36,10 @@ func (tb *TokenBucket) refill() {
 }
 
 func (tb *TokenBucket) WaitForToken(topic string, doLog bool) {
+	start := time.Now()
 	for {
 		if tb.Take() {
+			metrics.TokenBucketWait.WithLabelValues(topic).Observe(time.Since(start).Seconds())
 			if doLog {
 				slog.Info(topic + ": rpc token obtained")
 			}
@@ -0,0 +1,176 @@
+package referral
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// receiptPollInterval is the time between two receipt queries
+var receiptPollInterval = 2 * time.Second
+
+// waitForReceipt waits at most timeout for the receipt of one of the
+// transactions. Returns the receipt and the hash of the mined transaction,
+// or ethereum.NotFound if none was mined in time. Queries are limited
+// by bucket if not nil.
+func waitForReceipt(client *ethclient.Client, txHashes []common.Hash, timeout time.Duration, bucket *TokenBucket) (*types.Receipt, common.Hash, error) {
+	ctx := context.Background()
+	deadline := time.Now().Add(timeout)
+	for {
+		for _, txHash := range txHashes {
+			if bucket != nil {
+				bucket.WaitForToken("TransactionReceipt", false)
+			}
+			receipt, err := client.TransactionReceipt(ctx, txHash)
+			if err == nil && receipt != nil {
+				return receipt, txHash, nil
+			}
+			if err != nil && !errors.Is(err, ethereum.NotFound) {
+				return nil, txHash, err
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, txHashes[len(txHashes)-1], ethereum.NotFound
+		}
+		time.Sleep(receiptPollInterval)
+	}
+}
+
+// waitForPayment waits for the receipt of the payment transaction. If the
+// transaction remains pending, it is replaced with bumped fees according to
+// the gas policy. Rpc errors make us switch to another rpc of the list.
+// Returns the receipt and the hash of the transaction that was mined (the
+// latest replacement if none was mined)
+func (a *App) waitForPayment(txHash common.Hash, bucket *TokenBucket) (*types.Receipt, common.Hash, error) {
+	policy := a.Settings.GasPolicy
+	hashes := []common.Hash{txHash}
+	rpcErrors := 0
+	for replacements := 0; ; replacements++ {
+		client := a.rpcClient()
+		receipt, minedHash, err := waitForReceipt(client, hashes, policy.receiptTimeout(), bucket)
+		if err == nil {
+			if minedHash != txHash {
+				slog.Info("Payment tx " + txHash.Hex() + " mined as replacement " + minedHash.Hex())
+			}
+			return receipt, minedHash, nil
+		}
+		if !errors.Is(err, ethereum.NotFound) {
+			a.countRpcError()
+			rpcErrors++
+			if rpcErrors > len(a.Rpc) {
+				return nil, minedHash, err
+			}
+			slog.Info("Receipt query for tx " + minedHash.Hex() + " failed: " + err.Error())
+			a.failoverRpc(client)
+			replacements--
+			continue
+		}
+		if replacements == policy.maxReplacements() {
+			return nil, minedHash, errors.New("payment tx " + txHash.Hex() + " not mined after " +
+				strconv.Itoa(replacements) + " replacements")
+		}
+		// the transaction might wait for a nonce that was never sent,
+		// or be unknown to the rpc after a failover
+		err = a.PaymentExecutor.FillNonceGaps()
+		if err != nil {
+			slog.Info("Could not fill nonce gaps: " + err.Error())
+		}
+		replaced := hashes[len(hashes)-1]
+		newHash, err := a.PaymentExecutor.ReplaceTransaction(replaced, func(tx *types.Transaction, _ common.Hash) error {
+			return a.dbWriteTxReplacement(txHash, replaced, tx)
+		})
+		if err != nil {
+			// e.g. nonce too low: one of the transactions is being mined
+			slog.Info("Could not replace payment tx " + replaced.Hex() + ": " + err.Error())
+			continue
+		}
+		hashes = append(hashes, newHash)
+	}
+}
+
+// dbWriteTxReplacement records that tx replaces the transaction
+// replaced of the family of originalHash
+func (a *App) dbWriteTxReplacement(originalHash, replaced common.Hash, tx *types.Transaction) error {
+	query := `INSERT INTO referral_tx_replacement
+			(replacement_hash, broker_id, original_hash, replaced_hash, nonce, gas_fee_cap, gas_tip_cap)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	_, err := a.Db.Exec(query, tx.Hash().Hex(), a.Settings.BrokerId, originalHash.Hex(), replaced.Hex(),
+		tx.Nonce(), tx.GasFeeCap().String(), tx.GasTipCap().String())
+	if err != nil {
+		slog.Error("could not record replacement of tx " + replaced.Hex() + ": " + err.Error())
+	}
+	return err
+}
+
+// dbGetTxFamily returns the hashes of the transactions sent with the same
+// nonce as txHash: the original transaction and its replacements
+func (a *App) dbGetTxFamily(txHash string) []string {
+	query := `SELECT original_hash AS tx_hash, MIN(created_ts) AS created_ts
+			FROM referral_tx_replacement
+			WHERE original_hash = (SELECT COALESCE(MAX(original_hash), $1)
+				FROM referral_tx_replacement WHERE replacement_hash = $1)
+			GROUP BY original_hash
+		UNION ALL
+		SELECT replacement_hash, created_ts
+			FROM referral_tx_replacement
+			WHERE original_hash = (SELECT COALESCE(MAX(original_hash), $1)
+				FROM referral_tx_replacement WHERE replacement_hash = $1)
+		ORDER BY created_ts`
+	rows, err := a.Db.Query(query, txHash)
+	if err != nil {
+		slog.Error("could not query replacements of tx " + txHash + ": " + err.Error())
+		return []string{txHash}
+	}
+	defer rows.Close()
+	var family []string
+	for rows.Next() {
+		var h string
+		var ts time.Time
+		rows.Scan(&h, &ts)
+		family = append(family, h)
+	}
+	if len(family) == 0 {
+		// not replaced
+		return []string{txHash}
+	}
+	return family
+}
+
+// queryTxFamilyStatus queries the status of the transaction txHash and its
+// replacements. At most one of them can be mined, its hash is returned.
+func (a *App) queryTxFamilyStatus(txHash string) (TxStatus, string) {
+	receipt, h := a.queryTxFamilyReceipt(txHash)
+	return receiptTxStatus(receipt), h
+}
+
+// queryTxFamilyReceipt returns the receipt and the hash of the mined
+// transaction of the family of txHash, nil and txHash if none was found
+func (a *App) queryTxFamilyReceipt(txHash string) (*types.Receipt, string) {
+	for _, h := range a.dbGetTxFamily(txHash) {
+		receipt, err := getTransactionReceipt(a.rpcClient(), h)
+		if err != nil {
+			slog.Error("Could not obtain transaction " + h + " error:" + err.Error())
+			continue
+		}
+		return receipt, h
+	}
+	return nil, txHash
+}
+
+// dbSetPaymentTxHash sets the transaction hash of the payments sent
+// with txHash to the hash of the transaction that was mined
+func (a *App) dbSetPaymentTxHash(txHash, minedHash string) error {
+	query := `UPDATE referral_payment SET tx_hash = $2 WHERE tx_hash = $1`
+	_, err := a.Db.Exec(query, txHash, minedHash)
+	if err != nil {
+		slog.Error("could not set mined tx " + minedHash + " for payments of tx " + txHash + ": " + err.Error())
+	}
+	return err
+}
@@ -0,0 +1,655 @@
+package referral
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"referral-system/src/metrics"
+	"referral-system/src/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// webhook event types
+const (
+	WEBHOOK_EVENT_CODE_SELECTED     = "code-selected"
+	WEBHOOK_EVENT_CODE_UPSERTED     = "code-upserted"
+	WEBHOOK_EVENT_REFERRAL          = "referral"
+	WEBHOOK_EVENT_BATCH_STARTED     = "batch-started"
+	WEBHOOK_EVENT_BATCH_FINISHED    = "batch-finished"
+	WEBHOOK_EVENT_PAYMENT_CONFIRMED = "payment-confirmed"
+	WEBHOOK_EVENT_PAYMENT_FAILED    = "payment-failed"
+)
+
+var webhookEvents = []string{
+	WEBHOOK_EVENT_CODE_SELECTED,
+	WEBHOOK_EVENT_CODE_UPSERTED,
+	WEBHOOK_EVENT_REFERRAL,
+	WEBHOOK_EVENT_BATCH_STARTED,
+	WEBHOOK_EVENT_BATCH_FINISHED,
+	WEBHOOK_EVENT_PAYMENT_CONFIRMED,
+	WEBHOOK_EVENT_PAYMENT_FAILED,
+}
+
+// status of a webhook delivery
+const (
+	WEBHOOK_PENDING   = "pending"
+	WEBHOOK_DELIVERED = "delivered"
+	WEBHOOK_FAILED    = "failed"
+)
+
+// deliveries sent per run of the webhook worker
+const WEBHOOK_BATCH_SIZE = 50
+
+// max. length of a webhook url
+const WEBHOOK_MAX_URL_LEN = 2048
+
+// WebhookSettings configures the webhook notifications of partners
+type WebhookSettings struct {
+	// accept subscriptions and send deliveries
+	Enabled bool `json:"enabled"`
+	// attempts per delivery, default 5
+	MaxAttempts int `json:"maxAttempts"`
+	// wait before the first retry, doubled after each failed
+	// attempt, default 60 seconds
+	BackoffSeconds int `json:"backoffSeconds"`
+	// http timeout of a delivery, default 10 seconds
+	TimeoutSeconds int `json:"timeoutSeconds"`
+	// wait between runs of the worker, default 5 seconds
+	PollSeconds int `json:"pollSeconds"`
+	// allow http urls and private network addresses, for tests only
+	AllowInsecure bool `json:"allowInsecure"`
+}
+
+func (s WebhookSettings) maxAttempts() int {
+	if s.MaxAttempts < 1 {
+		return 5
+	}
+	return s.MaxAttempts
+}
+
+// backoff returns the wait before the next attempt after the
+// given number of attempts
+func (s WebhookSettings) backoff(attempts int) time.Duration {
+	wait := time.Duration(s.BackoffSeconds) * time.Second
+	if s.BackoffSeconds < 1 {
+		wait = time.Minute
+	}
+	for k := 1; k < attempts && k < 16; k++ {
+		wait *= 2
+	}
+	return wait
+}
+
+func (s WebhookSettings) timeout() time.Duration {
+	if s.TimeoutSeconds < 1 {
+		return 10 * time.Second
+	}
+	return time.Duration(s.TimeoutSeconds) * time.Second
+}
+
+func (s WebhookSettings) pollInterval() time.Duration {
+	if s.PollSeconds < 1 {
+		return 5 * time.Second
+	}
+	return time.Duration(s.PollSeconds) * time.Second
+}
+
+// webhookDelivery is a pending row of referral_webhook_delivery
+type webhookDelivery struct {
+	Id        int64
+	Addr      string
+	Event     string
+	Data      string
+	Attempts  int
+	CreatedTs time.Time
+}
+
+// webhookBody is the json body of a delivery, the id is the same for
+// all attempts of a delivery
+type webhookBody struct {
+	Id        int64           `json:"id"`
+	Event     string          `json:"event"`
+	ChainId   int             `json:"chainId"`
+	BrokerId  string          `json:"brokerId"`
+	CreatedTs int64           `json:"createdTs"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// data of the webhook events
+type webhookCodeSelected struct {
+	TraderAddr   string `json:"traderAddr"`
+	Code         string `json:"code"`
+	ReferrerAddr string `json:"referrerAddr"`
+}
+
+type webhookCodeUpserted struct {
+	Code             string  `json:"code"`
+	ReferrerAddr     string  `json:"referrerAddr"`
+	TraderRebatePerc float32 `json:"traderRebatePerc"`
+}
+
+type webhookReferral struct {
+	ParentAddr  string  `json:"parentAddr"`
+	ReferToAddr string  `json:"referToAddr"`
+	PassOnPerc  float32 `json:"passOnPerc"`
+}
+
+type webhookBatch struct {
+	BatchTs int64 `json:"batchTs"`
+}
+
+type webhookPayment struct {
+	TxHash    string          `json:"txHash"`
+	BatchTs   int64           `json:"batchTs"`
+	PayeeAddr string          `json:"payeeAddr"`
+	Amounts   []webhookAmount `json:"amounts"`
+}
+
+type webhookAmount struct {
+	PoolId     uint32 `json:"poolId"`
+	TokenAddr  string `json:"tokenAddr"`
+	AmountDecN string `json:"amountDecN"`
+}
+
+// parseWebhookEvents returns the event types of a comma separated
+// list, nil (all events) for an empty list
+func parseWebhookEvents(events string) ([]string, error) {
+	var res []string
+	seen := make(map[string]bool)
+	for _, e := range strings.Split(events, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" || seen[e] {
+			continue
+		}
+		known := false
+		for _, w := range webhookEvents {
+			known = known || w == e
+		}
+		if !known {
+			return nil, errors.New("unknown event " + e)
+		}
+		seen[e] = true
+		res = append(res, e)
+	}
+	return res, nil
+}
+
+// isWebhookEvent returns true if event is one of the subscribed events
+func isWebhookEvent(subscribed []string, event string) bool {
+	if len(subscribed) == 0 {
+		return true
+	}
+	for _, e := range subscribed {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWebhookUrl checks that deliveries can be sent to rawUrl. Unless
+// insecure urls are allowed, the host must only resolve to public addresses.
+func checkWebhookUrl(rawUrl string, allowInsecure bool) error {
+	if len(rawUrl) > WEBHOOK_MAX_URL_LEN {
+		return errors.New("url too long")
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Hostname() == "" {
+		return errors.New("invalid url")
+	}
+	if u.User != nil {
+		return errors.New("url must not contain credentials")
+	}
+	if u.Scheme != "https" && !(allowInsecure && u.Scheme == "http") {
+		return errors.New("url must use https")
+	}
+	if allowInsecure {
+		return nil
+	}
+	// reject internal hosts when registering, the dialer of
+	// newWebhookClient checks again at delivery time
+	ips, err := lookupWebhookHost(u.Hostname())
+	if err != nil || len(ips) == 0 {
+		return errors.New("webhook host " + u.Hostname() + " not resolved")
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			return errors.New("webhook address " + ip.String() + " not permitted")
+		}
+	}
+	return nil
+}
+
+// lookupWebhookHost resolves the host of a webhook url
+var lookupWebhookHost = net.LookupIP
+
+// isPublicIP returns false for loopback, private, link-local and
+// unspecified addresses
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// newWebhookClient returns the http client of the deliveries. Redirects
+// are not followed and, unless insecure urls are allowed, only public
+// addresses are dialed (checked after name resolution)
+func newWebhookClient(s WebhookSettings) *http.Client {
+	dialer := &net.Dialer{Timeout: s.timeout()}
+	if !s.AllowInsecure {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return errors.New("webhook address " + host + " not permitted")
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout:   s.timeout(),
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// webhookSignature returns the signature header of a delivery: the
+// HMAC-SHA256 of "<timestamp>.<body>" with the secret of the subscription
+func webhookSignature(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(ts, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhook posts the body of a delivery and returns the http status,
+// an error if the status is not 2xx
+func sendWebhook(client *http.Client, url, secret, event string, id int64, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "referral-system-webhook")
+	req.Header.Set("X-Referral-Event", event)
+	req.Header.Set("X-Referral-Delivery", strconv.FormatInt(id, 10))
+	req.Header.Set("X-Referral-Timestamp", strconv.FormatInt(ts, 10))
+	req.Header.Set("X-Referral-Signature", webhookSignature(secret, ts, body))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, errors.New("status " + strconv.Itoa(resp.StatusCode))
+	}
+	return resp.StatusCode, nil
+}
+
+// SetWebhook registers or ends (empty url) the webhook subscription of
+// a partner address and returns the subscription with a new secret.
+// The signature has been checked by the caller.
+func (a *App) SetWebhook(pl utils.APIWebhookPayload) (utils.APIWebhookSubscription, error) {
+	if !a.Settings.Webhooks.Enabled {
+		return utils.APIWebhookSubscription{}, errors.New("webhooks not enabled")
+	}
+	addr := strings.ToLower(pl.Addr)
+	events, err := parseWebhookEvents(pl.Events)
+	if err != nil {
+		return utils.APIWebhookSubscription{}, err
+	}
+	if pl.Url != "" {
+		if err := checkWebhookUrl(pl.Url, a.Settings.Webhooks.AllowInsecure); err != nil {
+			return utils.APIWebhookSubscription{}, err
+		}
+		if !a.isWebhookPartner(addr) {
+			return utils.APIWebhookSubscription{}, errors.New("not an agency or referrer")
+		}
+		if err := a.checkDenied(DENY_ACTION_WEBHOOK, addr); err != nil {
+			return utils.APIWebhookSubscription{}, err
+		}
+	}
+	createdOn := time.Unix(int64(pl.CreatedOn), 0)
+	query := `SELECT created_on FROM referral_webhook WHERE broker_id = $1 AND addr = $2`
+	var latest time.Time
+	err = a.Db.QueryRow(query, a.Settings.BrokerId, addr).Scan(&latest)
+	switch {
+	case err == sql.ErrNoRows && pl.Url == "":
+		return utils.APIWebhookSubscription{}, errors.New("no webhook registered")
+	case err != nil && err != sql.ErrNoRows:
+		slog.Error("SetWebhook: " + err.Error())
+		return utils.APIWebhookSubscription{}, errors.New("failed to set webhook")
+	case err == nil && !createdOn.After(latest):
+		return utils.APIWebhookSubscription{}, errors.New("newer webhook registered")
+	}
+	res := utils.APIWebhookSubscription{Addr: addr, Url: pl.Url, Events: events}
+	if pl.Url != "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			slog.Error("SetWebhook: " + err.Error())
+			return utils.APIWebhookSubscription{}, errors.New("failed to set webhook")
+		}
+		res.Secret = hex.EncodeToString(key)
+	}
+	query = `INSERT INTO referral_webhook (broker_id, addr, url, events, secret, created_on)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (broker_id, addr) DO UPDATE
+		SET url = EXCLUDED.url, events = EXCLUDED.events, secret = EXCLUDED.secret,
+			created_on = EXCLUDED.created_on`
+	_, err = a.Db.Exec(query, a.Settings.BrokerId, addr, pl.Url, strings.Join(events, ","), res.Secret, createdOn)
+	if err != nil {
+		slog.Error("SetWebhook: " + err.Error())
+		return utils.APIWebhookSubscription{}, errors.New("failed to set webhook")
+	}
+	if pl.Url == "" {
+		slog.Info("Webhook of " + addr + " removed")
+	} else {
+		slog.Info("Webhook of " + addr + " set to " + pl.Url)
+	}
+	return res, nil
+}
+
+// isWebhookPartner returns true if addr is an agency, the broker or the
+// referrer of a code of the broker
+func (a *App) isWebhookPartner(addr string) bool {
+	if isAgency, _ := a.IsAgency(addr); isAgency {
+		return true
+	}
+	return a.isPayoutParticipant(addr)
+}
+
+// WebhookDeliveries returns the latest webhook deliveries, of one
+// address if addr is not empty
+func (a *App) WebhookDeliveries(addr string) ([]utils.APIWebhookDelivery, error) {
+	query := `SELECT id, addr, url, event, status, attempts, response_code, last_error,
+			created_ts, delivered_ts
+		FROM referral_webhook_delivery
+		WHERE broker_id = $1 AND ($2 = '' OR addr = $2)
+		ORDER BY id DESC
+		LIMIT 100`
+	rows, err := a.Db.Query(query, a.Settings.BrokerId, strings.ToLower(addr))
+	if err != nil {
+		slog.Error("WebhookDeliveries: " + err.Error())
+		return nil, errors.New("failed to query webhook deliveries")
+	}
+	defer rows.Close()
+	res := []utils.APIWebhookDelivery{}
+	for rows.Next() {
+		var d utils.APIWebhookDelivery
+		var createdTs time.Time
+		var deliveredTs sql.NullTime
+		err = rows.Scan(&d.Id, &d.Addr, &d.Url, &d.Event, &d.Status, &d.Attempts, &d.ResponseCode,
+			&d.LastError, &createdTs, &deliveredTs)
+		if err != nil {
+			slog.Error("WebhookDeliveries: " + err.Error())
+			return nil, errors.New("failed to query webhook deliveries")
+		}
+		d.CreatedTs = createdTs.Unix()
+		if deliveredTs.Valid {
+			d.DeliveredTs = deliveredTs.Time.Unix()
+		}
+		res = append(res, d)
+	}
+	return res, nil
+}
+
+// notify queues a delivery of the event for the subscriptions of the
+// addresses, or for all subscriptions without addresses
+func (a *App) notify(event string, data any, addrs ...string) {
+	if !a.Settings.Webhooks.Enabled {
+		return
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		slog.Error("notify " + event + ": " + err.Error())
+		return
+	}
+	subs, err := a.dbGetWebhookSubscribers(addrs)
+	if err != nil {
+		slog.Error("notify " + event + ": " + err.Error())
+		return
+	}
+	query := `INSERT INTO referral_webhook_delivery (broker_id, addr, url, event, data, status)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+	for _, s := range subs {
+		if !isWebhookEvent(s.Events, event) {
+			continue
+		}
+		_, err = a.Db.Exec(query, a.Settings.BrokerId, s.Addr, s.Url, event, string(payload), WEBHOOK_PENDING)
+		if err != nil {
+			slog.Error("could not queue " + event + " webhook for " + s.Addr + ": " + err.Error())
+		}
+	}
+}
+
+// notifyPayment queues the deliveries of a confirmed or failed payment
+// transaction for its payees, one delivery per payee
+func (a *App) notifyPayment(event, txHash string, batchTs int64) {
+	if !a.Settings.Webhooks.Enabled {
+		return
+	}
+	query := `SELECT LOWER(payee_addr), pool_id, SUM(paid_amount_cc)
+		FROM referral_payment
+		WHERE tx_hash = $1
+		GROUP BY LOWER(payee_addr), pool_id
+		ORDER BY 1, 2`
+	rows, err := a.Db.Query(query, txHash)
+	if err != nil {
+		slog.Error("notifyPayment: " + err.Error())
+		return
+	}
+	var payees []string
+	payments := make(map[string]*webhookPayment)
+	for rows.Next() {
+		var payee, amount string
+		var poolId uint32
+		if err := rows.Scan(&payee, &poolId, &amount); err != nil {
+			slog.Error("notifyPayment: " + err.Error())
+			continue
+		}
+		p, exists := payments[payee]
+		if !exists {
+			p = &webhookPayment{TxHash: txHash, BatchTs: batchTs, PayeeAddr: payee}
+			payments[payee] = p
+			payees = append(payees, payee)
+		}
+		p.Amounts = append(p.Amounts, webhookAmount{PoolId: poolId, TokenAddr: a.poolTokenAddr(poolId), AmountDecN: amount})
+	}
+	rows.Close()
+	for _, payee := range payees {
+		a.notify(event, payments[payee], payee)
+	}
+}
+
+// webhookSubscription is an active row of referral_webhook
+type webhookSubscription struct {
+	Addr   string
+	Url    string
+	Events []string
+	Secret string
+}
+
+// dbGetWebhookSubscribers returns the active subscriptions of the
+// addresses, all active subscriptions without addresses
+func (a *App) dbGetWebhookSubscribers(addrs []string) ([]webhookSubscription, error) {
+	if len(addrs) == 0 {
+		return a.dbGetWebhooks("")
+	}
+	var res []webhookSubscription
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		addr = strings.ToLower(addr)
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		subs, err := a.dbGetWebhooks(addr)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, subs...)
+	}
+	return res, nil
+}
+
+// dbGetWebhooks returns the active subscription of addr, or all active
+// subscriptions if addr is empty
+func (a *App) dbGetWebhooks(addr string) ([]webhookSubscription, error) {
+	query := `SELECT addr, url, events, secret
+		FROM referral_webhook
+		WHERE broker_id = $1 AND url <> '' AND ($2 = '' OR addr = $2)
+		ORDER BY addr`
+	rows, err := a.Db.Query(query, a.Settings.BrokerId, addr)
+	if err != nil {
+		return nil, errors.New("dbGetWebhooks: " + err.Error())
+	}
+	defer rows.Close()
+	var res []webhookSubscription
+	for rows.Next() {
+		var s webhookSubscription
+		var events string
+		if err := rows.Scan(&s.Addr, &s.Url, &events, &s.Secret); err != nil {
+			return nil, errors.New("dbGetWebhooks: " + err.Error())
+		}
+		s.Events, _ = parseWebhookEvents(events)
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+// RunWebhooks sends the pending webhook deliveries
+func (a *App) RunWebhooks() {
+	slog.Info("Starting webhook deliveries for broker " + a.Settings.BrokerId)
+	for {
+		n, err := a.DeliverWebhooks()
+		if err != nil {
+			slog.Error("Webhook deliveries: " + err.Error())
+		}
+		if err != nil || n < WEBHOOK_BATCH_SIZE {
+			time.Sleep(a.Settings.Webhooks.pollInterval())
+		}
+	}
+}
+
+// DeliverWebhooks sends the pending deliveries that are due and returns
+// the number of deliveries attempted
+func (a *App) DeliverWebhooks() (int, error) {
+	settings := a.Settings.Webhooks
+	// deliveries are leased until the attempt is recorded, another
+	// instance of the service picks them up if we stop
+	lease := 2*settings.timeout() + time.Minute
+	deliveries, err := a.dbClaimWebhookDeliveries(lease)
+	if err != nil {
+		return 0, err
+	}
+	client := newWebhookClient(settings)
+	for _, d := range deliveries {
+		subs, err := a.dbGetWebhooks(d.Addr)
+		if err != nil {
+			return 0, err
+		}
+		if len(subs) == 0 {
+			a.dbSetWebhookAttempt(d, "", WEBHOOK_FAILED, 0, errors.New("subscription removed"))
+			continue
+		}
+		body, _ := json.Marshal(webhookBody{
+			Id:        d.Id,
+			Event:     d.Event,
+			ChainId:   a.Settings.ChainId,
+			BrokerId:  a.Settings.BrokerId,
+			CreatedTs: d.CreatedTs.Unix(),
+			Data:      json.RawMessage(d.Data),
+		})
+		code, err := sendWebhook(client, subs[0].Url, subs[0].Secret, d.Event, d.Id, body)
+		status := WEBHOOK_DELIVERED
+		if err != nil {
+			status = WEBHOOK_PENDING
+			if d.Attempts+1 >= settings.maxAttempts() {
+				status = WEBHOOK_FAILED
+			}
+			slog.Info("Webhook " + strconv.FormatInt(d.Id, 10) + " to " + subs[0].Url + " failed: " + err.Error())
+		}
+		a.dbSetWebhookAttempt(d, subs[0].Url, status, code, err)
+	}
+	return len(deliveries), nil
+}
+
+// dbClaimWebhookDeliveries returns the pending deliveries that are due
+// and postpones their next attempt by lease
+func (a *App) dbClaimWebhookDeliveries(lease time.Duration) ([]webhookDelivery, error) {
+	query := `UPDATE referral_webhook_delivery SET next_attempt_ts = $4
+		WHERE id IN (
+			SELECT id FROM referral_webhook_delivery
+			WHERE broker_id = $1 AND status = $2 AND next_attempt_ts <= CURRENT_TIMESTAMP
+			ORDER BY id
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, addr, event, data, attempts, created_ts`
+	rows, err := a.Db.Query(query, a.Settings.BrokerId, WEBHOOK_PENDING, WEBHOOK_BATCH_SIZE, time.Now().Add(lease))
+	if err != nil {
+		return nil, errors.New("dbClaimWebhookDeliveries: " + err.Error())
+	}
+	defer rows.Close()
+	var res []webhookDelivery
+	for rows.Next() {
+		var d webhookDelivery
+		if err := rows.Scan(&d.Id, &d.Addr, &d.Event, &d.Data, &d.Attempts, &d.CreatedTs); err != nil {
+			return nil, errors.New("dbClaimWebhookDeliveries: " + err.Error())
+		}
+		res = append(res, d)
+	}
+	// deliveries in order of creation
+	sort.Slice(res, func(k, j int) bool { return res[k].Id < res[j].Id })
+	return res, nil
+}
+
+// dbSetWebhookAttempt records an attempt of a delivery, pending
+// deliveries are retried after the backoff
+func (a *App) dbSetWebhookAttempt(d webhookDelivery, url, status string, code int, attemptErr error) {
+	attempts := d.Attempts + 1
+	next := time.Now().Add(a.Settings.Webhooks.backoff(attempts))
+	var deliveredTs sql.NullTime
+	lastError := ""
+	result := metrics.WEBHOOK_RETRY
+	switch status {
+	case WEBHOOK_DELIVERED:
+		deliveredTs = sql.NullTime{Time: time.Now(), Valid: true}
+		result = metrics.WEBHOOK_DELIVERED
+	case WEBHOOK_FAILED:
+		result = metrics.WEBHOOK_FAILED
+	}
+	if attemptErr != nil {
+		lastError = attemptErr.Error()
+		if len(lastError) > 500 {
+			lastError = lastError[:500]
+		}
+	}
+	query := `UPDATE referral_webhook_delivery
+		SET status = $2, attempts = $3, next_attempt_ts = $4, response_code = $5,
+			last_error = $6, url = COALESCE(NULLIF($7::TEXT, ''), url), delivered_ts = $8
+		WHERE id = $1`
+	_, err := a.Db.Exec(query, d.Id, status, attempts, next, code, lastError, url, deliveredTs)
+	if err != nil {
+		slog.Error("could not record webhook attempt " + strconv.FormatInt(d.Id, 10) + ": " + err.Error())
+	}
+	metrics.WebhookDeliveries.WithLabelValues(a.chainLabel(), a.Settings.BrokerId, d.Event, result).Inc()
+}
@@ -0,0 +1,107 @@
+//go:build integration
+
+package referral
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"referral-system/src/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestWebhooks registers a webhook, queues a code selection and
+// delivers it with a retry
+func TestWebhooks(t *testing.T) {
+	s := newSimDbApp(t, false)
+	a := s.app
+	a.Settings.Webhooks = WebhookSettings{Enabled: true, AllowInsecure: true, MaxAttempts: 3}
+	referrer := strings.ToLower(s.referrer.Hex())
+	trader := strings.ToLower(s.trader.Hex())
+
+	var mu sync.Mutex
+	var bodies [][]byte
+	var secret string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		ts, _ := strconv.ParseInt(r.Header.Get("X-Referral-Timestamp"), 10, 64)
+		if r.Header.Get("X-Referral-Signature") != webhookSignature(secret, ts, body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		bodies = append(bodies, body)
+		if len(bodies) == 1 {
+			// the first attempt fails
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	now := uint32(time.Now().Unix())
+	pl := utils.APIWebhookPayload{Addr: referrer, Url: srv.URL, CreatedOn: now}
+	if _, err := a.SetWebhook(pl); err == nil {
+		t.Errorf("expected webhook of non-partner rejected")
+	}
+	if err := a.UpsertCode(utils.APICodePayload{Code: "HOOK", ReferrerAddr: referrer, PassOnPercTDF: 1000}); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	sub, err := a.SetWebhook(pl)
+	if err != nil || len(sub.Secret) != 64 {
+		t.Fatalf("expected subscription with secret, got %+v (%v)", sub, err)
+	}
+	mu.Lock()
+	secret = sub.Secret
+	mu.Unlock()
+	if _, err := a.SetWebhook(pl); err == nil {
+		t.Errorf("expected replayed registration rejected")
+	}
+
+	if err := a.SelectCode(utils.APICodeSelectionPayload{Code: "HOOK", TraderAddr: trader}); err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if n, err := a.DeliverWebhooks(); n != 1 || err != nil {
+		t.Fatalf("expected 1 delivery, got %d (%v)", n, err)
+	}
+	deliveries, _ := a.WebhookDeliveries(referrer)
+	if len(deliveries) != 1 || deliveries[0].Status != WEBHOOK_PENDING || deliveries[0].ResponseCode != 503 {
+		t.Fatalf("expected delivery to be retried, got %+v", deliveries)
+	}
+	// not due before the backoff
+	if n, _ := a.DeliverWebhooks(); n != 0 {
+		t.Errorf("expected no delivery before the backoff, got %d", n)
+	}
+	a.Db.Exec(`UPDATE referral_webhook_delivery SET next_attempt_ts = now()`)
+	if n, err := a.DeliverWebhooks(); n != 1 || err != nil {
+		t.Fatalf("expected retry, got %d (%v)", n, err)
+	}
+	deliveries, _ = a.WebhookDeliveries("")
+	if len(deliveries) != 1 || deliveries[0].Status != WEBHOOK_DELIVERED || deliveries[0].Attempts != 2 {
+		t.Errorf("expected delivered after 2 attempts, got %+v", deliveries)
+	}
+	var body webhookBody
+	var data webhookCodeSelected
+	mu.Lock()
+	json.Unmarshal(bodies[1], &body)
+	mu.Unlock()
+	json.Unmarshal(body.Data, &data)
+	if body.Event != WEBHOOK_EVENT_CODE_SELECTED || body.Id != deliveries[0].Id || data.TraderAddr != trader || data.ReferrerAddr != referrer {
+		t.Errorf("unexpected delivery %+v %+v", body, data)
+	}
+
+	// no deliveries after the subscription ended
+	pl.Url, pl.CreatedOn = "", now+1
+	if _, err := a.SetWebhook(pl); err != nil {
+		t.Fatalf("unsubscribe: %v", err)
+	}
+	a.notify(WEBHOOK_EVENT_BATCH_STARTED, webhookBatch{BatchTs: int64(now)})
+	if deliveries, _ = a.WebhookDeliveries(""); len(deliveries) != 1 {
+		t.Errorf("expected no new delivery, got %d", len(deliveries))
+	}
+}
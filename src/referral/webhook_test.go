@@ -0,0 +1,128 @@
+package referral
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseWebhookEvents(t *testing.T) {
+	events, err := parseWebhookEvents("")
+	if err != nil || events != nil {
+		t.Errorf("expected all events, got %v (%v)", events, err)
+	}
+	events, err = parseWebhookEvents(" code-selected, payment-failed,code-selected")
+	if err != nil || len(events) != 2 || events[0] != WEBHOOK_EVENT_CODE_SELECTED || events[1] != WEBHOOK_EVENT_PAYMENT_FAILED {
+		t.Errorf("unexpected events %v (%v)", events, err)
+	}
+	if !isWebhookEvent(events, WEBHOOK_EVENT_PAYMENT_FAILED) || isWebhookEvent(events, WEBHOOK_EVENT_REFERRAL) {
+		t.Errorf("unexpected subscription of %v", events)
+	}
+	if _, err := parseWebhookEvents("code-selected,trade"); err == nil {
+		t.Errorf("expected error for unknown event")
+	}
+}
+
+func TestCheckWebhookUrl(t *testing.T) {
+	hosts := map[string][]net.IP{
+		"crm.example.org":  {net.ParseIP("93.184.215.14")},
+		"intern.example":   {net.ParseIP("10.1.2.3")},
+		"mixed.example":    {net.ParseIP("93.184.215.14"), net.ParseIP("127.0.0.1")},
+		"localhost":        {net.ParseIP("127.0.0.1")},
+		"169.254.169.254":  {net.ParseIP("169.254.169.254")},
+		"gone.example.org": nil,
+	}
+	defer func(lookup func(string) ([]net.IP, error)) { lookupWebhookHost = lookup }(lookupWebhookHost)
+	lookupWebhookHost = func(host string) ([]net.IP, error) {
+		if ips := hosts[host]; ips != nil {
+			return ips, nil
+		}
+		return nil, errors.New("no such host " + host)
+	}
+	cases := []struct {
+		url      string
+		insecure bool
+		valid    bool
+	}{
+		{"https://crm.example.org/hooks?id=1", false, true},
+		{"http://crm.example.org/hooks", false, false},
+		{"http://localhost:8080/hooks", true, true},
+		{"https://localhost:8080/hooks", false, false},
+		{"https://intern.example/hooks", false, false},
+		{"https://mixed.example/hooks", false, false},
+		{"https://169.254.169.254/latest", false, false},
+		{"https://gone.example.org/hooks", false, false},
+		{"https://user:pw@crm.example.org", false, false},
+		{"ftp://crm.example.org", true, false},
+		{"https://", false, false},
+		{"https://crm.example.org/" + strings.Repeat("a", WEBHOOK_MAX_URL_LEN), false, false},
+	}
+	for _, c := range cases {
+		if err := checkWebhookUrl(c.url, c.insecure); (err == nil) != c.valid {
+			t.Errorf("%s (insecure %v): expected valid %v, got %v", c.url, c.insecure, c.valid, err)
+		}
+	}
+}
+
+func TestWebhookSettings(t *testing.T) {
+	var s WebhookSettings
+	if s.maxAttempts() != 5 || s.backoff(1) != time.Minute || s.backoff(3) != 4*time.Minute || s.timeout() != 10*time.Second {
+		t.Errorf("unexpected defaults %d %s %s %s", s.maxAttempts(), s.backoff(1), s.backoff(3), s.timeout())
+	}
+	if s.backoff(100) <= 0 {
+		t.Errorf("backoff overflow %s", s.backoff(100))
+	}
+}
+
+func TestSendWebhook(t *testing.T) {
+	secret := "0123abcd"
+	var mu sync.Mutex
+	var received []byte
+	status := http.StatusInternalServerError
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		ts, _ := strconv.ParseInt(r.Header.Get("X-Referral-Timestamp"), 10, 64)
+		if r.Header.Get("X-Referral-Signature") != webhookSignature(secret, ts, body) ||
+			r.Header.Get("X-Referral-Event") != WEBHOOK_EVENT_BATCH_STARTED || r.Header.Get("X-Referral-Delivery") != "7" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		received = body
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	client := newWebhookClient(WebhookSettings{AllowInsecure: true})
+	body := []byte(`{"id":7}`)
+	if code, err := sendWebhook(client, srv.URL, secret, WEBHOOK_EVENT_BATCH_STARTED, 7, body); err == nil || code != 500 {
+		t.Errorf("expected error for status 500, got %d (%v)", code, err)
+	}
+	mu.Lock()
+	status = http.StatusNoContent
+	mu.Unlock()
+	if code, err := sendWebhook(client, srv.URL, secret, WEBHOOK_EVENT_BATCH_STARTED, 7, body); err != nil || code != 204 {
+		t.Errorf("expected delivery, got %d (%v)", code, err)
+	}
+	mu.Lock()
+	if string(received) != string(body) {
+		t.Errorf("unexpected body %s", received)
+	}
+	mu.Unlock()
+	if code, _ := sendWebhook(client, srv.URL, "other", WEBHOOK_EVENT_BATCH_STARTED, 7, body); code != http.StatusUnauthorized {
+		t.Errorf("expected wrong signature rejected, got %d", code)
+	}
+	// private addresses are not dialed
+	client = newWebhookClient(WebhookSettings{})
+	if _, err := sendWebhook(client, srv.URL, secret, WEBHOOK_EVENT_BATCH_STARTED, 7, body); err == nil ||
+		!strings.Contains(err.Error(), "not permitted") {
+		t.Errorf("expected loopback address rejected, got %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package simchain
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"math/big"
+	"os"
+	"referral-system/src/contracts"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// The contracts are compiled from sol/MultiPay.sol, sol/ERC20.sol and
+// sol/ClaimDistributor.sol (see README.md, Dev: Contracts) and deployed
+// by New. Set
+// SIMCHAIN_MULTIPAY_BIN to a file with the hex creation code of another
+// MultiPay build, e.g. the production contract, to deploy that instead.
+
+//go:embed sol/MultiPay.bin
+var multiPayBin string
+
+//go:embed sol/ERC20.bin
+var erc20Bin string
+
+//go:embed sol/ClaimDistributor.bin
+var claimDistributorBin string
+
+// MULTIPAY_BIN_ENV names the file with the MultiPay creation code that
+// replaces the embedded build
+const MULTIPAY_BIN_ENV = "SIMCHAIN_MULTIPAY_BIN"
+
+// deployerKey deploys the contracts and holds the token supply
+var deployerKey, _ = crypto.HexToECDSA("8f2a55949038a9610f50fb23b5883af3b4ecb3c3bb792cbcefbd1542c692be63")
+
+var (
+	// Deployer is the address of the contract deployer
+	Deployer = crypto.PubkeyToAddress(deployerKey.PublicKey)
+	// MultiPayAddr is the address of the MultiPay contract
+	MultiPayAddr = crypto.CreateAddress(Deployer, 0)
+	// TokenAddr is the address of the ERC-20 token, the deployer
+	// holds the supply of TokenSupply
+	TokenAddr = crypto.CreateAddress(Deployer, 1)
+	// ClaimDistributorAddr is the address of the claim distributor,
+	// owned by the deployer
+	ClaimDistributorAddr = crypto.CreateAddress(Deployer, 2)
+	// TokenSupply is the initial token balance of the deployer
+	TokenSupply = Ether(1_000_000)
+)
+
+// deployContracts deploys MultiPay, the token and the claim distributor
+// at MultiPayAddr, TokenAddr and ClaimDistributorAddr and mines the
+// deployments
+func (b *Backend) deployContracts() error {
+	bin := multiPayBin
+	if file := os.Getenv(MULTIPAY_BIN_ENV); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return errors.New("deployContracts: " + err.Error())
+		}
+		bin = string(data)
+	}
+	opts, err := b.deployerOpts()
+	if err != nil {
+		return err
+	}
+	mpayAbi, err := contracts.MultiPayMetaData.GetAbi()
+	if err != nil {
+		return err
+	}
+	tknAbi, err := contracts.Erc20MetaData.GetAbi()
+	if err != nil {
+		return err
+	}
+	distAbi, err := contracts.ClaimDistributorMetaData.GetAbi()
+	if err != nil {
+		return err
+	}
+	addr, mpayTx, _, err := bind.DeployContract(opts, *mpayAbi, hexCode(bin), b.Client)
+	if err != nil || addr != MultiPayAddr {
+		return errors.Join(errors.New("deployContracts: MultiPay not deployed at "+MultiPayAddr.Hex()), err)
+	}
+	addr, tknTx, _, err := bind.DeployContract(opts, *tknAbi, hexCode(erc20Bin), b.Client,
+		"Simulated Token", "SIM", uint8(18), TokenSupply, Deployer)
+	if err != nil || addr != TokenAddr {
+		return errors.Join(errors.New("deployContracts: token not deployed at "+TokenAddr.Hex()), err)
+	}
+	addr, distTx, _, err := bind.DeployContract(opts, *distAbi, hexCode(claimDistributorBin), b.Client)
+	if err != nil || addr != ClaimDistributorAddr {
+		return errors.Join(errors.New("deployContracts: claim distributor not deployed at "+ClaimDistributorAddr.Hex()), err)
+	}
+	b.Commit()
+	for _, tx := range []*types.Transaction{mpayTx, tknTx, distTx} {
+		r, err := b.Client.TransactionReceipt(context.Background(), tx.Hash())
+		if err != nil {
+			return errors.New("deployContracts: " + err.Error())
+		}
+		if r.Status != types.ReceiptStatusSuccessful {
+			return errors.New("deployContracts: deployment " + tx.Hash().Hex() + " failed")
+		}
+	}
+	return nil
+}
+
+// FundToken transfers tokens from the deployer, the transfer is mined
+// with the next Commit
+func (b *Backend) FundToken(to common.Address, amount *big.Int) (*types.Transaction, error) {
+	opts, err := b.deployerOpts()
+	if err != nil {
+		return nil, err
+	}
+	tkn, err := contracts.NewErc20(TokenAddr, b.Client)
+	if err != nil {
+		return nil, err
+	}
+	return tkn.Transfer(opts, to, amount)
+}
+
+// SetClaimRoot sets the merkle root of the claim distributor, the
+// transaction is mined with the next Commit
+func (b *Backend) SetClaimRoot(root common.Hash) (*types.Transaction, error) {
+	opts, err := b.deployerOpts()
+	if err != nil {
+		return nil, err
+	}
+	dist, err := contracts.NewClaimDistributor(ClaimDistributorAddr, b.Client)
+	if err != nil {
+		return nil, err
+	}
+	return dist.SetMerkleRoot(opts, root)
+}
+
+func (b *Backend) deployerOpts() (*bind.TransactOpts, error) {
+	opts, err := bind.NewKeyedTransactorWithChainID(deployerKey, big.NewInt(ChainId))
+	if err != nil {
+		return nil, err
+	}
+	// fixed limit, transactions are sent before the previous ones are mined
+	opts.GasLimit = 5_000_000
+	return opts, nil
+}
+
+func hexCode(bin string) []byte {
+	return common.FromHex(strings.TrimSpace(bin))
+}
@@ -0,0 +1,117 @@
+// Package simchain provides an in-memory chain with an attached
+// ethclient.Client for tests. The chain is based on go-ethereum's simulated
+// beacon and comes with deployed MultiPay, ERC-20 and claim distributor
+// contracts, see contracts.go.
+package simchain
+
+import (
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/eth"
+	"github.com/ethereum/go-ethereum/eth/catalyst"
+	"github.com/ethereum/go-ethereum/eth/ethconfig"
+	"github.com/ethereum/go-ethereum/eth/filters"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/node"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// ChainId of the simulated chain
+const ChainId = 1337
+
+// Backend is a simulated chain. Transactions are only mined
+// when calling Commit.
+type Backend struct {
+	Client *ethclient.Client
+	node   *node.Node
+	beacon *catalyst.SimulatedBeacon
+}
+
+// New starts a simulated chain with the given genesis allocation and
+// deploys the contracts in block 1
+func New(alloc types.GenesisAlloc) (*Backend, error) {
+	genesisAlloc := types.GenesisAlloc{Deployer: {Balance: Ether(100)}}
+	for addr, account := range alloc {
+		genesisAlloc[addr] = account
+	}
+	nodeConf := node.DefaultConfig
+	nodeConf.DataDir = ""
+	nodeConf.P2P = p2p.Config{NoDiscovery: true}
+
+	ethConf := ethconfig.Defaults
+	ethConf.Genesis = &core.Genesis{
+		Config:   params.AllDevChainProtocolChanges,
+		GasLimit: ethconfig.Defaults.Miner.GasCeil,
+		Alloc:    genesisAlloc,
+	}
+	ethConf.SyncMode = ethconfig.FullSync
+	ethConf.TxPool.NoLocals = true
+
+	stack, err := node.New(&nodeConf)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := eth.New(stack, &ethConf)
+	if err != nil {
+		return nil, errors.Join(err, stack.Close())
+	}
+	filterSystem := filters.NewFilterSystem(backend.APIBackend, filters.Config{})
+	stack.RegisterAPIs([]rpc.API{{
+		Namespace: "eth",
+		Service:   filters.NewFilterAPI(filterSystem),
+	}})
+	if err := stack.Start(); err != nil {
+		return nil, errors.Join(err, stack.Close())
+	}
+	beacon, err := catalyst.NewSimulatedBeacon(0, backend)
+	if err != nil {
+		return nil, errors.Join(err, stack.Close())
+	}
+	// reorg the chain back to genesis
+	if err := beacon.Fork(backend.BlockChain().GetCanonicalHash(0)); err != nil {
+		return nil, errors.Join(err, beacon.Stop(), stack.Close())
+	}
+	b := &Backend{
+		Client: ethclient.NewClient(stack.Attach()),
+		node:   stack,
+		beacon: beacon,
+	}
+	if err := b.deployContracts(); err != nil {
+		return nil, errors.Join(err, b.Close())
+	}
+	return b, nil
+}
+
+// Commit mines a block with the pending transactions
+func (b *Backend) Commit() common.Hash {
+	return b.beacon.Commit()
+}
+
+// Fork creates a side chain starting at the given parent block,
+// used to simulate reorgs
+func (b *Backend) Fork(parentHash common.Hash) error {
+	return b.beacon.Fork(parentHash)
+}
+
+// AdjustTime moves the block time forward and mines an empty block
+func (b *Backend) AdjustTime(adjustment time.Duration) error {
+	return b.beacon.AdjustTime(adjustment)
+}
+
+// Close shuts down the chain
+func (b *Backend) Close() error {
+	b.Client.Close()
+	return errors.Join(b.beacon.Stop(), b.node.Close())
+}
+
+// Ether converts an amount in ether into wei
+func Ether(amount int64) *big.Int {
+	return new(big.Int).Mul(big.NewInt(amount), big.NewInt(params.Ether))
+}
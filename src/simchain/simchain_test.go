@@ -0,0 +1,144 @@
+package simchain
+
+import (
+	"context"
+	"math/big"
+	"referral-system/src/contracts"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// testPaymentDigest is the digest of the payment summary that MultiPay
+// records, see sol/MultiPay.sol
+func testPaymentDigest(ps contracts.MultiPayPaySummary) common.Hash {
+	bytes32Type, _ := abi.NewType("bytes32", "", nil)
+	uint256Type, _ := abi.NewType("uint256", "", nil)
+	uint32Type, _ := abi.NewType("uint32", "", nil)
+	addressType, _ := abi.NewType("address", "", nil)
+	domain, _ := abi.Arguments{{Type: bytes32Type}, {Type: bytes32Type}, {Type: uint256Type}, {Type: addressType}}.Pack(
+		crypto.Keccak256Hash([]byte("EIP712Domain(string name,uint256 chainId,address verifyingContract)")),
+		crypto.Keccak256Hash([]byte("Multipay")), big.NewInt(ChainId), MultiPayAddr)
+	summary, _ := abi.Arguments{{Type: bytes32Type}, {Type: addressType}, {Type: addressType}, {Type: addressType},
+		{Type: uint32Type}, {Type: uint32Type}, {Type: uint256Type}}.Pack(
+		crypto.Keccak256Hash([]byte("PaySummary(address payer,address executor,address token,uint32 timestamp,uint32 id,uint256 totalAmount)")),
+		ps.Payer, ps.Executor, ps.Token, ps.Timestamp, ps.Id, ps.TotalAmount)
+	return crypto.Keccak256Hash(crypto.Keccak256(domain), crypto.Keccak256(summary))
+}
+
+func TestMultiPay(t *testing.T) {
+	payerKey, _ := crypto.GenerateKey()
+	execKey, _ := crypto.GenerateKey()
+	payer := crypto.PubkeyToAddress(payerKey.PublicKey)
+	exec := crypto.PubkeyToAddress(execKey.PublicKey)
+	sim, err := New(types.GenesisAlloc{
+		payer: {Balance: Ether(10)},
+		exec:  {Balance: Ether(10)},
+	})
+	if err != nil {
+		t.Fatalf("starting chain: %v", err)
+	}
+	defer sim.Close()
+	tkn, _ := contracts.NewErc20(TokenAddr, sim.Client)
+	mpay, _ := contracts.NewMultiPay(MultiPayAddr, sim.Client)
+	payerOpts, _ := bind.NewKeyedTransactorWithChainID(payerKey, big.NewInt(ChainId))
+	execOpts, _ := bind.NewKeyedTransactorWithChainID(execKey, big.NewInt(ChainId))
+	execOpts.GasLimit = 1_000_000
+
+	if _, err := sim.FundToken(payer, big.NewInt(1000)); err != nil {
+		t.Fatalf("fund: %v", err)
+	}
+	if _, err := tkn.Approve(payerOpts, MultiPayAddr, big.NewInt(1000)); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	sim.Commit()
+	payees := []common.Address{common.HexToAddress("0x01"), common.HexToAddress("0x02")}
+	// direct payment
+	payerOpts.GasLimit = 1_000_000
+	tx1, err := mpay.Pay(payerOpts, 7, TokenAddr, []*big.Int{big.NewInt(10), big.NewInt(20)}, payees, "pay")
+	if err != nil {
+		t.Fatalf("pay: %v", err)
+	}
+	// delegated payment by executor, signed by the payer
+	summary := contracts.MultiPayPaySummary{Payer: payer, Executor: exec, Token: TokenAddr, Timestamp: 1, Id: 8, TotalAmount: big.NewInt(300)}
+	digest := testPaymentDigest(summary)
+	sig, err := crypto.Sign(accounts.TextHash(digest.Bytes()), payerKey)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	amounts := []*big.Int{big.NewInt(100), big.NewInt(200)}
+	tx2, err := mpay.DelegatedPay(execOpts, summary, sig, amounts, payees, "delegated")
+	if err != nil {
+		t.Fatalf("delegatedPay: %v", err)
+	}
+	// payer is not the executor: must revert
+	tx3, err := mpay.DelegatedPay(payerOpts, summary, sig, amounts, payees, "fail")
+	if err != nil {
+		t.Fatalf("delegatedPay: %v", err)
+	}
+	// signed by the executor instead of the payer: must revert
+	other := summary
+	other.Id = 9
+	execSig, _ := crypto.Sign(accounts.TextHash(testPaymentDigest(other).Bytes()), execKey)
+	tx4, err := mpay.DelegatedPay(execOpts, other, execSig, amounts, payees, "fail")
+	if err != nil {
+		t.Fatalf("delegatedPay: %v", err)
+	}
+	sim.Commit()
+	// replay of an executed payment: must revert
+	tx5, err := mpay.DelegatedPay(execOpts, summary, sig, amounts, payees, "replay")
+	if err != nil {
+		t.Fatalf("delegatedPay: %v", err)
+	}
+	sim.Commit()
+	expectedStatus := []uint64{types.ReceiptStatusSuccessful, types.ReceiptStatusSuccessful,
+		types.ReceiptStatusFailed, types.ReceiptStatusFailed, types.ReceiptStatusFailed}
+	for k, tx := range []*types.Transaction{tx1, tx2, tx3, tx4, tx5} {
+		r, err := sim.Client.TransactionReceipt(context.Background(), tx.Hash())
+		if err != nil {
+			t.Fatalf("receipt: %v", err)
+		}
+		if r.Status != expectedStatus[k] {
+			t.Errorf("tx %d: unexpected status %d", k, r.Status)
+		}
+	}
+	if executed, err := mpay.ExecutedPaymentDigests(nil, digest); err != nil || !executed {
+		t.Errorf("expected executed digest %s (%v)", digest.Hex(), err)
+	}
+	if executed, _ := mpay.ExecutedPaymentDigests(nil, testPaymentDigest(other)); executed {
+		t.Errorf("unexpected executed digest of failed payment")
+	}
+	for k, expected := range []int64{110, 220} {
+		bal, _ := tkn.BalanceOf(nil, payees[k])
+		if bal.Int64() != expected {
+			t.Errorf("payee %d: expected balance %d, got %s", k, expected, bal.String())
+		}
+	}
+	bal, _ := tkn.BalanceOf(nil, payer)
+	if bal.Int64() != 670 {
+		t.Errorf("payer: expected balance 670, got %s", bal.String())
+	}
+	it, err := mpay.FilterPayment(&bind.FilterOpts{Start: 0}, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("filter: %v", err)
+	}
+	var events []*contracts.MultiPayPayment
+	for it.Next() {
+		events = append(events, it.Event)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	if events[0].Message != "pay" || events[0].Id != 7 || events[0].From != payer || events[0].Token != TokenAddr {
+		t.Errorf("unexpected event %+v", events[0])
+	}
+	if events[1].Message != "delegated" || events[1].Id != 8 || events[1].From != payer ||
+		events[1].Amounts[1].Int64() != 200 || events[1].Payees[1] != payees[1] {
+		t.Errorf("unexpected event %+v", events[1])
+	}
+}
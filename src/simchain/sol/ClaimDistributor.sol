@@ -0,0 +1,50 @@
+// SPDX-License-Identifier: MIT
+pragma solidity 0.8.21;
+
+interface IERC20Transfer {
+    function transfer(address to, uint256 amount) external returns (bool);
+}
+
+/// @title Claim distributor for the simulated chain
+/// @notice Implements the interface of src/contracts/abi/ClaimDistributor.json.
+/// The owner sets the merkle root of the cumulative claims; the leaves are
+/// hashed like OpenZeppelin's StandardMerkleTree with the types
+/// (address, address, uint256) and pairs are hashed in sorted order.
+contract ClaimDistributor {
+    address public immutable owner;
+    bytes32 public merkleRoot;
+    mapping(address => mapping(address => uint256)) public cumulativeClaimed;
+
+    event MerkleRootUpdated(bytes32 oldMerkleRoot, bytes32 newMerkleRoot);
+    event Claimed(address indexed account, address indexed token, uint256 amount);
+
+    constructor() {
+        owner = msg.sender;
+    }
+
+    function setMerkleRoot(bytes32 merkleRoot_) external {
+        require(msg.sender == owner, "not owner");
+        emit MerkleRootUpdated(merkleRoot, merkleRoot_);
+        merkleRoot = merkleRoot_;
+    }
+
+    function claim(address account, address token, uint256 cumulativeAmount, bytes32[] calldata proof) external {
+        bytes32 leaf = keccak256(bytes.concat(keccak256(abi.encode(account, token, cumulativeAmount))));
+        require(_verify(proof, leaf), "invalid proof");
+        uint256 claimed = cumulativeClaimed[account][token];
+        require(cumulativeAmount > claimed, "nothing to claim");
+        cumulativeClaimed[account][token] = cumulativeAmount;
+        uint256 amount = cumulativeAmount - claimed;
+        require(IERC20Transfer(token).transfer(account, amount), "transfer failed");
+        emit Claimed(account, token, amount);
+    }
+
+    function _verify(bytes32[] calldata proof, bytes32 leaf) private view returns (bool) {
+        bytes32 h = leaf;
+        for (uint256 i = 0; i < proof.length; i++) {
+            bytes32 p = proof[i];
+            h = h < p ? keccak256(abi.encodePacked(h, p)) : keccak256(abi.encodePacked(p, h));
+        }
+        return h == merkleRoot;
+    }
+}
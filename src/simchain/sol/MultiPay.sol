@@ -0,0 +1,135 @@
+// SPDX-License-Identifier: MIT
+pragma solidity 0.8.21;
+
+interface IERC20 {
+    function transferFrom(address from, address to, uint256 amount) external returns (bool);
+}
+
+/// @title MultiPay for the simulated chain
+/// @notice Implements the MultiPay interface of src/contracts/abi/MultiPay.json.
+/// Delegated payments are signed by the payer: the signature is over the
+/// eth-signed-message hash of keccak256(abi.encode(domainSeparator, structHash))
+/// and executed digests are recorded in executedPaymentDigests.
+contract MultiPay {
+    struct PaySummary {
+        address payer;
+        address executor;
+        address token;
+        uint32 timestamp;
+        uint32 id;
+        uint256 totalAmount;
+    }
+
+    bytes32 private constant DOMAIN_TYPEHASH =
+        keccak256("EIP712Domain(string name,uint256 chainId,address verifyingContract)");
+    bytes32 private constant PAY_SUMMARY_TYPEHASH =
+        keccak256(
+            "PaySummary(address payer,address executor,address token,uint32 timestamp,uint32 id,uint256 totalAmount)"
+        );
+    bytes32 private constant NAME_HASH = keccak256("Multipay");
+
+    mapping(bytes32 => bool) public executedPaymentDigests;
+
+    event Payment(
+        address indexed from,
+        uint32 indexed id,
+        address indexed token,
+        uint256[] amounts,
+        address[] payees,
+        string message
+    );
+
+    constructor() {}
+
+    function pay(
+        uint32 _id,
+        address _tokenAddr,
+        uint256[] memory _amounts,
+        address[] memory _payees,
+        string memory _message
+    ) external {
+        _pay(_id, _tokenAddr, msg.sender, _amounts, _payees, _message);
+    }
+
+    function delegatedPay(
+        PaySummary memory _payload,
+        bytes memory _signature,
+        uint256[] memory _amounts,
+        address[] memory _payees,
+        string memory _message
+    ) external {
+        require(msg.sender == _payload.executor, "executor mismatch");
+        bytes32 digest = _paymentDigest(_payload);
+        require(!executedPaymentDigests[digest], "payment already executed");
+        bytes32 signedHash = keccak256(abi.encodePacked("\x19Ethereum Signed Message:\n32", digest));
+        require(_recover(signedHash, _signature) == _payload.payer, "invalid signature");
+        uint256 total;
+        for (uint256 i = 0; i < _amounts.length; i++) {
+            total += _amounts[i];
+        }
+        require(total == _payload.totalAmount, "total amount mismatch");
+        executedPaymentDigests[digest] = true;
+        _pay(_payload.id, _payload.token, _payload.payer, _amounts, _payees, _message);
+    }
+
+    function _executePayment(
+        uint32 _id,
+        address _tokenAddr,
+        address _payer,
+        uint256[] memory _amounts,
+        address[] memory _payees,
+        string memory _message
+    ) public {
+        require(msg.sender == _payer, "sender is not payer");
+        _pay(_id, _tokenAddr, _payer, _amounts, _payees, _message);
+    }
+
+    function _pay(
+        uint32 _id,
+        address _tokenAddr,
+        address _payer,
+        uint256[] memory _amounts,
+        address[] memory _payees,
+        string memory _message
+    ) internal {
+        require(_amounts.length == _payees.length, "length mismatch");
+        for (uint256 i = 0; i < _payees.length; i++) {
+            require(IERC20(_tokenAddr).transferFrom(_payer, _payees[i], _amounts[i]), "transfer failed");
+        }
+        emit Payment(_payer, _id, _tokenAddr, _amounts, _payees, _message);
+    }
+
+    function _paymentDigest(PaySummary memory _payload) internal view returns (bytes32) {
+        bytes32 domainSeparator = keccak256(abi.encode(DOMAIN_TYPEHASH, NAME_HASH, block.chainid, address(this)));
+        bytes32 structHash = keccak256(
+            abi.encode(
+                PAY_SUMMARY_TYPEHASH,
+                _payload.payer,
+                _payload.executor,
+                _payload.token,
+                _payload.timestamp,
+                _payload.id,
+                _payload.totalAmount
+            )
+        );
+        return keccak256(abi.encode(domainSeparator, structHash));
+    }
+
+    function _recover(bytes32 _hash, bytes memory _signature) internal pure returns (address) {
+        require(_signature.length == 65, "invalid signature length");
+        bytes32 r;
+        bytes32 s;
+        uint8 v;
+        assembly {
+            r := mload(add(_signature, 0x20))
+            s := mload(add(_signature, 0x40))
+            v := byte(0, mload(add(_signature, 0x60)))
+        }
+        if (v < 27) {
+            v += 27;
+        }
+        address signer = ecrecover(_hash, v, r, s);
+        require(signer != address(0), "invalid signature");
+        return signer;
+    }
+}
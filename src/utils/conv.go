@@ -3,6 +3,7 @@ package utils
 import (
 	"math"
 	"math/big"
+	"strings"
 )
 
 // floatToDecN converts a floating point number to a decimal-n,
@@ -30,6 +31,24 @@ func DecNToFloat(num *big.Int, decN uint8) float64 {
 	return f
 }
 
+// DecNToString formats a decimal N number exactly as a decimal
+// string with decN fractional digits, e.g., 1500000 with 6
+// decimals as "1.500000"
+func DecNToString(num *big.Int, decN uint8) string {
+	if decN == 0 {
+		return num.String()
+	}
+	digits := new(big.Int).Abs(num).String()
+	if len(digits) <= int(decN) {
+		digits = strings.Repeat("0", int(decN)-len(digits)+1) + digits
+	}
+	res := digits[:len(digits)-int(decN)] + "." + digits[len(digits)-int(decN):]
+	if num.Sign() < 0 {
+		res = "-" + res
+	}
+	return res
+}
+
 // ABDKToDecN converts a 64.64 ABDK fixed point
 // number into a decimal N number
 func ABDKToDecN(num *big.Int, decN uint8) *big.Int {
@@ -1,7 +1,11 @@
 package utils
 
 import (
+	"errors"
+	"math"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/adhocore/gronx"
@@ -19,9 +23,35 @@ type APICodePayload struct {
 	ReferrerAddr  string `json:"referrerAddr"`
 	CreatedOn     uint32 `json:"createdOn"`
 	PassOnPercTDF uint32 `json:"passOnPercTDF"`
+	ValidFrom     uint32 `json:"validFrom,omitempty"` // optional, 0 = valid immediately
+	Expiry        uint32 `json:"expiry,omitempty"`    // optional, 0 = unchanged, CODE_EXPIRY_NONE = no expiry
 	Signature     string `json:"signature"`
 }
 
+// CODE_EXPIRY_NONE as expiry of a code payload removes the expiry of
+// the code
+const CODE_EXPIRY_NONE = math.MaxUint32
+
+// HasValidity returns true if the payload restricts the validity of the code
+func (cp APICodePayload) HasValidity() bool {
+	return cp.ValidFrom != 0 || cp.Expiry != 0
+}
+
+// APICodeTiersPayload replaces the volume tiers of a code, signed
+// by the code owner
+type APICodeTiersPayload struct {
+	Code         string               `json:"code"`
+	ReferrerAddr string               `json:"referrerAddr"`
+	CreatedOn    uint32               `json:"createdOn"`
+	Tiers        []APICodeTierPayload `json:"tiers"`
+	Signature    string               `json:"signature"`
+}
+
+type APICodeTierPayload struct {
+	MinVolume     uint64 `json:"minVolume"` // collateral currency units per pool and pay period
+	PassOnPercTDF uint32 `json:"passOnPercTDF"`
+}
+
 type APIReferPayload struct {
 	ParentAddr    string `json:"parentAddr"`
 	ReferToAddr   string `json:"referToAddr"`
@@ -30,6 +60,50 @@ type APIReferPayload struct {
 	Signature     string `json:"signature"`
 }
 
+// APIPayoutAddrPayload registers the address that receives the
+// earnings of an agency or referrer (Addr) from the broker
+type APIPayoutAddrPayload struct {
+	Addr       string `json:"addr"`
+	PayoutAddr string `json:"payoutAddr"` // = Addr to end the redirection
+	BrokerAddr string `json:"brokerAddr"`
+	CreatedOn  uint32 `json:"createdOn"`
+	Signature  string `json:"signature"`
+}
+
+// APIWebhookPayload registers the webhook of a partner address (Addr)
+// of the broker
+type APIWebhookPayload struct {
+	Addr string `json:"addr"`
+	Url  string `json:"url"` // empty to end the subscription
+	// comma separated event types, empty for all events
+	Events     string `json:"events"`
+	BrokerAddr string `json:"brokerAddr"`
+	CreatedOn  uint32 `json:"createdOn"`
+	Signature  string `json:"signature"`
+}
+
+// APIWebhookSubscription is the registered webhook, the secret is the
+// HMAC key of the deliveries
+type APIWebhookSubscription struct {
+	Addr   string   `json:"addr"`
+	Url    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+type APIWebhookDelivery struct {
+	Id           int64  `json:"id"`
+	Addr         string `json:"addr"`
+	Url          string `json:"url"`
+	Event        string `json:"event"`
+	Status       string `json:"status"`
+	Attempts     int    `json:"attempts"`
+	ResponseCode int    `json:"responseCode"`
+	LastError    string `json:"lastError"`
+	CreatedTs    int64  `json:"createdTs"`
+	DeliveredTs  int64  `json:"deliveredTs"`
+}
+
 type APIResponseHistEarnings struct {
 	PoolId    uint32  `json:"poolId"`
 	Code      string  `json:"code"`
@@ -40,9 +114,35 @@ type APIResponseHistEarnings struct {
 }
 
 type OpenPay struct {
-	PoolId    uint32  `json:"poolId"`
-	Amount    float64 `json:"earnings"`
-	TokenName string  `json:"tokenName"`
+	PoolId    uint32       `json:"poolId"`
+	Code      string       `json:"code"`
+	Amount    float64      `json:"earnings"`
+	Carried   float64      `json:"carried"`
+	TokenName string       `json:"tokenName"`
+	Volume    float64      `json:"volume"`
+	Tier      *APICodeTier `json:"tier,omitempty"`
+}
+
+// APICodeTier is a volume tier of a code, RebatePerc is the
+// percent rebate on broker fees (like /code-rebate)
+type APICodeTier struct {
+	MinVolume  float64 `json:"minVolume"`
+	RebatePerc float64 `json:"rebatePercent"`
+}
+
+// APITraderTier is the volume tier a trader reached in the
+// current pay period of a pool
+type APITraderTier struct {
+	PoolId     uint32  `json:"poolId"`
+	Volume     float64 `json:"volume"`
+	MinVolume  float64 `json:"minVolume"`
+	RebatePerc float64 `json:"rebatePercent"`
+}
+
+type APIResponseCodeRebate struct {
+	RebatePerc  float64         `json:"rebate_percent"`
+	Tiers       []APICodeTier   `json:"tiers,omitempty"`
+	TraderTiers []APITraderTier `json:"traderTiers,omitempty"`
 }
 type APIResponseOpenEarnings struct {
 	Code    string    `json:"code"`
@@ -63,6 +163,187 @@ type APIResponseTokenHoldings struct {
 	Rebates   []APIRebate `json:"rebates"`
 }
 
+type APIDryRunPayment struct {
+	TraderAddr string  `json:"traderAddr"`
+	PayeeAddr  string  `json:"payeeAddr"`
+	Code       string  `json:"code"`
+	Level      int     `json:"level"`
+	PoolId     uint32  `json:"poolId"`
+	TokenAddr  string  `json:"tokenAddr"`
+	AmountDecN string  `json:"amountDecN"`
+	Amount     float64 `json:"amount"`
+}
+
+type APIDryRunTotal struct {
+	PoolId     uint32  `json:"poolId"`
+	AmountDecN string  `json:"amountDecN"`
+	Amount     float64 `json:"amount"`
+}
+
+// APIDryRunCarry is a payment below the minimal payout of the
+// token whose fees are carried forward
+type APIDryRunCarry struct {
+	TraderAddr string  `json:"traderAddr"`
+	Code       string  `json:"code"`
+	PoolId     uint32  `json:"poolId"`
+	TokenAddr  string  `json:"tokenAddr"`
+	AmountDecN string  `json:"amountDecN"`
+	Amount     float64 `json:"amount"`
+}
+
+type APIResponseDryRun struct {
+	BatchTs  int64              `json:"batchTs"`
+	RunTs    int64              `json:"runTs"`
+	Payments []APIDryRunPayment `json:"payments"`
+	Totals   []APIDryRunTotal   `json:"totals"`
+	Carried  []APIDryRunCarry   `json:"carried"`
+	// number of MultiPay transactions of the batch
+	Transactions int `json:"transactions"`
+}
+
+// APIClaim is a leaf of the claim tree with its merkle proof
+type APIClaim struct {
+	TokenAddr            string   `json:"tokenAddr"`
+	CumulativeAmountDecN string   `json:"cumulativeAmountDecN"`
+	Proof                []string `json:"proof"`
+}
+
+// APIResponseClaims are the claims of an address in the latest claim tree
+type APIResponseClaims struct {
+	BatchTs int64      `json:"batchTs"`
+	Root    string     `json:"root"`
+	Claims  []APIClaim `json:"claims"`
+}
+
+type APIBatchStatus struct {
+	BatchTs  int64 `json:"batchTs"`
+	Finished bool  `json:"finished"`
+	Running  bool  `json:"running"`
+	Paused   bool  `json:"paused"`
+}
+
+type APIPaymentRetry struct {
+	TraderAddr    string `json:"traderAddr"`
+	PoolId        uint32 `json:"poolId"`
+	Code          string `json:"code"`
+	Level         int    `json:"level"`
+	AmountDecN    string `json:"amountDecN"`
+	BatchTs       int64  `json:"batchTs"`
+	FailedTxHash  string `json:"failedTxHash"`
+	RetryTxHash   string `json:"retryTxHash"`
+	Attempts      int    `json:"attempts"`
+	Status        string `json:"status"`
+	NextAttemptTs int64  `json:"nextAttemptTs"`
+}
+
+type APIDenyEntry struct {
+	Addr      string `json:"addr"`
+	Reason    string `json:"reason"`
+	Source    string `json:"source"`
+	AddedBy   string `json:"addedBy"`
+	CreatedTs int64  `json:"createdTs"`
+}
+
+// APIReconciliationBatch is the result of a reconciliation run for a
+// payment batch
+type APIReconciliationBatch struct {
+	BatchTs       int64 `json:"batchTs"`
+	DbPayments    int   `json:"dbPayments"`
+	ChainPayments int   `json:"chainPayments"`
+	Missing       int   `json:"missing"`
+	Extra         int   `json:"extra"`
+	AmountDiffers int   `json:"amountDiffers"`
+	PayeeDiffers  int   `json:"payeeDiffers"`
+}
+
+type APIReconciliationMismatch struct {
+	BatchTs         int64  `json:"batchTs"`
+	Kind            string `json:"kind"`
+	TxHash          string `json:"txHash"`
+	TraderAddr      string `json:"traderAddr"`
+	PoolId          uint32 `json:"poolId"`
+	Level           int    `json:"level"`
+	DbPayee         string `json:"dbPayee"`
+	ChainPayee      string `json:"chainPayee"`
+	DbAmountDecN    string `json:"dbAmountDecN"`
+	ChainAmountDecN string `json:"chainAmountDecN"`
+}
+
+type APIReconciliation struct {
+	RunTs      int64                       `json:"runTs"`
+	FromTs     int64                       `json:"fromTs"`
+	Batches    []APIReconciliationBatch    `json:"batches"`
+	Mismatches []APIReconciliationMismatch `json:"mismatches"`
+}
+
+// APIGasCost is the gas cost of the payment transactions of a batch or
+// period in one margin token
+type APIGasCost struct {
+	Ts        int64  `json:"ts"`
+	TokenAddr string `json:"tokenAddr"`
+	Txs       int    `json:"txs"`
+	FailedTxs int    `json:"failedTxs"`
+	// payments per trader, pool and code
+	Payments int    `json:"payments"`
+	GasUsed  uint64 `json:"gasUsed"`
+	// in the native token of the chain
+	GasFee           float64 `json:"gasFee"`
+	GasFeePerPayment float64 `json:"gasFeePerPayment"`
+	// in the margin token
+	PaidAmount float64 `json:"paidAmount"`
+	// gas fee in margin token units relative to the amount paid,
+	// null if no gas token price is configured for the token
+	GasShare *float64 `json:"gasShare"`
+}
+
+type APIGasReport struct {
+	Period string       `json:"period"`
+	FromTs int64        `json:"fromTs"`
+	Costs  []APIGasCost `json:"costs"`
+}
+
+// APIPayoutTransfer is the transfer of one level of a payment to a payee
+type APIPayoutTransfer struct {
+	TraderAddr    string `json:"traderAddr"`
+	Code          string `json:"code"`
+	Level         int    `json:"level"`
+	PoolId        uint32 `json:"poolId"`
+	PayeeAddr     string `json:"payeeAddr"`
+	PayoutAddr    string `json:"payoutAddr"`
+	TokenName     string `json:"tokenName"`
+	TokenAddr     string `json:"tokenAddr"`
+	TokenDecimals uint8  `json:"tokenDecimals"`
+	Amount        string `json:"amount"`
+	AmountDecN    string `json:"amountDecN"`
+	TxHash        string `json:"txHash"`
+	BatchTs       int64  `json:"batchTs"`
+	BlockNr       int64  `json:"blockNr"`
+	BlockTs       int64  `json:"blockTs"`
+	Confirmed     bool   `json:"confirmed"`
+}
+
+// APIPayoutTotal is the sum of the confirmed or unconfirmed transfers
+// of a token
+type APIPayoutTotal struct {
+	TokenName     string `json:"tokenName"`
+	TokenAddr     string `json:"tokenAddr"`
+	TokenDecimals uint8  `json:"tokenDecimals"`
+	Confirmed     bool   `json:"confirmed"`
+	Transfers     int    `json:"transfers"`
+	Amount        string `json:"amount"`
+	AmountDecN    string `json:"amountDecN"`
+}
+
+type APIPayoutExport struct {
+	ChainId    int                 `json:"chainId"`
+	BrokerId   string              `json:"brokerId"`
+	BrokerAddr string              `json:"brokerAddr"`
+	FromTs     int64               `json:"fromTs"`
+	ToTs       int64               `json:"toTs"`
+	Transfers  []APIPayoutTransfer `json:"transfers"`
+	Totals     []APIPayoutTotal    `json:"totals"`
+}
+
 type APIResponse struct {
 	Type string      `json:"type"`
 	Data interface{} `json:"data"`
@@ -86,3 +367,29 @@ func PrevPaymentSchedule(expr string) time.Time {
 	time, _ := gronx.PrevTick(expr, true)
 	return time
 }
+
+// ParseChainIds parses a comma separated list of chain ids,
+// e.g. "1101,42161"
+func ParseChainIds(s string) ([]int, error) {
+	var ids []int
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.Atoi(part)
+		if err != nil || id <= 0 {
+			return nil, errors.New("invalid chain id " + part)
+		}
+		if seen[id] {
+			return nil, errors.New("duplicate chain id " + part)
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("no chain id")
+	}
+	return ids, nil
+}
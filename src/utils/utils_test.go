@@ -51,9 +51,48 @@ func TestAbdkQuo(t *testing.T) {
 	fmt.Println(am.String())
 }
 
+func TestDecNToString(t *testing.T) {
+	cases := []struct {
+		num      int64
+		decN     uint8
+		expected string
+	}{
+		{1500000, 6, "1.500000"},
+		{42, 6, "0.000042"},
+		{0, 2, "0.00"},
+		{-1234, 2, "-12.34"},
+		{7, 0, "7"},
+	}
+	for _, c := range cases {
+		if s := DecNToString(big.NewInt(c.num), c.decN); s != c.expected {
+			t.Errorf("DecNToString(%d, %d) = %s, expected %s", c.num, c.decN, s, c.expected)
+		}
+	}
+	x, _ := new(big.Int).SetString("12345678901234567890123", 10)
+	if s := DecNToString(x, 18); s != "12345.678901234567890123" {
+		t.Errorf("unexpected conversion %s", s)
+	}
+}
+
 func TestRatio(t *testing.T) {
 	x, _ := new(big.Int).SetString("12345678901234567890", 10)
 	y, _ := new(big.Int).SetString("9876543210987654321", 10)
 	r := Ratio(x, y)
 	fmt.Println(r) //~1.25
 }
+
+func TestParseChainIds(t *testing.T) {
+	ids, err := ParseChainIds("1101, 42161,")
+	if err != nil {
+		t.Errorf("ParseChainIds: %v", err)
+		return
+	}
+	if len(ids) != 2 || ids[0] != 1101 || ids[1] != 42161 {
+		t.Errorf("wrong chain ids parsed: %v", ids)
+	}
+	for _, s := range []string{"", "1101,abc", "1101,1101", "-1"} {
+		if _, err := ParseChainIds(s); err == nil {
+			t.Errorf("ParseChainIds(%q): expected error", s)
+		}
+	}
+}